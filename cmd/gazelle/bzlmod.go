@@ -0,0 +1,347 @@
+/* Copyright 2019 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+const (
+	goDepsName      = "go_deps"
+	goDepsExtension = "@bazel_gazelle//:extensions.bzl"
+)
+
+// updateModuleFile writes tags for the go_deps module extension into the
+// MODULE.bazel file at path instead of writing go_repository rules into
+// WORKSPACE. Each go_repository rule in gen becomes a go_deps.module tag, or
+// a go_deps.module_override tag if the module is replaced. The repositories
+// are then imported with use_repo.
+//
+// Existing module and module_override tags for modules in gen are replaced.
+// Tags for other modules are preserved unless prune is true. Other
+// statements, including other go_deps tags like from_file and repositories
+// imported by hand with use_repo, are not modified. If the file doesn't
+// use the go_deps extension yet, a use_extension statement is added.
+func updateModuleFile(c *config.Config, path string, gen []*rule.Rule, prune bool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := bzl.ParseWorkspace(path, data)
+	if err != nil {
+		return err
+	}
+
+	// Find the variable the extension is assigned to. If there isn't one, a
+	// use_extension statement is added below if there are any tags.
+	extVar := ""
+	for _, stmt := range f.Stmt {
+		if extVar = goDepsExtensionVar(stmt); extVar != "" {
+			break
+		}
+	}
+	tagVar := extVar
+	if tagVar == "" {
+		tagVar = goDepsName
+	}
+
+	// Build tags for generated rules.
+	tags := make(map[string]*bzl.CallExpr)
+	for _, r := range gen {
+		if r.Kind() != "go_repository" {
+			continue
+		}
+		modPath := r.AttrString("importpath")
+		if r.AttrString("version") == "" || r.AttrString("sum") == "" {
+			c.Warnf("%s: go_repository without a module version and sum can't be written to %s; skipping", modPath, path)
+			continue
+		}
+		if r.AttrString("replace") == "" {
+			tags[modPath] = newGoDepsTag(tagVar, "module", [][2]string{
+				{"path", modPath},
+				{"sum", r.AttrString("sum")},
+				{"version", r.AttrString("version")},
+			})
+		} else {
+			tags[modPath] = newGoDepsTag(tagVar, "module_override", [][2]string{
+				{"path", modPath},
+				{"replace", r.AttrString("replace")},
+				{"sum", r.AttrString("sum")},
+				{"version", r.AttrString("version")},
+			})
+		}
+	}
+
+	if extVar == "" {
+		if len(tags) == 0 {
+			return nil
+		}
+		f.Stmt = append(f.Stmt, &bzl.AssignExpr{
+			LHS: &bzl.Ident{Name: goDepsName},
+			Op:  "=",
+			RHS: &bzl.CallExpr{
+				X: &bzl.Ident{Name: "use_extension"},
+				List: []bzl.Expr{
+					&bzl.StringExpr{Value: goDepsExtension},
+					&bzl.StringExpr{Value: goDepsName},
+				},
+			},
+		})
+		extVar = goDepsName
+	}
+
+	// Replace existing module tags, and prune tags for other modules if
+	// requested. Remember where the last tag is, so new tags can be inserted
+	// after it.
+	var stmts []bzl.Expr
+	seen := make(map[string]bool)
+	removedRepos := make(map[string]bool)
+	insertIndex := -1
+	var useRepo *bzl.CallExpr
+	for _, stmt := range f.Stmt {
+		if goDepsExtensionVar(stmt) == extVar && insertIndex < 0 {
+			stmts = append(stmts, stmt)
+			insertIndex = len(stmts)
+			continue
+		}
+		call, tag := goDepsTag(stmt, extVar)
+		if tag == "" {
+			if useRepo == nil && isGoDepsUseRepo(stmt, extVar) {
+				useRepo = stmt.(*bzl.CallExpr)
+			}
+			stmts = append(stmts, stmt)
+			continue
+		}
+		if modPath := callAttrString(call, "path"); modPath != "" && (tag == "module" || tag == "module_override") {
+			if seen[modPath] {
+				continue
+			}
+			if newCall, ok := tags[modPath]; ok {
+				newCall.Comments = call.Comments
+				stmt = newCall
+				seen[modPath] = true
+			} else if prune {
+				removedRepos[label.ImportPathToBazelRepoName(modPath)] = true
+				continue
+			}
+		}
+		stmts = append(stmts, stmt)
+		insertIndex = len(stmts)
+	}
+
+	// Insert tags for new modules, in order by path among the existing
+	// module tags where possible.
+	var newPaths []string
+	for modPath := range tags {
+		if !seen[modPath] {
+			newPaths = append(newPaths, modPath)
+		}
+	}
+	sort.Strings(newPaths)
+	for _, modPath := range newPaths {
+		i := insertIndex
+		for j, stmt := range stmts[:insertIndex] {
+			if call, tag := goDepsTag(stmt, extVar); tag == "module" || tag == "module_override" {
+				if p := callAttrString(call, "path"); p != "" && p > modPath {
+					i = j
+					break
+				}
+			}
+		}
+		stmts = append(stmts[:i:i], append([]bzl.Expr{tags[modPath]}, stmts[i:]...)...)
+		insertIndex++
+	}
+
+	// Import repositories for generated modules with use_repo.
+	addRepos := make(map[string]bool)
+	for modPath := range tags {
+		addRepos[label.ImportPathToBazelRepoName(modPath)] = true
+	}
+	if useRepo == nil && len(addRepos) > 0 {
+		useRepo = &bzl.CallExpr{
+			X:              &bzl.Ident{Name: "use_repo"},
+			List:           []bzl.Expr{&bzl.Ident{Name: extVar}},
+			ForceMultiLine: true,
+		}
+		stmts = append(stmts[:insertIndex:insertIndex], append([]bzl.Expr{useRepo}, stmts[insertIndex:]...)...)
+	}
+	if useRepo != nil && !updateUseRepo(useRepo, addRepos, removedRepos) {
+		for i, stmt := range stmts {
+			if stmt == useRepo {
+				stmts = append(stmts[:i], stmts[i+1:]...)
+				break
+			}
+		}
+	}
+
+	f.Stmt = stmts
+	if err := ioutil.WriteFile(path, bzl.Format(f), 0666); err != nil {
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return nil
+}
+
+// goDepsExtensionVar returns the name of the variable stmt assigns the
+// go_deps extension to, or "" if stmt is not such an assignment.
+func goDepsExtensionVar(stmt bzl.Expr) string {
+	assign, ok := stmt.(*bzl.AssignExpr)
+	if !ok {
+		return ""
+	}
+	id, ok := assign.LHS.(*bzl.Ident)
+	if !ok {
+		return ""
+	}
+	call, ok := assign.RHS.(*bzl.CallExpr)
+	if !ok || len(call.List) == 0 {
+		return ""
+	}
+	if fn, ok := call.X.(*bzl.Ident); !ok || fn.Name != "use_extension" {
+		return ""
+	}
+	// Keyword arguments like dev_dependency = True may follow the extension
+	// file and name.
+	file, ok := call.List[0].(*bzl.StringExpr)
+	if !ok || file.Value != goDepsExtension {
+		return ""
+	}
+	if len(call.List) > 1 {
+		if name, ok := call.List[1].(*bzl.StringExpr); ok && name.Value != goDepsName {
+			return ""
+		}
+	}
+	return id.Name
+}
+
+// goDepsTag returns stmt as a call and the name of the tag if stmt is a tag
+// of the extension assigned to extVar, like go_deps.module(...).
+func goDepsTag(stmt bzl.Expr, extVar string) (*bzl.CallExpr, string) {
+	call, ok := stmt.(*bzl.CallExpr)
+	if !ok {
+		return nil, ""
+	}
+	dot, ok := call.X.(*bzl.DotExpr)
+	if !ok {
+		return nil, ""
+	}
+	if id, ok := dot.X.(*bzl.Ident); !ok || id.Name != extVar {
+		return nil, ""
+	}
+	return call, dot.Name
+}
+
+// isGoDepsUseRepo returns whether stmt is a use_repo call for the extension
+// assigned to extVar.
+func isGoDepsUseRepo(stmt bzl.Expr, extVar string) bool {
+	call, ok := stmt.(*bzl.CallExpr)
+	if !ok || len(call.List) == 0 {
+		return false
+	}
+	if fn, ok := call.X.(*bzl.Ident); !ok || fn.Name != "use_repo" {
+		return false
+	}
+	id, ok := call.List[0].(*bzl.Ident)
+	return ok && id.Name == extVar
+}
+
+// updateUseRepo adds the repositories in add to a use_repo call and removes
+// the repositories in remove. If repository names in the call were sorted,
+// they're kept sorted; otherwise, new names are added at the end. Keyword
+// arguments are kept after them. updateUseRepo returns false if no
+// repositories are left, and the call should be deleted.
+func updateUseRepo(call *bzl.CallExpr, add, remove map[string]bool) bool {
+	var names, other []bzl.Expr
+	have := make(map[string]bool)
+	sorted := true
+	for _, arg := range call.List[1:] {
+		s, ok := arg.(*bzl.StringExpr)
+		if !ok {
+			other = append(other, arg)
+			continue
+		}
+		if len(names) > 0 && names[len(names)-1].(*bzl.StringExpr).Value > s.Value {
+			sorted = false
+		}
+		if !remove[s.Value] {
+			names = append(names, s)
+			have[s.Value] = true
+		}
+	}
+	var added []string
+	for name := range add {
+		if !have[name] {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		names = append(names, &bzl.StringExpr{Value: name})
+	}
+	if sorted {
+		sort.SliceStable(names, func(i, j int) bool {
+			return names[i].(*bzl.StringExpr).Value < names[j].(*bzl.StringExpr).Value
+		})
+	}
+	call.List = append(append(call.List[:1:1], names...), other...)
+	return len(call.List) > 1
+}
+
+// newGoDepsTag returns a call to <extVar>.<tag> with the given keyword
+// arguments, where extVar is the variable the go_deps extension is assigned
+// to. Empty values are omitted.
+func newGoDepsTag(extVar, tag string, attrs [][2]string) *bzl.CallExpr {
+	call := &bzl.CallExpr{
+		X:              &bzl.DotExpr{X: &bzl.Ident{Name: extVar}, Name: tag},
+		ForceMultiLine: true,
+	}
+	for _, attr := range attrs {
+		if attr[1] == "" {
+			continue
+		}
+		call.List = append(call.List, &bzl.AssignExpr{
+			LHS: &bzl.Ident{Name: attr[0]},
+			Op:  "=",
+			RHS: &bzl.StringExpr{Value: attr[1]},
+		})
+	}
+	return call
+}
+
+// callAttrString returns the value of a keyword argument with a string value
+// in call, or "" if there is no such argument.
+func callAttrString(call *bzl.CallExpr, key string) string {
+	for _, arg := range call.List {
+		assign, ok := arg.(*bzl.AssignExpr)
+		if !ok {
+			continue
+		}
+		if id, ok := assign.LHS.(*bzl.Ident); !ok || id.Name != key {
+			continue
+		}
+		if s, ok := assign.RHS.(*bzl.StringExpr); ok {
+			return s.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,327 @@
+/* Copyright 2019 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	"github.com/bazelbuild/bazel-gazelle/testtools"
+)
+
+func TestUpdateModuleFile(t *testing.T) {
+	files := []testtools.FileSpec{{
+		Path: "MODULE.bazel",
+		Content: `
+module(name = "example")
+
+bazel_dep(
+    name = "rules_go",
+    version = "0.1.0",
+)
+
+go_deps = use_extension(
+    "@bazel_gazelle//:extensions.bzl",
+    "go_deps",
+)
+
+# keep this module
+go_deps.module(
+    path = "example.com/kept",
+    sum = "h1:kept",
+    version = "v1.0.0",
+)
+
+go_deps.module(
+    path = "example.com/updated",
+    sum = "h1:old",
+    version = "v1.0.0",
+)
+
+use_repo(
+    go_deps,
+    "com_example_kept",
+    "com_example_updated",
+)
+
+register_toolchains("//:toolchain")
+`,
+	}}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	newRepo := func(importpath, version, sum, replace string) *rule.Rule {
+		r := rule.NewRule("go_repository", "")
+		r.SetAttr("importpath", importpath)
+		r.SetAttr("version", version)
+		r.SetAttr("sum", sum)
+		if replace != "" {
+			r.SetAttr("replace", replace)
+		}
+		return r
+	}
+	gen := []*rule.Rule{
+		newRepo("example.com/updated", "v1.1.0", "h1:new", ""),
+		newRepo("example.com/replaced", "v0.2.0", "h1:fork", "example.com/fork"),
+	}
+	if err := updateModuleFile(nil, filepath.Join(dir, "MODULE.bazel"), gen, false); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "MODULE.bazel",
+		Content: `
+module(name = "example")
+
+bazel_dep(
+    name = "rules_go",
+    version = "0.1.0",
+)
+
+go_deps = use_extension(
+    "@bazel_gazelle//:extensions.bzl",
+    "go_deps",
+)
+
+# keep this module
+go_deps.module(
+    path = "example.com/kept",
+    sum = "h1:kept",
+    version = "v1.0.0",
+)
+
+go_deps.module_override(
+    path = "example.com/replaced",
+    replace = "example.com/fork",
+    sum = "h1:fork",
+    version = "v0.2.0",
+)
+
+go_deps.module(
+    path = "example.com/updated",
+    sum = "h1:new",
+    version = "v1.1.0",
+)
+
+use_repo(
+    go_deps,
+    "com_example_kept",
+    "com_example_replaced",
+    "com_example_updated",
+)
+
+register_toolchains("//:toolchain")
+`,
+	}})
+
+	if err := updateModuleFile(nil, filepath.Join(dir, "MODULE.bazel"), gen[:1], true); err != nil {
+		t.Fatal(err)
+	}
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "MODULE.bazel",
+		Content: `
+module(name = "example")
+
+bazel_dep(
+    name = "rules_go",
+    version = "0.1.0",
+)
+
+go_deps = use_extension(
+    "@bazel_gazelle//:extensions.bzl",
+    "go_deps",
+)
+
+go_deps.module(
+    path = "example.com/updated",
+    sum = "h1:new",
+    version = "v1.1.0",
+)
+
+use_repo(
+    go_deps,
+    "com_example_updated",
+)
+
+register_toolchains("//:toolchain")
+`,
+	}})
+}
+
+func TestUpdateModuleFileKeepsOtherStatements(t *testing.T) {
+	files := []testtools.FileSpec{{
+		Path: "MODULE.bazel",
+		Content: `
+module(name = "example")
+
+go_deps = use_extension("@bazel_gazelle//:extensions.bzl", "go_deps")
+go_deps.from_file(go_mod = "//:go.mod")
+
+go_deps.module(
+    path = "example.com/old",
+    sum = "h1:old",
+    version = "v1.0.0",
+)
+
+go_deps.gazelle_override(
+    directives = ["gazelle:proto disable"],
+    path = "example.com/from_go_mod",
+)
+
+use_repo(
+    go_deps,
+    "com_example_from_go_mod",
+    "com_example_old",
+    go_mod_alias = "com_example_other",
+)
+`,
+	}}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	gen := []*rule.Rule{rule.NewRule("go_repository", "")}
+	gen[0].SetAttr("importpath", "example.com/new")
+	gen[0].SetAttr("version", "v0.1.0")
+	gen[0].SetAttr("sum", "h1:new")
+	if err := updateModuleFile(nil, filepath.Join(dir, "MODULE.bazel"), gen, true); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "MODULE.bazel",
+		Content: `
+module(name = "example")
+
+go_deps = use_extension("@bazel_gazelle//:extensions.bzl", "go_deps")
+
+go_deps.from_file(go_mod = "//:go.mod")
+
+go_deps.gazelle_override(
+    directives = ["gazelle:proto disable"],
+    path = "example.com/from_go_mod",
+)
+
+go_deps.module(
+    path = "example.com/new",
+    sum = "h1:new",
+    version = "v0.1.0",
+)
+
+use_repo(
+    go_deps,
+    "com_example_from_go_mod",
+    "com_example_new",
+    go_mod_alias = "com_example_other",
+)
+`,
+	}})
+}
+
+func TestUpdateModuleFileAddsExtension(t *testing.T) {
+	files := []testtools.FileSpec{{
+		Path: "MODULE.bazel",
+		Content: `
+module(name = "example")
+`,
+	}}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	gen := []*rule.Rule{rule.NewRule("go_repository", "")}
+	gen[0].SetAttr("importpath", "example.com/new")
+	gen[0].SetAttr("version", "v0.1.0")
+	gen[0].SetAttr("sum", "h1:new")
+	if err := updateModuleFile(nil, filepath.Join(dir, "MODULE.bazel"), gen, false); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "MODULE.bazel",
+		Content: `
+module(name = "example")
+
+go_deps = use_extension(
+    "@bazel_gazelle//:extensions.bzl",
+    "go_deps",
+)
+
+go_deps.module(
+    path = "example.com/new",
+    sum = "h1:new",
+    version = "v0.1.0",
+)
+
+use_repo(
+    go_deps,
+    "com_example_new",
+)
+`,
+	}})
+}
+
+func TestUpdateModuleFileExtensionVar(t *testing.T) {
+	for _, tc := range []struct {
+		desc, useExtension, extVar string
+	}{
+		{
+			desc:         "other_name",
+			useExtension: `deps = use_extension("@bazel_gazelle//:extensions.bzl", "go_deps")`,
+			extVar:       "deps",
+		}, {
+			desc: "dev_dependency",
+			useExtension: `go_deps = use_extension(
+    "@bazel_gazelle//:extensions.bzl",
+    "go_deps",
+    dev_dependency = True,
+)`,
+			extVar: "go_deps",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{{
+				Path:    "MODULE.bazel",
+				Content: tc.useExtension + "\n",
+			}})
+			defer cleanup()
+
+			gen := []*rule.Rule{rule.NewRule("go_repository", "")}
+			gen[0].SetAttr("importpath", "example.com/new")
+			gen[0].SetAttr("version", "v0.1.0")
+			gen[0].SetAttr("sum", "h1:new")
+			if err := updateModuleFile(nil, filepath.Join(dir, "MODULE.bazel"), gen, false); err != nil {
+				t.Fatal(err)
+			}
+
+			testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+				Path: "MODULE.bazel",
+				Content: tc.useExtension + `
+
+` + tc.extVar + `.module(
+    path = "example.com/new",
+    sum = "h1:new",
+    version = "v0.1.0",
+)
+
+use_repo(
+    ` + tc.extVar + `,
+    "com_example_new",
+)
+`,
+			}})
+		})
+	}
+}
@@ -16,11 +16,13 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/rule"
@@ -29,7 +31,7 @@ import (
 
 var exitError = fmt.Errorf("encountered changes while running diff")
 
-func diffFile(c *config.Config, f *rule.File) error {
+func diffFile(c *config.Config, f *rule.File, out io.Writer) error {
 	rel, err := filepath.Rel(c.RepoRoot, f.Path)
 	if err != nil {
 		return fmt.Errorf("error getting old path for file %q: %v", f.Path, err)
@@ -73,11 +75,6 @@ func diffFile(c *config.Config, f *rule.File) error {
 		diff.ToFile = outPath
 	}
 
-	uc := getUpdateConfig(c)
-	var out io.Writer = os.Stdout
-	if uc.patchPath != "" {
-		out = &uc.patchBuffer
-	}
 	if err := difflib.WriteUnifiedDiff(out, diff); err != nil {
 		return fmt.Errorf("error diffing %s: %v", f.Path, err)
 	}
@@ -87,3 +84,34 @@ func diffFile(c *config.Config, f *rule.File) error {
 
 	return nil
 }
+
+// failOnDiff wraps an emitFunc so that it returns exitError after emitting
+// a file whose formatted content differs from the file it was read from.
+func failOnDiff(emit emitFunc) emitFunc {
+	return func(c *config.Config, f *rule.File, w io.Writer) error {
+		if err := emit(c, f, w); err != nil {
+			return err
+		}
+		oldContent, err := readOriginalFile(c, f)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error reading original file: %v", err)
+		}
+		if err != nil || !bytes.Equal(oldContent, f.Format()) {
+			return exitError
+		}
+		return nil
+	}
+}
+
+// readOriginalFile returns the content f was loaded from. When
+// -experimental_read_build_files_dir is set, files are read from that
+// directory, and files that weren't found there are new, even if a file
+// exists at the same path in the repository.
+func readOriginalFile(c *config.Config, f *rule.File) ([]byte, error) {
+	if c.ReadBuildFilesDir != "" {
+		if rel, err := filepath.Rel(c.ReadBuildFilesDir, f.Path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, os.ErrNotExist
+		}
+	}
+	return ioutil.ReadFile(f.Path)
+}
@@ -17,7 +17,10 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/bazelbuild/bazel-gazelle/testtools"
@@ -102,6 +105,48 @@ func TestDiffNew(t *testing.T) {
 	testtools.CheckFiles(t, dir, want)
 }
 
+func TestDiffOrder(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/hello",
+		},
+	}
+	var wantPaths []string
+	for i := 0; i < 50; i++ {
+		pkg := fmt.Sprintf("pkg%02d", i)
+		files = append(files, testtools.FileSpec{
+			Path:    pkg + "/hello.go",
+			Content: "package " + pkg,
+		})
+		wantPaths = append(wantPaths, pkg+"/BUILD.bazel")
+	}
+	// Directories are visited in post-order, so the root comes last.
+	wantPaths = append(wantPaths, "BUILD.bazel")
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	wantError := "encountered changes while running diff"
+	if err := runGazelle(dir, []string{"-mode=diff", "-patch=p"}); err == nil || err.Error() != wantError {
+		t.Fatalf("got %v; want %q", err, wantError)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotPaths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "+++ ") {
+			gotPaths = append(gotPaths, strings.Fields(line)[1])
+		}
+	}
+	if got, want := strings.Join(gotPaths, "\n"), strings.Join(wantPaths, "\n"); got != want {
+		t.Errorf("got diffs for:\n%s\nwant:\n%s", got, want)
+	}
+}
+
 func TestDiffReadWriteDir(t *testing.T) {
 	files := []testtools.FileSpec{
 		{
@@ -150,3 +195,66 @@ func TestDiffReadWriteDir(t *testing.T) {
 	want := append(files, testtools.FileSpec{Path: "p", Content: wantPatch})
 	testtools.CheckFiles(t, dir, want)
 }
+
+func TestFailOnDiff(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `
+# gazelle:prefix example.com/hello
+`,
+		}, {
+			Path:    "hello.go",
+			Content: `package hello`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	wantError := "encountered changes while running diff"
+	if err := runGazelle(dir, []string{"-mode=print", "-fail_on_diff"}); err == nil || err.Error() != wantError {
+		t.Fatalf("got %v; want %q", err, wantError)
+	}
+	testtools.CheckFiles(t, dir, files)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGazelle(dir, []string{"-mode=print", "-fail_on_diff"}); err != nil {
+		t.Errorf("after update: got %v; want nil", err)
+	}
+
+	wantError = "-fail_on_diff set but -mode is fix, not print or diff"
+	if err := runGazelle(dir, []string{"-fail_on_diff"}); err == nil || err.Error() != wantError {
+		t.Errorf("got %v; want %q", err, wantError)
+	}
+
+	// With -experimental_read_build_files_dir, files are compared with the
+	// files in that directory, not the files in the repository, even if
+	// those are up to date.
+	if err := os.Mkdir(filepath.Join(dir, "read"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGazelle(dir, []string{"-go_prefix=example.com/hello", "-experimental_read_build_files_dir=read", "-experimental_write_build_files_dir=write"}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "write", "BUILD.bazel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.bazel"), content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	readArgs := []string{"-go_prefix=example.com/hello", "-mode=print", "-fail_on_diff", "-experimental_read_build_files_dir=read"}
+	wantError = "encountered changes while running diff"
+	if err := runGazelle(dir, readArgs); err == nil || err.Error() != wantError {
+		t.Errorf("empty read dir: got %v; want %q", err, wantError)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "read", "BUILD.bazel"), content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGazelle(dir, readArgs); err != nil {
+		t.Errorf("up-to-date read dir: got %v; want nil", err)
+	}
+}
@@ -0,0 +1,66 @@
+/* Copyright 2019 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"runtime"
+)
+
+// emitVisits emits the build file for each visit that didn't fail. Files are
+// independent, so they're formatted and written concurrently, with at most
+// GOMAXPROCS files in progress at once. Output from each file (printed files
+// and diffs) is buffered and copied to uc.out() in visit order, so it's the
+// same as if files were emitted one at a time.
+//
+// emitVisits returns a slice with the error from emitting each visit, indexed
+// like visits, and a non-nil error if output couldn't be written.
+func emitVisits(uc *updateConfig, visits []visitRecord) ([]error, error) {
+	errs := make([]error, len(visits))
+	bufs := make([]bytes.Buffer, len(visits))
+	done := make([]chan struct{}, len(visits))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	// Start emitting files in order so that the file we're waiting on below
+	// is never queued behind files that come after it.
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	go func() {
+		for i := range visits {
+			sem <- struct{}{}
+			go func(i int) {
+				defer func() {
+					<-sem
+					close(done[i])
+				}()
+				v := &visits[i]
+				errs[i] = uc.emit(v.c, v.file, &bufs[i])
+			}(i)
+		}
+	}()
+
+	out := uc.out()
+	var writeErr error
+	for i := range visits {
+		<-done[i]
+		if writeErr == nil && bufs[i].Len() > 0 {
+			_, writeErr = out.Write(bufs[i].Bytes())
+		}
+		bufs[i] = bytes.Buffer{}
+	}
+	return errs, writeErr
+}
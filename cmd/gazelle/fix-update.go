@@ -17,8 +17,10 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -35,6 +37,7 @@ import (
 	"github.com/bazelbuild/bazel-gazelle/resolve"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 	"github.com/bazelbuild/bazel-gazelle/walk"
+	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 // updateConfig holds configuration information needed to run the fix and
@@ -48,9 +51,34 @@ type updateConfig struct {
 	walkMode       walk.Mode
 	patchPath      string
 	patchBuffer    bytes.Buffer
+	failOnDiff     bool
+	sortRules      bool
+	depsLocality   bool
+	summary        bool
+	keepGoing      bool
+
+	// depsOrder lists groups of label prefixes. Labels in generated deps are
+	// grouped in this order. Read from the file named with
+	// -deps_order_policy.
+	depsOrder [][]string
+
+	// indexFile is the name of a file written by the index command. Rules
+	// in it are indexed instead of rules in directories that aren't updated.
+	// Set with -index_file.
+	indexFile string
+
+	// indexOut is the name of the file the index command writes. If empty,
+	// the index is written to stdout. Set with -o.
+	indexOut string
+
+	// langs is the set of names of languages that generate rules. If empty,
+	// all languages generate rules. Set with -lang.
+	langs map[string]bool
 }
 
-type emitFunc func(c *config.Config, f *rule.File) error
+// emitFunc writes a build file or describes how it would change. Output
+// meant for the user, like printed files and diffs, is written to w.
+type emitFunc func(c *config.Config, f *rule.File, w io.Writer) error
 
 var modeFromName = map[string]emitFunc{
 	"print": printFile,
@@ -60,14 +88,40 @@ var modeFromName = map[string]emitFunc{
 
 const updateName = "_update"
 
+// sortedKindOrder lists kinds that come first, in this order, when generated
+// rules are sorted with -sort_rules.
+var sortedKindOrder = []string{"go_library", "go_test", "go_binary"}
+
+// withIndent wraps an emitFunc so that files are formatted with the
+// indentation set with -indent.
+func withIndent(emit emitFunc) emitFunc {
+	return func(c *config.Config, f *rule.File, w io.Writer) error {
+		f.Indent = c.Indent
+		return emit(c, f, w)
+	}
+}
+
+// out returns the writer that emitted output should go to: the patch buffer
+// if -patch was set, otherwise standard output.
+func (uc *updateConfig) out() io.Writer {
+	if uc.patchPath != "" {
+		return &uc.patchBuffer
+	}
+	return os.Stdout
+}
+
 func getUpdateConfig(c *config.Config) *updateConfig {
 	return c.Exts[updateName].(*updateConfig)
 }
 
 type updateConfigurer struct {
+	cmd            string
 	mode           string
+	depsSort       string
+	depsOrderPath  string
 	recursive      bool
 	knownImports   []string
+	langs          []string
 	repoConfigPath string
 }
 
@@ -76,24 +130,84 @@ func (ucr *updateConfigurer) RegisterFlags(fs *flag.FlagSet, cmd string, c *conf
 	c.Exts[updateName] = uc
 
 	c.ShouldFix = cmd == "fix"
+	ucr.cmd = cmd
 
-	fs.StringVar(&ucr.mode, "mode", "fix", "print: prints all of the updated BUILD files\n\tfix: rewrites all of the BUILD files in place\n\tdiff: computes the rewrite but then just does a diff")
 	fs.BoolVar(&ucr.recursive, "r", true, "when true, gazelle will update subdirectories recursively")
-	fs.StringVar(&uc.patchPath, "patch", "", "when set with -mode=diff, gazelle will write to a file instead of stdout")
+	if cmd != "list-unresolved" && cmd != "report-unused-repos" && cmd != "index" {
+		// list-unresolved, report-unused-repos, and index don't write build
+		// files, so flags that control output don't apply.
+		fs.StringVar(&ucr.mode, "mode", "fix", "print: prints all of the updated BUILD files\n\tfix: rewrites all of the BUILD files in place\n\tdiff: computes the rewrite but then just does a diff")
+		fs.StringVar(&uc.patchPath, "patch", "", "when set with -mode=diff, gazelle will write to a file instead of stdout")
+		fs.BoolVar(&uc.failOnDiff, "fail_on_diff", false, "when set with -mode=print or -mode=diff, gazelle will exit with a non-zero status if any build file would change")
+		fs.BoolVar(&uc.sortRules, "sort_rules", false, "when true, generated rules in each build file are sorted by kind (go_library, go_test, go_binary, then others alphabetically) and name")
+		fs.StringVar(&ucr.depsSort, "deps_sort", "default", "default: deps are sorted alphabetically\n\tlocality: labels in the same repository and labels in external repositories are sorted in separate blocks")
+		fs.StringVar(&ucr.depsOrderPath, "deps_order_policy", "", "JSON file listing groups of label prefixes. Labels in generated deps are grouped in the order the groups are listed,\n\tseparated by blank lines")
+		fs.BoolVar(&uc.keepGoing, "keep_going", false, "when true, gazelle skips directories that can't be processed and continues with the rest, then reports all errors and exits with a non-zero status")
+		fs.BoolVar(&uc.summary, "summary", false, "when true, gazelle prints a summary of created, updated, and deleted rules to stderr")
+	}
+	if cmd == "index" {
+		fs.StringVar(&uc.indexOut, "o", "", "file where the index is written. If not set, the index is written to stdout.")
+	} else {
+		fs.StringVar(&uc.indexFile, "index_file", "", "file written by the index command. Only directories being updated are visited; libraries in other directories are resolved with the index in this file.")
+	}
 	fs.Var(&gzflag.MultiFlag{Values: &ucr.knownImports}, "known_import", "import path for which external resolution is skipped (can specify multiple times)")
+	fs.Var(&gzflag.MultiFlag{Values: &ucr.langs}, "lang", "comma-separated list of languages that generate rules, for example, go,proto (can specify multiple times). If not set, all languages generate rules.")
 	fs.StringVar(&ucr.repoConfigPath, "repo_config", "", "file where Gazelle should load repository configuration. Defaults to WORKSPACE.")
 }
 
 func (ucr *updateConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) error {
 	uc := getUpdateConfig(c)
 
-	var ok bool
-	uc.emit, ok = modeFromName[ucr.mode]
-	if !ok {
-		return fmt.Errorf("unrecognized emit mode: %q", ucr.mode)
+	// -mode is not registered for list-unresolved, report-unused-repos, and
+	// index, which don't emit files.
+	if ucr.mode != "" {
+		var ok bool
+		uc.emit, ok = modeFromName[ucr.mode]
+		if !ok {
+			return fmt.Errorf("unrecognized emit mode: %q", ucr.mode)
+		}
+		uc.emit = withIndent(uc.emit)
+		if uc.patchPath != "" && ucr.mode != "diff" {
+			return fmt.Errorf("-patch set but -mode is %s, not diff", ucr.mode)
+		}
+		if uc.failOnDiff {
+			if ucr.mode == "fix" {
+				return fmt.Errorf("-fail_on_diff set but -mode is fix, not print or diff")
+			}
+			uc.emit = failOnDiff(uc.emit)
+		}
 	}
-	if uc.patchPath != "" && ucr.mode != "diff" {
-		return fmt.Errorf("-patch set but -mode is %s, not diff", ucr.mode)
+
+	switch ucr.depsSort {
+	case "", "default":
+	case "locality":
+		uc.depsLocality = true
+	default:
+		return fmt.Errorf("-deps_sort: unrecognized mode %q", ucr.depsSort)
+	}
+	if ucr.depsOrderPath != "" {
+		if uc.depsLocality {
+			return fmt.Errorf("-deps_order_policy can't be used with -deps_sort=locality")
+		}
+		var err error
+		if uc.depsOrder, err = readDepsOrderPolicy(ucr.depsOrderPath); err != nil {
+			return fmt.Errorf("-deps_order_policy: %v", err)
+		}
+	}
+
+	for _, v := range ucr.langs {
+		for _, name := range strings.Split(v, ",") {
+			if name == "" {
+				continue
+			}
+			if !isKnownLanguage(name) {
+				return fmt.Errorf("-lang: unknown language %q", name)
+			}
+			if uc.langs == nil {
+				uc.langs = make(map[string]bool)
+			}
+			uc.langs[name] = true
+		}
 	}
 
 	dirs := fs.Args()
@@ -116,11 +230,28 @@ func (ucr *updateConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) erro
 		uc.dirs[i] = dir
 	}
 
-	if ucr.recursive {
+	if uc.indexFile != "" && (!c.IndexLibraries || c.LazyIndex) {
+		return fmt.Errorf("-index_file may only be used with -index=true")
+	}
+	if uc.indexFile != "" && ucr.cmd == "report-unused-repos" {
+		// Loading the index from a file skips directories that aren't being
+		// updated, but imports in every directory must be seen to tell whether
+		// a repository is used.
+		return fmt.Errorf("-index_file may not be used with report-unused-repos")
+	}
+
+	// Other directories only need to be visited to build the index. When the
+	// index is off or lazy, or when it's loaded from a file, only directories
+	// being updated are visited.
+	fullIndex := c.IndexLibraries && !c.LazyIndex && uc.indexFile == ""
+	switch {
+	case ucr.recursive && fullIndex:
 		uc.walkMode = walk.VisitAllUpdateSubdirsMode
-	} else if c.IndexLibraries {
+	case ucr.recursive:
+		uc.walkMode = walk.UpdateSubdirsMode
+	case fullIndex:
 		uc.walkMode = walk.VisitAllUpdateDirsMode
-	} else {
+	default:
 		uc.walkMode = walk.UpdateDirsMode
 	}
 
@@ -214,6 +345,10 @@ type visitRecord struct {
 	// file is the build file being processed.
 	file *rule.File
 
+	// before records the rules in the build file before it was updated.
+	// Only set with -summary.
+	before ruleSnapshot
+
 	// mappedKinds are mapped kinds used during this visit.
 	mappedKinds    []config.MappedKind
 	mappedKindInfo map[string]rule.KindInfo
@@ -261,6 +396,16 @@ func runFixUpdate(cmd command, args []string) (err error) {
 		return err
 	}
 
+	uc := getUpdateConfig(c)
+	if cmd == indexCmd && (!c.IndexLibraries || c.LazyIndex) {
+		return fmt.Errorf("the index command may only be used with -index=true")
+	}
+	if uc.indexFile != "" {
+		if err := loadIndexFile(ruleIndex, uc.indexFile); err != nil {
+			return fmt.Errorf("-index_file: %v", err)
+		}
+	}
+
 	if cmd == fixCmd {
 		// Only check the version when "fix" is run. Generated build files
 		// frequently work with older version of rules_go, and we don't want to
@@ -268,13 +413,27 @@ func runFixUpdate(cmd command, args []string) (err error) {
 		checkRulesGoVersion(c.RepoRoot)
 	}
 
-	// Visit all directories in the repository.
+	// Visit all directories in the repository. Only rules of languages
+	// selected with -lang are merged, but all languages are configured, and
+	// existing rules of all languages are indexed.
 	var visits []visitRecord
-	uc := getUpdateConfig(c)
+	var failures dirFailures
+	genLangs := filterLanguages(uc, languages)
 	walk.Walk(c, cexts, uc.dirs, uc.walkMode, func(dir, rel string, c *config.Config, update bool, f *rule.File, subdirs, regularFiles, genFiles []string) {
+		// A build file that couldn't be loaded was already reported by
+		// walk.Walk. With -keep_going, it counts as a failure.
+		if uc.keepGoing && f == nil && c.ReadBuildFilesDir == "" && hasBuildFile(c, regularFiles) {
+			failures.add(rel, "could not load build file")
+		}
+
+		// Rules from this directory loaded with -index_file are stale, even if
+		// its build file now has no rules to index.
+		ruleIndex.MarkVisited(rel)
+
 		// If this file is ignored or if Gazelle was not asked to update this
-		// directory, just index the build file and move on.
-		if !update {
+		// directory, just index the build file and move on. The index command
+		// only indexes build files.
+		if !update || cmd == indexCmd {
 			if c.IndexLibraries && f != nil {
 				for _, r := range f.Rules {
 					ruleIndex.AddRule(c, r, f)
@@ -283,17 +442,26 @@ func runFixUpdate(cmd command, args []string) (err error) {
 			return
 		}
 
+		var before ruleSnapshot
+		if uc.summary {
+			before = snapshotRules(f)
+		}
+
 		// Fix any problems in the file.
 		if f != nil {
-			for _, l := range languages {
+			for _, l := range genLangs {
 				l.Fix(c, f)
 			}
 		}
 
-		// Generate rules.
+		// Generate rules. Languages not selected with -lang don't generate
+		// rules, but other languages may depend on their rules (for example,
+		// go_proto_library depends on proto_library), so their existing rules
+		// are passed along as if they had been generated.
 		var empty, gen []*rule.Rule
 		var imports []interface{}
-		for _, l := range languages {
+		existing := unselectedRules(uc, languages, f)
+		for _, l := range genLangs {
 			res := l.GenerateRules(language.GenerateArgs{
 				Config:       c,
 				Dir:          dir,
@@ -303,9 +471,16 @@ func runFixUpdate(cmd command, args []string) (err error) {
 				RegularFiles: regularFiles,
 				GenFiles:     genFiles,
 				OtherEmpty:   empty,
-				OtherGen:     gen})
+				OtherGen:     append(existing[:len(existing):len(existing)], gen...)})
 			if len(res.Gen) != len(res.Imports) {
-				log.Panicf("%s: language %s generated %d rules but returned %d imports", rel, l.Name(), len(res.Gen), len(res.Imports))
+				msg := fmt.Sprintf("language %s generated %d rules but returned %d imports", l.Name(), len(res.Gen), len(res.Imports))
+				// With -keep_going, the rest of this directory is skipped.
+				if !uc.keepGoing {
+					log.Panicf("%s: %s", rel, msg)
+				}
+				log.Printf("%s: %s", rel, msg)
+				failures.add(rel, msg)
+				return
 			}
 			empty = append(empty, res.Empty...)
 			gen = append(gen, res.Gen...)
@@ -346,6 +521,7 @@ func runFixUpdate(cmd command, args []string) (err error) {
 			imports:        imports,
 			empty:          empty,
 			file:           f,
+			before:         before,
 			mappedKinds:    mappedKinds,
 			mappedKindInfo: mappedKindInfo,
 		})
@@ -361,6 +537,13 @@ func runFixUpdate(cmd command, args []string) (err error) {
 	// Finish building the index for dependency resolution.
 	ruleIndex.Finish()
 
+	if cmd == indexCmd {
+		return writeIndexFile(ruleIndex, uc.indexOut)
+	}
+	if cmd == listUnresolvedCmd {
+		return listUnresolved(os.Stdout, c, ruleIndex, mrslv, uc.repos, visits)
+	}
+
 	// Resolve dependencies.
 	rc, cleanupRc := repo.NewRemoteCache(uc.repos)
 	defer func() {
@@ -368,33 +551,82 @@ func runFixUpdate(cmd command, args []string) (err error) {
 			err = cerr
 		}
 	}()
+	if cmd == reportUnusedReposCmd {
+		disableRemoteLookups(rc)
+	}
 	for _, v := range visits {
 		for i, r := range v.rules {
 			from := label.New(c.RepoName, v.pkgRel, r.Name())
 			mrslv.Resolver(r, v.pkgRel).Resolve(v.c, ruleIndex, rc, r, v.imports[i], from)
 		}
-		merger.MergeFile(v.file, v.empty, v.rules, merger.PostResolve,
-			unionKindInfoMaps(kinds, v.mappedKindInfo))
+		mergeKinds := unionKindInfoMaps(kinds, v.mappedKindInfo)
+		for _, r := range v.rules {
+			for attr := range mergeKinds[r.Kind()].ResolveAttrs {
+				remapRepoLabels(v.c, r.Attr(attr))
+			}
+		}
+		ruleIndex.RemoveAliasedDeps(v.c, v.file, v.rules, mergeKinds)
+		merger.MergeFile(v.file, v.empty, v.rules, merger.PostResolve, mergeKinds)
+		if v.c.ShouldFix {
+			// In fix mode, existing references to renamed repositories are
+			// rewritten too, including in attributes Gazelle doesn't manage.
+			for _, r := range v.file.Rules {
+				for _, attr := range r.AttrKeys() {
+					remapRepoLabels(v.c, r.Attr(attr))
+				}
+			}
+		}
+		if uc.sortRules {
+			merger.SortRules(v.file, v.rules, mergeKinds, sortedKindOrder)
+		}
+		if uc.depsLocality {
+			merger.GroupDepsByLocality(v.file, v.rules, mergeKinds)
+		} else if uc.depsOrder != nil {
+			merger.GroupDepsByPrefix(v.file, v.rules, mergeKinds, uc.depsOrder)
+		}
+	}
+
+	if cmd == reportUnusedReposCmd {
+		return reportUnusedRepos(os.Stdout, c, visits)
 	}
 
 	// Emit merged files.
 	var exit error
+	var changes []ruleChange
 	for _, v := range visits {
 		merger.FixLoads(v.file, applyKindMappings(v.mappedKinds, loads))
-		if err := uc.emit(v.c, v.file); err != nil {
+		if uc.summary {
+			changes = append(changes, diffRules(v.pkgRel, v.before, snapshotRules(v.file))...)
+		}
+	}
+	emitErrs, err := emitVisits(uc, visits)
+	if err != nil {
+		return err
+	}
+	for i, v := range visits {
+		if err := emitErrs[i]; err != nil {
 			if err == exitError {
 				exit = err
 			} else {
 				log.Print(err)
+				if uc.keepGoing {
+					failures.add(v.pkgRel, err.Error())
+				}
 			}
 		}
 	}
+	if uc.summary {
+		printSummary(os.Stderr, "rules", changes)
+	}
 	if uc.patchPath != "" {
 		if err := ioutil.WriteFile(uc.patchPath, uc.patchBuffer.Bytes(), 0666); err != nil {
 			return err
 		}
 	}
 
+	if len(failures) > 0 {
+		return failures
+	}
 	return exit
 }
 
@@ -412,7 +644,16 @@ func newFixUpdateConfiguration(cmd command, args []string, cexts []config.Config
 
 	if err := fs.Parse(args); err != nil {
 		if err == flag.ErrHelp {
-			fixUpdateUsage(fs)
+			switch cmd {
+			case listUnresolvedCmd:
+				listUnresolvedUsage(fs)
+			case reportUnusedReposCmd:
+				reportUnusedReposUsage(fs)
+			case indexCmd:
+				indexUsage(fs)
+			default:
+				fixUpdateUsage(fs)
+			}
 			return nil, err
 		}
 		// flag already prints the error; don't print it again.
@@ -480,7 +721,7 @@ func fixRepoFiles(c *config.Config, loads []rule.LoadInfo) error {
 				return err
 			}
 		}
-		if err := uc.emit(c, f); err != nil {
+		if err := uc.emit(c, f, uc.out()); err != nil {
 			return err
 		}
 	}
@@ -559,6 +800,62 @@ func unionKindInfoMaps(a, b map[string]rule.KindInfo) map[string]rule.KindInfo {
 	return result
 }
 
+// readDepsOrderPolicy reads a JSON list of groups of label prefixes, for
+// example:
+//
+//	[
+//	  ["@org_golang_x_"],
+//	  [":", "//"],
+//	  ["@"]
+//	]
+//
+// A prefix may only appear once.
+func readDepsOrderPolicy(path string) ([][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var groups [][]string
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	seen := make(map[string]bool)
+	for i, prefixes := range groups {
+		if len(prefixes) == 0 {
+			return nil, fmt.Errorf("%s: group %d has no prefixes", path, i)
+		}
+		for _, p := range prefixes {
+			if p == "" {
+				return nil, fmt.Errorf("%s: group %d has an empty prefix", path, i)
+			}
+			if seen[p] {
+				return nil, fmt.Errorf("%s: prefix %q is listed more than once", path, p)
+			}
+			seen[p] = true
+		}
+	}
+	return groups, nil
+}
+
+// remapRepoLabels replaces the repository names of labels in e that were
+// renamed with repo_remap directives. Strings are modified in place, so the
+// rest of each label is written the same way.
+func remapRepoLabels(c *config.Config, e bzl.Expr) {
+	bzl.Walk(e, func(x bzl.Expr, _ []bzl.Expr) {
+		s, ok := x.(*bzl.StringExpr)
+		if !ok || !strings.HasPrefix(s.Value, "@") {
+			return
+		}
+		l, err := label.Parse(s.Value)
+		if err != nil || l.Repo == "" {
+			return
+		}
+		if newRepo := resolve.RemapRepo(c, l.Repo); newRepo != l.Repo {
+			s.Value = "@" + newRepo + strings.TrimPrefix(s.Value, "@"+l.Repo)
+		}
+	})
+}
+
 // applyKindMappings returns a copy of LoadInfo that includes c.KindMap.
 func applyKindMappings(mappedKinds []config.MappedKind, loads []rule.LoadInfo) []rule.LoadInfo {
 	if len(mappedKinds) == 0 {
@@ -590,3 +887,89 @@ func appendOrMergeKindMapping(mappedLoads []rule.LoadInfo, mappedKind config.Map
 		Symbols: []string{mappedKind.KindName},
 	})
 }
+
+// dirFailures is a list of errors for directories that were skipped with
+// -keep_going. It is returned as an error at the end of the run.
+type dirFailures []string
+
+func (fs *dirFailures) add(rel, msg string) {
+	if rel == "" {
+		rel = "."
+	}
+	*fs = append(*fs, fmt.Sprintf("%s: %s", rel, msg))
+}
+
+func (fs dirFailures) Error() string {
+	return fmt.Sprintf("-keep_going: %d errors:\n\t%s", len(fs), strings.Join(fs, "\n\t"))
+}
+
+// isKnownLanguage returns whether name is the name of a language Gazelle
+// was built with.
+func isKnownLanguage(name string) bool {
+	for _, l := range languages {
+		if l.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// filterLanguages returns the languages in langs selected with -lang. All
+// languages are returned if -lang was not set.
+func filterLanguages(uc *updateConfig, langs []language.Language) []language.Language {
+	if len(uc.langs) == 0 {
+		return langs
+	}
+	var filtered []language.Language
+	for _, l := range langs {
+		if uc.generates(l) {
+			filtered = append(filtered, l)
+		}
+	}
+	return filtered
+}
+
+// generates returns whether rules generated by l should be merged into
+// build files, i.e., whether l was selected with -lang.
+func (uc *updateConfig) generates(l language.Language) bool {
+	return len(uc.langs) == 0 || uc.langs[l.Name()]
+}
+
+// unselectedRules returns the rules in f with kinds that belong only to
+// languages not selected with -lang.
+func unselectedRules(uc *updateConfig, languages []language.Language, f *rule.File) []*rule.Rule {
+	if f == nil || len(uc.langs) == 0 {
+		return nil
+	}
+	selectedKinds := make(map[string]bool)
+	unselectedKinds := make(map[string]bool)
+	for _, l := range languages {
+		for kind := range l.Kinds() {
+			if uc.generates(l) {
+				selectedKinds[kind] = true
+			} else {
+				unselectedKinds[kind] = true
+			}
+		}
+	}
+	var rules []*rule.Rule
+	for _, r := range f.Rules {
+		if unselectedKinds[r.Kind()] && !selectedKinds[r.Kind()] {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// hasBuildFile returns whether a directory contains a file with one of the
+// names build files may have.
+func hasBuildFile(c *config.Config, regularFiles []string) bool {
+	for _, name := range c.ValidBuildFileNames {
+		for _, f := range regularFiles {
+			if f == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -24,7 +25,7 @@ import (
 	"github.com/bazelbuild/bazel-gazelle/rule"
 )
 
-func fixFile(c *config.Config, f *rule.File) error {
+func fixFile(c *config.Config, f *rule.File, _ io.Writer) error {
 	outPath := findOutputPath(c, f)
 	if err := os.MkdirAll(filepath.Dir(outPath), 0777); err != nil {
 		return err
@@ -31,13 +31,19 @@ const (
 	fixCmd
 	updateReposCmd
 	helpCmd
+	listUnresolvedCmd
+	reportUnusedReposCmd
+	indexCmd
 )
 
 var commandFromName = map[string]command{
-	"fix":          fixCmd,
-	"help":         helpCmd,
-	"update":       updateCmd,
-	"update-repos": updateReposCmd,
+	"fix":                 fixCmd,
+	"help":                helpCmd,
+	"index":               indexCmd,
+	"list-unresolved":     listUnresolvedCmd,
+	"report-unused-repos": reportUnusedReposCmd,
+	"update":              updateCmd,
+	"update-repos":        updateReposCmd,
 }
 
 var nameFromCommand = []string{
@@ -46,6 +52,9 @@ var nameFromCommand = []string{
 	"fix",
 	"update-repos",
 	"help",
+	"list-unresolved",
+	"report-unused-repos",
+	"index",
 }
 
 func (cmd command) String() string {
@@ -78,7 +87,7 @@ func run(args []string) error {
 	}
 
 	switch cmd {
-	case fixCmd, updateCmd:
+	case fixCmd, updateCmd, listUnresolvedCmd, reportUnusedReposCmd, indexCmd:
 		return runFixUpdate(cmd, args)
 	case helpCmd:
 		return help()
@@ -109,6 +118,12 @@ Gazelle defaults to "update".
       existing rules.
   update-repos - updates repository rules in the WORKSPACE file. Run with
       -h for details.
+  list-unresolved - prints imports that can't be resolved to a rule in this
+      repository or in a declared external repository. No files are changed.
+  report-unused-repos - prints go_repository rules for repositories that no
+      package in this repository depends on. No files are changed.
+  index - writes an index of libraries in this repository to a file, which
+      later runs may load with -index_file instead of indexing again.
   help - show this message.
 
 For usage information for a specific command, run the command with the -h flag.
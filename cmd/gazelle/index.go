@@ -0,0 +1,74 @@
+/* Copyright 2019 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/bazelbuild/bazel-gazelle/resolve"
+)
+
+// writeIndexFile saves ix to the file at path, or to stdout if path is empty.
+func writeIndexFile(ix *resolve.RuleIndex, path string) error {
+	if path == "" {
+		return ix.Save(os.Stdout)
+	}
+	var buf bytes.Buffer
+	if err := ix.Save(&buf); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0666)
+}
+
+// loadIndexFile loads rules saved by the index command from the file at path
+// into ix.
+func loadIndexFile(ix *resolve.RuleIndex, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := ix.Load(f); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func indexUsage(fs *flag.FlagSet) {
+	fmt.Fprint(os.Stderr, `usage: gazelle index [flags...] [package-dirs...]
+
+The index command indexes libraries in existing build files the same way as
+update, then writes the index as JSON to the file named with -o, or to
+stdout. No build files are generated or changed.
+
+Later runs of update, fix, and list-unresolved may load the index with
+-index_file instead of walking the whole repository to build it. Those runs
+only visit the directories they're asked to update, and rules in those
+directories replace the rules from the file. Libraries added or changed in
+other directories since the index was written are not seen, so write the
+index again when build files change outside the directories being updated.
+report-unused-repos doesn't accept -index_file, since it needs to see imports
+in every directory.
+
+FLAGS:
+
+`)
+	fs.PrintDefaults()
+}
@@ -66,6 +66,8 @@ func TestHelp(t *testing.T) {
 		{"fix", "-h"},
 		{"update", "-h"},
 		{"update-repos", "-h"},
+		{"report-unused-repos", "-h"},
+		{"index", "-h"},
 	} {
 		t.Run(args[0], func(t *testing.T) {
 			if err := runGazelle(".", args); err == nil {
@@ -975,6 +977,66 @@ go_library(
 	})
 }
 
+// TestResolveKeptAlias checks that Gazelle does not add a dependency on a
+// library when a '# keep' dependency on an alias of that library is present.
+func TestResolveKeptAlias(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "foo/foo.go",
+			Content: `
+package foo
+
+import _ "example.com/repo/bar"
+`,
+		}, {
+			Path: "foo/BUILD.bazel",
+			Content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+    deps = [
+        "//bar:bar_alias",  # keep
+    ],
+)
+`,
+		}, {
+			Path: "bar/BUILD.bazel",
+			Content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["bar.go"],
+    importpath = "example.com/repo/bar",
+    visibility = ["//visibility:public"],
+)
+
+alias(
+    name = "bar_alias",
+    actual = ":go_default_library",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path:    "bar/bar.go",
+			Content: "package bar",
+		},
+	}
+
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	args := []string{"-go_prefix", "example.com/repo"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{files[2], files[3]})
+}
+
 // TestResolveVendorSubdirectory checks that Gazelle can resolve libraries
 // in a vendor directory which is not at the repository root.
 func TestResolveVendorSubdirectory(t *testing.T) {
@@ -2842,6 +2904,88 @@ go_library(
 	})
 }
 
+// TestNestedModulePrefix checks that the module paths in go.mod files are
+// used as prefixes, and that a prefix directive takes precedence.
+func TestNestedModulePrefix(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "go.mod",
+			Content: "module example.com/root",
+		}, {
+			Path:    "root.go",
+			Content: "package root",
+		}, {
+			Path: "sub/go.mod",
+			Content: `// A nested module.
+module "example.com/other/sub" // comment
+
+require example.com/root v1.0.0
+`,
+		}, {
+			Path:    "sub/lib/lib.go",
+			Content: "package lib",
+		}, {
+			Path:    "override/go.mod",
+			Content: "module example.com/override",
+		}, {
+			Path:    "override/BUILD.bazel",
+			Content: "# gazelle:prefix example.com/directive",
+		}, {
+			Path:    "override/override.go",
+			Content: "package override",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["root.go"],
+    importpath = "example.com/root",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "sub/lib/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/other/sub/lib",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "override/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:prefix example.com/directive
+
+go_library(
+    name = "go_default_library",
+    srcs = ["override.go"],
+    importpath = "example.com/directive",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
 // TestGoImportVisibility checks that submodules implicitly declared with
 // go_repository rules in the repo config file (WORKSPACE) have visibility
 // for rules generated in internal directories where appropriate.
@@ -2975,3 +3119,3736 @@ go_repository(
 		},
 	})
 }
+
+func TestCrossModuleLocalResolve(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "m1/go.mod",
+			Content: "module example.com/m1",
+		}, {
+			Path: "m1/a/a.go",
+			Content: `package a
+
+import (
+	_ "example.com/m2"
+	_ "example.com/m2/b"
+)
+`,
+		}, {
+			Path:    "m2/go.mod",
+			Content: "module example.com/m2",
+		}, {
+			Path:    "m2/m2.go",
+			Content: "package m2",
+		}, {
+			Path:    "m2/b/b.go",
+			Content: "package b",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, []string{"-index=false"}); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "m1/a/BUILD.bazel",
+		Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/m1/a",
+    visibility = ["//visibility:public"],
+    deps = [
+        "//m2:go_default_library",
+        "//m2/b:go_default_library",
+    ],
+)
+`,
+	}})
+}
+
+// TestCrossModuleLocalResolveOutsideWalk checks that modules are found in
+// directories Gazelle doesn't visit, that modules in testdata are ignored, and
+// that hand-written libraries keep their names.
+func TestCrossModuleLocalResolveOutsideWalk(t *testing.T) {
+	files := []testtools.FileSpec{
+		{
+			Path: "WORKSPACE",
+			Content: `
+go_repository(
+    name = "com_example_m3",
+    importpath = "example.com/m3",
+)
+`,
+		},
+		{
+			Path:    "m1/go.mod",
+			Content: "module example.com/m1",
+		}, {
+			Path: "m1/a/a.go",
+			Content: `package a
+
+import (
+	_ "example.com/m2"
+	_ "example.com/m2/b"
+	_ "example.com/m3"
+)
+`,
+		}, {
+			Path:    "m1/testdata/m3/go.mod",
+			Content: "module example.com/m3",
+		}, {
+			Path:    "m2/go.mod",
+			Content: "module example.com/m2",
+		}, {
+			Path:    "m2/m2.go",
+			Content: "package m2",
+		}, {
+			Path: "m2/b/BUILD.bazel",
+			Content: `
+go_library(
+    name = "b",
+    srcs = ["b.go"],
+    importpath = "example.com/m2/b",
+)
+`,
+		}, {
+			Path:    "m2/b/b.go",
+			Content: "package b",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, []string{"-index=false", "m1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "m1/a/BUILD.bazel",
+		Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/m1/a",
+    visibility = ["//visibility:public"],
+    deps = [
+        "//m2:go_default_library",
+        "//m2/b",
+        "@com_example_m3//:go_default_library",
+    ],
+)
+`,
+	}})
+}
+
+func TestGoKeepDep(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `
+# gazelle:prefix example.com/repo
+# gazelle:go_keep_dep //drivers:postgres
+`,
+		}, {
+			Path:    "root.go",
+			Content: "package root",
+		}, {
+			Path: "lib/lib.go",
+			Content: `package lib
+
+import _ "example.com/repo/drivers"
+`,
+		}, {
+			Path:    "lib/lib_test.go",
+			Content: "package lib",
+		}, {
+			Path:    "drivers/BUILD.bazel",
+			Content: "# gazelle:go_keep_dep",
+		}, {
+			Path:    "drivers/drivers.go",
+			Content: "package drivers",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:prefix example.com/repo
+# gazelle:go_keep_dep //drivers:postgres
+
+go_library(
+    name = "go_default_library",
+    srcs = ["root.go"],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+    deps = ["//drivers:postgres"],
+)
+`,
+		}, {
+			Path: "lib/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo/lib",
+    visibility = ["//visibility:public"],
+    deps = [
+        "//drivers:go_default_library",
+        "//drivers:postgres",
+    ],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    embed = [":go_default_library"],
+)
+`,
+		}, {
+			Path: "drivers/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:go_keep_dep
+
+go_library(
+    name = "go_default_library",
+    srcs = ["drivers.go"],
+    importpath = "example.com/repo/drivers",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestGoGcOpts(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path:    "root.go",
+			Content: "package root",
+		}, {
+			Path: "debug/BUILD.bazel",
+			Content: `
+# gazelle:go_gc_goopts -N -l
+# gazelle:go_gc_linkopts -s -w
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    gc_goopts = ["-B"],
+    importpath = "example.com/repo/debug",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path:    "debug/lib.go",
+			Content: "package debug",
+		}, {
+			Path:    "debug/lib_test.go",
+			Content: "package debug",
+		}, {
+			Path:    "debug/cmd/main.go",
+			Content: "package main",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:prefix example.com/repo
+
+go_library(
+    name = "go_default_library",
+    srcs = ["root.go"],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "debug/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+# gazelle:go_gc_goopts -N -l
+# gazelle:go_gc_linkopts -s -w
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    gc_goopts = ["-B"],
+    importpath = "example.com/repo/debug",
+    visibility = ["//visibility:public"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    embed = [":go_default_library"],
+    gc_goopts = [
+        "-N",
+        "-l",
+    ],
+    gc_linkopts = [
+        "-s",
+        "-w",
+    ],
+)
+`,
+		}, {
+			Path: "debug/cmd/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["main.go"],
+    gc_goopts = [
+        "-N",
+        "-l",
+    ],
+    importpath = "example.com/repo/debug/cmd",
+    visibility = ["//visibility:private"],
+)
+
+go_binary(
+    name = "cmd",
+    embed = [":go_default_library"],
+    gc_goopts = [
+        "-N",
+        "-l",
+    ],
+    gc_linkopts = [
+        "-s",
+        "-w",
+    ],
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestImportComment(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path:    "foo/foo.go",
+			Content: `package foo // import "example.com/canonical/foo"`,
+		}, {
+			Path: "bar/bar.go",
+			Content: `package bar
+
+import _ "example.com/canonical/foo"
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "foo/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    importpath = "example.com/canonical/foo",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "bar/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["bar.go"],
+    importpath = "example.com/repo/bar",
+    visibility = ["//visibility:public"],
+    deps = ["//foo:go_default_library"],
+)
+`,
+		},
+	})
+}
+
+func TestKeepGoing(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path:    "bad/BUILD.bazel",
+			Content: "go_library(",
+		}, {
+			Path:    "bad/bad.go",
+			Content: "package bad",
+		}, {
+			Path:    "good/good.go",
+			Content: "package good",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	err := runGazelle(dir, []string{"-keep_going"})
+	if err == nil {
+		t.Fatal("got success; want error")
+	}
+	if want := "bad: could not load build file"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q; want error containing %q", err, want)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path:    "bad/BUILD.bazel",
+			Content: "go_library(",
+		}, {
+			Path: "good/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["good.go"],
+    importpath = "example.com/repo/good",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+
+	// Without -keep_going, the error is only logged.
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportedMainPackage(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path:    "cmd/tool/main.go",
+			Content: "package main",
+		}, {
+			Path:    "cmd/other/main.go",
+			Content: "package main",
+		}, {
+			Path: "lib/lib_test.go",
+			Content: `package lib
+
+import _ "example.com/repo/cmd/tool"
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "cmd/tool/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["main.go"],
+    importpath = "example.com/repo/cmd/tool",
+    visibility = ["//visibility:public"],
+)
+
+go_binary(
+    name = "tool",
+    embed = [":go_default_library"],
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "cmd/other/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["main.go"],
+    importpath = "example.com/repo/cmd/other",
+    visibility = ["//visibility:private"],
+)
+
+go_binary(
+    name = "other",
+    embed = [":go_default_library"],
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "lib/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    deps = ["//cmd/tool:go_default_library"],
+)
+`,
+		},
+	})
+}
+
+func TestListUnresolved(t *testing.T) {
+	files := []testtools.FileSpec{
+		{
+			Path: "WORKSPACE",
+			Content: `
+go_repository(
+    name = "com_example_known",
+    importpath = "example.com/known",
+)
+`,
+		}, {
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path: "a/a.go",
+			Content: `package a
+
+import (
+	"fmt"
+
+	_ "example.com/known/pkg"
+	_ "example.com/missing/pkg"
+	_ "example.com/repo/b"
+	_ "golang.org/x/sync/errgroup"
+)
+
+var _ = fmt.Println
+`,
+		}, {
+			Path: "a/a_test.go",
+			Content: `package a
+
+import _ "example.com/missing/testonly"
+`,
+		}, {
+			Path:    "b/b.go",
+			Content: "package b",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	out, err := ioutil.TempFile(dir, "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	oldStdout := os.Stdout
+	os.Stdout = out
+	err = runGazelle(dir, []string{"list-unresolved"})
+	os.Stdout = oldStdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `a/a.go
+	example.com/missing/pkg
+	golang.org/x/sync/errgroup
+a/a_test.go
+	example.com/missing/testonly
+`
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// No build files are written.
+	for _, name := range []string{"a/BUILD.bazel", "b/BUILD.bazel"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("%s: got error %v; want not exist", name, err)
+		}
+	}
+}
+
+func TestReportUnusedRepos(t *testing.T) {
+	files := []testtools.FileSpec{
+		{
+			Path: "WORKSPACE",
+			Content: `
+http_archive(
+    name = "io_bazel_rules_go",
+)
+
+go_repository(
+    name = "com_example_used",
+    importpath = "example.com/used",
+)
+
+go_repository(
+    name = "com_example_testonly",
+    importpath = "example.com/testonly",
+)
+
+go_repository(
+    name = "com_example_manual",
+    importpath = "example.com/manual",
+)
+
+go_repository(
+    name = "com_example_unused",
+    importpath = "example.com/unused",
+)
+
+go_repository(
+    name = "com_example_indirect",
+    importpath = "example.com/indirect",
+)
+`,
+		}, {
+			Path: "BUILD.bazel",
+			Content: `# gazelle:prefix example.com/repo
+
+genrule(
+    name = "gen",
+    srcs = ["@com_example_manual//:data"],
+    outs = ["gen.txt"],
+    cmd = "cp $< $@",
+)
+`,
+		}, {
+			Path: "a/a.go",
+			Content: `package a
+
+import _ "example.com/used/pkg"
+`,
+		}, {
+			Path: "a/a_test.go",
+			Content: `package a
+
+import _ "example.com/testonly"
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	out, err := ioutil.TempFile(dir, "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	oldStdout := os.Stdout
+	os.Stdout = out
+	err = runGazelle(dir, []string{"report-unused-repos"})
+	os.Stdout = oldStdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "com_example_indirect\texample.com/indirect\ncom_example_unused\texample.com/unused\n"
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// No build files are written.
+	if _, err := os.Stat(filepath.Join(dir, "a", "BUILD.bazel")); !os.IsNotExist(err) {
+		t.Errorf("a/BUILD.bazel: got error %v; want not exist", err)
+	}
+}
+
+func TestGoTestShardCountFlaky(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path:    "small/small_test.go",
+			Content: "package small",
+		}, {
+			Path: "big/BUILD.bazel",
+			Content: `
+# gazelle:go_test_shard_count 4
+# gazelle:go_test_flaky true
+
+go_test(
+    name = "go_default_test",
+    srcs = ["big_test.go"],
+    shard_count = 2,
+)
+`,
+		}, {
+			Path:    "big/big_test.go",
+			Content: "package big",
+		}, {
+			Path:    "big/sub/sub_test.go",
+			Content: "package sub",
+		}, {
+			Path:    "big/stable/BUILD.bazel",
+			Content: "# gazelle:go_test_flaky false",
+		}, {
+			Path:    "big/stable/stable_test.go",
+			Content: "package stable",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "small/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["small_test.go"],
+)
+`,
+		}, {
+			Path: "big/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+# gazelle:go_test_shard_count 4
+# gazelle:go_test_flaky true
+
+go_test(
+    name = "go_default_test",
+    srcs = ["big_test.go"],
+    flaky = True,
+    shard_count = 2,
+)
+`,
+		}, {
+			Path: "big/sub/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["sub_test.go"],
+    flaky = True,
+    shard_count = 4,
+)
+`,
+		}, {
+			Path: "big/stable/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+# gazelle:go_test_flaky false
+
+go_test(
+    name = "go_default_test",
+    srcs = ["stable_test.go"],
+    shard_count = 4,
+)
+`,
+		},
+	})
+}
+
+func TestGoTestEnv(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `# gazelle:prefix example.com/repo
+# gazelle:go_test_env FOO=1
+# gazelle:go_test_env_inherit HOME
+`,
+		}, {
+			Path:    "a/a_test.go",
+			Content: "package a",
+		}, {
+			Path: "a/b/BUILD.bazel",
+			Content: `
+# gazelle:go_test_env FOO=2
+# gazelle:go_test_env BAR=x=y
+# gazelle:go_test_env_inherit PATH
+`,
+		}, {
+			Path:    "a/b/b_test.go",
+			Content: "package b",
+		}, {
+			Path: "kept/BUILD.bazel",
+			Content: `
+go_test(
+    name = "go_default_test",
+    srcs = ["kept_test.go"],
+    env = {"FOO": "custom"},
+)
+`,
+		}, {
+			Path:    "kept/kept_test.go",
+			Content: "package kept",
+		}, {
+			Path: "reset/BUILD.bazel",
+			Content: `
+# gazelle:go_test_env
+# gazelle:go_test_env_inherit
+`,
+		}, {
+			Path:    "reset/reset_test.go",
+			Content: "package reset",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	// Running twice should not change the output.
+	for i := 0; i < 2; i++ {
+		if err := runGazelle(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "a/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["a_test.go"],
+    env = {
+        "FOO": "1",
+    },
+    env_inherit = ["HOME"],
+)
+`,
+		}, {
+			Path: "a/b/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+# gazelle:go_test_env FOO=2
+# gazelle:go_test_env BAR=x=y
+# gazelle:go_test_env_inherit PATH
+
+go_test(
+    name = "go_default_test",
+    srcs = ["b_test.go"],
+    env = {
+        "BAR": "x=y",
+        "FOO": "2",
+    },
+    env_inherit = [
+        "HOME",
+        "PATH",
+    ],
+)
+`,
+		}, {
+			Path: "kept/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["kept_test.go"],
+    env = {"FOO": "custom"},
+    env_inherit = ["HOME"],
+)
+`,
+		}, {
+			Path: "reset/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+# gazelle:go_test_env
+# gazelle:go_test_env_inherit
+
+go_test(
+    name = "go_default_test",
+    srcs = ["reset_test.go"],
+)
+`,
+		},
+	})
+}
+
+func TestGoLibraryPure(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path:    "pure/BUILD.bazel",
+			Content: "# gazelle:go_library_pure on",
+		}, {
+			Path:    "pure/pure.go",
+			Content: "package pure",
+		}, {
+			Path: "pure/cgo.go",
+			Content: `package pure
+
+import "C"
+`,
+		}, {
+			Path:    "pure/cgo.c",
+			Content: "int x;",
+		}, {
+			Path: "pure/kept/BUILD.bazel",
+			Content: `
+go_library(
+    name = "go_default_library",
+    srcs = ["kept.go"],
+    importpath = "example.com/repo/pure/kept",
+    pure = "auto",
+)
+`,
+		}, {
+			Path:    "pure/kept/kept.go",
+			Content: "package kept",
+		}, {
+			Path:    "pure/cgo/BUILD.bazel",
+			Content: "# gazelle:go_library_pure off",
+		}, {
+			Path: "pure/cgo/cgo.go",
+			Content: `package cgo
+
+import "C"
+`,
+		}, {
+			Path:    "other/other.go",
+			Content: "package other",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	// Running twice should not change the output.
+	for i := 0; i < 2; i++ {
+		if err := runGazelle(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "pure/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:go_library_pure on
+
+go_library(
+    name = "go_default_library",
+    srcs = ["pure.go"],
+    importpath = "example.com/repo/pure",
+    pure = "on",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "pure/kept/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["kept.go"],
+    importpath = "example.com/repo/pure/kept",
+    pure = "auto",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "pure/cgo/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:go_library_pure off
+
+go_library(
+    name = "go_default_library",
+    srcs = ["cgo.go"],
+    cgo = True,
+    importpath = "example.com/repo/pure/cgo",
+    pure = "off",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "other/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["other.go"],
+    importpath = "example.com/repo/other",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestConfigFile(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "tools/gazelle.cfg",
+			Content: `
+# gazelle:prefix example.com/repo
+# gazelle:proto disable
+# gazelle:exclude skipped
+`,
+		}, {
+			Path:    "a/a.go",
+			Content: "package a",
+		}, {
+			Path:    "a/a.proto",
+			Content: `syntax = "proto3";`,
+		}, {
+			Path:    "skipped/skipped.go",
+			Content: "package skipped",
+		}, {
+			Path:    "sub/BUILD.bazel",
+			Content: "# gazelle:prefix example.com/other",
+		}, {
+			Path:    "sub/sub.go",
+			Content: "package sub",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	args := []string{"-config", filepath.Join(dir, "tools", "gazelle.cfg")}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "a/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/repo/a",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "sub/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:prefix example.com/other
+
+go_library(
+    name = "go_default_library",
+    srcs = ["sub.go"],
+    importpath = "example.com/other",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+	if _, err := os.Stat(filepath.Join(dir, "skipped", "BUILD.bazel")); !os.IsNotExist(err) {
+		t.Errorf("skipped/BUILD.bazel: got error %v; want not exist", err)
+	}
+
+	if err := runGazelle(dir, []string{"-config", filepath.Join(dir, "missing.cfg")}); err == nil {
+		t.Error("got success with missing -config file; want error")
+	}
+}
+
+func TestProtoAlias(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `
+# gazelle:prefix example.com/repo
+# gazelle:proto_alias foo_proto_lib foo_proto
+# gazelle:proto_alias foo_go_proto_lib foo_go_proto
+`,
+		}, {
+			Path: "foo/foo.proto",
+			Content: `
+syntax = "proto3";
+
+package foo;
+
+option go_package = "example.com/repo/foo";
+`,
+		}, {
+			Path: "bar/BUILD.bazel",
+			Content: `
+# gazelle:proto_alias
+
+proto_library(
+    name = "bar_proto_lib",
+    srcs = ["bar.proto"],
+)
+`,
+		}, {
+			Path: "bar/bar.proto",
+			Content: `
+syntax = "proto3";
+
+package bar;
+
+option go_package = "example.com/repo/bar";
+`,
+		}, {
+			Path: "baz/BUILD.bazel",
+			Content: `
+proto_library(
+    name = "baz_proto",
+    srcs = ["baz.proto"],
+    deps = [
+        "//foo:foo_proto_lib",  # keep
+    ],
+)
+
+alias(
+    name = "baz_proto_lib",
+    actual = ":baz_proto",
+)
+`,
+		}, {
+			Path: "baz/baz.proto",
+			Content: `
+syntax = "proto3";
+
+package baz;
+
+import "foo/foo.proto";
+
+option go_package = "example.com/repo/baz";
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	wantFoo := `
+load("@rules_proto//proto:defs.bzl", "proto_library")
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+)
+
+# legacy name (proto_alias)
+alias(
+    name = "foo_proto_lib",
+    actual = ":foo_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/repo/foo",
+    proto = ":foo_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    embed = [":foo_go_proto"],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+)
+
+# legacy name (proto_alias)
+alias(
+    name = "foo_go_proto_lib",
+    actual = ":foo_go_proto",
+    visibility = ["//visibility:public"],
+)
+`
+	// The hand-written alias in baz is left alone, and the dependency on
+	// //foo:foo_proto isn't added next to the kept alias of it.
+	wantBaz := `
+load("@rules_proto//proto:defs.bzl", "proto_library")
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+proto_library(
+    name = "baz_proto",
+    srcs = ["baz.proto"],
+    visibility = ["//visibility:public"],
+    deps = [
+        "//foo:foo_proto_lib",  # keep
+    ],
+)
+
+alias(
+    name = "baz_proto_lib",
+    actual = ":baz_proto",
+)
+
+go_proto_library(
+    name = "baz_go_proto",
+    importpath = "example.com/repo/baz",
+    proto = ":baz_proto",
+    visibility = ["//visibility:public"],
+    deps = ["//foo:go_default_library"],
+)
+
+go_library(
+    name = "go_default_library",
+    embed = [":baz_go_proto"],
+    importpath = "example.com/repo/baz",
+    visibility = ["//visibility:public"],
+)
+`
+	for i := 0; i < 2; i++ {
+		// Running again doesn't change anything.
+		if err := runGazelle(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		testtools.CheckFiles(t, dir, []testtools.FileSpec{
+			{Path: "foo/BUILD.bazel", Content: wantFoo},
+			{Path: "baz/BUILD.bazel", Content: wantBaz},
+		})
+	}
+
+	// Aliases aren't generated after the directive is reset.
+	data, err := ioutil.ReadFile(filepath.Join(dir, "bar", "BUILD.bazel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "alias(") {
+		t.Errorf("bar/BUILD.bazel contains an alias:\n%s", data)
+	}
+
+	// Aliases are deleted when their directives are removed.
+	if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.bazel"), []byte(`
+# gazelle:prefix example.com/repo
+# gazelle:proto_alias foo_proto_lib foo_proto
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{Path: "foo/BUILD.bazel", Content: `
+load("@rules_proto//proto:defs.bzl", "proto_library")
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+)
+
+# legacy name (proto_alias)
+alias(
+    name = "foo_proto_lib",
+    actual = ":foo_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/repo/foo",
+    proto = ":foo_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    embed = [":foo_go_proto"],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+)
+`},
+		{Path: "baz/BUILD.bazel", Content: wantBaz},
+	})
+}
+
+func TestLang(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path: "lib/BUILD.bazel",
+			Content: `
+load("@rules_proto//proto:defs.bzl", "proto_library")
+
+proto_library(
+    name = "old_proto",
+    srcs = ["old.proto"],
+)
+`,
+		}, {
+			Path:    "lib/lib.go",
+			Content: "package lib",
+		}, {
+			Path:    "lib/new.proto",
+			Content: `syntax = "proto3";`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, []string{"-lang=go"}); err != nil {
+		t.Fatal(err)
+	}
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "lib/BUILD.bazel",
+		Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@rules_proto//proto:defs.bzl", "proto_library")
+
+proto_library(
+    name = "old_proto",
+    srcs = ["old.proto"],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo/lib",
+    visibility = ["//visibility:public"],
+)
+`,
+	}})
+
+	if err := runGazelle(dir, []string{"-lang=foo,go"}); err == nil {
+		t.Error("got success for unknown language; want error")
+	} else if want := `-lang: unknown language "foo"`; err.Error() != want {
+		t.Errorf("got error %q; want %q", err, want)
+	}
+}
+
+func TestLangKeepsProtoRules(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path: "foo/foo.proto",
+			Content: `syntax = "proto3";
+
+option go_package = "example.com/repo/foo";
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := `
+load("@rules_proto//proto:defs.bzl", "proto_library")
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/repo/foo",
+    proto = ":foo_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    embed = [":foo_go_proto"],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+)
+`
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{Path: "foo/BUILD.bazel", Content: want}})
+
+	// Proto rules aren't generated with -lang=go, but Go rules generated from
+	// existing proto_library rules must not be deleted.
+	if err := runGazelle(dir, []string{"-lang=go"}); err != nil {
+		t.Fatal(err)
+	}
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{Path: "foo/BUILD.bazel", Content: want}})
+}
+
+func TestGoBinaryOut(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path:    "cmd/BUILD.bazel",
+			Content: "# gazelle:go_binary_out deploy-tool",
+		}, {
+			Path:    "cmd/main.go",
+			Content: "package main",
+		}, {
+			Path:    "cmd/sub/main.go",
+			Content: "package main",
+		}, {
+			Path: "kept/BUILD.bazel",
+			Content: `
+# gazelle:go_binary_out new-name
+
+go_binary(
+    name = "kept",
+    out = "old-name",
+)
+`,
+		}, {
+			Path:    "kept/main.go",
+			Content: "package main",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "cmd/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+# gazelle:go_binary_out deploy-tool
+
+go_library(
+    name = "go_default_library",
+    srcs = ["main.go"],
+    importpath = "example.com/repo/cmd",
+    visibility = ["//visibility:private"],
+)
+
+go_binary(
+    name = "cmd",
+    out = "deploy-tool",
+    embed = [":go_default_library"],
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "cmd/sub/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["main.go"],
+    importpath = "example.com/repo/cmd/sub",
+    visibility = ["//visibility:private"],
+)
+
+go_binary(
+    name = "sub",
+    embed = [":go_default_library"],
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "kept/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+# gazelle:go_binary_out new-name
+
+go_binary(
+    name = "kept",
+    out = "old-name",
+    embed = [":go_default_library"],
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["main.go"],
+    importpath = "example.com/repo/kept",
+    visibility = ["//visibility:private"],
+)
+`,
+		},
+	})
+}
+
+func TestIndent(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path:    "lib/lib.go",
+			Content: "package lib",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, []string{"-indent=2"}); err != nil {
+		t.Fatal(err)
+	}
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "lib/BUILD.bazel",
+		Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+  name = "go_default_library",
+  srcs = ["lib.go"],
+  importpath = "example.com/repo/lib",
+  visibility = ["//visibility:public"],
+)
+`,
+	}})
+
+	if err := runGazelle(dir, []string{"-indent=x"}); err == nil {
+		t.Error("got success with -indent=x; want error")
+	}
+}
+
+func TestEmbedExistingGoProtoLibrary(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path: "disabled/BUILD.bazel",
+			Content: `
+# gazelle:proto disable
+
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/repo/disabled",
+    proto = "//protos:foo_proto",
+)
+`,
+		}, {
+			Path:    "disabled/extra.go",
+			Content: "package disabled",
+		}, {
+			Path: "kept/BUILD.bazel",
+			Content: `
+go_proto_library(
+    name = "bar_go_proto",
+    importpath = "example.com/repo/kept",
+    proto = "//protos:bar_proto",
+)  # keep
+`,
+		}, {
+			Path:    "kept/extra.go",
+			Content: "package kept",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "disabled/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+# gazelle:proto disable
+
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/repo/disabled",
+    proto = "//protos:foo_proto",
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["extra.go"],
+    embed = [":foo_go_proto"],
+    importpath = "example.com/repo/disabled",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "kept/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+go_proto_library(
+    name = "bar_go_proto",
+    importpath = "example.com/repo/kept",
+    proto = "//protos:bar_proto",
+)  # keep
+
+go_library(
+    name = "go_default_library",
+    srcs = ["extra.go"],
+    embed = [":bar_go_proto"],
+    importpath = "example.com/repo/kept",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestGoRegenerate(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:prefix example.com/repo
+# gazelle:go_regenerate go_default_library
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "gone.go",
+        "lib.go",
+    ],
+    cgo = True,
+    importpath = "example.com/wrong",
+    tags = ["manual"],
+    visibility = ["//visibility:private"],
+    deps = [
+        "//bogus:go_default_library",
+        "//extra:go_default_library",  # keep
+    ],
+)
+`,
+		}, {
+			Path:    "lib.go",
+			Content: "package lib",
+		}, {
+			Path: "sub/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["sub.go"],
+    importpath = "example.com/repo/sub",
+    tags = ["manual"],
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path:    "sub/sub.go",
+			Content: "package sub",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:prefix example.com/repo
+# gazelle:go_regenerate go_default_library
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+    deps = [
+        "//extra:go_default_library",  # keep
+    ],
+)
+`,
+		}, {
+			// The directive isn't inherited.
+			Path: "sub/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["sub.go"],
+    importpath = "example.com/repo/sub",
+    tags = ["manual"],
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestUpdateReposMacroHeader(t *testing.T) {
+	files := []testtools.FileSpec{
+		{
+			Path: "WORKSPACE",
+			Content: `
+# gazelle:repository_macro repositories.bzl%go_repositories
+`,
+		}, {
+			Path: "repositories.bzl",
+			Content: `
+# Copyright 2019 Example Authors
+
+load("@bazel_gazelle//:deps.bzl", "go_repository")
+
+def go_repositories():
+    pass
+`,
+		}, {
+			Path: "Gopkg.lock",
+			Content: `# This file is autogenerated, do not edit; changes may be undone by the next 'dep ensure'.
+
+[[projects]]
+  name = "github.com/pkg/errors"
+  packages = ["."]
+  revision = "645ef00459ed84a119197bfb8d8205042c6df63d"
+  version = "v0.8.0"
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	for _, source := range []string{"Gopkg.lock", "Gopkg.lock (updated)"} {
+		args := []string{"update-repos", "-build_file_generation", "off", "-from_file", "Gopkg.lock", "-to_macro", "repositories.bzl%go_repositories",
+			"-macro_header", "DO NOT EDIT - generated by gazelle update-repos",
+			"-macro_header", "Source: " + source}
+		if err := runGazelle(dir, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "repositories.bzl",
+			Content: `
+# Copyright 2019 Example Authors
+
+# DO NOT EDIT - generated by gazelle update-repos
+# Source: Gopkg.lock (updated)
+
+load("@bazel_gazelle//:deps.bzl", "go_repository")
+
+def go_repositories():
+    go_repository(
+        name = "com_github_pkg_errors",
+        build_file_generation = "off",
+        commit = "645ef00459ed84a119197bfb8d8205042c6df63d",
+        importpath = "github.com/pkg/errors",
+    )
+`,
+		}})
+
+	if err := runGazelle(dir, []string{"update-repos", "-from_file", "Gopkg.lock", "-macro_header", "DO NOT EDIT"}); err == nil {
+		t.Error("got success with -macro_header and no -to_macro; want error")
+	}
+}
+
+func TestGoExtraExtensions(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `
+# gazelle:prefix example.com/repo
+# gazelle:go_extra_extensions .go.tmpl
+`,
+		}, {
+			Path:    "lib.go",
+			Content: "package lib",
+		}, {
+			Path:    "gen.go.tmpl",
+			Content: "package lib\n\nconst Version = {{.Version}}\n",
+		}, {
+			Path:    "gen_linux.go.tmpl",
+			Content: "package lib",
+		}, {
+			Path:    "lib_test.go",
+			Content: "package lib",
+		}, {
+			Path:    "lib_test.go.tmpl",
+			Content: "package lib",
+		}, {
+			Path:    "README.tmpl",
+			Content: "not Go",
+		}, {
+			Path:    "sub/sub.go",
+			Content: "package sub",
+		}, {
+			Path:    "sub/sub.go.tmpl",
+			Content: "package sub",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+# gazelle:prefix example.com/repo
+# gazelle:go_extra_extensions .go.tmpl
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "gen.go.tmpl",
+        "gen_linux.go.tmpl",
+        "lib.go",
+    ],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = [
+        "lib_test.go",
+        "lib_test.go.tmpl",
+    ],
+    embed = [":go_default_library"],
+)
+`,
+		}, {
+			// The directive is inherited.
+			Path: "sub/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "sub.go",
+        "sub.go.tmpl",
+    ],
+    importpath = "example.com/repo/sub",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestResolvePkgConfig(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `
+# gazelle:prefix example.com/repo
+# gazelle:resolve_pkgconfig libfoo //third_party:libfoo
+`,
+		}, {
+			Path: "sub/BUILD.bazel",
+			Content: `
+# gazelle:resolve_pkgconfig libbar @bar//:libbar
+`,
+		}, {
+			Path: "sub/sub.go",
+			Content: `package sub
+
+/*
+#cgo pkg-config: libfoo libbar libunknown
+*/
+import "C"
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "sub/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:resolve_pkgconfig libbar @bar//:libbar
+
+go_library(
+    name = "go_default_library",
+    srcs = ["sub.go"],
+    cdeps = [
+        "//third_party:libfoo",
+        "@bar//:libbar",
+    ],
+    cgo = True,
+    importpath = "example.com/repo/sub",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestResolveCgoLib(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `
+# gazelle:prefix example.com/repo
+# gazelle:resolve_cgo_lib foo //third_party:foo_import
+# gazelle:resolve_cgo_lib bar //third_party:bar_import
+`,
+		}, {
+			Path: "sub/sub.go",
+			Content: `package sub
+
+/*
+#cgo LDFLAGS: -lfoo -lm -Wl,--as-needed
+#cgo linux LDFLAGS: -l bar
+*/
+import "C"
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "sub/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["sub.go"],
+    cdeps = [
+        "//third_party:foo_import",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:android": [
+            "//third_party:bar_import",
+        ],
+        "@io_bazel_rules_go//go/platform:linux": [
+            "//third_party:bar_import",
+        ],
+        "//conditions:default": [],
+    }),
+    cgo = True,
+    clinkopts = ["-lm -Wl,--as-needed"],
+    importpath = "example.com/repo/sub",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+// TestHandWrittenCdeps checks that cdeps written by hand are not changed,
+// with or without resolve_cgo_lib directives, and that libraries that can't
+// be added to them stay in clinkopts.
+func TestHandWrittenCdeps(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path: "plain/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["plain.go"],
+    cdeps = ["//third_party:x"],
+    cgo = True,
+    importpath = "example.com/repo/plain",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "plain/plain.go",
+			Content: `package plain
+
+import "C"
+`,
+		}, {
+			Path: "mapped/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:resolve_cgo_lib foo //third_party:foo_import
+
+go_library(
+    name = "go_default_library",
+    srcs = ["mapped.go"],
+    cdeps = ["//third_party:x"],
+    cgo = True,
+    clinkopts = ["-lfoo"],
+    importpath = "example.com/repo/mapped",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "mapped/mapped.go",
+			Content: `package mapped
+
+/*
+#cgo LDFLAGS: -lfoo
+*/
+import "C"
+`,
+		}, {
+			Path: "generated/generated.go",
+			Content: `package generated
+
+/*
+#cgo LDFLAGS: -lfoo
+*/
+import "C"
+`,
+		}, {
+			Path:    "generated/BUILD.bazel",
+			Content: "# gazelle:resolve_cgo_lib foo //third_party:foo_import",
+		}, {
+			Path: "stale/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:resolve_cgo_lib foo //third_party:foo_import
+# gazelle:resolve_pkgconfig bar //third_party:bar
+
+go_library(
+    name = "go_default_library",
+    srcs = ["stale.go"],
+    cdeps = [
+        "//third_party:foo_import",
+        "//third_party:x",
+    ],
+    cgo = True,
+    importpath = "example.com/repo/stale",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "stale/stale.go",
+			Content: `package stale
+
+/*
+#cgo pkg-config: bar
+*/
+import "C"
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	want := []testtools.FileSpec{
+		files[2],
+		{
+			Path: "mapped/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:resolve_cgo_lib foo //third_party:foo_import
+
+go_library(
+    name = "go_default_library",
+    srcs = ["mapped.go"],
+    cdeps = [
+        "//third_party:x",
+        "//third_party:foo_import",
+    ],
+    cgo = True,
+    importpath = "example.com/repo/mapped",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			// The library is no longer linked, so its label is removed. The
+			// pkg-config package is added.
+			Path: "stale/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:resolve_cgo_lib foo //third_party:foo_import
+# gazelle:resolve_pkgconfig bar //third_party:bar
+
+go_library(
+    name = "go_default_library",
+    srcs = ["stale.go"],
+    cdeps = [
+        "//third_party:x",
+        "//third_party:bar",
+    ],
+    cgo = True,
+    importpath = "example.com/repo/stale",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "generated/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:resolve_cgo_lib foo //third_party:foo_import
+
+go_library(
+    name = "go_default_library",
+    srcs = ["generated.go"],
+    cdeps = ["//third_party:foo_import"],
+    cgo = True,
+    importpath = "example.com/repo/generated",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	}
+	// The second run sees the cdeps set by the first and keeps it.
+	for i := 0; i < 2; i++ {
+		if err := runGazelle(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		testtools.CheckFiles(t, dir, want)
+	}
+}
+
+// TestPregeneratedGoOnly checks that a directory with checked-in .pb.go files
+// and no .proto files gets a plain go_library in every proto mode.
+func TestPregeneratedGoOnly(t *testing.T) {
+	for _, mode := range []string{"default", "package", "legacy", "disable", "disable_global"} {
+		t.Run(mode, func(t *testing.T) {
+			files := []testtools.FileSpec{
+				{Path: "WORKSPACE"},
+				{
+					Path:    "BUILD.bazel",
+					Content: "# gazelle:prefix example.com/repo\n# gazelle:proto " + mode + "\n",
+				}, {
+					Path:    "foo/foo.pb.go",
+					Content: "package foo\n",
+				}, {
+					Path:    "foo/foo_grpc.pb.go",
+					Content: "package foo\n",
+				},
+			}
+			dir, cleanup := testtools.CreateFiles(t, files)
+			defer cleanup()
+
+			if err := runGazelle(dir, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			testtools.CheckFiles(t, dir, []testtools.FileSpec{
+				{
+					Path: "foo/BUILD.bazel",
+					Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "foo.pb.go",
+        "foo_grpc.pb.go",
+    ],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+)
+`,
+				},
+			})
+		})
+	}
+}
+
+func TestRepoRemap(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `
+# gazelle:prefix example.com/repo
+# gazelle:repo_remap com_github_old_lib @com_github_fork_lib
+`,
+		}, {
+			Path: "foo/foo.go",
+			Content: `package foo
+
+import _ "github.com/old/lib"
+`,
+		}, {
+			Path: "foo/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    data = ["@com_github_old_lib//testdata:data"],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+    deps = [
+        "@com_github_old_lib//extra:go_default_library",  # keep
+    ],
+)
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	// update only changes labels it generates.
+	if err := runGazelle(dir, []string{"update"}); err != nil {
+		t.Fatal(err)
+	}
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "foo/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    data = ["@com_github_old_lib//testdata:data"],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+    deps = [
+        "@com_github_fork_lib//:go_default_library",
+        "@com_github_old_lib//extra:go_default_library",  # keep
+    ],
+)
+`,
+		},
+	})
+
+	// fix rewrites existing references, too.
+	if err := runGazelle(dir, []string{"fix"}); err != nil {
+		t.Fatal(err)
+	}
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "foo/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    data = ["@com_github_fork_lib//testdata:data"],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+    deps = [
+        "@com_github_fork_lib//:go_default_library",
+        "@com_github_fork_lib//extra:go_default_library",  # keep
+    ],
+)
+`,
+		},
+	})
+}
+
+func TestLazyIndex(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path: "a/a.go",
+			Content: `package a
+
+import (
+	_ "example.com/repo/b"
+	_ "example.com/repo/c"
+)
+`,
+		}, {
+			Path: "b/BUILD.bazel",
+			Content: `
+go_library(
+    name = "b_lib",
+    srcs = ["b.go"],
+    importpath = "example.com/repo/b",
+)
+`,
+		}, {
+			Path:    "b/b.go",
+			Content: "package b",
+		}, {
+			Path: "c/BUILD.bazel",
+			Content: `
+go_library(
+    name = "c_lib",
+    srcs = ["c.go"],
+    importpath = "example.com/repo/c",
+)
+`,
+		}, {
+			Path:    "c/c.go",
+			Content: "package c",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	// b isn't visited, so its library isn't indexed, and the import is
+	// resolved using the prefix. c is updated, so its library is indexed.
+	args := []string{"-index=lazy", filepath.Join(dir, "a"), filepath.Join(dir, "c")}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "a/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/repo/a",
+    visibility = ["//visibility:public"],
+    deps = [
+        "//b:go_default_library",
+        "//c:c_lib",
+    ],
+)
+`,
+		}, {
+			Path: "b/BUILD.bazel",
+			Content: `
+go_library(
+    name = "b_lib",
+    srcs = ["b.go"],
+    importpath = "example.com/repo/b",
+)
+`,
+		},
+	})
+}
+
+func TestGoTestonly(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path:    "testutil/BUILD.bazel",
+			Content: "# gazelle:go_testonly true",
+		}, {
+			Path:    "testutil/util.go",
+			Content: "package testutil",
+		}, {
+			Path:    "testutil/util_test.go",
+			Content: "package testutil",
+		}, {
+			Path:    "testutil/cmd/main.go",
+			Content: "package main",
+		}, {
+			Path:    "testutil/real/BUILD.bazel",
+			Content: "# gazelle:go_testonly false",
+		}, {
+			Path:    "testutil/real/real.go",
+			Content: "package real",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "testutil/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+# gazelle:go_testonly true
+
+go_library(
+    name = "go_default_library",
+    testonly = True,
+    srcs = ["util.go"],
+    importpath = "example.com/repo/testutil",
+    visibility = ["//visibility:public"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["util_test.go"],
+    embed = [":go_default_library"],
+)
+`,
+		}, {
+			Path: "testutil/cmd/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    testonly = True,
+    srcs = ["main.go"],
+    importpath = "example.com/repo/testutil/cmd",
+    visibility = ["//visibility:private"],
+)
+
+go_binary(
+    name = "cmd",
+    testonly = True,
+    embed = [":go_default_library"],
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "testutil/real/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:go_testonly false
+
+go_library(
+    name = "go_default_library",
+    srcs = ["real.go"],
+    importpath = "example.com/repo/testutil/real",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestUpdateReposLockHash(t *testing.T) {
+	files := []testtools.FileSpec{
+		{
+			Path:    "WORKSPACE",
+			Content: "# gazelle:repo bazel_gazelle",
+		},
+		{
+			Path: "Gopkg.lock",
+			Content: `# This file is autogenerated, do not edit; changes may be undone by the next 'dep ensure'.
+
+[[projects]]
+  name = "github.com/pkg/errors"
+  packages = ["."]
+  revision = "645ef00459ed84a119197bfb8d8205042c6df63d"
+  version = "v0.8.0"
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, []string{"update-repos", "-from_file", "Gopkg.lock"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, lockHashFileName)); !os.IsNotExist(err) {
+		t.Errorf("%s was written without -lock_hash", lockHashFileName)
+	}
+
+	// Running twice should produce the same hash.
+	for i := 0; i < 2; i++ {
+		if err := runGazelle(dir, []string{"update-repos", "-from_file", "Gopkg.lock", "-lock_hash"}); err != nil {
+			t.Fatal(err)
+		}
+		testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+			Path:    lockHashFileName,
+			Content: "sha256:982bce172d2d4a5696daae3c3137c209044357443da920dde0b055de6793cad8\n",
+		}})
+	}
+
+	if err := runGazelle(dir, []string{"update-repos", "-lock_hash", "github.com/pkg/errors"}); err == nil {
+		t.Error("got success with -lock_hash and no -from_file; want error")
+	}
+}
+
+func TestUpdateReposWerror(t *testing.T) {
+	files := []testtools.FileSpec{
+		{
+			Path:    "WORKSPACE",
+			Content: "# gazelle:repo bazel_gazelle",
+		}, {
+			Path: "Gopkg.lock",
+			Content: `[[projects]]
+  name = "github.com/pkg/errors"
+  packages = ["."]
+  revision = "645ef00459ed84a119197bfb8d8205042c6df63d"
+  version = "v0.8.0"
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, []string{"update-repos", "-from_file", "Gopkg.lock", "-werror", "missing-sum,toolchain"}); err != nil {
+		t.Fatal(err)
+	}
+	err := runGazelle(dir, []string{"update-repos", "-from_file", "Gopkg.lock", "-werror", "misssing-sum"})
+	if err == nil || !strings.Contains(err.Error(), `unknown warning category "misssing-sum"`) {
+		t.Errorf("got error %v; want unknown warning category error", err)
+	}
+}
+
+func TestGoGeneratedPackage(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path: "app/app.go",
+			Content: `package app
+
+import (
+	_ "example.com/repo/gen/api"
+	_ "example.com/repo/gen/api/v2"
+)
+`,
+		}, {
+			Path: "gen/BUILD.bazel",
+			Content: `# gazelle:go_generated_package example.com/repo/gen/api :api
+# gazelle:go_generated_package example.com/repo/gen/api/v2 //gen/v2:api
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "app/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["app.go"],
+    importpath = "example.com/repo/app",
+    visibility = ["//visibility:public"],
+    deps = [
+        "//gen:api",
+        "//gen/v2:api",
+    ],
+)
+`,
+		},
+	})
+}
+
+func TestGoTestSize(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `# gazelle:prefix example.com/repo
+# gazelle:go_test_size small
+`,
+		}, {
+			Path:    "a/a_test.go",
+			Content: "package a",
+		}, {
+			Path: "b/BUILD.bazel",
+			Content: `
+# gazelle:go_test_size large
+
+go_test(
+    name = "go_default_test",
+    srcs = ["b_test.go"],
+    size = "enormous",
+)
+`,
+		}, {
+			Path:    "b/b_test.go",
+			Content: "package b",
+		}, {
+			Path:    "b/c/c_test.go",
+			Content: "package c",
+		}, {
+			Path:    "d/BUILD.bazel",
+			Content: "# gazelle:go_test_size",
+		}, {
+			Path:    "d/d_test.go",
+			Content: "package d",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "a/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    size = "small",
+    srcs = ["a_test.go"],
+)
+`,
+		}, {
+			Path: "b/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+# gazelle:go_test_size large
+
+go_test(
+    name = "go_default_test",
+    size = "enormous",
+    srcs = ["b_test.go"],
+)
+`,
+		}, {
+			Path: "b/c/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    size = "large",
+    srcs = ["c_test.go"],
+)
+`,
+		}, {
+			Path: "d/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+# gazelle:go_test_size
+
+go_test(
+    name = "go_default_test",
+    srcs = ["d_test.go"],
+)
+`,
+		},
+	})
+}
+
+func TestPrefixTrailingSlash(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/foo/",
+		}, {
+			Path:    "a/a.go",
+			Content: "package a",
+		}, {
+			Path:    "b/BUILD.bazel",
+			Content: "# gazelle:prefix example.com//bar//",
+		}, {
+			Path: "b/c/c.go",
+			Content: `package c
+
+import _ "example.com/bar/d"
+`,
+		}, {
+			Path:    "b/d/d.go",
+			Content: "package d",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	for _, args := range [][]string{nil, {"-index=false"}} {
+		if err := runGazelle(dir, args); err != nil {
+			t.Fatal(err)
+		}
+
+		testtools.CheckFiles(t, dir, []testtools.FileSpec{
+			{
+				Path: "a/BUILD.bazel",
+				Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/foo/a",
+    visibility = ["//visibility:public"],
+)
+`,
+			}, {
+				Path: "b/c/BUILD.bazel",
+				Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["c.go"],
+    importpath = "example.com/bar/c",
+    visibility = ["//visibility:public"],
+    deps = ["//b/d:go_default_library"],
+)
+`,
+			},
+		})
+	}
+}
+
+func TestGoPlatformSrcs(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `# gazelle:prefix example.com/repo
+# gazelle:go_platform_srcs true
+`,
+		}, {
+			Path:    "foo/foo.go",
+			Content: "package foo",
+		}, {
+			Path:    "foo/foo_linux.go",
+			Content: "package foo",
+		}, {
+			Path:    "foo/foo_arm64.go",
+			Content: "package foo",
+		}, {
+			Path:    "foo/foo_linux_amd64.go",
+			Content: "package foo",
+		}, {
+			Path:    "flat/BUILD.bazel",
+			Content: "# gazelle:go_platform_srcs false",
+		}, {
+			Path:    "flat/flat.go",
+			Content: "package flat",
+		}, {
+			Path:    "flat/flat_linux_amd64.go",
+			Content: "package flat",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	// Running twice should not change the output. Files with _linux suffixes
+	// also build on android.
+	for i := 0; i < 2; i++ {
+		if err := runGazelle(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "foo/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "foo.go",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:android": [
+            "foo_linux.go",
+        ],
+        "@io_bazel_rules_go//go/platform:linux": [
+            "foo_linux.go",
+        ],
+        "//conditions:default": [],
+    }) + select({
+        "@io_bazel_rules_go//go/platform:arm64": [
+            "foo_arm64.go",
+        ],
+        "//conditions:default": [],
+    }) + select({
+        "@io_bazel_rules_go//go/platform:android_amd64": [
+            "foo_linux_amd64.go",
+        ],
+        "@io_bazel_rules_go//go/platform:linux_amd64": [
+            "foo_linux_amd64.go",
+        ],
+        "//conditions:default": [],
+    }),
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			Path: "flat/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:go_platform_srcs false
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "flat.go",
+        "flat_linux_amd64.go",
+    ],
+    importpath = "example.com/repo/flat",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestKeepDepInSelect(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `
+# gazelle:prefix example.com/repo
+
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+    deps = select({
+        "@io_bazel_rules_go//go/platform:linux": [
+            "//b:go_default_library",  # keep
+        ],
+        "//conditions:default": [
+            "//b:go_default_library",  # keep
+        ],
+    }),
+)
+`,
+		}, {
+			Path: "a.go",
+			Content: `package a
+
+import (
+	_ "example.com/repo/b"
+	_ "example.com/repo/c"
+)
+`,
+		}, {
+			Path:    "b/b.go",
+			Content: "package b",
+		}, {
+			Path:    "c/c.go",
+			Content: "package c",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "BUILD.bazel",
+		Content: `
+# gazelle:prefix example.com/repo
+
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+    deps = [
+        "//c:go_default_library",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:linux": [
+            "//b:go_default_library",  # keep
+        ],
+        "//conditions:default": [
+            "//b:go_default_library",  # keep
+        ],
+    }),
+)
+`,
+	}})
+}
+
+func TestFixImportPathMigration(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "go.mod",
+			Content: "module example.com/new",
+		}, {
+			Path: "a/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/old/a",
+    visibility = ["//visibility:public"],
+    deps = ["@com_example_old//b:go_default_library"],
+)
+
+go_library(
+    name = "extra",
+    srcs = ["extra.go"],
+    importmap = "example.com/old/vendor/extra",
+    importpath = "example.com/old/a/extra",
+    deps = ["@com_example_old//b:go_default_library"],  # keep
+)
+
+filegroup(
+    name = "all",
+    srcs = [
+        ":go_default_library",
+        "@com_example_old//:go_default_library",
+        "@com_example_old//a:extra",
+        "@com_example_other//:go_default_library",
+    ],
+)
+`,
+		}, {
+			Path: "a/a.go",
+			Content: `package a
+
+import _ "example.com/new/b"
+`,
+		}, {
+			Path:    "b/b.go",
+			Content: "package b",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, []string{"fix", "-importpath_migration=example.com/old=example.com/new"}); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "a/BUILD.bazel",
+		Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/new/a",
+    visibility = ["//visibility:public"],
+    deps = ["//b:go_default_library"],
+)
+
+go_library(
+    name = "extra",
+    srcs = ["extra.go"],
+    importmap = "example.com/new/vendor/extra",
+    importpath = "example.com/new/a/extra",
+    deps = ["//b:go_default_library"],  # keep
+)
+
+filegroup(
+    name = "all",
+    srcs = [
+        ":go_default_library",
+        "//:go_default_library",
+        ":extra",
+        "@com_example_other//:go_default_library",
+    ],
+)
+`,
+	}})
+}
+
+func TestGoLayoutGopath(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path:    "legacy/BUILD.bazel",
+			Content: "# gazelle:go_layout gopath",
+		}, {
+			Path: "legacy/src/example.com/foo/foo.go",
+			Content: `package foo
+
+import (
+	_ "example.com/bar"
+	_ "github.com/pkg/errors"
+)
+`,
+		}, {
+			Path:    "legacy/src/example.com/bar/bar.go",
+			Content: "package bar",
+		}, {
+			Path:    "legacy/tools/tools.go",
+			Content: "package tools",
+		},
+	}
+
+	for _, args := range [][]string{nil, {"-index=false"}} {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			dir, cleanup := testtools.CreateFiles(t, files)
+			defer cleanup()
+
+			if err := runGazelle(dir, args); err != nil {
+				t.Fatal(err)
+			}
+
+			testtools.CheckFiles(t, dir, []testtools.FileSpec{
+				{
+					Path: "legacy/src/example.com/foo/BUILD.bazel",
+					Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    importpath = "example.com/foo",
+    visibility = ["//visibility:public"],
+    deps = [
+        "//legacy/src/example.com/bar:go_default_library",
+        "@com_github_pkg_errors//:go_default_library",
+    ],
+)
+`,
+				}, {
+					Path: "legacy/src/example.com/bar/BUILD.bazel",
+					Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["bar.go"],
+    importpath = "example.com/bar",
+    visibility = ["//visibility:public"],
+)
+`,
+				}, {
+					// Outside of src, the prefix is still used.
+					Path: "legacy/tools/BUILD.bazel",
+					Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["tools.go"],
+    importpath = "example.com/repo/legacy/tools",
+    visibility = ["//visibility:public"],
+)
+`,
+				},
+			})
+		})
+	}
+}
+
+func TestGoTestRundir(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `# gazelle:prefix example.com/repo
+# gazelle:go_test_rundir .
+`,
+		}, {
+			Path:    "a/a_test.go",
+			Content: "package a",
+		}, {
+			Path:    "b/BUILD.bazel",
+			Content: "# gazelle:go_test_rundir b/testdata/",
+		}, {
+			Path:    "b/b_test.go",
+			Content: "package b",
+		}, {
+			Path:    "c/BUILD.bazel",
+			Content: "# gazelle:go_test_rundir ../outside",
+		}, {
+			Path:    "c/c_test.go",
+			Content: "package c",
+		}, {
+			Path:    "d/BUILD.bazel",
+			Content: "# gazelle:go_test_rundir",
+		}, {
+			Path:    "d/d_test.go",
+			Content: "package d",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "a/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["a_test.go"],
+    rundir = ".",
+)
+`,
+		}, {
+			Path: "b/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+# gazelle:go_test_rundir b/testdata/
+
+go_test(
+    name = "go_default_test",
+    srcs = ["b_test.go"],
+    rundir = "b/testdata",
+)
+`,
+		}, {
+			// An invalid value is ignored, and the inherited value is kept.
+			Path: "c/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+# gazelle:go_test_rundir ../outside
+
+go_test(
+    name = "go_default_test",
+    srcs = ["c_test.go"],
+    rundir = ".",
+)
+`,
+		}, {
+			Path: "d/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+# gazelle:go_test_rundir
+
+go_test(
+    name = "go_default_test",
+    srcs = ["d_test.go"],
+)
+`,
+		},
+	})
+}
+
+// TestCdepsPlatformSelect checks that cdeps from cgo files constrained to some
+// platforms by file names or build tags are selected on those platforms, with
+// an empty list on other platforms, the same way srcs are filtered.
+func TestCdepsPlatformSelect(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `
+# gazelle:prefix example.com/repo
+# gazelle:resolve_pkgconfig libfoo //third_party:libfoo
+`,
+		}, {
+			Path:    "sub/sub.go",
+			Content: "package sub",
+		}, {
+			Path: "sub/sub_linux.go",
+			Content: `package sub
+
+/*
+#cgo pkg-config: libfoo
+*/
+import "C"
+`,
+		}, {
+			Path: "sub/sub_cgo_darwin.go",
+			Content: `// +build cgo
+
+package sub
+
+/*
+#cgo pkg-config: libfoo
+*/
+import "C"
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "sub/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "sub.go",
+        "sub_cgo_darwin.go",
+        "sub_linux.go",
+    ],
+    cdeps = select({
+        "@io_bazel_rules_go//go/platform:android": [
+            "//third_party:libfoo",
+        ],
+        "@io_bazel_rules_go//go/platform:darwin": [
+            "//third_party:libfoo",
+        ],
+        "@io_bazel_rules_go//go/platform:ios": [
+            "//third_party:libfoo",
+        ],
+        "@io_bazel_rules_go//go/platform:linux": [
+            "//third_party:libfoo",
+        ],
+        "//conditions:default": [],
+    }),
+    cgo = True,
+    importpath = "example.com/repo/sub",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestGoTestResolve(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `# gazelle:prefix example.com/repo
+# gazelle:go_test_resolve example.com/repo/db //db/testutil:fake_db
+`,
+		}, {
+			Path:    "db/db.go",
+			Content: "package db",
+		}, {
+			Path: "a/a.go",
+			Content: `package a
+
+import _ "example.com/repo/db"
+`,
+		}, {
+			Path: "a/a_test.go",
+			Content: `package a
+
+import _ "example.com/repo/db"
+`,
+		}, {
+			Path:    "b/BUILD.bazel",
+			Content: "# gazelle:go_test_resolve",
+		}, {
+			Path: "b/b_test.go",
+			Content: `package b
+
+import _ "example.com/repo/db"
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{
+		{
+			Path: "a/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/repo/a",
+    visibility = ["//visibility:public"],
+    deps = ["//db:go_default_library"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["a_test.go"],
+    embed = [":go_default_library"],
+    deps = ["//db/testutil:fake_db"],
+)
+`,
+		}, {
+			Path: "b/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+# gazelle:go_test_resolve
+
+go_test(
+    name = "go_default_test",
+    srcs = ["b_test.go"],
+    deps = ["//db:go_default_library"],
+)
+`,
+		},
+	})
+}
+
+func TestGoGenerateGenrule(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path: "BUILD.bazel",
+			Content: `# gazelle:prefix example.com/repo
+# gazelle:go_generate_genrule stringer @org_golang_x_tools//cmd/stringer -output
+`,
+		}, {
+			Path: "pill/pill.go",
+			Content: `package pill
+
+//go:generate stringer -type=Pill -output=pill_string.go $GOFILE
+//go:generate mockgen -source=pill.go
+//go:generate stringer -type=Other
+
+type Pill int
+`,
+		}, {
+			Path: "pill/kind.go",
+			Content: `package pill
+
+//go:generate stringer -type "Kind Name" -output kind_string.go
+`,
+		}, {
+			Path: "color/BUILD.bazel",
+			Content: `
+genrule(
+    name = "color_string_gen",
+    outs = ["color_string.go"],
+    cmd = "./gen.sh > $@",
+)
+`,
+		}, {
+			Path: "color/color.go",
+			Content: `package color
+
+//go:generate stringer -type=Color -output=color_string.go
+`,
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	want := []testtools.FileSpec{
+		{
+			Path: "pill/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "kind.go",
+        "kind_string.go",
+        "pill.go",
+        "pill_string.go",
+    ],
+    importpath = "example.com/repo/pill",
+    visibility = ["//visibility:public"],
+)
+
+# generated from //go:generate
+genrule(
+    name = "kind_string_gen",
+    srcs = ["kind.go"],
+    outs = ["kind_string.go"],
+    cmd = "$(location @org_golang_x_tools//cmd/stringer) -type 'Kind Name' -output $@",
+    tools = ["@org_golang_x_tools//cmd/stringer"],
+)
+
+# generated from //go:generate
+genrule(
+    name = "pill_string_gen",
+    srcs = ["pill.go"],
+    outs = ["pill_string.go"],
+    cmd = "$(location @org_golang_x_tools//cmd/stringer) -type=Pill -output=$@ $(location pill.go)",
+    tools = ["@org_golang_x_tools//cmd/stringer"],
+)
+`,
+		}, {
+			// A genrule Gazelle didn't generate is left alone.
+			Path: "color/BUILD.bazel",
+			Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+genrule(
+    name = "color_string_gen",
+    outs = ["color_string.go"],
+    cmd = "./gen.sh > $@",
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "color.go",
+        "color_string.go",
+    ],
+    importpath = "example.com/repo/color",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	}
+
+	// The second run sees the outputs of the genrules as generated files.
+	for i := 0; i < 2; i++ {
+		if err := runGazelle(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		testtools.CheckFiles(t, dir, want)
+	}
+
+	// The genrule is deleted when its //go:generate directive is removed.
+	if err := ioutil.WriteFile(filepath.Join(dir, "pill", "kind.go"), []byte("package pill\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "pill/BUILD.bazel",
+		Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "kind.go",
+        "pill.go",
+        "pill_string.go",
+    ],
+    importpath = "example.com/repo/pill",
+    visibility = ["//visibility:public"],
+)
+
+# generated from //go:generate
+genrule(
+    name = "pill_string_gen",
+    srcs = ["pill.go"],
+    outs = ["pill_string.go"],
+    cmd = "$(location @org_golang_x_tools//cmd/stringer) -type=Pill -output=$@ $(location pill.go)",
+    tools = ["@org_golang_x_tools//cmd/stringer"],
+)
+`,
+	}})
+}
+
+func TestIndexFile(t *testing.T) {
+	files := []testtools.FileSpec{
+		{Path: "WORKSPACE"},
+		{
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path: "a/a.go",
+			Content: `package a
+
+import (
+	_ "example.com/repo/b"
+	_ "example.com/repo/c"
+)
+`,
+		}, {
+			Path: "b/BUILD.bazel",
+			Content: `
+go_library(
+    name = "b_lib",
+    srcs = ["b.go"],
+    importpath = "example.com/repo/b",
+)
+`,
+		}, {
+			Path:    "b/b.go",
+			Content: "package b",
+		}, {
+			Path: "c/BUILD.bazel",
+			Content: `
+go_library(
+    name = "c_lib",
+    srcs = ["c.go"],
+    importpath = "example.com/repo/c",
+)
+`,
+		}, {
+			Path:    "c/c.go",
+			Content: "package c",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	indexPath := filepath.Join(dir, "index.json")
+	if err := runGazelle(dir, []string{"index", "-o", indexPath}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"label": "//b:b_lib"`) {
+		t.Errorf("index doesn't contain //b:b_lib:\n%s", data)
+	}
+	// The index command doesn't generate build files.
+	if _, err := os.Stat(filepath.Join(dir, "a", "BUILD.bazel")); !os.IsNotExist(err) {
+		t.Errorf("a/BUILD.bazel was written by the index command")
+	}
+
+	// c's library is renamed after the index is written. b isn't visited, so
+	// its library comes from the index. c is updated, so its current library
+	// replaces the one in the index.
+	if err := ioutil.WriteFile(filepath.Join(dir, "c", "BUILD.bazel"), []byte(`
+go_library(
+    name = "c2_lib",
+    srcs = ["c.go"],
+    importpath = "example.com/repo/c",
+)
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-index_file", indexPath, filepath.Join(dir, "a"), filepath.Join(dir, "c")}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "a/BUILD.bazel",
+		Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/repo/a",
+    visibility = ["//visibility:public"],
+    deps = [
+        "//b:b_lib",
+        "//c:c2_lib",
+    ],
+)
+`,
+	}})
+
+	// b's library is removed after the index is written again. b is updated,
+	// so its library from the index is dropped, even though b has no rules
+	// left to index.
+	if err := runGazelle(dir, []string{"index", "-o", indexPath}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "b", "b.go")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "b", "BUILD.bazel"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	args = []string{"-index_file", indexPath, filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "a/BUILD.bazel",
+		Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/repo/a",
+    visibility = ["//visibility:public"],
+    deps = ["//c:c2_lib"],
+)
+`,
+	}})
+
+	if err := runGazelle(dir, []string{"-index=lazy", "-index_file", indexPath}); err == nil {
+		t.Error("with -index=lazy and -index_file, got success; want error")
+	}
+	if err := runGazelle(dir, []string{"report-unused-repos", "-index_file", indexPath}); err == nil {
+		t.Error("report-unused-repos with -index_file: got success; want error")
+	}
+}
+
+func TestDepsOrderPolicy(t *testing.T) {
+	files := []testtools.FileSpec{
+		{
+			Path: "WORKSPACE",
+			Content: `
+go_repository(
+    name = "com_example_ext",
+    importpath = "example.com/ext",
+)
+
+go_repository(
+    name = "org_golang_x_sys",
+    importpath = "golang.org/x/sys",
+)
+`,
+		}, {
+			Path:    "BUILD.bazel",
+			Content: "# gazelle:prefix example.com/repo",
+		}, {
+			Path: "policy.json",
+			Content: `[
+  ["@org_golang_x_"],
+  [":", "//"],
+  ["@"]
+]`,
+		}, {
+			Path: "a/a.go",
+			Content: `package a
+
+import (
+	_ "example.com/ext"
+	_ "example.com/repo/b"
+	_ "golang.org/x/sys/unix"
+)
+`,
+		}, {
+			Path:    "b/b.go",
+			Content: "package b",
+		},
+	}
+	dir, cleanup := testtools.CreateFiles(t, files)
+	defer cleanup()
+
+	args := []string{"-deps_order_policy", filepath.Join(dir, "policy.json")}
+	want := []testtools.FileSpec{{
+		Path: "a/BUILD.bazel",
+		Content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/repo/a",
+    visibility = ["//visibility:public"],
+    deps = [
+        "@org_golang_x_sys//unix:go_default_library",
+
+        "//b:go_default_library",
+
+        "@com_example_ext//:go_default_library",
+    ],
+)
+`,
+	}}
+	// Running again keeps the same order.
+	for i := 0; i < 2; i++ {
+		if err := runGazelle(dir, args); err != nil {
+			t.Fatal(err)
+		}
+		testtools.CheckFiles(t, dir, want)
+	}
+
+	args = []string{"-deps_sort", "locality", "-deps_order_policy", filepath.Join(dir, "policy.json")}
+	if err := runGazelle(dir, args); err == nil {
+		t.Error("with -deps_sort=locality and -deps_order_policy, got success; want error")
+	}
+}
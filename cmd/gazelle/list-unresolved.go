@@ -0,0 +1,123 @@
+/* Copyright 2019 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/repo"
+	"github.com/bazelbuild/bazel-gazelle/resolve"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	"golang.org/x/tools/go/vcs"
+)
+
+// unresolvedLister is implemented by resolvers that can report imports
+// they can't resolve. The Go extension implements this.
+type unresolvedLister interface {
+	// UnresolvedImports returns imports of r that can't be resolved to a rule
+	// in this repository or in a declared external repository. The returned
+	// map is keyed by the slash-separated path of the source file (relative
+	// to the repository root) that contains each import, or by the label of
+	// r if no source file could be found.
+	UnresolvedImports(c *config.Config, ix *resolve.RuleIndex, rc *repo.RemoteCache, r *rule.Rule, imports interface{}, from label.Label) map[string][]string
+}
+
+// listUnresolved prints imports in visited directories that can't be
+// resolved, grouped by the file that imports them. No build files are
+// written.
+func listUnresolved(w io.Writer, c *config.Config, ix *resolve.RuleIndex, mrslv *metaResolver, repos []repo.Repo, visits []visitRecord) (err error) {
+	// Only repositories that are already known are considered. Imports that
+	// would need to be looked up over the network are reported instead.
+	rc, cleanupRc := repo.NewRemoteCache(repos)
+	defer func() {
+		if cerr := cleanupRc(); err == nil && cerr != nil {
+			err = cerr
+		}
+	}()
+	disableRemoteLookups(rc)
+
+	unresolved := make(map[string]map[string]bool)
+	for _, v := range visits {
+		for i, r := range v.rules {
+			lister, ok := mrslv.Resolver(r, v.pkgRel).(unresolvedLister)
+			if !ok {
+				continue
+			}
+			from := label.New(c.RepoName, v.pkgRel, r.Name())
+			for file, imps := range lister.UnresolvedImports(v.c, ix, rc, r, v.imports[i], from) {
+				if unresolved[file] == nil {
+					unresolved[file] = make(map[string]bool)
+				}
+				for _, imp := range imps {
+					unresolved[file][imp] = true
+				}
+			}
+		}
+	}
+
+	files := make([]string, 0, len(unresolved))
+	for file := range unresolved {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		imps := make([]string, 0, len(unresolved[file]))
+		for imp := range unresolved[file] {
+			imps = append(imps, imp)
+		}
+		sort.Strings(imps)
+		fmt.Fprintf(w, "%s\n", file)
+		for _, imp := range imps {
+			fmt.Fprintf(w, "\t%s\n", imp)
+		}
+	}
+	return nil
+}
+
+// disableRemoteLookups prevents rc from accessing the network. Imports that
+// aren't provided by a known repository fail to resolve instead.
+func disableRemoteLookups(rc *repo.RemoteCache) {
+	rc.RepoRootForImportPath = func(importPath string, _ bool) (*vcs.RepoRoot, error) {
+		return nil, fmt.Errorf("no known repository provides %s", importPath)
+	}
+	rc.ModInfo = func(importPath string) (string, error) {
+		return "", fmt.Errorf("no known module provides %s", importPath)
+	}
+}
+
+func listUnresolvedUsage(fs *flag.FlagSet) {
+	fmt.Fprint(os.Stderr, `usage: gazelle list-unresolved [flags...] [package-dirs...]
+
+The list-unresolved command prints imports that can't be resolved to a rule in
+this repository or in an external repository declared in WORKSPACE. Each file
+with unresolved imports is printed, followed by its unresolved imports, one
+per line. This can be used to find missing go_repository rules. Build files are
+not changed, and the network is not accessed.
+
+Directories are processed the same way as the update command. Libraries in
+other directories are indexed so that imports can be resolved to them.
+
+FLAGS:
+
+`)
+	fs.PrintDefaults()
+}
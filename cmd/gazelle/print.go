@@ -16,14 +16,14 @@ limitations under the License.
 package main
 
 import (
-	"os"
+	"io"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 )
 
-func printFile(c *config.Config, f *rule.File) error {
+func printFile(c *config.Config, f *rule.File, w io.Writer) error {
 	content := f.Format()
-	_, err := os.Stdout.Write(content)
+	_, err := w.Write(content)
 	return err
 }
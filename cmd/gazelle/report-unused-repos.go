@@ -0,0 +1,87 @@
+/* Copyright 2019 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// reportUnusedRepos prints the name and import path of each go_repository
+// rule in c.Repos that isn't referenced by any rule in visited build files
+// after dependencies have been resolved. No build files are written.
+func reportUnusedRepos(w io.Writer, c *config.Config, visits []visitRecord) error {
+	used := make(map[string]bool)
+	for _, v := range visits {
+		for _, r := range v.file.Rules {
+			for _, attr := range r.AttrKeys() {
+				bzl.Walk(r.Attr(attr), func(x bzl.Expr, _ []bzl.Expr) {
+					s, ok := x.(*bzl.StringExpr)
+					if !ok {
+						return
+					}
+					if l, err := label.Parse(s.Value); err == nil && l.Repo != "" {
+						used[l.Repo] = true
+					}
+				})
+			}
+		}
+	}
+
+	var unused []string
+	importPaths := make(map[string]string)
+	for _, r := range c.Repos {
+		if r.Kind() != "go_repository" || used[r.Name()] {
+			continue
+		}
+		unused = append(unused, r.Name())
+		importPaths[r.Name()] = r.AttrString("importpath")
+	}
+	sort.Strings(unused)
+	for _, name := range unused {
+		fmt.Fprintf(w, "%s\t%s\n", name, importPaths[name])
+	}
+	return nil
+}
+
+func reportUnusedReposUsage(fs *flag.FlagSet) {
+	fmt.Fprint(os.Stderr, `usage: gazelle report-unused-repos [flags...] [package-dirs...]
+
+The report-unused-repos command prints go_repository rules declared in
+WORKSPACE (or the file named with -repo_config) for repositories that no
+package in this repository depends on. Each repository is printed on its own
+line with its name and import path, separated by a tab. These are often
+modules required indirectly by go.mod that nothing here imports. Build files
+are not changed, and the network is not accessed.
+
+Dependencies are resolved the same way as the update command, and any label
+in a visited build file counts as a use, including labels in rules Gazelle
+doesn't manage. Repositories used only by directories that aren't visited,
+by WORKSPACE itself, or implicitly by toolchains and proto compilers are
+reported as unused, so review the list before deleting rules.
+
+FLAGS:
+
+`)
+	fs.PrintDefaults()
+}
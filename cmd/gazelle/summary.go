@@ -0,0 +1,151 @@
+/* Copyright 2019 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// ruleKey identifies a rule within a build file.
+type ruleKey struct {
+	kind, name string
+}
+
+// ruleSnapshot records the content of each named rule in a build file at
+// some point in time, so that changes can be reported with -summary.
+type ruleSnapshot map[ruleKey]string
+
+// snapshotRules records the content of named rules in f. f may be nil, in
+// which case an empty snapshot is returned. f is synced first, so rules that
+// were deleted are not included.
+func snapshotRules(f *rule.File) ruleSnapshot {
+	s := make(ruleSnapshot)
+	if f == nil {
+		return s
+	}
+	f.Sync()
+	for _, r := range f.Rules {
+		if r.Name() == "" {
+			continue
+		}
+		s[ruleKey{r.Kind(), r.Name()}] = ruleText(r)
+	}
+	return s
+}
+
+// ruleText returns a string containing a rule's arguments and attributes.
+// Two rules with the same text are equivalent.
+func ruleText(r *rule.Rule) string {
+	var b strings.Builder
+	for _, arg := range r.Args() {
+		fmt.Fprintf(&b, "%s\n", bzl.FormatString(arg))
+	}
+	for _, key := range r.AttrKeys() {
+		fmt.Fprintf(&b, "%s = %s\n", key, bzl.FormatString(r.Attr(key)))
+	}
+	return b.String()
+}
+
+// ruleChangeAction describes what happened to a rule.
+type ruleChangeAction int
+
+const (
+	ruleCreated ruleChangeAction = iota
+	ruleUpdated
+	ruleDeleted
+)
+
+func (a ruleChangeAction) String() string {
+	switch a {
+	case ruleCreated:
+		return "created"
+	case ruleUpdated:
+		return "updated"
+	default:
+		return "deleted"
+	}
+}
+
+// ruleChange describes a rule that was created, updated, or deleted in a
+// build file.
+type ruleChange struct {
+	// file identifies the build file, usually by its directory relative to
+	// the repository root.
+	file string
+
+	action     ruleChangeAction
+	kind, name string
+}
+
+// diffRules compares snapshots of a build file taken before and after an
+// update and returns a list of changes.
+func diffRules(file string, before, after ruleSnapshot) []ruleChange {
+	var changes []ruleChange
+	for key, text := range after {
+		if beforeText, ok := before[key]; !ok {
+			changes = append(changes, ruleChange{file: file, action: ruleCreated, kind: key.kind, name: key.name})
+		} else if beforeText != text {
+			changes = append(changes, ruleChange{file: file, action: ruleUpdated, kind: key.kind, name: key.name})
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			changes = append(changes, ruleChange{file: file, action: ruleDeleted, kind: key.kind, name: key.name})
+		}
+	}
+	return changes
+}
+
+// printSummary writes counts of created, updated, and deleted rules to w,
+// followed by a list of changes grouped by file. noun describes the rules
+// being counted (for example, "rules" or "go_repository rules").
+func printSummary(w io.Writer, noun string, changes []ruleChange) {
+	var counts [ruleDeleted + 1]int
+	for _, c := range changes {
+		counts[c.action]++
+	}
+	fmt.Fprintf(w, "%s: %d created, %d updated, %d deleted\n", noun, counts[ruleCreated], counts[ruleUpdated], counts[ruleDeleted])
+
+	sort.Slice(changes, func(i, j int) bool {
+		ci, cj := changes[i], changes[j]
+		if ci.file != cj.file {
+			return ci.file < cj.file
+		}
+		if ci.action != cj.action {
+			return ci.action < cj.action
+		}
+		if ci.kind != cj.kind {
+			return ci.kind < cj.kind
+		}
+		return ci.name < cj.name
+	})
+	for i, c := range changes {
+		if i == 0 || changes[i-1].file != c.file {
+			file := c.file
+			if file == "" {
+				file = "."
+			}
+			fmt.Fprintf(w, "%s:\n", file)
+		}
+		fmt.Fprintf(w, "  %s %s %s\n", c.action, c.kind, c.name)
+	}
+}
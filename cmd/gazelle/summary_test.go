@@ -0,0 +1,72 @@
+/* Copyright 2019 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+func TestSummary(t *testing.T) {
+	oldFile, err := rule.LoadData("foo/BUILD.bazel", "foo", []byte(`
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["foo_test.go"],
+)
+
+go_binary(
+    name = "foo",
+    embed = [":go_default_library"],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := snapshotRules(oldFile)
+	oldFile.Rules[0].SetAttr("srcs", []string{"bar.go", "foo.go"})
+	oldFile.Rules[2].Delete()
+	r := rule.NewRule("go_proto_library", "foo_go_proto")
+	r.Insert(oldFile)
+	changes := diffRules("foo", before, snapshotRules(oldFile))
+	changes = append(changes, diffRules("", nil, snapshotRules(nil))...)
+
+	repoFile, err := rule.LoadData("", "", []byte(`go_repository(name = "org_golang_x_tools")`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes = append(changes, diffRules("bar", nil, snapshotRules(repoFile))...)
+
+	var buf bytes.Buffer
+	printSummary(&buf, "rules", changes)
+	want := `rules: 2 created, 1 updated, 1 deleted
+bar:
+  created go_repository org_golang_x_tools
+foo:
+  created go_proto_library foo_go_proto
+  updated go_library go_default_library
+  deleted go_binary foo
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
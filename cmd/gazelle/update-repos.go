@@ -16,15 +16,19 @@ limitations under the License.
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
+	gzflag "github.com/bazelbuild/bazel-gazelle/flag"
 	"github.com/bazelbuild/bazel-gazelle/language"
 	"github.com/bazelbuild/bazel-gazelle/merger"
 	"github.com/bazelbuild/bazel-gazelle/repo"
@@ -37,7 +41,12 @@ type updateReposConfig struct {
 	importPaths   []string
 	macroFileName string
 	macroDefName  string
+	macroHeader   []string
+	werror        []string
 	pruneRules    bool
+	bzlmod        bool
+	summary       bool
+	lockHash      bool
 	workspace     *rule.File
 	repoFileMap   map[string]*rule.File
 }
@@ -77,7 +86,23 @@ func (*updateReposConfigurer) RegisterFlags(fs *flag.FlagSet, cmd string, c *con
 	c.Exts[updateReposName] = uc
 	fs.StringVar(&uc.repoFilePath, "from_file", "", "Gazelle will translate repositories listed in this file into repository rules in WORKSPACE or a .bzl macro function. Gopkg.lock and go.mod files are supported")
 	fs.Var(macroFlag{macroFileName: &uc.macroFileName, macroDefName: &uc.macroDefName}, "to_macro", "Tells Gazelle to write repository rules into a .bzl macro function rather than the WORKSPACE file. . The expected format is: macroFile%defName")
+	fs.Var(&gzflag.MultiFlag{Values: &uc.macroHeader}, "macro_header", "a line of a comment written at the top of the file named with -to_macro (may be repeated)")
 	fs.BoolVar(&uc.pruneRules, "prune", false, "When enabled, Gazelle will remove rules that no longer have equivalent repos in the Gopkg.lock/go.mod file. Can only used with -from_file.")
+	fs.BoolVar(&uc.summary, "summary", false, "When enabled, Gazelle prints a summary of created, updated, and deleted repository rules to stderr.")
+	fs.Var(&gzflag.MultiFlag{Values: &uc.werror}, "werror", "comma-separated list of warning categories to report as errors, like missing-sum (may be repeated)")
+	fs.BoolVar(&uc.lockHash, "lock_hash", false, "When enabled with -from_file, Gazelle writes a hash of the imported modules (importpath@version:sum) to "+lockHashFileName+" in the repository root.")
+	fs.BoolVar(&uc.bzlmod, "bzlmod", false, "When enabled, Gazelle will write go_deps module extension tags into MODULE.bazel instead of writing go_repository rules into WORKSPACE.")
+}
+
+// warningCategories lists the categories of warnings that may be reported
+// as errors with -werror. They're logged with Config.WarnCategoryf.
+var warningCategories = map[string]bool{
+	"download-error":  true,
+	"malformed-sum":   true,
+	"min-version":     true,
+	"missing-sum":     true,
+	"skipped-replace": true,
+	"toolchain":       true,
 }
 
 func (*updateReposConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) error {
@@ -95,12 +120,45 @@ func (*updateReposConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) err
 		if uc.pruneRules {
 			return fmt.Errorf("the -prune option can only be used with -from_file")
 		}
+		if uc.lockHash {
+			return fmt.Errorf("the -lock_hash option can only be used with -from_file")
+		}
 		uc.importPaths = fs.Args()
 	}
+	if uc.bzlmod && uc.macroFileName != "" {
+		return fmt.Errorf("the -bzlmod and -to_macro options may not be used together")
+	}
+	if len(uc.macroHeader) > 0 && uc.macroFileName == "" {
+		return fmt.Errorf("the -macro_header option can only be used with -to_macro")
+	}
+	for _, value := range uc.werror {
+		for _, category := range strings.Split(value, ",") {
+			category = strings.TrimSpace(category)
+			if category == "" {
+				continue
+			}
+			if !warningCategories[category] {
+				known := make([]string, 0, len(warningCategories))
+				for k := range warningCategories {
+					known = append(known, k)
+				}
+				sort.Strings(known)
+				return fmt.Errorf("-werror: unknown warning category %q; known categories are %s", category, strings.Join(known, ", "))
+			}
+			if c.WarningsAsErrors == nil {
+				c.WarningsAsErrors = make(map[string]bool)
+			}
+			c.WarningsAsErrors[category] = true
+		}
+	}
 
 	var err error
 	workspacePath := filepath.Join(c.RepoRoot, "WORKSPACE")
 	uc.workspace, err = rule.LoadWorkspaceFile(workspacePath, "")
+	if os.IsNotExist(err) && uc.bzlmod {
+		// Modules don't need a WORKSPACE file.
+		uc.workspace, err = rule.EmptyFile(workspacePath, ""), nil
+	}
 	if err != nil {
 		return fmt.Errorf("loading WORKSPACE file: %v", err)
 	}
@@ -155,6 +213,10 @@ func updateRepos(args []string) (err error) {
 	}()
 
 	// Fix the workspace file with each language.
+	var workspaceBefore ruleSnapshot
+	if uc.summary {
+		workspaceBefore = snapshotRules(uc.workspace)
+	}
 	for _, lang := range languages {
 		lang.Fix(c, uc.workspace)
 	}
@@ -169,6 +231,18 @@ func updateRepos(args []string) (err error) {
 	if err != nil {
 		return err
 	}
+	if promoted := c.PromotedWarnings(); len(promoted) > 0 {
+		return fmt.Errorf("-werror: %d warnings were reported as errors", len(promoted))
+	}
+	if uc.bzlmod {
+		if err := updateModuleFile(c, filepath.Join(c.RepoRoot, "MODULE.bazel"), gen, uc.pruneRules); err != nil {
+			return err
+		}
+		if uc.lockHash {
+			return writeLockHash(c.RepoRoot, gen)
+		}
+		return nil
+	}
 
 	// Organize generated and empty rules by file. A rule should go into the file
 	// it came from (by name). New rules should go into WORKSPACE or the file
@@ -260,9 +334,27 @@ func updateRepos(args []string) (err error) {
 	})
 
 	updatedFiles := make(map[string]*rule.File)
+	var changes []ruleChange
 	for _, f := range sortedFiles {
+		var before ruleSnapshot
+		if uc.summary {
+			before = workspaceBefore
+			if f != uc.workspace {
+				before = snapshotRules(f)
+			}
+		}
 		merger.MergeFile(f, emptyForFiles[f], genForFiles[f], merger.PreResolve, kinds)
 		merger.FixLoads(f, loads)
+		if uc.summary {
+			name, err := filepath.Rel(c.RepoRoot, f.Path)
+			if err != nil {
+				name = f.Path
+			}
+			if f.DefName != "" {
+				name += "%" + f.DefName
+			}
+			changes = append(changes, diffRules(filepath.ToSlash(name), before, snapshotRules(f))...)
+		}
 		if f == uc.workspace {
 			if err := merger.CheckGazelleLoaded(f); err != nil {
 				return err
@@ -279,6 +371,10 @@ func updateRepos(args []string) (err error) {
 	// Write updated files to disk.
 	for _, f := range sortedFiles {
 		if uf := updatedFiles[f.Path]; uf != nil {
+			if uf.Path == macroPath && len(uc.macroHeader) > 0 {
+				setMacroHeader(uf, uc.macroHeader)
+			}
+			uf.Indent = c.Indent
 			if err := uf.Save(uf.Path); err != nil {
 				return err
 			}
@@ -286,6 +382,54 @@ func updateRepos(args []string) (err error) {
 		}
 	}
 
+	if uc.lockHash {
+		if err := writeLockHash(c.RepoRoot, gen); err != nil {
+			return err
+		}
+	}
+
+	if uc.summary {
+		printSummary(os.Stderr, "repository rules", changes)
+	}
+	return nil
+}
+
+// lockHashFileName is the name of the file written with -lock_hash.
+const lockHashFileName = ".go_deps.lock.hash"
+
+// lockHash returns a hash of the modules imported as go_repository rules in
+// gen. Each rule is described by a line of the form importpath@version:sum,
+// and the lines are sorted before hashing, so the hash only changes when the
+// module set changes. Rules without a version (for example, those imported
+// from Gopkg.lock) use their commit instead. The hash is returned in the form
+// "sha256:<hex>".
+func lockHash(gen []*rule.Rule) string {
+	var lines []string
+	for _, r := range gen {
+		if r.Kind() != "go_repository" {
+			continue
+		}
+		version := r.AttrString("version")
+		if version == "" {
+			version = r.AttrString("commit")
+		}
+		lines = append(lines, fmt.Sprintf("%s@%s:%s\n", r.AttrString("importpath"), version, r.AttrString("sum")))
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, line := range lines {
+		h.Write([]byte(line))
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// writeLockHash writes the hash of the modules in gen to lockHashFileName
+// in repoRoot. See lockHash.
+func writeLockHash(repoRoot string, gen []*rule.Rule) error {
+	path := filepath.Join(repoRoot, lockHashFileName)
+	if err := ioutil.WriteFile(path, []byte(lockHash(gen)+"\n"), 0666); err != nil {
+		return fmt.Errorf("-lock_hash: %v", err)
+	}
 	return nil
 }
 
@@ -385,6 +529,40 @@ func importRepos(c *config.Config, rc *repo.RemoteCache) (gen, empty []*rule.Rul
 	return res.Gen, res.Empty, res.Error
 }
 
+// setMacroHeader writes header as a block of comments before the first
+// statement in f that isn't a comment, usually a load. Each line is prefixed
+// with "# " unless it already starts with "#". A comment block written
+// earlier is recognized by its first line and replaced, so the header isn't
+// duplicated when update-repos runs again, even if later lines changed.
+func setMacroHeader(f *rule.File, header []string) {
+	comments := make([]bzl.Comment, len(header))
+	for i, line := range header {
+		if !strings.HasPrefix(line, "#") {
+			line = strings.TrimRight("# "+line, " ")
+		}
+		comments[i] = bzl.Comment{Token: line}
+	}
+
+	f.Sync()
+	stmts := make([]bzl.Expr, 0, len(f.File.Stmt)+1)
+	for _, stmt := range f.File.Stmt {
+		if block, ok := stmt.(*bzl.CommentBlock); ok && len(block.After) > 0 && block.After[0].Token == comments[0].Token {
+			continue
+		}
+		stmts = append(stmts, stmt)
+	}
+	i := 0
+	for i < len(stmts) {
+		if _, ok := stmts[i].(*bzl.CommentBlock); !ok {
+			break
+		}
+		i++
+	}
+	block := &bzl.CommentBlock{Comments: bzl.Comments{After: comments}}
+	stmts = append(stmts[:i], append([]bzl.Expr{block}, stmts[i:]...)...)
+	f.File.Stmt = stmts
+}
+
 // ensureMacroInWorkspace adds a call to the repository macro if the -to_macro
 // flag was used, and the macro was not called or declared with a
 // '# gazelle:repository_macro' directive.
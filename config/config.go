@@ -31,6 +31,7 @@ import (
 	"fmt"
 	"log"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/wspace"
@@ -75,11 +76,40 @@ type Config struct {
 	// libraries in the workspace for dependency resolution
 	IndexLibraries bool
 
+	// LazyIndex indicates that only libraries in directories Gazelle updates
+	// are indexed, instead of libraries in the whole repository. IndexLibraries
+	// is also true in this mode. Imports of other libraries in the repository
+	// are resolved as if the index were off. Set with -index=lazy.
+	LazyIndex bool
+
+	// Verbosity is the minimum level of messages logged with Logf and related
+	// methods. Set with -verbosity on the command line.
+	Verbosity LogLevel
+
+	// WarningsAsErrors is a set of warning categories, like "missing-sum".
+	// Messages logged with WarnCategoryf in these categories are reported as
+	// errors. Set with -werror on the command line.
+	WarningsAsErrors map[string]bool
+
+	// promotedWarnings holds messages logged with WarnCategoryf in categories
+	// in WarningsAsErrors. The slice is shared by clones of the configuration.
+	promotedWarnings *[]string
+
+	// Indent is the string written for each level of indentation in build
+	// files. If empty, four spaces are written, like buildifier. Set with
+	// -indent on the command line.
+	Indent string
+
 	// KindMap maps from a kind name to its replacement. It provides a way for
 	// users to customize the kind of rules created by Gazelle, via
 	// # gazelle:map_kind.
 	KindMap map[string]MappedKind
 
+	// ConfigFile is a file of directives loaded with -config, or nil if the
+	// flag isn't set. Its directives are applied in the repository root before
+	// directives in the root build file, so build files may override them.
+	ConfigFile *rule.File
+
 	// Repos is a list of repository rules declared in the main WORKSPACE file
 	// or in macros called by the main WORKSPACE file. This may affect rule
 	// generation and dependency resolution.
@@ -101,6 +131,7 @@ func New() *Config {
 	return &Config{
 		ValidBuildFileNames: DefaultValidBuildFileNames,
 		Exts:                make(map[string]interface{}),
+		promotedWarnings:    new([]string),
 	}
 }
 
@@ -176,15 +207,22 @@ type Configurer interface {
 // i.e., those that apply to Config itself and not to Config.Exts.
 type CommonConfigurer struct {
 	repoRoot, buildFileNames, readBuildFilesDir, writeBuildFilesDir string
-	indexLibraries                                                  bool
+	index, verbosity, indent, configPath                            string
 }
 
 func (cc *CommonConfigurer) RegisterFlags(fs *flag.FlagSet, cmd string, c *Config) {
 	fs.StringVar(&cc.repoRoot, "repo_root", "", "path to a directory which corresponds to go_prefix, otherwise gazelle searches for it.")
 	fs.StringVar(&cc.buildFileNames, "build_file_name", strings.Join(DefaultValidBuildFileNames, ","), "comma-separated list of valid build file names.\nThe first element of the list is the name of output build files to generate.")
-	fs.BoolVar(&cc.indexLibraries, "index", true, "when true, gazelle will build an index of libraries in the workspace for dependency resolution")
+	cc.index = "true"
+	fs.Var(indexFlag{&cc.index}, "index", "true, false, or lazy. When true, gazelle will build an index of libraries in the workspace for dependency resolution.\nWhen lazy, only libraries in directories gazelle updates are indexed.")
 	fs.StringVar(&cc.readBuildFilesDir, "experimental_read_build_files_dir", "", "path to a directory where build files should be read from (instead of -repo_root)")
 	fs.StringVar(&cc.writeBuildFilesDir, "experimental_write_build_files_dir", "", "path to a directory where build files should be written to (instead of -repo_root)")
+	fs.StringVar(&cc.verbosity, "verbosity", LogInfo.String(), "minimum level of messages to log: debug, info, warn, or error")
+	fs.StringVar(&cc.indent, "indent", "", "indentation of build files written by gazelle: a number of spaces, or \"tab\". If unset, four spaces are used, like buildifier.")
+	// update-repos doesn't walk the repository, so it doesn't read directives.
+	if cmd != "update-repos" {
+		fs.StringVar(&cc.configPath, "config", "", "path to a file of gazelle directives that apply to the whole repository. Directives in build files override them.")
+	}
 }
 
 func (cc *CommonConfigurer) CheckFlags(fs *flag.FlagSet, c *Config) error {
@@ -216,10 +254,70 @@ func (cc *CommonConfigurer) CheckFlags(fs *flag.FlagSet, c *Config) error {
 			return fmt.Errorf("%s: failed to find absolute path of -write_build_files_dir: %v", cc.writeBuildFilesDir, err)
 		}
 	}
-	c.IndexLibraries = cc.indexLibraries
+	switch cc.index {
+	case "lazy":
+		c.IndexLibraries = true
+		c.LazyIndex = true
+	default:
+		// indexFlag only accepts "lazy" and boolean values.
+		c.IndexLibraries, _ = strconv.ParseBool(cc.index)
+	}
+	c.Verbosity, err = ParseLogLevel(cc.verbosity)
+	if err != nil {
+		return fmt.Errorf("-verbosity: %v", err)
+	}
+	switch cc.indent {
+	case "":
+	case "tab":
+		c.Indent = "\t"
+	default:
+		n, err := strconv.Atoi(cc.indent)
+		if err != nil || n < 1 {
+			return fmt.Errorf("-indent: must be a positive number of spaces or \"tab\", got %q", cc.indent)
+		}
+		c.Indent = strings.Repeat(" ", n)
+	}
+	if cc.configPath != "" {
+		c.ConfigFile, err = rule.LoadFile(cc.configPath, "")
+		if err != nil {
+			return fmt.Errorf("-config: %v", err)
+		}
+	}
 	return nil
 }
 
+// indexFlag is the value of the -index flag: a boolean, or "lazy". "on" and
+// "off" are accepted as synonyms for "true" and "false".
+type indexFlag struct {
+	value *string
+}
+
+func (f indexFlag) Set(value string) error {
+	switch value {
+	case "lazy":
+	case "on":
+		value = "true"
+	case "off":
+		value = "false"
+	default:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("must be true, false, or lazy")
+		}
+	}
+	*f.value = value
+	return nil
+}
+
+func (f indexFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return *f.value
+}
+
+// IsBoolFlag allows -index to be set without a value, like a boolean flag.
+func (f indexFlag) IsBoolFlag() bool { return true }
+
 func (cc *CommonConfigurer) KnownDirectives() []string {
 	return []string{"build_file_name", "map_kind"}
 }
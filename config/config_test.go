@@ -16,8 +16,10 @@ limitations under the License.
 package config
 
 import (
+	"bytes"
 	"flag"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -44,7 +46,7 @@ func TestCommonConfigurerFlags(t *testing.T) {
 	cc := &CommonConfigurer{}
 	fs := flag.NewFlagSet("test", flag.ContinueOnError)
 	cc.RegisterFlags(fs, "test", c)
-	args := []string{"-repo_root", dir, "-build_file_name", "x,y"}
+	args := []string{"-repo_root", dir, "-build_file_name", "x,y", "-verbosity", "warn", "-index=lazy"}
 	if err := fs.Parse(args); err != nil {
 		t.Fatal(err)
 	}
@@ -60,6 +62,67 @@ func TestCommonConfigurerFlags(t *testing.T) {
 	if !reflect.DeepEqual(c.ValidBuildFileNames, wantBuildFileNames) {
 		t.Errorf("for ValidBuildFileNames, got %#v, want %#v", c.ValidBuildFileNames, wantBuildFileNames)
 	}
+
+	if c.Verbosity != LogWarn {
+		t.Errorf("for Verbosity, got %v, want %v", c.Verbosity, LogWarn)
+	}
+
+	if !c.IndexLibraries || !c.LazyIndex {
+		t.Errorf("for -index=lazy, got IndexLibraries %v and LazyIndex %v, want true and true", c.IndexLibraries, c.LazyIndex)
+	}
+
+	fs = flag.NewFlagSet("update-repos", flag.ContinueOnError)
+	(&CommonConfigurer{}).RegisterFlags(fs, "update-repos", New())
+	if fs.Lookup("config") != nil {
+		t.Error("-config registered for update-repos; want not registered")
+	}
+}
+
+func TestLogVerbosity(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	c := New()
+	c.Verbosity = LogWarn
+	c.Debugf("debug")
+	c.Infof("info")
+	c.Warnf("warn")
+	c.Errorf("error")
+	if got, want := buf.String(), "warn\nerror\n"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	if _, err := ParseLogLevel("loud"); err == nil {
+		t.Error("ParseLogLevel: got nil error for unknown level")
+	}
+}
+
+func TestWarnCategory(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	c := New()
+	c.Verbosity = LogError
+	c.WarningsAsErrors = map[string]bool{"missing-sum": true}
+	cc := c.Clone()
+	cc.WarnCategoryf("skipped-replace", "skipped %s", "a")
+	cc.WarnCategoryf("missing-sum", "missing %s", "b")
+	if got, want := buf.String(), "missing b\n"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got, want := c.PromotedWarnings(), []string{"missing b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PromotedWarnings: got %q; want %q", got, want)
+	}
 }
 
 func TestCommonConfigurerDirectives(t *testing.T) {
@@ -0,0 +1,127 @@
+/* Copyright 2019 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"log"
+)
+
+// LogLevel indicates the severity of a message logged through Config.
+// Messages below Config.Verbosity are discarded.
+type LogLevel int
+
+const (
+	// LogDebug is used for messages that are only useful when diagnosing
+	// problems with Gazelle itself.
+	LogDebug LogLevel = iota - 1
+
+	// LogInfo is used for informational messages. This is the default
+	// verbosity, so the zero value of LogLevel is LogInfo.
+	LogInfo
+
+	// LogWarn is used for problems that Gazelle can work around, for example,
+	// a module that can't be translated into a repository rule.
+	LogWarn
+
+	// LogError is used for problems that prevent Gazelle from doing
+	// what was asked.
+	LogError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogDebug: "debug",
+	LogInfo:  "info",
+	LogWarn:  "warn",
+	LogError: "error",
+}
+
+func (l LogLevel) String() string {
+	if s, ok := logLevelNames[l]; ok {
+		return s
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// ParseLogLevel converts a level name ("debug", "info", "warn", or "error")
+// into a LogLevel.
+func ParseLogLevel(s string) (LogLevel, error) {
+	for l, name := range logLevelNames {
+		if s == name {
+			return l, nil
+		}
+	}
+	return LogInfo, fmt.Errorf("unknown log level %q; valid levels are debug, info, warn, error", s)
+}
+
+// Logf logs a message with the given level if it is at least c.Verbosity.
+// c may be nil, in which case the default verbosity is used.
+func (c *Config) Logf(level LogLevel, format string, args ...interface{}) {
+	verbosity := LogInfo
+	if c != nil {
+		verbosity = c.Verbosity
+	}
+	if level < verbosity {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// Debugf logs a message at LogDebug level.
+func (c *Config) Debugf(format string, args ...interface{}) {
+	c.Logf(LogDebug, format, args...)
+}
+
+// Infof logs a message at LogInfo level.
+func (c *Config) Infof(format string, args ...interface{}) {
+	c.Logf(LogInfo, format, args...)
+}
+
+// Warnf logs a message at LogWarn level.
+func (c *Config) Warnf(format string, args ...interface{}) {
+	c.Logf(LogWarn, format, args...)
+}
+
+// Errorf logs a message at LogError level.
+func (c *Config) Errorf(format string, args ...interface{}) {
+	c.Logf(LogError, format, args...)
+}
+
+// WarnCategoryf logs a message at LogWarn level, like Warnf. category is a
+// short name for the kind of problem, like "missing-sum". If category is in
+// c.WarningsAsErrors, the message is logged at LogError level instead, and
+// it's recorded, so the command can fail after reporting every problem.
+// See PromotedWarnings.
+func (c *Config) WarnCategoryf(category, format string, args ...interface{}) {
+	if c == nil || !c.WarningsAsErrors[category] {
+		c.Warnf(format, args...)
+		return
+	}
+	c.Errorf(format, args...)
+	if c.promotedWarnings == nil {
+		c.promotedWarnings = new([]string)
+	}
+	*c.promotedWarnings = append(*c.promotedWarnings, fmt.Sprintf(format, args...))
+}
+
+// PromotedWarnings returns messages logged with WarnCategoryf that were
+// reported as errors because their categories are in c.WarningsAsErrors.
+func (c *Config) PromotedWarnings() []string {
+	if c == nil || c.promotedWarnings == nil {
+		return nil
+	}
+	return *c.promotedWarnings
+}
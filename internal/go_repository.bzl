@@ -108,6 +108,11 @@ def _go_repository_impl(ctx):
         "GIT_SSH_COMMAND",
     ]
     env.update({k: ctx.os.environ[k] for k in env_keys if k in ctx.os.environ})
+    for kv in ctx.attr.environ:
+        k, sep, v = kv.partition("=")
+        if not sep:
+            fail("environ entries must have the form KEY=VALUE: %s" % kv)
+        env[k] = v
 
     if fetch_repo_args:
         # Disable sumdb in fetch_repo. In module mode, the sum is a mandatory
@@ -127,6 +132,10 @@ def _go_repository_impl(ctx):
         if result.stderr:
             print("fetch_repo: " + result.stderr)
 
+    # Apply pre-patches before looking for build files, since they may add or
+    # remove files that affect build file generation.
+    patch(ctx, patches = ctx.attr.pre_patches, patch_cmds = [])
+
     # Repositories are fetched. Determine if build file generation is needed.
     build_file_names = ctx.attr.build_file_name.split(",")
     existing_build_file = ""
@@ -138,6 +147,15 @@ def _go_repository_impl(ctx):
 
     generate = (ctx.attr.build_file_generation == "on" or (not existing_build_file and ctx.attr.build_file_generation == "auto"))
 
+    # A curated build file replaces the root build file, and Gazelle doesn't
+    # generate build files.
+    if ctx.attr.build_file:
+        ctx.file(
+            existing_build_file or build_file_names[0],
+            ctx.read(ctx.path(ctx.attr.build_file)),
+        )
+        generate = False
+
     if generate:
         # Build file generation is needed. Populate Gazelle directive at root build file
         build_file_name = existing_build_file or build_file_names[0]
@@ -250,6 +268,15 @@ go_repository = repository_rule(
         "build_config": attr.label(default= "@bazel_gazelle_go_repository_config//:WORKSPACE"),
         "build_directives": attr.string_list(default = []),
 
+        # Environment variables to set when fetching and generating build files.
+        "environ": attr.string_list(),
+
+        # A build file to use instead of generating build files.
+        "build_file": attr.label(allow_single_file = True),
+
+        # Patches to apply before running gazelle.
+        "pre_patches": attr.label_list(),
+
         # Patches to apply after running gazelle.
         "patches": attr.label_list(),
         "patch_tool": attr.string(default = "patch"),
@@ -260,10 +287,17 @@ go_repository = repository_rule(
 """See repository.rst#go-repository for full documentation."""
 
 # Copied from @bazel_tools//tools/build_defs/repo:utils.bzl
-def patch(ctx):
-    """Implementation of patching an already extracted repository"""
+def patch(ctx, patches = None, patch_cmds = None):
+    """Implementation of patching an already extracted repository
+
+    patches and patch_cmds default to the patches and patch_cmds attributes.
+    """
+    if patches == None:
+        patches = ctx.attr.patches
+    if patch_cmds == None:
+        patch_cmds = ctx.attr.patch_cmds
     bash_exe = ctx.os.environ["BAZEL_SH"] if "BAZEL_SH" in ctx.os.environ else "bash"
-    for patchfile in ctx.attr.patches:
+    for patchfile in patches:
         command = "{patchtool} {patch_args} < {patchfile}".format(
             patchtool = ctx.attr.patch_tool,
             patchfile = ctx.path(patchfile),
@@ -276,7 +310,7 @@ def patch(ctx):
         if st.return_code:
             fail("Error applying patch %s:\n%s%s" %
                  (str(patchfile), st.stderr, st.stdout))
-    for cmd in ctx.attr.patch_cmds:
+    for cmd in patch_cmds:
         st = ctx.execute([bash_exe, "-c", cmd])
         if st.return_code:
             fail("Error applying patch command %s:\n%s%s" %
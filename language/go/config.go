@@ -19,15 +19,19 @@ import (
 	"flag"
 	"fmt"
 	"go/build"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
 	gzflag "github.com/bazelbuild/bazel-gazelle/flag"
+	"github.com/bazelbuild/bazel-gazelle/label"
 	"github.com/bazelbuild/bazel-gazelle/language/proto"
+	"github.com/bazelbuild/bazel-gazelle/pathtools"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 	bzl "github.com/bazelbuild/buildtools/build"
 )
@@ -50,6 +54,16 @@ type goConfig struct {
 	// to infer an importpath for a rule without setting the prefix.
 	prefixSet bool
 
+	// gopathLayout indicates that import paths of packages in the src
+	// subdirectory of gopathRel are derived from their paths within src, as in
+	// a GOPATH workspace, instead of from the prefix. Set with
+	// # gazelle:go_layout gopath.
+	gopathLayout bool
+
+	// gopathRel is the package name of the directory where gopathLayout was
+	// set ("" for the root directory).
+	gopathRel string
+
 	// importMapPrefix is a prefix of a package path, used to generate importmap
 	// attributes. Set with # gazelle:importmap_prefix.
 	importMapPrefix string
@@ -62,6 +76,27 @@ type goConfig struct {
 	// (under the current prefix) should be resolved.
 	depMode dependencyMode
 
+	// useVendorModules indicates that vendor/modules.txt should be read
+	// into vendoredModules. Set with -vendor on the command line.
+	useVendorModules bool
+
+	// verboseResolve indicates that each import resolution should be logged
+	// with the rules considered and where the chosen label came from. Set
+	// with -verbose_resolve on the command line.
+	verboseResolve bool
+
+	// importPathMigrationOld and importPathMigrationNew are the old and new
+	// paths of a renamed module. When set, gazelle fix rewrites importpath and
+	// importmap attributes under the old path and labels in the repository
+	// named for the old path. Set with -importpath_migration on the command
+	// line.
+	importPathMigrationOld, importPathMigrationNew string
+
+	// vendoredModules is a list of paths of modules listed in
+	// vendor/modules.txt. Imports within these modules are resolved to
+	// libraries in the vendor directory, regardless of depMode.
+	vendoredModules []string
+
 	// goProtoCompilers is the protocol buffers compiler(s) to use for go code.
 	goProtoCompilers []string
 
@@ -83,6 +118,97 @@ type goConfig struct {
 	// visible to
 	goVisibility []string
 
+	// extraExtensions is a list of file name extensions, like ".go.tmpl", of
+	// files that are added to srcs of Go rules like .go files. Set with
+	// # gazelle:go_extra_extensions, and inherited by subdirectories.
+	extraExtensions []string
+
+	// keepDeps is a list of labels added to the deps of every go_library
+	// rule, even when no import refers to them. Set with
+	// # gazelle:go_keep_dep, and inherited by subdirectories.
+	keepDeps []label.Label
+
+	// gcGoopts and gcLinkopts are set as the gc_goopts and gc_linkopts
+	// attributes of generated rules. Set with # gazelle:go_gc_goopts and
+	// # gazelle:go_gc_linkopts, and inherited by subdirectories.
+	gcGoopts, gcLinkopts []string
+
+	// pkgConfigLabels maps names of packages in #cgo pkg-config directives to
+	// labels of cc_library rules added to cdeps. Set with
+	// # gazelle:resolve_pkgconfig, and inherited by subdirectories.
+	pkgConfigLabels map[string]label.Label
+
+	// cgoLibLabels maps names of libraries linked with -l flags in #cgo
+	// LDFLAGS directives to labels of rules (usually cc_import) added to
+	// cdeps instead. Set with # gazelle:resolve_cgo_lib, and inherited by
+	// subdirectories.
+	cgoLibLabels map[string]label.Label
+
+	// testShardCount and testFlaky are set as the shard_count and flaky
+	// attributes of generated go_test rules. Set with
+	// # gazelle:go_test_shard_count and # gazelle:go_test_flaky, and inherited
+	// by subdirectories. testShardCount is 0 and testFlaky is false when unset.
+	testShardCount int
+	testFlaky      bool
+
+	// platformSrcs indicates that srcs of generated Go rules should be split
+	// into select expressions keyed by the platforms each file builds on,
+	// instead of a flat list filtered by rules_go at build time. Set with
+	// # gazelle:go_platform_srcs and inherited by subdirectories.
+	platformSrcs bool
+
+	// testSize is set as the size attribute of generated go_test rules. Set
+	// with # gazelle:go_test_size and inherited by subdirectories. Empty when
+	// unset.
+	testSize string
+
+	// testRundir is set as the rundir attribute of generated go_test rules,
+	// the directory tests run in, relative to the workspace root. Set with
+	// # gazelle:go_test_rundir and inherited by subdirectories. Empty when
+	// unset.
+	testRundir string
+
+	// testEnv and testEnvInherit are set as the env and env_inherit
+	// attributes of generated go_test rules. Set with # gazelle:go_test_env
+	// and # gazelle:go_test_env_inherit. Values from multiple directives
+	// accumulate and are inherited by subdirectories.
+	testEnv        map[string]string
+	testEnvInherit []string
+
+	// goGenerateTools maps commands in //go:generate directives to tools
+	// used to translate the directives into genrules. Set with
+	// # gazelle:go_generate_genrule and inherited by subdirectories.
+	goGenerateTools map[string]goGenerateTool
+
+	// testResolves maps import paths to labels that go_test rules depend on
+	// instead of the usual targets, for example, test support libraries.
+	// Other rules are not affected. Set with # gazelle:go_test_resolve and
+	// inherited by subdirectories.
+	testResolves map[string]label.Label
+
+	// libraryPure is set as the pure attribute of generated go_library rules
+	// ("on", "off", or "auto"). When it's "on", .go files that use cgo are
+	// excluded from sources. Set with # gazelle:go_library_pure, and inherited
+	// by subdirectories. It's empty when unset.
+	libraryPure string
+
+	// testOnly indicates that testonly = True should be set on generated
+	// go_library and go_binary rules. Set with # gazelle:go_testonly, and
+	// inherited by subdirectories.
+	testOnly bool
+
+	// binaryOut is set as the out attribute of the generated go_binary rule.
+	// Set with # gazelle:go_binary_out. Unlike most directives, it only
+	// applies to the directory where it's written, since binaries in
+	// different directories need different names.
+	binaryOut string
+
+	// regenerate is the set of names of existing rules whose attributes are
+	// cleared before merging, so they're rebuilt from scratch. Set with
+	// # gazelle:go_regenerate. Like binaryOut, it only applies to the directory
+	// where it's written.
+	regenerate map[string]bool
+
 	// moduleMode is true if the current directory is intended to be built
 	// as part of a module. Minimal module compatibility won't be supported
 	// if this is true in the root directory. External dependencies may be
@@ -98,6 +224,151 @@ type goConfig struct {
 	// buildTagsAttr, buildFileProtoModeAttr, and buildExtraArgsAttr are
 	// attributes for go_repository rules, set on the command line.
 	buildExternalAttr, buildFileNamesAttr, buildFileGenerationAttr, buildTagsAttr, buildFileProtoModeAttr, buildExtraArgsAttr string
+
+	// moduleArchives is a list of archive URL templates for modules with
+	// matching import paths, optionally followed by a comma and a strip_prefix
+	// template. Matching modules imported from go.mod are fetched from the
+	// archive (urls, strip_prefix, and sha256) instead of with version and sum.
+	// The last match is used. Set with -module_archive on the command line.
+	moduleArchives []importPathValue
+
+	// vcsCommits is a list of remote URL templates for modules with matching
+	// import paths. Matching modules imported from go.mod at pseudo-versions
+	// are fetched from the remote at the commit in the pseudo-version (vcs,
+	// remote, and commit) instead of with version and sum. The last match is
+	// used. Set with -vcs_commit on the command line.
+	vcsCommits []importPathValue
+
+	// repoAttrsFile is the path to a JSON file mapping importpath patterns to
+	// attributes of generated go_repository rules. Set with -repo_attrs_file
+	// on the command line.
+	repoAttrsFile string
+
+	// repoAttrs is a list of rules that set attributes of go_repository rules
+	// with matching import paths. Rules for pattern flags like -build_file
+	// and -environ come first, in command line order, followed by rules read
+	// from repoAttrsFile by CheckFlags. Every matching rule is applied, so
+	// the last match wins.
+	repoAttrs []repoAttrsRule
+
+	// directivesPolicyFile is the path to a JSON file mapping module path
+	// prefixes to build_directives for generated go_repository rules. Set
+	// with -directives_policy on the command line. directivesPolicy holds the
+	// entries read from the file by CheckFlags.
+	directivesPolicyFile string
+	directivesPolicy     directivesPolicy
+
+	// requireSumDB indicates that sums of go_repository rules imported from
+	// go.mod must be verified with the checksum database. Sums from go.sum
+	// are not trusted. Set with -require_sumdb on the command line.
+	requireSumDB bool
+
+	// skipGoList indicates that modules imported from go.mod should be read
+	// from go.mod and go.sum directly when possible, instead of running
+	// go list. Set with -skip_go_list on the command line.
+	skipGoList bool
+
+	// directOnly indicates that only modules required directly in go.mod
+	// should be imported, not indirect dependencies. Set with -direct_only
+	// on the command line.
+	directOnly bool
+
+	// markTestOnly indicates that go_repository rules imported from go.mod
+	// should be marked with a comment if their modules aren't needed to build
+	// non-test packages in the main module. Set with -mark_test_only on the
+	// command line.
+	markTestOnly bool
+
+	// packagePatterns is a comma-separated list of package patterns. When
+	// importing from go.mod, only modules providing packages needed to build
+	// and test the matched packages are imported. Set with -package on the
+	// command line.
+	packagePatterns string
+
+	// replaceComments indicates that go_repository rules imported from go.mod
+	// for replaced modules should have a comment listing the module and its
+	// replacements. Set with -replace_comments on the command line.
+	replaceComments bool
+
+	// reportSizes indicates that the zip size of each module whose
+	// go_repository rule is new or changed should be logged after importing
+	// from go.mod. Set with -report_sizes on the command line.
+	reportSizes bool
+
+	// validateReplaces indicates that replacement modules in go.mod should be
+	// downloaded before go_repository rules are generated, so that
+	// replacements that can't be fetched are reported early. Set with
+	// -validate_replaces on the command line.
+	validateReplaces bool
+
+	// noNetwork indicates that importing from go.mod must not access the
+	// network. go commands are run with GOPROXY=off, and missing sums are
+	// reported as an error instead of being downloaded. Set with -no_network
+	// on the command line.
+	noNetwork bool
+
+	// updateGoSum indicates that sums downloaded while importing modules from
+	// go.mod should be added to the go.sum file next to go.mod, so later
+	// imports don't need to download them again. Set with -update_go_sum on
+	// the command line.
+	updateGoSum bool
+
+	// minVersions maps module paths to the minimum versions that may be
+	// imported from go.mod. Set with -min_version on the command line.
+	// strictMinVersions indicates that modules below their minimum versions
+	// are errors instead of warnings. Set with -min_version_strict.
+	minVersions       map[string]string
+	strictMinVersions bool
+
+	// goModCache is the absolute path to the module cache used by go commands
+	// run to import modules from go.mod. If empty, GOMODCACHE from the
+	// environment (or its default) is used. Set with -gomodcache on the
+	// command line.
+	goModCache string
+
+	// sumDBSnapshot is the path to a file containing a local copy of checksum
+	// database records, in go.sum format. Sums of go_repository rules
+	// imported from go.mod must match sums in this file. Set with
+	// -sumdb_snapshot on the command line.
+	sumDBSnapshot string
+
+	// localModules is the set of modules in this repository (found in go.mod
+	// files in subdirectories). It's shared by all directories, since imports
+	// may cross module boundaries in any direction. It's set in CheckFlags and
+	// used during resolution.
+	localModules *localModules
+
+	// generatedPackages maps import paths of packages built from generated
+	// sources, which aren't on disk when Gazelle runs, to the labels of the
+	// go_library rules that build them. Set with
+	// # gazelle:go_generated_package. Like localModules, the map is shared by
+	// all directories, so a package may be declared next to the rule that
+	// generates it and imported from anywhere.
+	generatedPackages map[string]label.Label
+
+	// caseInsensitiveFS indicates that the repository is on a case-insensitive
+	// file system. When set, imports are resolved to indexed libraries whose
+	// import paths differ only in case.
+	caseInsensitiveFS bool
+
+	// repoManifests maps external repository names to tables that map
+	// import path subpaths (relative to the repository's root import path,
+	// "" for the root) to labels of the libraries that provide them. Set with
+	// # gazelle:go_repository_manifest. The map is replaced, not modified,
+	// when a new manifest is loaded.
+	repoManifests map[string]map[string]label.Label
+
+	// workspaceRoots map import path prefixes to packages in other Bazel
+	// workspaces, like sibling workspaces declared with local_repository.
+	// Set with # gazelle:resolve_workspace_root, and inherited by
+	// subdirectories.
+	workspaceRoots []workspaceRoot
+}
+
+// workspaceRoot maps import paths at or below importPrefix to packages at or
+// below pkg in the repository named repo.
+type workspaceRoot struct {
+	repo, pkg, importPrefix string
 }
 
 var (
@@ -107,8 +378,9 @@ var (
 
 func newGoConfig() *goConfig {
 	gc := &goConfig{
-		goProtoCompilers: defaultGoProtoCompilers,
-		goGrpcCompilers:  defaultGoGrpcCompilers,
+		goProtoCompilers:  defaultGoProtoCompilers,
+		goGrpcCompilers:   defaultGoGrpcCompilers,
+		generatedPackages: make(map[string]label.Label),
 	}
 	gc.preprocessTags()
 	return gc
@@ -127,6 +399,39 @@ func (gc *goConfig) clone() *goConfig {
 	gcCopy.goProtoCompilers = gc.goProtoCompilers[:len(gc.goProtoCompilers):len(gc.goProtoCompilers)]
 	gcCopy.goGrpcCompilers = gc.goGrpcCompilers[:len(gc.goGrpcCompilers):len(gc.goGrpcCompilers)]
 	gcCopy.submodules = gc.submodules[:len(gc.submodules):len(gc.submodules)]
+	gcCopy.keepDeps = gc.keepDeps[:len(gc.keepDeps):len(gc.keepDeps)]
+	if gc.pkgConfigLabels != nil {
+		gcCopy.pkgConfigLabels = make(map[string]label.Label)
+		for k, v := range gc.pkgConfigLabels {
+			gcCopy.pkgConfigLabels[k] = v
+		}
+	}
+	if gc.cgoLibLabels != nil {
+		gcCopy.cgoLibLabels = make(map[string]label.Label)
+		for k, v := range gc.cgoLibLabels {
+			gcCopy.cgoLibLabels[k] = v
+		}
+	}
+	if gc.testEnv != nil {
+		gcCopy.testEnv = make(map[string]string)
+		for k, v := range gc.testEnv {
+			gcCopy.testEnv[k] = v
+		}
+	}
+	gcCopy.testEnvInherit = gc.testEnvInherit[:len(gc.testEnvInherit):len(gc.testEnvInherit)]
+	if gc.goGenerateTools != nil {
+		gcCopy.goGenerateTools = make(map[string]goGenerateTool)
+		for k, v := range gc.goGenerateTools {
+			gcCopy.goGenerateTools[k] = v
+		}
+	}
+	if gc.testResolves != nil {
+		gcCopy.testResolves = make(map[string]label.Label)
+		for k, v := range gc.testResolves {
+			gcCopy.testResolves[k] = v
+		}
+	}
+	gcCopy.workspaceRoots = gc.workspaceRoots[:len(gc.workspaceRoots):len(gc.workspaceRoots)]
 	return &gcCopy
 }
 
@@ -155,6 +460,21 @@ func (gc *goConfig) setBuildTags(tags string) error {
 	return nil
 }
 
+// gopathImportPath returns the import path of the package in directory rel
+// if rel is within the src subdirectory of a GOPATH-style tree set with
+// # gazelle:go_layout gopath. ok is false for other directories, including
+// src itself, which has no import path.
+func (gc *goConfig) gopathImportPath(rel string) (importPath string, ok bool) {
+	if !gc.gopathLayout {
+		return "", false
+	}
+	srcRel := path.Join(gc.gopathRel, "src")
+	if rel == srcRel || !pathtools.HasPrefix(rel, srcRel) {
+		return "", false
+	}
+	return pathtools.TrimPrefix(rel, srcRel), true
+}
+
 func getProtoMode(c *config.Config) proto.Mode {
 	if pc := proto.GetProtoConfig(c); pc != nil {
 		return pc.Mode
@@ -208,6 +528,28 @@ func (f *externalFlag) String() string {
 	return f.depMode.String()
 }
 
+// importPathMigrationFlag parses -importpath_migration=old=new.
+type importPathMigrationFlag struct {
+	old, new *string
+}
+
+func (f importPathMigrationFlag) Set(value string) error {
+	i := strings.IndexByte(value, '=')
+	if i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("expected old_importpath=new_importpath, got %q", value)
+	}
+	*f.old = cleanPrefix(value[:i])
+	*f.new = cleanPrefix(value[i+1:])
+	return nil
+}
+
+func (f importPathMigrationFlag) String() string {
+	if f.old == nil || *f.old == "" {
+		return ""
+	}
+	return *f.old + "=" + *f.new
+}
+
 type tagsFlag func(string) error
 
 func (f tagsFlag) Set(value string) error {
@@ -222,6 +564,142 @@ type moduleRepo struct {
 	repoName, modulePath string
 }
 
+// importPathValue associates a value with a glob pattern that is matched
+// against the importpath attribute of go_repository rules. Patterns use the
+// syntax of path.Match.
+type importPathValue struct {
+	pattern, value string
+}
+
+// importPathValueFlag collects repeated flags of the form pattern=value.
+type importPathValueFlag struct {
+	values *[]importPathValue
+}
+
+func (f importPathValueFlag) Set(v string) error {
+	i := strings.IndexByte(v, '=')
+	if i <= 0 {
+		return fmt.Errorf("expected importpath_pattern=value, got %q", v)
+	}
+	pattern := v[:i]
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid importpath pattern %q: %v", pattern, err)
+	}
+	*f.values = append(*f.values, importPathValue{pattern: pattern, value: v[i+1:]})
+	return nil
+}
+
+func (f importPathValueFlag) String() string {
+	return ""
+}
+
+// repoAttrFlag collects repeated flags of the form pattern=value as rules
+// that set attr on go_repository rules whose importpath matches the pattern.
+// Rules are added to rules in command line order.
+//
+// If all is set, values without a pattern are stored there instead and apply
+// to all rules. Values that start with "-", like build_extra_args, may contain
+// "=", so they're always treated as values for all rules. If allowed is not
+// empty, values must be one of allowed. If list is set, it converts values to
+// lists that are added to the attribute instead of replacing it.
+type repoAttrFlag struct {
+	rules   *[]repoAttrsRule
+	attr    string
+	all     *string
+	allowed []string
+	list    func(string) []string
+}
+
+func (f *repoAttrFlag) Set(v string) error {
+	if f.all != nil && (strings.HasPrefix(v, "-") || !strings.Contains(v, "=")) {
+		if err := f.checkAllowed(v); err != nil {
+			return err
+		}
+		*f.all = v
+		return nil
+	}
+
+	i := strings.IndexByte(v, '=')
+	if i <= 0 {
+		return fmt.Errorf("expected importpath_pattern=value, got %q", v)
+	}
+	pattern, value := v[:i], v[i+1:]
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid importpath pattern %q: %v", pattern, err)
+	}
+	if err := f.checkAllowed(value); err != nil {
+		return err
+	}
+	ar := repoAttrsRule{pattern: pattern, attrs: map[string]interface{}{f.attr: value}}
+	if f.list != nil {
+		ar.attrs[f.attr] = f.list(value)
+		ar.appendLists = true
+	}
+	*f.rules = append(*f.rules, ar)
+	return nil
+}
+
+func (f *repoAttrFlag) checkAllowed(value string) error {
+	if len(f.allowed) == 0 {
+		return nil
+	}
+	for _, a := range f.allowed {
+		if value == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value %q; expected one of %s", value, strings.Join(f.allowed, ", "))
+}
+
+func (f *repoAttrFlag) String() string {
+	if f == nil || f.all == nil {
+		return ""
+	}
+	return *f.all
+}
+
+// commaList and singleList convert repoAttrFlag values to lists.
+func commaList(v string) []string  { return strings.Split(v, ",") }
+func singleList(v string) []string { return []string{v} }
+
+// minVersionFlag collects repeated flags of the form path@version into a map
+// from module paths to minimum versions.
+type minVersionFlag struct {
+	versions *map[string]string
+}
+
+func (f minVersionFlag) Set(v string) error {
+	i := strings.LastIndexByte(v, '@')
+	if i <= 0 {
+		return fmt.Errorf("expected module_path@version, got %q", v)
+	}
+	modPath, version := v[:i], v[i+1:]
+	if canonicalVersion(version) == "" {
+		return fmt.Errorf("invalid version %q in %q: must be a semantic version like v1.2.3", version, v)
+	}
+	if *f.versions == nil {
+		*f.versions = make(map[string]string)
+	}
+	(*f.versions)[modPath] = version
+	return nil
+}
+
+func (f minVersionFlag) String() string {
+	return ""
+}
+
+// matchImportPathValues returns the values whose patterns match importPath,
+// in the order they were given.
+func matchImportPathValues(values []importPathValue, importPath string) []string {
+	var matched []string
+	for _, v := range values {
+		if ok, _ := path.Match(v.pattern, importPath); ok {
+			matched = append(matched, v.value)
+		}
+	}
+	return matched
+}
+
 var validBuildExternalAttr = []string{"external", "vendored"}
 var validBuildFileGenerationAttr = []string{"auto", "on", "off"}
 var validBuildFileProtoModeAttr = []string{"default", "legacy", "disable", "disable_global", "package"}
@@ -229,18 +707,41 @@ var validBuildFileProtoModeAttr = []string{"default", "legacy", "disable", "disa
 func (*goLang) KnownDirectives() []string {
 	return []string{
 		"build_tags",
+		"go_binary_out",
+		"go_extra_extensions",
+		"go_gc_goopts",
+		"go_gc_linkopts",
+		"go_generate_genrule",
+		"go_generated_package",
 		"go_grpc_compilers",
+		"go_keep_dep",
+		"go_layout",
+		"go_library_pure",
+		"go_platform_srcs",
 		"go_proto_compilers",
+		"go_regenerate",
+		"go_repository_manifest",
+		"go_test_env",
+		"go_test_env_inherit",
+		"go_test_flaky",
+		"go_test_resolve",
+		"go_test_rundir",
+		"go_test_shard_count",
+		"go_test_size",
+		"go_testonly",
 		"go_visibility",
 		"importmap_prefix",
 		"prefix",
+		"resolve_cgo_lib",
+		"resolve_pkgconfig",
+		"resolve_workspace_root",
 	}
 }
 
 func (*goLang) RegisterFlags(fs *flag.FlagSet, cmd string, c *config.Config) {
 	gc := newGoConfig()
 	switch cmd {
-	case "fix", "update":
+	case "fix", "update", "list-unresolved", "report-unused-repos":
 		fs.Var(
 			tagsFlag(gc.setBuildTags),
 			"build_tags",
@@ -253,6 +754,16 @@ func (*goLang) RegisterFlags(fs *flag.FlagSet, cmd string, c *config.Config) {
 			&externalFlag{&gc.depMode},
 			"external",
 			"external: resolve external packages with go_repository\n\tvendored: resolve external packages as packages in vendor/")
+		fs.BoolVar(
+			&gc.useVendorModules,
+			"vendor",
+			false,
+			"resolve imports in modules listed in vendor/modules.txt to packages in vendor/")
+		fs.BoolVar(
+			&gc.verboseResolve,
+			"verbose_resolve",
+			false,
+			"log how each import is resolved, including indexed rules that provide it and where the chosen label came from")
 		fs.Var(
 			&gzflag.MultiFlag{Values: &gc.goProtoCompilers, IsSet: &gc.goProtoCompilersSet},
 			"go_proto_compiler",
@@ -271,29 +782,112 @@ func (*goLang) RegisterFlags(fs *flag.FlagSet, cmd string, c *config.Config) {
 			"go_repository_module_mode",
 			false,
 			"set when gazelle is invoked by go_repository in module mode")
+		if cmd == "fix" {
+			fs.Var(
+				importPathMigrationFlag{&gc.importPathMigrationOld, &gc.importPathMigrationNew},
+				"importpath_migration",
+				"old=new: after a module is renamed, rewrite importpath and importmap attributes under the old path,\n\tand labels in the repository named for the old path to labels in this repository")
+		}
 
 	case "update-repos":
 		fs.Var(&gzflag.AllowedStringFlag{Value: &gc.buildExternalAttr, Allowed: validBuildExternalAttr},
 			"build_external",
 			"Sets the build_external attribute for the generated go_repository rule(s).")
-		fs.StringVar(&gc.buildExtraArgsAttr,
+		fs.Var(&repoAttrFlag{rules: &gc.repoAttrs, attr: "build_extra_args", all: &gc.buildExtraArgsAttr, list: commaList},
 			"build_extra_args",
-			"",
-			"Sets the build_extra_args attribute for the generated go_repository rule(s).")
-		fs.Var(&gzflag.AllowedStringFlag{Value: &gc.buildFileGenerationAttr, Allowed: validBuildFileGenerationAttr},
+			"arg1,arg2,...: sets the build_extra_args attribute for the generated go_repository rule(s)\n\timportpath_pattern=arg1,arg2,...: sets build_extra_args only for rules whose importpath matches the pattern (may be repeated)")
+		fs.Var(&repoAttrFlag{rules: &gc.repoAttrs, attr: "build_file_generation", all: &gc.buildFileGenerationAttr, allowed: validBuildFileGenerationAttr},
 			"build_file_generation",
-			"Sets the build_file_generation attribute for the generated go_repository rule(s).")
+			"mode: sets the build_file_generation attribute for the generated go_repository rule(s)\n\timportpath_pattern=mode: sets build_file_generation only for rules whose importpath matches the pattern (may be repeated)")
+		fs.Var(&repoAttrFlag{rules: &gc.repoAttrs, attr: "build_file"},
+			"build_file",
+			"importpath_pattern=label: sets the build_file attribute of generated go_repository rules whose importpath\n\tmatches the pattern, so the labeled file is used instead of generated build files (may be repeated)")
 		fs.StringVar(&gc.buildFileNamesAttr,
 			"build_file_names",
 			"",
 			"Sets the build_file_name attribute for the generated go_repository rule(s).")
-		fs.Var(&gzflag.AllowedStringFlag{Value: &gc.buildFileProtoModeAttr, Allowed: validBuildFileProtoModeAttr},
+		fs.Var(&repoAttrFlag{rules: &gc.repoAttrs, attr: "build_file_proto_mode", all: &gc.buildFileProtoModeAttr, allowed: validBuildFileProtoModeAttr},
 			"build_file_proto_mode",
-			"Sets the build_file_proto_mode attribute for the generated go_repository rule(s).")
+			"mode: sets the build_file_proto_mode attribute for the generated go_repository rule(s)\n\timportpath_pattern=mode: sets build_file_proto_mode only for rules whose importpath matches the pattern (may be repeated)")
 		fs.StringVar(&gc.buildTagsAttr,
 			"build_tags",
 			"",
 			"Sets the build_tags attribute for the generated go_repository rule(s).")
+		fs.Var(&repoAttrFlag{rules: &gc.repoAttrs, attr: "environ", list: singleList},
+			"environ",
+			"importpath_pattern=KEY=VALUE: adds KEY=VALUE to the environ attribute of generated go_repository rules\n\twhose importpath matches the pattern (may be repeated)")
+		fs.Var(&repoAttrFlag{rules: &gc.repoAttrs, attr: "pre_patches", list: commaList},
+			"pre_patches",
+			"importpath_pattern=label1,label2,...: adds patch labels to the pre_patches attribute of generated go_repository\n\trules whose importpath matches the pattern. Pre-patches are applied before build files are generated (may be repeated)")
+		fs.Var(importPathValueFlag{&gc.moduleArchives},
+			"module_archive",
+			"importpath_pattern=url[,strip_prefix]: when importing from go.mod, fetch matching modules from an archive at url\n\tinstead of a module proxy. {path} and {version} in url and strip_prefix are replaced with the module path and version (may be repeated)")
+		fs.Var(importPathValueFlag{&gc.vcsCommits},
+			"vcs_commit",
+			"importpath_pattern=remote: when importing from go.mod, fetch matching modules at pseudo-versions from the git\n\trepository at remote at the commit in the pseudo-version, without a sum. {path} in remote is replaced with the\n\tmodule path (may be repeated)")
+		fs.StringVar(&gc.repoAttrsFile,
+			"repo_attrs_file",
+			"",
+			"JSON file mapping importpath patterns to objects of attributes to set on generated go_repository rules.\n\tAll matching patterns are applied in order, so the last match wins. Attributes in the file override values from other flags.")
+		fs.StringVar(&gc.directivesPolicyFile,
+			"directives_policy",
+			"",
+			"JSON file mapping module path prefixes to lists of directives to set in the build_directives attribute of\n\tgenerated go_repository rules. Attributes set with other flags win over conflicting directives.")
+		fs.BoolVar(&gc.requireSumDB,
+			"require_sumdb",
+			false,
+			"When importing from go.mod, verify each module's sum with the checksum database (GOSUMDB) instead of\n\ttrusting go.sum, and fail if any sum can't be verified.")
+		fs.BoolVar(&gc.noNetwork,
+			"no_network",
+			false,
+			"When importing from go.mod, fail instead of accessing the network. go commands are run with GOPROXY=off,\n\tand modules whose sums are missing from go.sum are reported as an error.")
+		fs.BoolVar(&gc.directOnly,
+			"direct_only",
+			false,
+			"When importing from go.mod, only import modules required directly, not those marked '// indirect' or\n\tnot listed in go.mod.")
+		fs.BoolVar(&gc.markTestOnly,
+			"mark_test_only",
+			false,
+			"When importing from go.mod, add a '# test-only' comment above go_repository rules for modules that\n\taren't needed to build non-test packages in the main module, according to 'go list -deps'.")
+		fs.StringVar(&gc.packagePatterns,
+			"package",
+			"",
+			"When importing from go.mod, only import modules providing packages needed to build or test the\n\tpackages matched by this comma-separated list of patterns, like ./cmd/server/...")
+		fs.BoolVar(&gc.replaceComments,
+			"replace_comments",
+			false,
+			"When importing from go.mod, add a comment like '# via: A@v1 => B@v2' above go_repository rules for\n\treplaced modules, listing the module and its replacements.")
+		fs.BoolVar(&gc.reportSizes,
+			"report_sizes",
+			false,
+			"When importing from go.mod, download each module whose go_repository rule is new or changed and log the\n\tsize of its zip file, along with the total.")
+		fs.BoolVar(&gc.validateReplaces,
+			"validate_replaces",
+			false,
+			"When importing from go.mod, run 'go mod download' for each replacement module and fail without\n\tgenerating rules if any can't be downloaded.")
+		fs.Var(minVersionFlag{&gc.minVersions},
+			"min_version",
+			"module_path@version: when importing from go.mod, warn if the module is selected at a lower version\n\t(may be repeated)")
+		fs.BoolVar(&gc.strictMinVersions,
+			"min_version_strict",
+			false,
+			"When set with -min_version, fail without writing rules if any module is below its minimum version.")
+		fs.StringVar(&gc.goModCache,
+			"gomodcache",
+			"",
+			"When importing from go.mod, use this directory as the module cache (GOMODCACHE) for go commands\n\tthat Gazelle runs, instead of the cache from the environment.")
+		fs.StringVar(&gc.sumDBSnapshot,
+			"sumdb_snapshot",
+			"",
+			"When importing from go.mod, check that the sum of each generated go_repository rule matches the sum in this\n\tlocal copy of checksum database records (in go.sum format), and fail if any sum is different or missing.")
+		fs.BoolVar(&gc.updateGoSum,
+			"update_go_sum",
+			false,
+			"When importing from go.mod, add sums that had to be downloaded to the go.sum file next to go.mod.\n\tExisting lines in go.sum are not changed. go.sum is modified in place, so review the change before committing it.")
+		fs.BoolVar(&gc.skipGoList,
+			"skip_go_list",
+			false,
+			"When importing from go.mod, read modules from go.mod and go.sum without running 'go list' if every\n\trequirement has a sum and no modules are replaced. Indirect dependencies not listed in go.mod are not imported.")
 	}
 	c.Exts[goName] = gc
 }
@@ -304,10 +898,85 @@ func (*goLang) CheckFlags(fs *flag.FlagSet, c *config.Config) error {
 	// or when the package name can't be determined.
 	// TODO(jayconrod): deprecate and remove this behavior.
 	gc := getGoConfig(c)
+	gc.prefix = cleanPrefix(gc.prefix)
 	if pc := proto.GetProtoConfig(c); pc != nil {
 		pc.GoPrefix = gc.prefix
 	}
 
+	if gc.useVendorModules {
+		modulesTxtPath := filepath.Join(c.RepoRoot, "vendor", "modules.txt")
+		vendoredModules, err := readVendoredModules(modulesTxtPath)
+		if err != nil {
+			return fmt.Errorf("-vendor set but vendored modules could not be read: %v", err)
+		}
+		gc.vendoredModules = vendoredModules
+	}
+
+	gc.caseInsensitiveFS = isCaseInsensitiveDir(c.RepoRoot)
+	gc.localModules = newLocalModules(c.RepoRoot)
+
+	// GOMODCACHE must be an absolute path.
+	if gc.goModCache != "" {
+		goModCache, err := filepath.Abs(gc.goModCache)
+		if err != nil {
+			return fmt.Errorf("-gomodcache: %v", err)
+		}
+		gc.goModCache = goModCache
+	}
+
+	if gc.sumDBSnapshot != "" {
+		if _, err := os.Stat(gc.sumDBSnapshot); err != nil {
+			return fmt.Errorf("-sumdb_snapshot: %v", err)
+		}
+	}
+
+	for _, ar := range gc.repoAttrs {
+		if v, ok := ar.attrs["build_file"].(string); ok {
+			if _, err := label.Parse(v); err != nil {
+				return fmt.Errorf("-build_file: invalid label %q for %s: %v", v, ar.pattern, err)
+			}
+		}
+	}
+
+	for _, v := range gc.vcsCommits {
+		if v.value == "" {
+			return fmt.Errorf("-vcs_commit: missing remote for %s", v.pattern)
+		}
+	}
+
+	// These flags can't work without downloading modules.
+	if gc.noNetwork {
+		for _, f := range []struct {
+			name string
+			set  bool
+		}{
+			{"-require_sumdb", gc.requireSumDB},
+			{"-validate_replaces", gc.validateReplaces},
+			{"-report_sizes", gc.reportSizes},
+			{"-module_archive", len(gc.moduleArchives) > 0},
+		} {
+			if f.set {
+				return fmt.Errorf("-no_network: can't be used with %s, which downloads modules", f.name)
+			}
+		}
+	}
+
+	if gc.repoAttrsFile != "" {
+		repoAttrs, err := readRepoAttrsFile(gc.repoAttrsFile)
+		if err != nil {
+			return fmt.Errorf("-repo_attrs_file: %v", err)
+		}
+		gc.repoAttrs = append(gc.repoAttrs, repoAttrs...)
+	}
+
+	if gc.directivesPolicyFile != "" {
+		policy, err := readDirectivesPolicy(gc.directivesPolicyFile)
+		if err != nil {
+			return fmt.Errorf("-directives_policy: %v", err)
+		}
+		gc.directivesPolicy = policy
+	}
+
 	// List modules that may refer to internal packages in this module.
 	for _, r := range c.Repos {
 		if r.Kind() != "go_repository" {
@@ -335,6 +1004,8 @@ func (*goLang) Configure(c *config.Config, rel string, f *rule.File) {
 		gc = raw.(*goConfig).clone()
 	}
 	c.Exts[goName] = gc
+	gc.binaryOut = ""
+	gc.regenerate = nil
 
 	if !gc.moduleMode {
 		st, err := os.Stat(filepath.Join(c.RepoRoot, filepath.FromSlash(rel), "go.mod"))
@@ -348,18 +1019,35 @@ func (*goLang) Configure(c *config.Config, rel string, f *rule.File) {
 		gc.importMapPrefixRel = rel
 		gc.prefix = ""
 		gc.prefixRel = rel
+		// Vendored packages are imported relative to the vendor directory,
+		// even in a GOPATH-style tree.
+		gc.gopathLayout = false
 	}
 
-	if f != nil {
-		setPrefix := func(prefix string) {
-			if err := checkPrefix(prefix); err != nil {
-				log.Print(err)
-				return
-			}
-			gc.prefix = prefix
-			gc.prefixSet = true
-			gc.prefixRel = rel
+	setPrefix := func(prefix string) {
+		if err := checkPrefix(prefix); err != nil {
+			log.Print(err)
+			return
 		}
+		gc.prefix = cleanPrefix(prefix)
+		gc.prefixSet = true
+		gc.prefixRel = rel
+	}
+
+	// A go.mod file in a subdirectory marks the root of a nested module, so its
+	// module path is used as the prefix. In the repository root, a prefix set
+	// on the command line takes precedence. In either case, a prefix directive
+	// in the build file takes precedence.
+	if rel != "" || !gc.prefixSet {
+		goModPath := filepath.Join(c.RepoRoot, filepath.FromSlash(rel), "go.mod")
+		if modulePath, err := readModulePath(goModPath); err != nil && !os.IsNotExist(err) {
+			c.Warnf("%v", err)
+		} else if modulePath != "" {
+			setPrefix(modulePath)
+		}
+	}
+
+	if f != nil {
 		for _, d := range f.Directives {
 			switch d.Key {
 			case "build_tags":
@@ -370,6 +1058,53 @@ func (*goLang) Configure(c *config.Config, rel string, f *rule.File) {
 				gc.preprocessTags()
 				gc.setBuildTags(d.Value)
 
+			case "go_gc_goopts":
+				// An empty value resets the directive.
+				gc.gcGoopts = strings.Fields(d.Value)
+
+			case "go_gc_linkopts":
+				// An empty value resets the directive.
+				gc.gcLinkopts = strings.Fields(d.Value)
+
+			case "go_generate_genrule":
+				// An empty value resets the directive.
+				if d.Value == "" {
+					gc.goGenerateTools = nil
+					continue
+				}
+				fields := strings.Fields(d.Value)
+				if len(fields) != 3 || !strings.HasPrefix(fields[2], "-") {
+					c.Warnf("%s: invalid go_generate_genrule directive %q: expected a command, a tool label, and an output flag", f.Path, d.Value)
+					continue
+				}
+				l, err := label.Parse(fields[1])
+				if err != nil {
+					c.Warnf("%s: invalid go_generate_genrule directive %q: %v", f.Path, d.Value, err)
+					continue
+				}
+				if gc.goGenerateTools == nil {
+					gc.goGenerateTools = make(map[string]goGenerateTool)
+				}
+				gc.goGenerateTools[fields[0]] = goGenerateTool{tool: l.Abs("", rel), outFlag: fields[2]}
+
+			case "go_generated_package":
+				fields := strings.Fields(d.Value)
+				if len(fields) != 2 {
+					c.Warnf("%s: invalid go_generated_package directive %q: expected an import path and a label", f.Path, d.Value)
+					continue
+				}
+				l, err := label.Parse(fields[1])
+				if err != nil {
+					c.Warnf("%s: invalid go_generated_package directive %q: %v", f.Path, d.Value, err)
+					continue
+				}
+				l = l.Abs("", rel)
+				if old, ok := gc.generatedPackages[fields[0]]; ok && old != l {
+					c.Warnf("%s: go_generated_package: %s is already provided by %s; ignoring %s", f.Path, fields[0], old, l)
+					continue
+				}
+				gc.generatedPackages[fields[0]] = l
+
 			case "go_grpc_compilers":
 				// Special syntax (empty value) to reset directive.
 				if d.Value == "" {
@@ -380,6 +1115,68 @@ func (*goLang) Configure(c *config.Config, rel string, f *rule.File) {
 					gc.goGrpcCompilers = splitValue(d.Value)
 				}
 
+			case "go_keep_dep":
+				// Special syntax (empty value) to reset directive.
+				if d.Value == "" {
+					gc.keepDeps = nil
+					continue
+				}
+				l, err := label.Parse(d.Value)
+				if err != nil {
+					c.Warnf("%s: invalid go_keep_dep label %q: %v", f.Path, d.Value, err)
+					continue
+				}
+				gc.keepDeps = append(gc.keepDeps, l.Abs("", rel))
+
+			case "resolve_cgo_lib":
+				fields := strings.Fields(d.Value)
+				if len(fields) != 2 {
+					c.Warnf("%s: invalid resolve_cgo_lib directive %q: expected a library name and a label", f.Path, d.Value)
+					continue
+				}
+				l, err := label.Parse(fields[1])
+				if err != nil {
+					c.Warnf("%s: invalid resolve_cgo_lib label %q: %v", f.Path, fields[1], err)
+					continue
+				}
+				if gc.cgoLibLabels == nil {
+					gc.cgoLibLabels = make(map[string]label.Label)
+				}
+				gc.cgoLibLabels[strings.TrimPrefix(fields[0], "-l")] = l.Abs("", rel)
+
+			case "resolve_pkgconfig":
+				fields := strings.Fields(d.Value)
+				if len(fields) != 2 {
+					c.Warnf("%s: invalid resolve_pkgconfig directive %q: expected a pkg-config name and a label", f.Path, d.Value)
+					continue
+				}
+				l, err := label.Parse(fields[1])
+				if err != nil {
+					c.Warnf("%s: invalid resolve_pkgconfig label %q: %v", f.Path, fields[1], err)
+					continue
+				}
+				if gc.pkgConfigLabels == nil {
+					gc.pkgConfigLabels = make(map[string]label.Label)
+				}
+				gc.pkgConfigLabels[fields[0]] = l.Abs("", rel)
+
+			case "resolve_workspace_root":
+				// An empty value resets the directive.
+				if d.Value == "" {
+					gc.workspaceRoots = nil
+					continue
+				}
+				fields := strings.Fields(d.Value)
+				if len(fields) != 3 || !strings.HasPrefix(fields[0], "@") || !strings.HasPrefix(fields[1], "//") || strings.Contains(fields[1], ":") {
+					c.Warnf("%s: invalid resolve_workspace_root directive %q: expected a repository name like @repo, a package like //path, and an import path prefix", f.Path, d.Value)
+					continue
+				}
+				gc.workspaceRoots = append(gc.workspaceRoots, workspaceRoot{
+					repo:         strings.TrimPrefix(fields[0], "@"),
+					pkg:          strings.Trim(fields[1], "/"),
+					importPrefix: strings.TrimSuffix(fields[2], "/"),
+				})
+
 			case "go_proto_compilers":
 				// Special syntax (empty value) to reset directive.
 				if d.Value == "" {
@@ -390,6 +1187,209 @@ func (*goLang) Configure(c *config.Config, rel string, f *rule.File) {
 					gc.goProtoCompilers = splitValue(d.Value)
 				}
 
+			case "go_repository_manifest":
+				fields := strings.Fields(d.Value)
+				if len(fields) != 2 {
+					c.Warnf("%s: expected two arguments (gazelle:go_repository_manifest repo_name manifest_file), got %v", f.Path, fields)
+					continue
+				}
+				manifest, err := loadRepoManifest(filepath.Join(c.RepoRoot, filepath.FromSlash(fields[1])))
+				if err != nil {
+					c.Warnf("%v", err)
+					continue
+				}
+				repoManifests := make(map[string]map[string]label.Label)
+				for k, v := range gc.repoManifests {
+					repoManifests[k] = v
+				}
+				repoManifests[fields[0]] = manifest
+				gc.repoManifests = repoManifests
+
+			case "go_extra_extensions":
+				// An empty value resets the directive.
+				var exts []string
+				for _, e := range strings.Split(d.Value, ",") {
+					e = strings.TrimSpace(e)
+					if e == "" {
+						continue
+					}
+					if !strings.HasPrefix(e, ".") || strings.HasSuffix(e, ".go") {
+						c.Warnf("%s: invalid go_extra_extensions value %q: extensions must start with \".\" and must not end with \".go\"", f.Path, e)
+						continue
+					}
+					exts = append(exts, e)
+				}
+				gc.extraExtensions = exts
+
+			case "go_binary_out":
+				out := strings.TrimSpace(d.Value)
+				if strings.ContainsAny(out, "/\\") {
+					c.Warnf("%s: invalid go_binary_out value %q: must be a file name, not a path", f.Path, d.Value)
+					continue
+				}
+				gc.binaryOut = out
+
+			case "go_regenerate":
+				name := strings.TrimSpace(d.Value)
+				if name == "" {
+					c.Warnf("%s: go_regenerate requires a rule name", f.Path)
+					continue
+				}
+				if gc.regenerate == nil {
+					gc.regenerate = make(map[string]bool)
+				}
+				gc.regenerate[name] = true
+
+			case "go_test_env":
+				// An empty value resets the directive.
+				if d.Value == "" {
+					gc.testEnv = nil
+					continue
+				}
+				i := strings.Index(d.Value, "=")
+				if i <= 0 {
+					c.Warnf("%s: invalid go_test_env value %q: expected KEY=VALUE", f.Path, d.Value)
+					continue
+				}
+				if gc.testEnv == nil {
+					gc.testEnv = make(map[string]string)
+				}
+				gc.testEnv[d.Value[:i]] = d.Value[i+1:]
+
+			case "go_test_resolve":
+				// An empty value resets the directive.
+				if d.Value == "" {
+					gc.testResolves = nil
+					continue
+				}
+				fields := strings.Fields(d.Value)
+				if len(fields) != 2 {
+					c.Warnf("%s: invalid go_test_resolve directive %q: expected an import path and a label", f.Path, d.Value)
+					continue
+				}
+				l, err := label.Parse(fields[1])
+				if err != nil {
+					c.Warnf("%s: invalid go_test_resolve directive %q: %v", f.Path, d.Value, err)
+					continue
+				}
+				if gc.testResolves == nil {
+					gc.testResolves = make(map[string]label.Label)
+				}
+				gc.testResolves[fields[0]] = l.Abs("", rel)
+
+			case "go_test_env_inherit":
+				// An empty value resets the directive.
+				name := strings.TrimSpace(d.Value)
+				if name == "" {
+					gc.testEnvInherit = nil
+					continue
+				}
+				seen := false
+				for _, v := range gc.testEnvInherit {
+					if v == name {
+						seen = true
+						break
+					}
+				}
+				if !seen {
+					gc.testEnvInherit = append(gc.testEnvInherit, name)
+				}
+
+			case "go_test_flaky":
+				// An empty value resets the directive.
+				if d.Value == "" {
+					gc.testFlaky = false
+					continue
+				}
+				flaky, err := strconv.ParseBool(d.Value)
+				if err != nil {
+					c.Warnf("%s: invalid go_test_flaky value %q: %v", f.Path, d.Value, err)
+					continue
+				}
+				gc.testFlaky = flaky
+
+			case "go_platform_srcs":
+				// An empty value resets the directive.
+				if d.Value == "" {
+					gc.platformSrcs = false
+					continue
+				}
+				platformSrcs, err := strconv.ParseBool(d.Value)
+				if err != nil {
+					c.Warnf("%s: invalid go_platform_srcs value %q: %v", f.Path, d.Value, err)
+					continue
+				}
+				gc.platformSrcs = platformSrcs
+
+			case "go_layout":
+				// An empty value resets the directive.
+				switch d.Value {
+				case "", "module":
+					gc.gopathLayout = false
+				case "gopath":
+					gc.gopathLayout = true
+					gc.gopathRel = rel
+				default:
+					c.Warnf("%s: invalid go_layout value %q: must be gopath or module", f.Path, d.Value)
+				}
+
+			case "go_library_pure":
+				// An empty value resets the directive.
+				switch d.Value {
+				case "", "on", "off", "auto":
+					gc.libraryPure = d.Value
+				default:
+					c.Warnf("%s: invalid go_library_pure value %q: must be on, off, or auto", f.Path, d.Value)
+				}
+
+			case "go_testonly":
+				// An empty value resets the directive.
+				if d.Value == "" {
+					gc.testOnly = false
+					continue
+				}
+				testOnly, err := strconv.ParseBool(d.Value)
+				if err != nil {
+					c.Warnf("%s: invalid go_testonly value %q: %v", f.Path, d.Value, err)
+					continue
+				}
+				gc.testOnly = testOnly
+
+			case "go_test_shard_count":
+				// An empty value resets the directive.
+				if d.Value == "" {
+					gc.testShardCount = 0
+					continue
+				}
+				n, err := strconv.Atoi(d.Value)
+				if err != nil || n < 1 {
+					c.Warnf("%s: invalid go_test_shard_count value %q: must be a positive integer", f.Path, d.Value)
+					continue
+				}
+				gc.testShardCount = n
+
+			case "go_test_rundir":
+				// An empty value resets the directive.
+				if d.Value == "" {
+					gc.testRundir = ""
+					continue
+				}
+				rundir := path.Clean(d.Value)
+				if path.IsAbs(rundir) || rundir == ".." || strings.HasPrefix(rundir, "../") {
+					c.Warnf("%s: invalid go_test_rundir value %q: must be a path relative to the workspace root", f.Path, d.Value)
+					continue
+				}
+				gc.testRundir = rundir
+
+			case "go_test_size":
+				// An empty value resets the directive.
+				switch d.Value {
+				case "", "small", "medium", "large", "enormous":
+					gc.testSize = d.Value
+				default:
+					c.Warnf("%s: invalid go_test_size value %q: must be small, medium, large, or enormous", f.Path, d.Value)
+				}
+
 			case "go_visibility":
 				gc.goVisibility = append(gc.goVisibility, strings.TrimSpace(d.Value))
 
@@ -425,6 +1425,42 @@ func (*goLang) Configure(c *config.Config, rel string, f *rule.File) {
 	}
 }
 
+// loadRepoManifest reads a file that maps import paths within an external
+// repository to labels of libraries in that repository. Each line contains
+// an import path relative to the repository's root import path ("." for the
+// root) and a label relative to the repository root, for example:
+//
+//	sub/pkg //sub/pkg:custom_name
+//
+// Blank lines and lines starting with "#" are ignored.
+func loadRepoManifest(path string) (map[string]label.Label, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := make(map[string]label.Label)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected import path and label, got %q", path, i+1, line)
+		}
+		l, err := label.Parse(fields[1])
+		if err != nil || l.Repo != "" || l.Relative {
+			return nil, fmt.Errorf("%s:%d: label %q must start with // and must not name a repository", path, i+1, fields[1])
+		}
+		subpath := fields[0]
+		if subpath == "." {
+			subpath = ""
+		}
+		manifest[subpath] = l
+	}
+	return manifest, nil
+}
+
 // checkPrefix checks that a string may be used as a prefix. We forbid local
 // (relative) imports and those beginning with "/". We allow the empty string,
 // but generated rules must not have an empty importpath.
@@ -435,6 +1471,16 @@ func checkPrefix(prefix string) error {
 	return nil
 }
 
+// cleanPrefix removes trailing slashes and redundant separators from a
+// prefix, so import paths derived from it don't contain empty elements.
+// The empty prefix is returned unchanged.
+func cleanPrefix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	return path.Clean(prefix)
+}
+
 // splitDirective splits a comma-separated directive value into its component
 // parts, trimming each of any whitespace characters.
 func splitValue(value string) []string {
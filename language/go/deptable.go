@@ -0,0 +1,136 @@
+/* Copyright 2019 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package golang
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/language"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// depTableColumns are the columns required in a dependency table. Other
+// columns are ignored, except for "name", which sets the repository name.
+var depTableColumns = []string{"importpath", "version", "sum"}
+
+// importReposFromTable imports modules from a table of dependencies computed
+// by some other tool. The table is tab-separated (.tsv) or comma-separated
+// (.csv). The first row is a header naming the columns, which must include
+// importpath, version, and sum. Lines starting with '#' are ignored.
+//
+// No network access is needed: each row becomes a go_repository rule as is.
+// All malformed rows are reported together.
+func importReposFromTable(args language.ImportReposArgs) language.ImportReposResult {
+	data, err := ioutil.ReadFile(args.Path)
+	if err != nil {
+		return language.ImportReposResult{Error: err}
+	}
+	comma := ','
+	if filepath.Ext(args.Path) == ".tsv" {
+		comma = '\t'
+	}
+
+	var header []string
+	columns := make(map[string]int)
+	var gen []*rule.Rule
+	var errs []string
+	seen := make(map[string]int)
+	for i, line := range strings.Split(string(data), "\n") {
+		lineNum := i + 1
+		if t := strings.TrimSpace(line); t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		line = strings.TrimSuffix(line, "\r")
+		// Each row is parsed on its own so errors can be reported with line
+		// numbers. Quoted fields may not span lines.
+		cr := csv.NewReader(strings.NewReader(line))
+		cr.Comma = comma
+		cr.LazyQuotes = comma == '\t'
+		cr.TrimLeadingSpace = true
+		record, err := cr.Read()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: %v", args.Path, lineNum, err))
+			continue
+		}
+		for j := range record {
+			record[j] = strings.TrimSpace(record[j])
+		}
+
+		if header == nil {
+			header = record
+			for j, name := range header {
+				columns[strings.ToLower(name)] = j
+			}
+			var missing []string
+			for _, name := range depTableColumns {
+				if _, ok := columns[name]; !ok {
+					missing = append(missing, name)
+				}
+			}
+			if len(missing) > 0 {
+				return language.ImportReposResult{Error: fmt.Errorf("%s:%d: header is missing required columns: %s", args.Path, lineNum, strings.Join(missing, ", "))}
+			}
+			continue
+		}
+
+		if len(record) != len(header) {
+			errs = append(errs, fmt.Sprintf("%s:%d: got %d columns; want %d", args.Path, lineNum, len(record), len(header)))
+			continue
+		}
+		importPath := record[columns["importpath"]]
+		version := record[columns["version"]]
+		sum := record[columns["sum"]]
+		var problems []string
+		if importPath == "" {
+			problems = append(problems, "importpath is empty")
+		} else if prev, ok := seen[importPath]; ok {
+			problems = append(problems, fmt.Sprintf("%s is already listed on line %d", importPath, prev))
+		}
+		if !strings.HasPrefix(version, "v") {
+			problems = append(problems, fmt.Sprintf("version %q is not a module version", version))
+		}
+		if !strings.HasPrefix(sum, "h1:") {
+			problems = append(problems, fmt.Sprintf("sum %q is not an h1: hash", sum))
+		}
+		if len(problems) > 0 {
+			errs = append(errs, fmt.Sprintf("%s:%d: %s", args.Path, lineNum, strings.Join(problems, "; ")))
+			continue
+		}
+		seen[importPath] = lineNum
+
+		name := label.ImportPathToBazelRepoName(importPath)
+		if j, ok := columns["name"]; ok && record[j] != "" {
+			name = record[j]
+		}
+		r := rule.NewRule("go_repository", name)
+		r.SetAttr("importpath", importPath)
+		r.SetAttr("version", version)
+		r.SetAttr("sum", sum)
+		gen = append(gen, r)
+	}
+	if header == nil {
+		return language.ImportReposResult{Error: fmt.Errorf("%s: missing header row", args.Path)}
+	}
+	if len(errs) > 0 {
+		return language.ImportReposResult{Error: fmt.Errorf("malformed rows in dependency table:\n%s", strings.Join(errs, "\n"))}
+	}
+	return language.ImportReposResult{Gen: gen}
+}
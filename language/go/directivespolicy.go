@@ -0,0 +1,120 @@
+/* Copyright 2019 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package golang
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/pathtools"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// directivesPolicy is a list of build_directives to set on generated
+// go_repository rules for modules under path prefixes. It's read from the
+// file named with -directives_policy.
+type directivesPolicy []directivesPolicyEntry
+
+type directivesPolicyEntry struct {
+	prefix     string
+	directives []string
+}
+
+// directiveAttrs maps directives to go_repository attributes that have the
+// same effect. When a policy directive and an attribute set with flags would
+// both apply to a rule, the attribute wins.
+var directiveAttrs = map[string]string{
+	"build_file_name": "build_file_name",
+	"build_tags":      "build_tags",
+	"proto":           "build_file_proto_mode",
+}
+
+// readDirectivesPolicy reads a JSON object mapping module path prefixes to
+// lists of directives, for example:
+//
+//	{
+//	  "example.com/platform": ["gazelle:proto disable"]
+//	}
+//
+// Prefixes match whole path components. Entries are returned from the
+// shortest prefix to the longest, so directives for more specific prefixes
+// come later and take precedence.
+func readDirectivesPolicy(filename string) (directivesPolicy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string][]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	policy := make(directivesPolicy, 0, len(raw))
+	for prefix, directives := range raw {
+		for _, d := range directives {
+			if !strings.HasPrefix(d, "gazelle:") {
+				return nil, fmt.Errorf("%s: %s: directive %q does not start with \"gazelle:\"", filename, prefix, d)
+			}
+		}
+		policy = append(policy, directivesPolicyEntry{prefix: strings.TrimSuffix(prefix, "/"), directives: directives})
+	}
+	sort.Slice(policy, func(i, j int) bool {
+		if len(policy[i].prefix) != len(policy[j].prefix) {
+			return len(policy[i].prefix) < len(policy[j].prefix)
+		}
+		return policy[i].prefix < policy[j].prefix
+	})
+	return policy, nil
+}
+
+// apply sets the build_directives attribute of r to the directives for all
+// prefixes matching its importpath. Flags win over the policy: if
+// build_directives was already set, or a directive conflicts with an
+// attribute that was set, a warning is logged, and the policy's directives
+// are not used.
+func (policy directivesPolicy) apply(c *config.Config, r *rule.Rule) {
+	importPath := r.AttrString("importpath")
+	var directives []string
+	for _, e := range policy {
+		if pathtools.HasPrefix(importPath, e.prefix) {
+			directives = append(directives, e.directives...)
+		}
+	}
+	if len(directives) == 0 {
+		return
+	}
+	if r.Attr("build_directives") != nil {
+		c.Warnf("-directives_policy: %s: build_directives set with flags override the policy", importPath)
+		return
+	}
+	kept := directives[:0]
+	for _, d := range directives {
+		key := strings.Fields(strings.TrimPrefix(d, "gazelle:"))
+		if len(key) > 0 {
+			if attr, ok := directiveAttrs[key[0]]; ok && r.Attr(attr) != nil {
+				c.Warnf("-directives_policy: %s: %q conflicts with the %s attribute set with flags; ignoring it", importPath, d, attr)
+				continue
+			}
+		}
+		kept = append(kept, d)
+	}
+	if len(kept) > 0 {
+		r.SetAttr("build_directives", kept)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
@@ -80,8 +81,16 @@ type fileInfo struct {
 	// CXXFLAGS, and LDFLAGS directives in cgo comments.
 	copts, clinkopts []taggedOpts
 
+	// pkgConfigs contains names of packages in pkg-config directives in cgo
+	// comments. Each name is stored separately, without flags.
+	pkgConfigs []taggedOpts
+
 	// hasServices indicates whether a .proto file has service definitions.
 	hasServices bool
+
+	// goGenerates contains the text of //go:generate directives in a .go
+	// file, after the "//go:generate" prefix.
+	goGenerates []string
 }
 
 // tagLine represents the space-separated disjunction of build tag groups
@@ -192,6 +201,12 @@ const (
 
 	// protoExt is applied to .proto files.
 	protoExt
+
+	// extraGoExt is applied to files with extensions set with
+	// # gazelle:go_extra_extensions. They're added to srcs like .go files,
+	// but they aren't parsed, since they may not be valid Go until they're
+	// processed (for example, templates).
+	extraGoExt
 )
 
 // fileNameInfo returns information that can be inferred from the name of
@@ -266,25 +281,70 @@ func otherFileInfo(path string) fileInfo {
 	return info
 }
 
+// extraGoFileNameInfo returns information that can be inferred from the
+// name of a file ending with ext, an extension set with
+// # gazelle:go_extra_extensions. The name is interpreted as if ext were
+// ".go", so "foo_test.go.tmpl" is a test, and "foo_linux.go.tmpl" is only
+// built on Linux.
+func extraGoFileNameInfo(path, ext string) fileInfo {
+	info := fileNameInfo(strings.TrimSuffix(path, ext) + ".go")
+	info.path = path
+	info.name = filepath.Base(path)
+	if info.ext == goExt {
+		info.ext = extraGoExt
+	}
+	return info
+}
+
+// extraGoFileInfo returns information about a file ending with ext, an
+// extension set with # gazelle:go_extra_extensions. Build tags are read,
+// but the file is not otherwise parsed.
+func extraGoFileInfo(path, ext string) fileInfo {
+	info := extraGoFileNameInfo(path, ext)
+	if info.ext == unknownExt {
+		return info
+	}
+
+	tags, err := readTags(info.path)
+	if err != nil {
+		log.Printf("%s: error reading file: %v", info.path, err)
+		return info
+	}
+	info.tags = tags
+	return info
+}
+
 // goFileInfo returns information about a .go file. It will parse part of the
 // file to determine the package name, imports, and build constraints.
 // If the file can't be read, an error will be logged, and partial information
 // will be returned.
 // This function is intended to match go/build.Context.Import.
-// TODD(#53): extract canonical import path
 func goFileInfo(path, rel string) fileInfo {
 	info := fileNameInfo(path)
+	src, err := ioutil.ReadFile(info.path)
+	if err != nil {
+		log.Printf("%s: error reading go file: %v", info.path, err)
+		return info
+	}
 	fset := token.NewFileSet()
-	pf, err := parser.ParseFile(fset, info.path, nil, parser.ImportsOnly|parser.ParseComments)
+	pf, err := parser.ParseFile(fset, info.path, src, parser.ImportsOnly|parser.ParseComments)
 	if err != nil {
 		log.Printf("%s: error reading go file: %v", info.path, err)
 		return info
 	}
+	info.goGenerates = readGoGenerates(src)
 
 	info.packageName = pf.Name.Name
 	if info.isTest && strings.HasSuffix(info.packageName, "_test") {
 		info.packageName = info.packageName[:len(info.packageName)-len("_test")]
 	}
+	if !info.isTest {
+		if importPath, err := findImportComment(fset, pf); err != nil {
+			log.Printf("%s: error reading go file: %v", info.path, err)
+		} else {
+			info.importPath = importPath
+		}
+	}
 
 	for _, decl := range pf.Decls {
 		d, ok := decl.(*ast.GenDecl)
@@ -333,8 +393,62 @@ func goFileInfo(path, rel string) fileInfo {
 	return info
 }
 
-// saveCgo extracts CFLAGS, CPPFLAGS, CXXFLAGS, and LDFLAGS directives
-// from a comment above a "C" import. This is intended to match logic in
+// readGoGenerates returns the text of //go:generate directives in the Go
+// source src. Like the go command, only lines that start with
+// "//go:generate" followed by a space or tab are recognized.
+func readGoGenerates(src []byte) []string {
+	if !bytes.Contains(src, []byte("//go:generate")) {
+		return nil
+	}
+	var lines []string
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if !strings.HasPrefix(line, "//go:generate ") && !strings.HasPrefix(line, "//go:generate\t") {
+			continue
+		}
+		lines = append(lines, strings.TrimSpace(line[len("//go:generate"):]))
+	}
+	return lines
+}
+
+// findImportComment returns the import path in an import comment on the
+// package clause of a parsed file, for example:
+//
+//     package foo // import "example.com/foo"
+//
+// An empty string is returned if there is no import comment. This is intended
+// to match go/build's handling of import comments.
+func findImportComment(fset *token.FileSet, pf *ast.File) (string, error) {
+	line := fset.Position(pf.Name.End()).Line
+	for _, cg := range pf.Comments {
+		if cg.Pos() < pf.Name.End() {
+			continue
+		}
+		if fset.Position(cg.Pos()).Line != line {
+			break
+		}
+		text := cg.List[0].Text
+		if strings.HasPrefix(text, "//") {
+			text = text[len("//"):]
+		} else {
+			text = strings.TrimSuffix(text[len("/*"):], "*/")
+		}
+		text = strings.TrimSpace(text)
+		if !strings.HasPrefix(text, "import ") && !strings.HasPrefix(text, "import\t") {
+			return "", nil
+		}
+		quoted := strings.TrimSpace(text[len("import"):])
+		importPath, err := strconv.Unquote(quoted)
+		if err != nil {
+			return "", fmt.Errorf("invalid import comment %s", cg.List[0].Text)
+		}
+		return importPath, nil
+	}
+	return "", nil
+}
+
+// saveCgo extracts CFLAGS, CPPFLAGS, CXXFLAGS, LDFLAGS, and pkg-config
+// directives from a comment above a "C" import. This is intended to match logic in
 // go/build.Context.saveCgo.
 func saveCgo(info *fileInfo, rel string, cg *ast.CommentGroup) error {
 	text := cg.Text()
@@ -386,7 +500,13 @@ func saveCgo(info *fileInfo, rel string, cg *ast.CommentGroup) error {
 		case "LDFLAGS":
 			info.clinkopts = append(info.clinkopts, taggedOpts{tags, joinedStr})
 		case "pkg-config":
-			return fmt.Errorf("%s: pkg-config not supported: %s", info.path, orig)
+			for _, opt := range opts {
+				if strings.HasPrefix(opt, "-") {
+					// Flags like --static don't name packages.
+					continue
+				}
+				info.pkgConfigs = append(info.pkgConfigs, taggedOpts{tags, opt})
+			}
 		default:
 			return fmt.Errorf("%s: invalid #cgo verb: %s", info.path, orig)
 		}
@@ -513,7 +633,8 @@ func safeCgoName(s string, spaces bool) bool {
 // readTags reads and extracts build tags from the block of comments
 // and blank lines at the start of a file which is separated from the
 // rest of the file by a blank line. Each string in the returned slice
-// is the trimmed text of a line after a "+build" prefix.
+// is the trimmed text of a line after a "+build" prefix. If there is
+// a //go:build line, its expression is returned instead.
 // Based on go/build.Context.shouldBuild.
 func readTags(path string) ([]tagLine, error) {
 	f, err := os.Open(path)
@@ -542,9 +663,23 @@ func readTags(path string) ([]tagLine, error) {
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
+	allLines := lines
 	lines = lines[:end]
 
-	// Pass 2: Process each line in the run.
+	// Pass 2: A //go:build line takes precedence over other constraints. It
+	// doesn't need to be followed by a blank line, so the whole run of
+	// comments is searched.
+	for _, line := range allLines {
+		if expr := strings.TrimPrefix(line, "go:build"); expr != line && (expr == "" || expr[0] == ' ' || expr[0] == '\t') {
+			l, err := parseGoBuildExpr(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid //go:build line: %v", err)
+			}
+			return []tagLine{l}, nil
+		}
+	}
+
+	// Pass 3: Process each line in the run.
 	var tagLines []tagLine
 	for _, line := range lines {
 		fields := strings.Fields(line)
@@ -555,6 +690,138 @@ func readTags(path string) ([]tagLine, error) {
 	return tagLines, nil
 }
 
+// parseGoBuildExpr parses the expression in a //go:build line, which may
+// combine tags with "!", "&&", "||", and parentheses. The expression is
+// converted to a disjunction of conjunctions, the form of +build lines, so
+// it's evaluated the same way. Negations are pushed down to tags using
+// De Morgan's laws, so only tags may be negated in the result.
+func parseGoBuildExpr(expr string) (tagLine, error) {
+	p := &buildExprParser{s: expr}
+	pos, _, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.next(); tok != "" {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	return pos, nil
+}
+
+// buildExprParser is a recursive descent parser for //go:build expressions.
+// Each parse method returns the parsed expression and its negation, both as
+// disjunctions of conjunctions.
+type buildExprParser struct {
+	s string
+}
+
+func (p *buildExprParser) parseOr() (pos, neg tagLine, err error) {
+	pos, neg, err = p.parseAnd()
+	if err != nil {
+		return nil, nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		pos2, neg2, err := p.parseAnd()
+		if err != nil {
+			return nil, nil, err
+		}
+		pos, neg = orTagLines(pos, pos2), andTagLines(neg, neg2)
+	}
+	return pos, neg, nil
+}
+
+func (p *buildExprParser) parseAnd() (pos, neg tagLine, err error) {
+	pos, neg, err = p.parseNot()
+	if err != nil {
+		return nil, nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		pos2, neg2, err := p.parseNot()
+		if err != nil {
+			return nil, nil, err
+		}
+		pos, neg = andTagLines(pos, pos2), orTagLines(neg, neg2)
+	}
+	return pos, neg, nil
+}
+
+func (p *buildExprParser) parseNot() (pos, neg tagLine, err error) {
+	switch tok := p.next(); tok {
+	case "!":
+		pos, neg, err = p.parseNot()
+		return neg, pos, err
+	case "(":
+		pos, neg, err = p.parseOr()
+		if err != nil {
+			return nil, nil, err
+		}
+		if tok := p.next(); tok != ")" {
+			return nil, nil, fmt.Errorf("missing )")
+		}
+		return pos, neg, nil
+	case "":
+		return nil, nil, fmt.Errorf("unexpected end of expression")
+	default:
+		if !isBuildTagChar(rune(tok[0])) {
+			return nil, nil, fmt.Errorf("unexpected %q", tok)
+		}
+		return tagLine{{tok}}, tagLine{{"!" + tok}}, nil
+	}
+}
+
+// peek returns the next token without consuming it. An empty string is
+// returned at the end of the expression.
+func (p *buildExprParser) peek() string {
+	s := strings.TrimLeft(p.s, " \t")
+	switch {
+	case s == "":
+		return ""
+	case strings.HasPrefix(s, "&&"), strings.HasPrefix(s, "||"):
+		return s[:2]
+	case s[0] == '!', s[0] == '(', s[0] == ')':
+		return s[:1]
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return !isBuildTagChar(r) })
+	switch {
+	case i < 0:
+		return s
+	case i == 0:
+		// Not a valid token. Return one character so the caller reports it.
+		return s[:1]
+	default:
+		return s[:i]
+	}
+}
+
+func isBuildTagChar(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '_' || r == '.'
+}
+
+// next returns and consumes the next token.
+func (p *buildExprParser) next() string {
+	tok := p.peek()
+	p.s = strings.TrimLeft(p.s, " \t")[len(tok):]
+	return tok
+}
+
+// orTagLines returns the disjunction of a and b.
+func orTagLines(a, b tagLine) tagLine {
+	return append(append(tagLine{}, a...), b...)
+}
+
+// andTagLines returns the conjunction of a and b, distributed into a
+// disjunction of conjunctions.
+func andTagLines(a, b tagLine) tagLine {
+	l := make(tagLine, 0, len(a)*len(b))
+	for _, ga := range a {
+		for _, gb := range b {
+			l = append(l, append(append(tagGroup{}, ga...), gb...))
+		}
+	}
+	return l
+}
+
 func parseTagsInGroups(groups []string) tagLine {
 	var l tagLine
 	for _, g := range groups {
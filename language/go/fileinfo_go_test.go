@@ -94,6 +94,47 @@ import "fmt"
 				imports:     []string{"fmt"},
 			},
 		},
+		{
+			"import comment",
+			"foo.go",
+			`package foo // import "example.com/foo"
+`,
+			fileInfo{
+				packageName: "foo",
+				importPath:  "example.com/foo",
+			},
+		},
+		{
+			"block import comment",
+			"foo.go",
+			`package foo /* import "example.com/foo" */
+`,
+			fileInfo{
+				packageName: "foo",
+				importPath:  "example.com/foo",
+			},
+		},
+		{
+			"comment after package clause",
+			"foo.go",
+			`package foo // not an import comment
+
+// import "example.com/foo"
+`,
+			fileInfo{
+				packageName: "foo",
+			},
+		},
+		{
+			"import comment in test",
+			"foo_test.go",
+			`package foo // import "example.com/foo"
+`,
+			fileInfo{
+				packageName: "foo",
+				isTest:      true,
+			},
+		},
 		{
 			"cgo",
 			"foo.go",
@@ -152,6 +193,7 @@ package route
 			// Clear fields we don't care about for testing.
 			got = fileInfo{
 				packageName: got.packageName,
+				importPath:  got.importPath,
 				isTest:      got.isTest,
 				imports:     got.imports,
 				isCgo:       got.isCgo,
@@ -283,6 +325,28 @@ import ("C")
 				},
 			},
 		},
+		{
+			"pkg-config",
+			`package foo
+
+/*
+#cgo pkg-config: --static libfoo libbar
+#cgo linux pkg-config: libbaz
+*/
+import "C"
+`,
+			fileInfo{
+				isCgo: true,
+				pkgConfigs: []taggedOpts{
+					{opts: "libfoo"},
+					{opts: "libbar"},
+					{
+						tags: tagLine{{"linux"}},
+						opts: "libbaz",
+					},
+				},
+			},
+		},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
 			dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "TestCgo")
@@ -299,7 +363,7 @@ import ("C")
 			got := goFileInfo(path, "")
 
 			// Clear fields we don't care about for testing.
-			got = fileInfo{isCgo: got.isCgo, copts: got.copts, clinkopts: got.clinkopts}
+			got = fileInfo{isCgo: got.isCgo, copts: got.copts, clinkopts: got.clinkopts, pkgConfigs: got.pkgConfigs}
 
 			if !reflect.DeepEqual(got, tc.want) {
 				t.Errorf("case %q: got %#v; want %#v", tc.desc, got, tc.want)
@@ -314,6 +314,26 @@ package main`,
 			"/* +build foo */\n\n",
 			nil,
 		},
+		{
+			"go:build",
+			"//go:build foo && !bar\n\npackage main",
+			[]tagLine{{{"foo", "!bar"}}},
+		},
+		{
+			"go:build without blank line",
+			"//go:build foo\npackage main",
+			[]tagLine{{{"foo"}}},
+		},
+		{
+			"go:build takes precedence",
+			"//go:build foo || bar\n// +build baz\n\npackage main",
+			[]tagLine{{{"foo"}, {"bar"}}},
+		},
+		{
+			"go:build with space is not a constraint",
+			"// go:build foo\n\npackage main",
+			nil,
+		},
 	} {
 		f, err := ioutil.TempFile(".", "TestReadTags")
 		if err != nil {
@@ -336,6 +356,44 @@ package main`,
 	}
 }
 
+func TestParseGoBuildExpr(t *testing.T) {
+	for _, tc := range []struct {
+		expr, wantErr string
+		want          tagLine
+	}{
+		{expr: "a", want: tagLine{{"a"}}},
+		{expr: "!a", want: tagLine{{"!a"}}},
+		{expr: "a && b || c", want: tagLine{{"a", "b"}, {"c"}}},
+		{expr: "a || b && c", want: tagLine{{"a"}, {"b", "c"}}},
+		{expr: "(a || b) && c", want: tagLine{{"a", "c"}, {"b", "c"}}},
+		{expr: "!(a || b)", want: tagLine{{"!a", "!b"}}},
+		{expr: "!(a && !b)", want: tagLine{{"!a"}, {"b"}}},
+		{expr: "!!a", want: tagLine{{"a"}}},
+		{expr: "go1.17 && linux_test", want: tagLine{{"go1.17", "linux_test"}}},
+		{expr: "", wantErr: "unexpected end of expression"},
+		{expr: "a &&", wantErr: "unexpected end of expression"},
+		{expr: "(a || b", wantErr: "missing )"},
+		{expr: "a b", wantErr: `unexpected "b"`},
+		{expr: "a, b", wantErr: `unexpected ","`},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			got, err := parseGoBuildExpr(tc.expr)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Errorf("got error %v; want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %#v; want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
 func TestCheckConstraints(t *testing.T) {
 	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "TestCheckConstraints")
 	if err != nil {
@@ -500,6 +558,53 @@ import "C"
 			desc:    "race msan tags negated",
 			content: "//+ build !msan,!race",
 			want:    true,
+		}, {
+			desc:    "go:build os negated satisfied",
+			os:      "linux",
+			content: "//go:build !windows\n\npackage foo",
+			want:    true,
+		}, {
+			desc:    "go:build os negated unsatisfied",
+			os:      "windows",
+			content: "//go:build !windows\n\npackage foo",
+			want:    false,
+		}, {
+			desc:        "go:build and or satisfied",
+			genericTags: map[string]bool{"a": true, "c": true},
+			content:     "//go:build (a && b) || c\n\npackage foo",
+			want:        true,
+		}, {
+			desc:        "go:build and or unsatisfied",
+			genericTags: map[string]bool{"a": true},
+			content:     "//go:build (a && b) || c\n\npackage foo",
+			want:        false,
+		}, {
+			desc:        "go:build negated group satisfied",
+			genericTags: map[string]bool{"a": true},
+			content:     "//go:build !(a && b)\n\npackage foo",
+			want:        true,
+		}, {
+			desc:        "go:build negated group unsatisfied",
+			genericTags: map[string]bool{"a": true, "b": true},
+			content:     "//go:build !(a && b)\n\npackage foo",
+			want:        false,
+		}, {
+			desc:        "go:build double negative",
+			genericTags: map[string]bool{"a": true},
+			content:     "//go:build !!a\n\npackage foo",
+			want:        true,
+		}, {
+			desc:    "go:build os and arch satisfied",
+			os:      "linux",
+			arch:    "arm64",
+			content: "//go:build (linux || darwin) && !amd64\n\npackage foo",
+			want:    true,
+		}, {
+			desc:    "go:build os and arch unsatisfied",
+			os:      "linux",
+			arch:    "amd64",
+			content: "//go:build (linux || darwin) && !amd64\n\npackage foo",
+			want:    false,
 		},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
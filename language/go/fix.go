@@ -17,14 +17,19 @@ package golang
 
 import (
 	"log"
+	"path"
+	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
 	"github.com/bazelbuild/bazel-gazelle/language/proto"
+	"github.com/bazelbuild/bazel-gazelle/pathtools"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 func (_ *goLang) Fix(c *config.Config, f *rule.File) {
+	migrateImportPaths(c, f)
 	migrateLibraryEmbed(c, f)
 	migrateGrpcCompilers(c, f)
 	flattenSrcs(c, f)
@@ -51,6 +56,62 @@ func migrateLibraryEmbed(c *config.Config, f *rule.File) {
 	}
 }
 
+// migrateImportPaths rewrites import paths and labels after a module is
+// renamed from gc.importPathMigrationOld to gc.importPathMigrationNew.
+// importpath and importmap attributes of Go rules at or below the old path
+// are moved under the new path. Labels in any rule that point to the
+// repository for the old path (which usually means this repository was once
+// imported as an external dependency) are rewritten to packages in this
+// repository. Since the migration is requested explicitly, values marked
+// with "# keep" are rewritten too; only rules marked with "# keep" are left
+// alone.
+func migrateImportPaths(c *config.Config, f *rule.File) {
+	gc := getGoConfig(c)
+	oldPath, newPath := gc.importPathMigrationOld, gc.importPathMigrationNew
+	if !c.ShouldFix || oldPath == "" {
+		return
+	}
+	oldRepos := map[string]bool{label.ImportPathToBazelRepoName(oldPath): true}
+	for _, r := range c.Repos {
+		if r.Kind() == "go_repository" && r.AttrString("importpath") == oldPath {
+			oldRepos[r.Name()] = true
+		}
+	}
+
+	for _, r := range f.Rules {
+		if r.ShouldKeep() {
+			continue
+		}
+		if isGoRule(r.Kind()) {
+			for _, key := range []string{"importpath", "importmap"} {
+				if v := r.AttrString(key); v != "" && pathtools.HasPrefix(v, oldPath) {
+					r.SetAttr(key, path.Join(newPath, pathtools.TrimPrefix(v, oldPath)))
+				}
+			}
+		}
+		for _, key := range r.AttrKeys() {
+			bzl.Walk(r.Attr(key), func(x bzl.Expr, _ []bzl.Expr) {
+				s, ok := x.(*bzl.StringExpr)
+				if !ok || !strings.HasPrefix(s.Value, "@") {
+					return
+				}
+				l, err := label.Parse(s.Value)
+				if err != nil || !oldRepos[l.Repo] {
+					return
+				}
+				// Find the package in this repository with the same import path
+				// under the new module path.
+				imp := path.Join(newPath, l.Pkg)
+				if !pathtools.HasPrefix(imp, gc.prefix) {
+					return
+				}
+				pkg := path.Join(gc.prefixRel, pathtools.TrimPrefix(imp, gc.prefix))
+				s.Value = label.New("", pkg, l.Name).Rel("", f.Pkg).String()
+			})
+		}
+	}
+}
+
 // migrateGrpcCompilers converts "go_grpc_library" rules into "go_proto_library"
 // rules with a "compilers" attribute.
 func migrateGrpcCompilers(c *config.Config, f *rule.File) {
@@ -76,7 +137,7 @@ func squashCgoLibrary(c *config.Config, f *rule.File) {
 	for _, r := range f.Rules {
 		if r.Kind() == "cgo_library" && r.Name() == "cgo_default_library" && !r.ShouldKeep() {
 			if cgoLibrary != nil {
-				log.Printf("%s: when fixing existing file, multiple cgo_library rules with default name found", f.Path)
+				c.Warnf("%s: when fixing existing file, multiple cgo_library rules with default name found", f.Path)
 				continue
 			}
 			cgoLibrary = r
@@ -84,7 +145,7 @@ func squashCgoLibrary(c *config.Config, f *rule.File) {
 		}
 		if r.Kind() == "go_library" && r.Name() == defaultLibName {
 			if goLibrary != nil {
-				log.Printf("%s: when fixing existing file, multiple go_library rules with default name referencing cgo_library found", f.Path)
+				c.Warnf("%s: when fixing existing file, multiple go_library rules with default name referencing cgo_library found", f.Path)
 			}
 			goLibrary = r
 			continue
@@ -95,7 +156,7 @@ func squashCgoLibrary(c *config.Config, f *rule.File) {
 		return
 	}
 	if !c.ShouldFix {
-		log.Printf("%s: cgo_library is deprecated. Run 'gazelle fix' to squash with go_library.", f.Path)
+		c.Warnf("%s: cgo_library is deprecated. Run 'gazelle fix' to squash with go_library.", f.Path)
 		return
 	}
 
@@ -138,9 +199,9 @@ func squashXtest(c *config.Config, f *rule.File) {
 	}
 	if !c.ShouldFix {
 		if itest == nil {
-			log.Printf("%s: go_default_xtest is no longer necessary. Run 'gazelle fix' to rename to go_default_test.", f.Path)
+			c.Warnf("%s: go_default_xtest is no longer necessary. Run 'gazelle fix' to rename to go_default_test.", f.Path)
 		} else {
-			log.Printf("%s: go_default_xtest is no longer necessary. Run 'gazelle fix' to squash with go_default_test.", f.Path)
+			c.Warnf("%s: go_default_xtest is no longer necessary. Run 'gazelle fix' to squash with go_default_test.", f.Path)
 		}
 		return
 	}
@@ -211,7 +272,7 @@ func removeLegacyProto(c *config.Config, f *rule.File) {
 		return
 	}
 	if !c.ShouldFix {
-		log.Printf("%s: go_proto_library.bzl is deprecated. Run 'gazelle fix' to replace old rules.", f.Path)
+		c.Warnf("%s: go_proto_library.bzl is deprecated. Run 'gazelle fix' to replace old rules.", f.Path)
 		return
 	}
 
@@ -26,10 +26,12 @@ import (
 	"sync"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
 	"github.com/bazelbuild/bazel-gazelle/language"
 	"github.com/bazelbuild/bazel-gazelle/language/proto"
 	"github.com/bazelbuild/bazel-gazelle/pathtools"
 	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 func (gl *goLang) GenerateRules(args language.GenerateArgs) language.GenerateResult {
@@ -39,6 +41,16 @@ func (gl *goLang) GenerateRules(args language.GenerateArgs) language.GenerateRes
 	gc := getGoConfig(c)
 	pcMode := getProtoMode(c)
 
+	// Clear attributes of existing rules named with # gazelle:go_regenerate,
+	// so the generated rules replace them instead of being merged into them.
+	if args.File != nil && len(gc.regenerate) > 0 {
+		for _, r := range args.File.Rules {
+			if _, ok := goKinds[r.Kind()]; ok && gc.regenerate[r.Name()] && !r.ShouldKeep() {
+				r.ClearAttrs()
+			}
+		}
+	}
+
 	// This is a collection of proto_library rule names that have a corresponding
 	// go_proto_library rule already generated.
 	goProtoRules := make(map[string]struct{})
@@ -61,7 +73,15 @@ func (gl *goLang) GenerateRules(args language.GenerateArgs) language.GenerateRes
 		if r.Kind() != "proto_library" {
 			continue
 		}
-		pkg := r.PrivateAttr(proto.PackageKey).(proto.Package)
+		// Existing rules passed along when proto rules aren't generated (for
+		// example, with -lang=go) have no package attached, so their sources
+		// are read here.
+		pkg, ok := r.PrivateAttr(proto.PackageKey).(proto.Package)
+		if !ok {
+			if pkg, ok = proto.ReadPackage(args.Dir, r.AttrStrings("srcs")); !ok {
+				continue
+			}
+		}
 		protoPackages[r.Name()] = pkg
 		for name, info := range pkg.Files {
 			protoFileInfo[name] = info
@@ -92,6 +112,21 @@ func (gl *goLang) GenerateRules(args language.GenerateArgs) language.GenerateRes
 		filterFiles(&genFiles, keep)
 	}
 
+	// Outputs of genrules translated from //go:generate directives are added
+	// when the genrules are generated again, so they're dropped if the
+	// directives are removed.
+	if args.File != nil {
+		goGenerateOuts := make(map[string]bool)
+		for _, r := range args.File.Rules {
+			if isGoGenerateRule(r) {
+				for _, out := range r.AttrStrings("outs") {
+					goGenerateOuts[out] = true
+				}
+			}
+		}
+		filterFiles(&genFiles, func(f string) bool { return !goGenerateOuts[f] })
+	}
+
 	// Split regular files into files which can determine the package name and
 	// import path and other files.
 	var goFiles, otherFiles []string
@@ -169,6 +204,7 @@ func (gl *goLang) GenerateRules(args language.GenerateArgs) language.GenerateRes
 	g := &generator{
 		c:                   c,
 		rel:                 args.Rel,
+		file:                args.File,
 		shouldSetVisibility: args.File == nil || !args.File.HasDefaultVisibility(),
 	}
 	var res language.GenerateResult
@@ -202,6 +238,12 @@ func (gl *goLang) GenerateRules(args language.GenerateArgs) language.GenerateRes
 		// go_proto_library unless there are actually go files.
 		protoEmbed = ""
 	}
+	if pkg != nil && protoEmbed == "" && pkg.firstGoFile() != "" {
+		// A go_proto_library Gazelle didn't generate here may provide the same
+		// package as the Go files. Embed it instead of generating a go_library
+		// that duplicates its package.
+		protoEmbed = findGoProtoLibrary(args, pcMode, pkg.importPath)
+	}
 
 	// Complete the Go package and generate rules for that.
 	if pkg != nil {
@@ -217,7 +259,12 @@ func (gl *goLang) GenerateRules(args language.GenerateArgs) language.GenerateRes
 
 		// Process the other static files.
 		for _, file := range otherFiles {
-			info := otherFileInfo(filepath.Join(args.Dir, file))
+			var info fileInfo
+			if ext := extraExtension(gc, file); ext != "" {
+				info = extraGoFileInfo(filepath.Join(args.Dir, file), ext)
+			} else {
+				info = otherFileInfo(filepath.Join(args.Dir, file))
+			}
 			if err := pkg.addFile(c, info, cgo); err != nil {
 				log.Print(err)
 			}
@@ -244,12 +291,26 @@ func (gl *goLang) GenerateRules(args language.GenerateArgs) language.GenerateRes
 			if regularFileSet[f] || consumedFileSet[f] {
 				continue
 			}
-			info := fileNameInfo(filepath.Join(args.Dir, f))
+			var info fileInfo
+			if ext := extraExtension(gc, f); ext != "" {
+				info = extraGoFileNameInfo(filepath.Join(args.Dir, f), ext)
+			} else {
+				info = fileNameInfo(filepath.Join(args.Dir, f))
+			}
 			if err := pkg.addFile(c, info, cgo); err != nil {
 				log.Print(err)
 			}
 		}
 
+		// Translate //go:generate directives into genrules. The files they
+		// write are built with the package.
+		genRules, genOuts := g.generateGoGenerateRules(pkg, regularFileSet)
+		for _, f := range genOuts {
+			if err := pkg.addFile(c, fileNameInfo(filepath.Join(args.Dir, f)), cgo); err != nil {
+				c.Warnf("%v", err)
+			}
+		}
+
 		// Generate Go rules.
 		if protoName == "" {
 			// Empty proto rules for deletion.
@@ -260,12 +321,24 @@ func (gl *goLang) GenerateRules(args language.GenerateArgs) language.GenerateRes
 		var libName string
 		if !lib.IsEmpty(goKinds[lib.Kind()]) {
 			libName = lib.Name()
+			if pkg.isCommand() && lib.Attr("visibility") != nil {
+				l := label.New(c.RepoName, args.Rel, libName)
+				gl.mainLibs[l] = mainLib{r: lib, visibility: g.commonVisibility(pkg.importPath)}
+			}
 		}
 		rules = append(rules, lib)
 		rules = append(rules,
 			g.generateBin(pkg, libName),
 			g.generateTest(pkg, libName))
+		rules = append(rules, genRules...)
+	}
+	var genRules []*rule.Rule
+	for _, r := range rules {
+		if r.Kind() == "genrule" {
+			genRules = append(genRules, r)
+		}
 	}
+	rules = append(rules, emptyGoGenerateRules(args.File, genRules)...)
 
 	for _, r := range rules {
 		if r.IsEmpty(goKinds[r.Kind()]) {
@@ -276,6 +349,20 @@ func (gl *goLang) GenerateRules(args language.GenerateArgs) language.GenerateRes
 		}
 	}
 
+	// Generate aliases for legacy go_proto_library names.
+	var goProtos []*rule.Rule
+	for _, r := range res.Gen {
+		if r.Kind() == "go_proto_library" {
+			goProtos = append(goProtos, r)
+		}
+	}
+	aliases, emptyAliases := proto.GenerateAliases(c, args.File, goProtos)
+	for _, r := range aliases {
+		res.Gen = append(res.Gen, r)
+		res.Imports = append(res.Imports, nil)
+	}
+	res.Empty = append(res.Empty, emptyAliases...)
+
 	if args.File != nil || len(res.Gen) > 0 {
 		gl.goPkgRels[args.Rel] = true
 	} else {
@@ -290,6 +377,19 @@ func (gl *goLang) GenerateRules(args language.GenerateArgs) language.GenerateRes
 	return res
 }
 
+// extraExtension returns the extension set with # gazelle:go_extra_extensions
+// that name ends with, or "" if there is none. If several match, the longest
+// is returned.
+func extraExtension(gc *goConfig, name string) string {
+	match := ""
+	for _, ext := range gc.extraExtensions {
+		if strings.HasSuffix(name, ext) && len(name) > len(ext) && len(ext) > len(match) {
+			match = ext
+		}
+	}
+	return match
+}
+
 func filterFiles(files *[]string, pred func(string) bool) {
 	w := 0
 	for r := 0; r < len(*files); r++ {
@@ -386,9 +486,38 @@ func defaultPackageName(c *config.Config, rel string) string {
 	return pathtools.RelBaseName(rel, gc.prefix, "")
 }
 
+// findGoProtoLibrary returns the name of a go_proto_library rule in the
+// directory with the given importpath that Gazelle won't replace: a rule
+// generated by another extension, or an existing rule that's marked with
+// "# keep" or that Gazelle doesn't manage in proto mode. "" is returned
+// if there is no such rule.
+func findGoProtoLibrary(args language.GenerateArgs, mode proto.Mode, importPath string) string {
+	if importPath == "" {
+		return ""
+	}
+	for _, r := range args.OtherGen {
+		if r.Kind() == "go_proto_library" && r.AttrString("importpath") == importPath {
+			return r.Name()
+		}
+	}
+	if args.File == nil {
+		return ""
+	}
+	for _, r := range args.File.Rules {
+		if r.Kind() != "go_proto_library" || r.AttrString("importpath") != importPath {
+			continue
+		}
+		if r.ShouldKeep() || !mode.ShouldGenerateRules() {
+			return r.Name()
+		}
+	}
+	return ""
+}
+
 type generator struct {
 	c                   *config.Config
 	rel                 string
+	file                *rule.File
 	shouldSetVisibility bool
 }
 
@@ -457,6 +586,9 @@ func (g *generator) generateLib(pkg *goPackage, embed string) *rule.Rule {
 	}
 	g.setCommonAttrs(goLibrary, pkg.rel, visibility, pkg.library, embed)
 	g.setImportAttrs(goLibrary, pkg.importPath)
+	if pure := getGoConfig(g.c).libraryPure; pure != "" {
+		goLibrary.SetAttr("pure", pure)
+	}
 	return goLibrary
 }
 
@@ -468,6 +600,9 @@ func (g *generator) generateBin(pkg *goPackage, library string) *rule.Rule {
 	}
 	visibility := g.commonVisibility(pkg.importPath)
 	g.setCommonAttrs(goBinary, pkg.rel, visibility, pkg.binary, library)
+	if out := getGoConfig(g.c).binaryOut; out != "" {
+		goBinary.SetAttr("out", out)
+	}
 	return goBinary
 }
 
@@ -480,22 +615,90 @@ func (g *generator) generateTest(pkg *goPackage, library string) *rule.Rule {
 	if pkg.hasTestdata {
 		goTest.SetAttr("data", rule.GlobValue{Patterns: []string{"testdata/**"}})
 	}
+	gc := getGoConfig(g.c)
+	if gc.testSize != "" {
+		goTest.SetAttr("size", gc.testSize)
+	}
+	if gc.testShardCount > 0 {
+		goTest.SetAttr("shard_count", gc.testShardCount)
+	}
+	if gc.testFlaky {
+		goTest.SetAttr("flaky", true)
+	}
+	if len(gc.testEnv) > 0 {
+		goTest.SetAttr("env", gc.testEnv)
+	}
+	if len(gc.testEnvInherit) > 0 {
+		goTest.SetAttr("env_inherit", gc.testEnvInherit)
+	}
+	if gc.testRundir != "" {
+		goTest.SetAttr("rundir", gc.testRundir)
+	}
 	return goTest
 }
 
 func (g *generator) setCommonAttrs(r *rule.Rule, pkgRel string, visibility []string, target goTarget, embed string) {
+	gc := getGoConfig(g.c)
 	if !target.sources.isEmpty() {
-		r.SetAttr("srcs", target.sources.buildFlat())
+		if gc.platformSrcs {
+			// Files constrained to an OS are keyed by OS, files constrained to
+			// an architecture by architecture, and files constrained to both
+			// by the GOOS_GOARCH platform.
+			r.SetAttr("srcs", target.sources.build())
+		} else {
+			r.SetAttr("srcs", target.sources.buildFlat())
+		}
 	}
 	if target.cgo {
 		r.SetAttr("cgo", true)
 	}
-	if !target.clinkopts.isEmpty() {
-		r.SetAttr("clinkopts", g.options(target.clinkopts.build(), pkgRel))
+	clinkopts := target.clinkopts
+	var cdeps rule.PlatformStrings
+	if !target.cdeps.isEmpty() {
+		cdeps = target.cdeps.build()
+		cdeps, _ = cdeps.Map(func(s string) (string, error) {
+			l, err := label.Parse(s)
+			if err != nil {
+				return "", err
+			}
+			return l.Rel(g.c.RepoName, pkgRel).String(), nil
+		})
+	}
+	if expr, ok := g.cdepsExpr(r, cdeps); !ok {
+		// The existing cdeps attribute can't be updated, so it's left alone.
+		// -l flags for resolved libraries stay in clinkopts, so they're
+		// still linked, but pkg-config packages are only linked through
+		// cdeps.
+		if flat := uniqueSorted(cdeps.Flat()); len(flat) > 0 {
+			g.c.Warnf("%s: %s has a cdeps attribute Gazelle can't update; add %s to it to resolve #cgo libraries and pkg-config packages", pkgRel, r.Name(), strings.Join(flat, ", "))
+			clinkopts = target.rawClinkopts
+		}
+	} else if expr != nil {
+		r.SetAttr("cdeps", expr)
+	}
+	if !clinkopts.isEmpty() {
+		r.SetAttr("clinkopts", g.options(clinkopts.build(), pkgRel))
 	}
 	if !target.copts.isEmpty() {
 		r.SetAttr("copts", g.options(target.copts.build(), pkgRel))
 	}
+	if names := uniqueSorted(target.unmappedPkgConfigs); len(names) > 0 {
+		g.c.Warnf("%s: no resolve_pkgconfig directive for pkg-config packages: %s", pkgRel, strings.Join(names, ", "))
+	}
+	if names := uniqueSorted(target.unmappedCgoLibs); len(names) > 0 {
+		g.c.Warnf("%s: no resolve_cgo_lib directive for libraries in #cgo LDFLAGS, left in clinkopts: %s", pkgRel, strings.Join(names, ", "))
+	}
+	// go_library does not have gc_linkopts.
+	if len(gc.gcGoopts) > 0 {
+		r.SetAttr("gc_goopts", gc.gcGoopts)
+	}
+	if len(gc.gcLinkopts) > 0 && r.Kind() != "go_library" {
+		r.SetAttr("gc_linkopts", gc.gcLinkopts)
+	}
+	// go_test rules are always testonly.
+	if gc.testOnly && r.Kind() != "go_test" {
+		r.SetAttr("testonly", true)
+	}
 	if g.shouldSetVisibility && len(visibility) > 0 {
 		r.SetAttr("visibility", visibility)
 	}
@@ -570,6 +773,124 @@ var (
 	longOptPrefixes = []string{"-I", "-L", "-F", "-iquote", "-isystem"}
 )
 
+// cdepsExpr returns the cdeps attribute to generate for r, given the labels
+// of libraries and packages resolved from #cgo directives. Labels in the
+// cdeps attribute of the existing rule with the same kind and name that
+// aren't mapped with resolve_cgo_lib or resolve_pkgconfig were written by
+// hand, so they're included, and they're kept when rules are merged. Other
+// labels are only included if they're in cdeps, so stale ones are removed.
+// nil is returned if there's nothing to set. ok is false if the existing
+// attribute is not a list or select expression that can be updated.
+func (g *generator) cdepsExpr(r *rule.Rule, cdeps rule.PlatformStrings) (expr bzl.Expr, ok bool) {
+	var genRule *rule.Rule
+	if !cdeps.IsEmpty() {
+		genRule = rule.NewRule(r.Kind(), r.Name())
+		genRule.SetAttr("cdeps", cdeps)
+	}
+	var old bzl.Expr
+	if g.file != nil {
+		for _, o := range g.file.Rules {
+			if o.Kind() == r.Kind() && o.Name() == r.Name() {
+				old = o.Attr("cdeps")
+				break
+			}
+		}
+	}
+	if old == nil {
+		if genRule == nil {
+			return nil, true
+		}
+		return genRule.Attr("cdeps"), true
+	}
+	if !isStringsExpr(old) {
+		return nil, false
+	}
+
+	// Copy the existing attribute without mapped labels. Formatting and
+	// parsing it again preserves comments.
+	f, err := bzl.ParseBuild("cdeps", []byte("cdeps = "+bzl.FormatString(old)))
+	if err != nil {
+		return nil, false
+	}
+	handWritten := f.Stmt[0].(*bzl.AssignExpr).RHS
+	gc := getGoConfig(g.c)
+	from := label.New(g.c.RepoName, g.rel, r.Name())
+	mapped := make(map[label.Label]bool)
+	for _, m := range []map[string]label.Label{gc.cgoLibLabels, gc.pkgConfigLabels} {
+		for _, l := range m {
+			mapped[l.Abs(from.Repo, from.Pkg)] = true
+		}
+	}
+	count := 0
+	bzl.Walk(handWritten, func(e bzl.Expr, _ []bzl.Expr) {
+		list, ok := e.(*bzl.ListExpr)
+		if !ok {
+			return
+		}
+		kept := list.List[:0]
+		for _, v := range list.List {
+			if s, ok := v.(*bzl.StringExpr); ok {
+				if l, err := label.Parse(s.Value); err == nil && mapped[l.Abs(from.Repo, from.Pkg)] && !rule.ShouldKeep(v) {
+					continue
+				}
+				count++
+			}
+			kept = append(kept, v)
+		}
+		list.List = kept
+	})
+	if count == 0 {
+		if genRule == nil {
+			return nil, true
+		}
+		return genRule.Attr("cdeps"), true
+	}
+	if genRule == nil {
+		return handWritten, true
+	}
+
+	oldRule := rule.NewRule(r.Kind(), r.Name())
+	oldRule.SetAttr("cdeps", handWritten)
+	if err := rule.SquashRules(oldRule, genRule, ""); err != nil {
+		return nil, false
+	}
+	return genRule.Attr("cdeps"), true
+}
+
+// isStringsExpr returns whether e is a list of strings, a select expression
+// with lists of strings, or a sum of those.
+func isStringsExpr(e bzl.Expr) bool {
+	switch e := e.(type) {
+	case *bzl.StringExpr:
+		return true
+	case *bzl.ListExpr:
+		for _, v := range e.List {
+			if _, ok := v.(*bzl.StringExpr); !ok {
+				return false
+			}
+		}
+		return true
+	case *bzl.BinaryExpr:
+		return e.Op == "+" && isStringsExpr(e.X) && isStringsExpr(e.Y)
+	case *bzl.CallExpr:
+		fn, ok := e.X.(*bzl.Ident)
+		if !ok || fn.Name != "select" || len(e.List) != 1 {
+			return false
+		}
+		dict, ok := e.List[0].(*bzl.DictExpr)
+		if !ok {
+			return false
+		}
+		for _, kv := range dict.List {
+			if _, ok := kv.(*bzl.KeyValueExpr).Value.(*bzl.ListExpr); !ok || !isStringsExpr(kv.(*bzl.KeyValueExpr).Value) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
 // options transforms package-relative paths in cgo options into repository-
 // root-relative paths that Bazel can understand. For example, if a cgo file
 // in //foo declares an include flag in its copts: "-Ibar", this method
@@ -625,6 +946,23 @@ func (g *generator) options(opts rule.PlatformStrings, pkgRel string) rule.Platf
 	return opts
 }
 
+// uniqueSorted returns a sorted copy of names without duplicates.
+func uniqueSorted(names []string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var unique []string
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
 func escapeOption(opt string) string {
 	return strings.NewReplacer(
 		`\`, `\\`,
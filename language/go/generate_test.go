@@ -245,9 +245,7 @@ func TestConsumedGenFiles(t *testing.T) {
 	otherRule.SetAttr("srcs", []string{"mocks.go"})
 	args.OtherGen = append(args.OtherGen, otherRule)
 
-	gl := goLang{
-		goPkgRels: make(map[string]bool),
-	}
+	gl := NewLanguage().(*goLang)
 	gl.Configure(args.Config, "", nil)
 	res := gl.GenerateRules(args)
 	got := res.Gen[0].AttrStrings("srcs")
@@ -0,0 +1,246 @@
+/* Copyright 2019 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package golang
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// goGenerateTool describes a command in //go:generate directives that is
+// translated into a genrule. Set with # gazelle:go_generate_genrule.
+type goGenerateTool struct {
+	// tool is the label of the executable that runs the command.
+	tool label.Label
+
+	// outFlag is the flag whose value names the file the command writes, for
+	// example, "-output".
+	outFlag string
+}
+
+// goGenerate is a //go:generate directive in a file of a package.
+type goGenerate struct {
+	file, line string
+}
+
+// goGenerateComment is added above genrules translated from //go:generate
+// directives. Only genrules with this comment are updated or deleted; other
+// genrules are left alone.
+const goGenerateComment = "# generated from //go:generate"
+
+// generateGoGenerateRules returns a genrule for each //go:generate directive
+// in pkg whose command was named with # gazelle:go_generate_genrule, along
+// with the names of the files the genrules write. Other directives are
+// ignored with a note. Nothing is generated for commands whose output file
+// is already checked in, since the genrule would conflict with it, or when
+// the build file already has a rule with the genrule's name that Gazelle
+// didn't generate. regularFiles is the set of files in the package's
+// directory.
+func (g *generator) generateGoGenerateRules(pkg *goPackage, regularFiles map[string]bool) ([]*rule.Rule, []string) {
+	gc := getGoConfig(g.c)
+	if len(gc.goGenerateTools) == 0 {
+		return nil, nil
+	}
+	existing := make(map[string]*rule.Rule)
+	if g.file != nil {
+		for _, r := range g.file.Rules {
+			existing[r.Name()] = r
+		}
+	}
+	var rules []*rule.Rule
+	var outs []string
+	seen := make(map[string]string)
+	for _, gen := range pkg.generates {
+		where := path.Join(pkg.rel, gen.file)
+		args, err := splitGoGenerate(gen.line, gen.file, pkg.name)
+		if err != nil {
+			g.c.Warnf("%s: //go:generate %s: %v; not translated to a genrule", where, gen.line, err)
+			continue
+		}
+		tool, ok := gc.goGenerateTools[args[0]]
+		if !ok {
+			g.c.Infof("%s: //go:generate %s: %s is not named in a go_generate_genrule directive; not translated to a genrule", where, gen.line, args[0])
+			continue
+		}
+		tool.tool = tool.tool.Rel(g.c.RepoName, pkg.rel)
+		r, out, err := goGenerateRule(tool, gen.file, args, regularFiles)
+		if err != nil {
+			g.c.Warnf("%s: //go:generate %s: %v; not translated to a genrule", where, gen.line, err)
+			continue
+		}
+		if prev, ok := seen[out]; ok {
+			g.c.Warnf("%s: //go:generate %s: %s is also written by //go:generate %s; not translated to a genrule", where, gen.line, out, prev)
+			continue
+		}
+		if old := existing[r.Name()]; old != nil && !isGoGenerateRule(old) {
+			g.c.Warnf("%s: //go:generate %s: a %s rule named %s already exists; not translated to a genrule", where, gen.line, old.Kind(), r.Name())
+			continue
+		}
+		seen[out] = gen.line
+		rules = append(rules, r)
+		outs = append(outs, out)
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Name() < rules[j].Name() })
+	return rules, outs
+}
+
+// emptyGoGenerateRules returns empty genrules for genrules previously
+// translated from //go:generate directives in f that aren't in gen, so they
+// can be deleted.
+func emptyGoGenerateRules(f *rule.File, gen []*rule.Rule) []*rule.Rule {
+	if f == nil {
+		return nil
+	}
+	genNames := make(map[string]bool)
+	for _, r := range gen {
+		genNames[r.Name()] = true
+	}
+	var empty []*rule.Rule
+	for _, r := range f.Rules {
+		if isGoGenerateRule(r) && !genNames[r.Name()] {
+			empty = append(empty, rule.NewRule("genrule", r.Name()))
+		}
+	}
+	return empty
+}
+
+// isGoGenerateRule returns whether r is a genrule translated from a
+// //go:generate directive.
+func isGoGenerateRule(r *rule.Rule) bool {
+	if r.Kind() != "genrule" {
+		return false
+	}
+	for _, c := range r.Comments() {
+		if c == goGenerateComment {
+			return true
+		}
+	}
+	return false
+}
+
+// goGenerateRule returns a genrule that runs the command args from a
+// //go:generate directive in file with tool. The value of tool.outFlag in
+// args names the output file, which is returned. Arguments naming files in
+// regularFiles are passed with $(location) and added to srcs, along with
+// file itself.
+func goGenerateRule(tool goGenerateTool, file string, args []string, regularFiles map[string]bool) (*rule.Rule, string, error) {
+	cmd := []string{"$(location " + tool.tool.String() + ")"}
+	srcs := map[string]bool{file: true}
+	var out string
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == tool.outFlag && i+1 < len(args):
+			i++
+			out = args[i]
+			cmd = append(cmd, arg, "$@")
+			continue
+		case strings.HasPrefix(arg, tool.outFlag+"="):
+			out = arg[len(tool.outFlag)+1:]
+			cmd = append(cmd, tool.outFlag+"=$@")
+			continue
+		case regularFiles[arg]:
+			srcs[arg] = true
+			cmd = append(cmd, "$(location "+arg+")")
+			continue
+		}
+		cmd = append(cmd, genruleArg(arg))
+	}
+	if out == "" {
+		return nil, "", fmt.Errorf("output can't be inferred without %s", tool.outFlag)
+	}
+	if out != path.Base(out) || out == "." || out == ".." {
+		return nil, "", fmt.Errorf("output %q is not in the package directory", out)
+	}
+	if regularFiles[out] {
+		return nil, "", fmt.Errorf("output %s is checked in; delete it to generate it with a genrule", out)
+	}
+
+	srcList := make([]string, 0, len(srcs))
+	for src := range srcs {
+		srcList = append(srcList, src)
+	}
+	sort.Strings(srcList)
+	r := rule.NewRule("genrule", strings.TrimSuffix(out, ".go")+"_gen")
+	r.AddComment(goGenerateComment)
+	r.SetAttr("srcs", srcList)
+	r.SetAttr("outs", []string{out})
+	r.SetAttr("cmd", strings.Join(cmd, " "))
+	r.SetAttr("tools", []string{tool.tool.String()})
+	return r, out, nil
+}
+
+// splitGoGenerate splits the text of a //go:generate directive into words
+// the way the go command does: words are separated by spaces, and
+// double-quoted strings are Go strings. $GOFILE and $GOPACKAGE are expanded.
+// Other environment variables are not supported, since their values when
+// the genrule runs are unknown.
+func splitGoGenerate(line, file, pkgName string) ([]string, error) {
+	var words []string
+	line = strings.TrimSpace(line)
+	for line != "" {
+		var word string
+		if line[0] == '"' {
+			i := 1
+			for ; i < len(line); i++ {
+				if line[i] == '\\' {
+					i++
+				} else if line[i] == '"' {
+					break
+				}
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			var err error
+			if word, err = strconv.Unquote(line[:i+1]); err != nil {
+				return nil, err
+			}
+			line = line[i+1:]
+		} else {
+			i := strings.IndexAny(line, " \t")
+			if i < 0 {
+				i = len(line)
+			}
+			word, line = line[:i], line[i:]
+		}
+		line = strings.TrimLeft(line, " \t")
+		word = strings.Replace(word, "$GOFILE", file, -1)
+		word = strings.Replace(word, "$GOPACKAGE", pkgName, -1)
+		if strings.Contains(word, "$") {
+			return nil, fmt.Errorf("environment variables other than $GOFILE and $GOPACKAGE are not supported")
+		}
+		words = append(words, word)
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("no command")
+	}
+	return words, nil
+}
+
+// genruleArg quotes arg for a genrule's shell command if needed.
+func genruleArg(arg string) string {
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=.,/:+@%") == "" {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
@@ -17,11 +17,29 @@ package golang
 
 import "github.com/bazelbuild/bazel-gazelle/rule"
 
+// goKinds describes the kinds of rules the Go extension generates.
+//
+// Attributes that are only set by directives, like pure, out, testonly,
+// gc_goopts, and go_test's size, shard_count, flaky, env, env_inherit, and
+// rundir, are deliberately not mergeable. Gazelle can't tell whether an
+// existing value came from a directive or was written by hand, so those
+// attributes are only added to rules that don't have them.
 var goKinds = map[string]rule.KindInfo{
 	"filegroup": {
 		NonEmptyAttrs:  map[string]bool{"srcs": true},
 		MergeableAttrs: map[string]bool{"srcs": true},
 	},
+	// Only genrules translated from //go:generate directives are matched with
+	// generated and empty rules; see generateGoGenerateRules.
+	"genrule": {
+		NonEmptyAttrs: map[string]bool{"outs": true},
+		MergeableAttrs: map[string]bool{
+			"cmd":   true,
+			"outs":  true,
+			"srcs":  true,
+			"tools": true,
+		},
+	},
 	"go_binary": {
 		MatchAny: true,
 		NonEmptyAttrs: map[string]bool{
@@ -31,6 +49,7 @@ var goKinds = map[string]rule.KindInfo{
 		},
 		SubstituteAttrs: map[string]bool{"embed": true},
 		MergeableAttrs: map[string]bool{
+			"cdeps":     true,
 			"cgo":       true,
 			"clinkopts": true,
 			"copts":     true,
@@ -50,6 +69,7 @@ var goKinds = map[string]rule.KindInfo{
 			"embed": true,
 		},
 		MergeableAttrs: map[string]bool{
+			"cdeps":      true,
 			"cgo":        true,
 			"clinkopts":  true,
 			"copts":      true,
@@ -109,6 +129,7 @@ var goKinds = map[string]rule.KindInfo{
 			"srcs":  true,
 		},
 		MergeableAttrs: map[string]bool{
+			"cdeps":     true,
 			"cgo":       true,
 			"clinkopts": true,
 			"copts":     true,
@@ -53,7 +53,11 @@ limitations under the License.
 // Known Types and Google APIs. rules_go declares canonical rules for these.
 package golang
 
-import "github.com/bazelbuild/bazel-gazelle/language"
+import (
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/language"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
 
 const goName = "go"
 
@@ -61,10 +65,25 @@ type goLang struct {
 	// goPkgDirs is a set of relative paths to directories containing buildable
 	// Go code, including in subdirectories.
 	goPkgRels map[string]bool
+
+	// mainLibs maps labels of generated go_library rules for main packages
+	// to the libraries. These libraries are private unless they're imported
+	// by another package.
+	mainLibs map[label.Label]mainLib
+}
+
+// mainLib is a generated go_library rule for a main package, together with
+// the visibility it should have if it's imported by another package.
+type mainLib struct {
+	r          *rule.Rule
+	visibility []string
 }
 
 func (_ *goLang) Name() string { return goName }
 
 func NewLanguage() language.Language {
-	return &goLang{goPkgRels: make(map[string]bool)}
+	return &goLang{
+		goPkgRels: make(map[string]bool),
+		mainLibs:  make(map[label.Label]mainLib),
+	}
 }
@@ -17,23 +17,48 @@ package golang
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"go/build"
 	"io"
 	"io/ioutil"
-	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/label"
 	"github.com/bazelbuild/bazel-gazelle/language"
+	"github.com/bazelbuild/bazel-gazelle/pathtools"
 	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
 )
 
+// module is a module reported by "go list -m -json".
+type module struct {
+	Path, Version, Sum string
+	Main               bool
+	Replace            *struct {
+		Path, Version string
+	}
+
+	// via lists path@version of the module and each replacement applied to
+	// it, in order. It's recorded before same-path replacements are folded
+	// into Version, and it's used for -replace_comments.
+	via []string
+}
+
 func importReposFromModules(args language.ImportReposArgs) language.ImportReposResult {
 	// Copy go.mod to temporary directory. We may run commands that modify it,
 	// and we want to leave the original alone.
@@ -43,33 +68,90 @@ func importReposFromModules(args language.ImportReposArgs) language.ImportReposR
 	}
 	defer os.RemoveAll(tempDir)
 
-	// List all modules except for the main module, including implicit indirect
-	// dependencies.
-	type module struct {
-		Path, Version, Sum string
-		Main               bool
-		Replace            *struct {
-			Path, Version string
+	gc := getGoConfig(args.Config)
+	checkGoToolchain(args.Config, args.Path)
+	if err := checkGoModPruning(args.Path); err != nil {
+		return language.ImportReposResult{Error: err}
+	}
+
+	// With -package, only modules providing packages in the build closure of
+	// the named packages are imported.
+	var closure map[string]bool
+	if gc.packagePatterns != "" {
+		closure, err = listBuildModules(args.Config, filepath.Dir(args.Path), true, strings.Split(gc.packagePatterns, ","))
+		if err != nil {
+			return language.ImportReposResult{Error: fmt.Errorf("-package: %v", err)}
+		}
+		if len(closure) == 0 {
+			return language.ImportReposResult{Error: fmt.Errorf("-package: %s matched no packages", gc.packagePatterns)}
 		}
 	}
-	// path@version can be used as a unique identifier for looking up sums
-	pathToModule := map[string]*module{}
-	data, err := goListModules(tempDir)
-	if err != nil {
-		return language.ImportReposResult{Error: err}
+
+	// With -direct_only, only modules required in go.mod without an
+	// "// indirect" comment are imported.
+	var direct map[string]bool
+	if gc.directOnly {
+		data, err := ioutil.ReadFile(args.Path)
+		if err != nil {
+			return language.ImportReposResult{Error: err}
+		}
+		requires, _, err := readGoModRequires(args.Path, data)
+		if err != nil {
+			return language.ImportReposResult{Error: err}
+		}
+		direct = make(map[string]bool)
+		for _, req := range requires {
+			if !req.indirect {
+				direct[req.path] = true
+			}
+		}
 	}
-	dec := json.NewDecoder(bytes.NewReader(data))
-	for dec.More() {
-		mod := new(module)
-		if err := dec.Decode(mod); err != nil {
+
+	// List all modules except for the main module, including implicit indirect
+	// dependencies. If requested, try to read the module list from go.mod and
+	// go.sum without running go list. Either way, the modules are processed
+	// the same way below.
+	env := goCommandEnv(gc)
+	var mods []*module
+	listed := false
+	if gc.skipGoList && !gc.requireSumDB {
+		if mods, listed = readGoModModules(args.Path, gc.directOnly); !listed {
+			args.Config.Debugf("%s: not all requirements have sums, or modules are replaced; running go list", args.Path)
+		}
+	}
+	if !listed {
+		data, err := goListModules(tempDir, env)
+		if err != nil {
 			return language.ImportReposResult{Error: err}
 		}
-		if mod.Main {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for dec.More() {
+			mod := new(module)
+			if err := dec.Decode(mod); err != nil {
+				return language.ImportReposResult{Error: err}
+			}
+			mods = append(mods, mod)
+		}
+	}
+
+	// path@version can be used as a unique identifier for looking up sums
+	pathToModule := map[string]*module{}
+	for _, mod := range mods {
+		if mod.Main || direct != nil && !direct[mod.Path] || closure != nil && !closure[mod.Path] {
 			continue
 		}
+		if mod.Replace != nil {
+			mod.via = []string{modulePathVersion(mod.Path, mod.Version), modulePathVersion(mod.Replace.Path, mod.Replace.Version)}
+		}
+		// A replacement with the same path only selects a different version.
+		// The rule uses that version directly instead of a replace attribute.
+		if mod.Replace != nil && mod.Replace.Path == mod.Path && mod.Replace.Version != "" {
+			mod.Version = mod.Replace.Version
+			mod.Replace = nil
+		}
 		if mod.Replace != nil {
 			if filepath.IsAbs(mod.Replace.Path) || build.IsLocalImport(mod.Replace.Path) {
-				log.Printf("go_repository does not support file path replacements for %s -> %s", mod.Path,
+				args.Config.WarnCategoryf("skipped-replace", "go_repository does not support file path replacements for %s -> %s", mod.Path,
 					mod.Replace.Path)
 				continue
 			}
@@ -78,123 +160,1675 @@ func importReposFromModules(args language.ImportReposArgs) language.ImportReposR
 			pathToModule[mod.Path+"@"+mod.Version] = mod
 		}
 	}
-	// Load sums from go.sum. Ideally, they're all there.
-	goSumPath := filepath.Join(filepath.Dir(args.Path), "go.sum")
-	data, _ = ioutil.ReadFile(goSumPath)
-	lines := bytes.Split(data, []byte("\n"))
-	for _, line := range lines {
-		line = bytes.TrimSpace(line)
-		fields := bytes.Fields(line)
-		if len(fields) != 3 {
-			continue
-		}
-		path, version, sum := string(fields[0]), string(fields[1]), string(fields[2])
-		if strings.HasSuffix(version, "/go.mod") {
-			continue
+	// With -validate_replaces, make sure replacement modules can be downloaded
+	// before generating any rules. go_repository would otherwise fail to fetch
+	// them at build time.
+	if gc.validateReplaces {
+		if err := validateReplaces(tempDir, pathToModule, env); err != nil {
+			return language.ImportReposResult{Error: err}
 		}
-		if mod, ok := pathToModule[path+"@"+version]; ok {
-			mod.Sum = sum
+	}
+
+	// Load sums from go.sum. Ideally, they're all there. If sums must be
+	// verified with the checksum database, go.sum is not trusted, and all sums
+	// are obtained by go mod download.
+	if !gc.requireSumDB {
+		sums := readGoSum(filepath.Join(filepath.Dir(args.Path), "go.sum"))
+		for pathVer, mod := range pathToModule {
+			mod.Sum = lookupSum(sums, pathVer)
 		}
 	}
-	// If sums are missing, run go mod download to get them.
+	// If sums are missing, run go mod download to get them. Modules replaced
+	// without a version have no sum, so they're skipped, and so are modules
+	// fetched from archives with -module_archive or from version control with
+	// -vcs_commit, which may not be available from any module proxy.
 	var missingSumArgs []string
 	for pathVer, mod := range pathToModule {
-		if mod.Sum == "" {
+		if len(matchImportPathValues(gc.moduleArchives, mod.Path)) > 0 {
+			continue
+		}
+		version := mod.Version
+		if mod.Replace != nil {
+			version = mod.Replace.Version
+		}
+		if _, ok := pseudoVersionCommit(version); ok && len(matchImportPathValues(gc.vcsCommits, mod.Path)) > 0 {
+			continue
+		}
+		if mod.Sum == "" && !strings.HasSuffix(pathVer, "@") {
 			missingSumArgs = append(missingSumArgs, pathVer)
 		}
 	}
+	sort.Strings(missingSumArgs)
+	var downloadedSums []goSumEntry
+	// If GOPROXY is a single file:// mirror, read sums from .ziphash files in
+	// the mirror. This is much faster than running go mod download, which is
+	// still used for modules that aren't found. The mirror is not trusted when
+	// sums must be verified.
+	if !gc.requireSumDB && len(missingSumArgs) > 0 {
+		if proxyDir := fileProxyDir(os.Getenv("GOPROXY")); proxyDir != "" {
+			missingSumArgs, downloadedSums = readFileProxySums(proxyDir, pathToModule, missingSumArgs)
+		}
+	}
+	if gc.noNetwork && len(missingSumArgs) > 0 {
+		return language.ImportReposResult{Error: fmt.Errorf("-no_network: sums for these modules are missing from go.sum and would be downloaded:\n\t%s", strings.Join(missingSumArgs, "\n\t"))}
+	}
 	if len(missingSumArgs) > 0 {
-		data, err := goModDownload(tempDir, missingSumArgs)
-		if err != nil {
+		var data []byte
+		var err error
+		if gc.requireSumDB {
+			data, err = goModDownloadSumDB(tempDir, missingSumArgs, env)
+		} else {
+			data, err = goModDownload(tempDir, missingSumArgs, env)
+		}
+		// When sums are verified, go mod download reports modules that fail
+		// verification in its output. Report those below instead of failing
+		// on the exit status.
+		if err != nil && (!gc.requireSumDB || len(data) == 0) {
 			return language.ImportReposResult{Error: err}
 		}
-		dec = json.NewDecoder(bytes.NewReader(data))
+		dec := json.NewDecoder(bytes.NewReader(data))
 		for dec.More() {
-			var dl module
+			var dl struct {
+				module
+				GoModSum, Error string
+			}
 			if err := dec.Decode(&dl); err != nil {
 				return language.ImportReposResult{Error: err}
 			}
+			if dl.Error != "" {
+				args.Config.WarnCategoryf("download-error", "%s@%s: %s", dl.Path, dl.Version, dl.Error)
+				continue
+			}
+			if dl.Sum != "" && !isModuleZipSum(dl.Sum) {
+				args.Config.WarnCategoryf("malformed-sum", "%s@%s: go mod download reported malformed sum %q", dl.Path, dl.Version, dl.Sum)
+				dl.Sum = ""
+			}
+			if dl.Sum != "" {
+				downloadedSums = append(downloadedSums, goSumEntry{dl.Path, dl.Version, dl.Sum})
+			}
+			if dl.GoModSum != "" && isModuleZipSum(dl.GoModSum) {
+				downloadedSums = append(downloadedSums, goSumEntry{dl.Path, dl.Version + "/go.mod", dl.GoModSum})
+			}
 			if mod, ok := pathToModule[dl.Path+"@"+dl.Version]; ok {
 				mod.Sum = dl.Sum
+			} else {
+				// go mod download may report a canonical version that's spelled
+				// differently from the version we asked for.
+				for pathVer, mod := range pathToModule {
+					if canonicalPathVersion(pathVer) == canonicalPathVersion(dl.Path+"@"+dl.Version) {
+						mod.Sum = dl.Sum
+					}
+				}
+			}
+		}
+	}
+	if gc.requireSumDB {
+		var unverified []string
+		for _, pathVer := range missingSumArgs {
+			if pathToModule[pathVer].Sum == "" {
+				unverified = append(unverified, pathVer)
 			}
 		}
+		if len(unverified) > 0 {
+			return language.ImportReposResult{Error: fmt.Errorf("-require_sumdb: could not verify sums with the checksum database for modules: %s", strings.Join(unverified, ", "))}
+		}
+	}
+
+	// With -sumdb_snapshot, check the sums that will be written before
+	// generating any rules. Modules without sums can't be verified, so
+	// they're reported as errors, too.
+	if gc.sumDBSnapshot != "" {
+		var entries []goSumEntry
+		for pathVer, mod := range pathToModule {
+			i := strings.LastIndex(pathVer, "@")
+			if i == len(pathVer)-1 {
+				continue
+			}
+			entries = append(entries, goSumEntry{pathVer[:i], pathVer[i+1:], mod.Sum})
+		}
+		if err := checkSumDBSnapshot(gc.sumDBSnapshot, entries); err != nil {
+			return language.ImportReposResult{Error: err}
+		}
+	}
+
+	// With -update_go_sum, save downloaded sums in the original go.sum (not
+	// the temporary copy) so that the next import doesn't download them.
+	if gc.updateGoSum && len(downloadedSums) > 0 {
+		goSumPath := filepath.Join(filepath.Dir(args.Path), "go.sum")
+		added, err := addGoSumEntries(goSumPath, downloadedSums)
+		if err != nil {
+			return language.ImportReposResult{Error: fmt.Errorf("-update_go_sum: %v", err)}
+		}
+		if added > 0 {
+			args.Config.Infof("%s: added %d sums", goSumPath, added)
+		}
 	}
 
 	// Translate to repository rules.
 	gen := make([]*rule.Rule, 0, len(pathToModule))
+	via := make(map[string][]string)
+	var archiveErrs []string
 	for pathVer, mod := range pathToModule {
-		if mod.Sum == "" {
-			log.Printf("could not determine sum for module %s", pathVer)
+		if mod.via != nil {
+			via[mod.Path] = mod.via
+		}
+		version := mod.Version
+		fetchPath := mod.Path
+		if mod.Replace != nil {
+			version = mod.Replace.Version
+			fetchPath = mod.Replace.Path
+		}
+		if version != "" {
+			if r, err := moduleArchiveRule(gc, mod.Path, fetchPath, version); err != nil {
+				archiveErrs = append(archiveErrs, err.Error())
+				continue
+			} else if r != nil {
+				gen = append(gen, r)
+				continue
+			}
+			if r := vcsCommitRule(gc, mod.Path, fetchPath, version); r != nil {
+				gen = append(gen, r)
+				continue
+			}
+		}
+		if mod.Sum == "" && version != "" {
+			msg := fmt.Sprintf("could not determine sum for module %s", pathVer)
+			if mod.Replace != nil {
+				msg += fmt.Sprintf(" (replacing %s@%s)", mod.Path, mod.Version)
+			}
+			if canonical := canonicalPathVersion(pathVer); canonical != pathVer {
+				msg += fmt.Sprintf(" or %s", canonical)
+			}
+			args.Config.WarnCategoryf("missing-sum", "%s: not found in go.sum or reported by go mod download", msg)
 			continue
 		}
 		r := rule.NewRule("go_repository", label.ImportPathToBazelRepoName(mod.Path))
 		r.SetAttr("importpath", mod.Path)
-		r.SetAttr("sum", mod.Sum)
-		if mod.Replace == nil {
-			r.SetAttr("version", mod.Version)
-		} else {
+		// Empty sum and version attributes are omitted, since go_repository
+		// doesn't accept empty strings for them.
+		if mod.Sum != "" {
+			if gc.requireSumDB {
+				r.SetAttr("sum", sumDBVerifiedExpr(mod.Sum))
+			} else {
+				r.SetAttr("sum", mod.Sum)
+			}
+		}
+		if mod.Replace != nil {
 			r.SetAttr("replace", mod.Replace.Path)
-			r.SetAttr("version", mod.Replace.Version)
+		}
+		if version != "" {
+			r.SetAttr("version", version)
 		}
 		gen = append(gen, r)
 	}
+	if len(archiveErrs) > 0 {
+		sort.Strings(archiveErrs)
+		return language.ImportReposResult{Error: fmt.Errorf("-module_archive: could not download archives to compute sha256:\n\t%s", strings.Join(archiveErrs, "\n\t"))}
+	}
 	sort.Slice(gen, func(i, j int) bool {
 		return gen[i].Name() < gen[j].Name()
 	})
+	if err := checkMinVersions(args.Config, gc, gen); err != nil {
+		return language.ImportReposResult{Error: err}
+	}
+	if gc.markTestOnly {
+		if err := markTestOnlyModules(args.Config, args.Path, gen); err != nil {
+			return language.ImportReposResult{Error: err}
+		}
+	}
+	if gc.replaceComments {
+		setReplaceComments(args.Config, gen, via)
+	}
+	if gc.reportSizes {
+		reportModuleSizes(args.Config, tempDir, env, gen)
+	}
 	return language.ImportReposResult{Gen: gen}
 }
 
-// goListModules invokes "go list" in a directory containing a go.mod file.
-var goListModules = func(dir string) ([]byte, error) {
-	goTool := findGoTool()
-	cmd := exec.Command(goTool, "list", "-m", "-json", "all")
-	cmd.Stderr = os.Stderr
-	cmd.Dir = dir
-	return cmd.Output()
+// moduleArchiveRule returns a go_repository rule for the module importPath
+// that fetches an archive set with -module_archive instead of using version
+// and sum. fetchPath is the path of the module that's fetched, which differs
+// from importPath when the module is replaced. {path} and {version} in the
+// URL and strip_prefix templates are replaced with fetchPath and version.
+// The archive is downloaded to compute its sha256, and an error is returned
+// if it can't be downloaded. nil is returned if no pattern matches
+// importPath.
+func moduleArchiveRule(gc *goConfig, importPath, fetchPath, version string) (*rule.Rule, error) {
+	matches := matchImportPathValues(gc.moduleArchives, importPath)
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	urlTemplate, stripPrefixTemplate := matches[len(matches)-1], ""
+	if i := strings.IndexByte(urlTemplate, ','); i >= 0 {
+		urlTemplate, stripPrefixTemplate = urlTemplate[:i], urlTemplate[i+1:]
+	}
+	replacer := strings.NewReplacer("{path}", fetchPath, "{version}", version)
+	archiveURL := replacer.Replace(urlTemplate)
+	sum, err := fetchArchiveSHA256(archiveURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s@%s: %v", fetchPath, version, err)
+	}
+
+	r := rule.NewRule("go_repository", label.ImportPathToBazelRepoName(importPath))
+	r.SetAttr("importpath", importPath)
+	r.SetAttr("urls", []string{archiveURL})
+	if stripPrefix := replacer.Replace(stripPrefixTemplate); stripPrefix != "" {
+		r.SetAttr("strip_prefix", stripPrefix)
+	}
+	r.SetAttr("sha256", sum)
+	return r, nil
 }
 
-// goModDownload invokes "go mod download" in a directory containing a
-// go.mod file.
-var goModDownload = func(dir string, args []string) ([]byte, error) {
-	goTool := findGoTool()
-	cmd := exec.Command(goTool, "mod", "download", "-json")
-	cmd.Args = append(cmd.Args, args...)
-	cmd.Stderr = os.Stderr
-	cmd.Dir = dir
-	return cmd.Output()
+// vcsCommitRule returns a go_repository rule for the module importPath that
+// fetches the commit in the pseudo-version version from a git repository set
+// with -vcs_commit, instead of using version and sum. fetchPath is the path
+// of the module that's fetched, which differs from importPath when the module
+// is replaced. {path} in the remote template is replaced with fetchPath. nil
+// is returned if no pattern matches importPath, or if version is not a
+// pseudo-version.
+func vcsCommitRule(gc *goConfig, importPath, fetchPath, version string) *rule.Rule {
+	matches := matchImportPathValues(gc.vcsCommits, importPath)
+	if len(matches) == 0 {
+		return nil
+	}
+	commit, ok := pseudoVersionCommit(version)
+	if !ok {
+		return nil
+	}
+	r := rule.NewRule("go_repository", label.ImportPathToBazelRepoName(importPath))
+	r.SetAttr("importpath", importPath)
+	r.SetAttr("commit", commit)
+	r.SetAttr("remote", strings.Replace(matches[len(matches)-1], "{path}", fetchPath, -1))
+	r.SetAttr("vcs", "git")
+	return r
 }
 
-// copyGoModToTemp copies to given go.mod file to a temporary directory.
-// go list tends to mutate go.mod files, but gazelle shouldn't do that.
-func copyGoModToTemp(filename string) (tempDir string, err error) {
-	goModOrig, err := os.Open(filename)
+// pseudoVersionRegexp matches pseudo-versions, which the go command uses for
+// commits that aren't tagged with a release version, for example,
+// v0.0.0-20190101000000-0123456789ab.
+var pseudoVersionRegexp = regexp.MustCompile(`^v[0-9]+\.(0\.0-|[0-9]+\.[0-9]+-([^+]*\.)?0\.)[0-9]{14}-[A-Za-z0-9]+(\+incompatible)?$`)
+
+// pseudoVersionCommit returns the abbreviated commit hash at the end of a
+// pseudo-version. ok is false if v is not a pseudo-version.
+func pseudoVersionCommit(v string) (commit string, ok bool) {
+	if !pseudoVersionRegexp.MatchString(v) {
+		return "", false
+	}
+	v = strings.TrimSuffix(v, "+incompatible")
+	return v[strings.LastIndexByte(v, '-')+1:], true
+}
+
+// archiveClient is used to download archives for -module_archive. The
+// timeout covers reading the whole archive, so a stalled server doesn't
+// block Gazelle indefinitely.
+var archiveClient = &http.Client{Timeout: 5 * time.Minute}
+
+// fetchArchiveSHA256 downloads the archive at archiveURL and returns the
+// hex-encoded SHA-256 hash of its contents.
+var fetchArchiveSHA256 = func(archiveURL string) (string, error) {
+	resp, err := archiveClient.Get(archiveURL)
 	if err != nil {
 		return "", err
 	}
-	defer goModOrig.Close()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", archiveURL, resp.Status)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	tempDir, err = ioutil.TempDir("", "gazelle-temp-gomod")
+// reportModuleSizes logs the zip size of each module in gen whose
+// go_repository rule is new or has a different version, replacement, or sum
+// than the existing rule with the same name in c.Repos. Modules are
+// downloaded with go mod download in dir, which must contain a go.mod file.
+// This is only informational, so download problems are logged as warnings.
+func reportModuleSizes(c *config.Config, dir string, env []string, gen []*rule.Rule) {
+	existing := make(map[string]*rule.Rule)
+	for _, r := range c.Repos {
+		if r.Kind() == "go_repository" {
+			existing[r.Name()] = r
+		}
+	}
+	var pathVers []string
+	for _, r := range gen {
+		if er, ok := existing[r.Name()]; ok &&
+			er.AttrString("version") == r.AttrString("version") &&
+			er.AttrString("replace") == r.AttrString("replace") &&
+			er.AttrString("sum") == r.AttrString("sum") {
+			continue
+		}
+		version := r.AttrString("version")
+		if version == "" {
+			continue
+		}
+		modPath := r.AttrString("replace")
+		if modPath == "" {
+			modPath = r.AttrString("importpath")
+		}
+		pathVers = append(pathVers, modPath+"@"+version)
+	}
+	if len(pathVers) == 0 {
+		c.Infof("-report_sizes: no new or changed modules")
+		return
+	}
+	sort.Strings(pathVers)
+
+	// go mod download reports errors for individual modules in its output, so
+	// the output is read even if the command fails.
+	data, err := goModDownload(dir, pathVers, env)
+	if err != nil && len(data) == 0 {
+		c.Warnf("-report_sizes: %v", err)
+		return
+	}
+	var total int64
+	var count int
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var dl struct {
+			Path, Version, Zip, Error string
+		}
+		if err := dec.Decode(&dl); err != nil {
+			c.Warnf("-report_sizes: %v", err)
+			return
+		}
+		if dl.Error != "" {
+			c.WarnCategoryf("download-error", "%s@%s: %s", dl.Path, dl.Version, dl.Error)
+			continue
+		}
+		fi, err := os.Stat(dl.Zip)
+		if err != nil {
+			c.Warnf("-report_sizes: %s@%s: %v", dl.Path, dl.Version, err)
+			continue
+		}
+		c.Infof("%s@%s: %s", dl.Path, dl.Version, formatSize(fi.Size()))
+		total += fi.Size()
+		count++
+	}
+	c.Infof("-report_sizes: %d new or changed modules, %s total", count, formatSize(total))
+}
+
+// formatSize formats a number of bytes for humans, using binary units.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// checkSumDBSnapshot compares sums that will be written in go_repository
+// rules with sums in the file at snapshotPath, a local copy of checksum
+// database records in go.sum format. For replaced modules, entries should
+// have the replacement's path and version. An error listing every module
+// without a sum, or whose sum is different or missing in the snapshot,
+// is returned.
+func checkSumDBSnapshot(snapshotPath string, entries []goSumEntry) error {
+	snapshot := readGoSum(snapshotPath)
+	var errs []string
+	for _, e := range entries {
+		pathVer := e.path + "@" + e.version
+		switch want := lookupSum(snapshot, pathVer); {
+		case e.sum == "":
+			errs = append(errs, fmt.Sprintf("%s: not found in go.sum or reported by go mod download", pathVer))
+		case want == "":
+			errs = append(errs, fmt.Sprintf("%s: not found in snapshot", pathVer))
+		case want != e.sum:
+			errs = append(errs, fmt.Sprintf("%s: sum %s does not match %s in snapshot", pathVer, e.sum, want))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("-sumdb_snapshot: sums could not be verified with %s:\n\t%s", snapshotPath, strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// testOnlyComment is added above go_repository rules for modules that aren't
+// needed to build non-test packages in the main module.
+const testOnlyComment = "# test-only"
+
+// markTestOnlyModules adds testOnlyComment above generated go_repository
+// rules for modules that don't provide any package in the build closure of
+// the main module's non-test packages, as reported by go list -deps. Modules
+// needed only by tests, or not needed at all, are marked. Comments aren't
+// merged into existing rules, so existing rules with the same names in
+// c.Repos are marked or unmarked directly.
+func markTestOnlyModules(c *config.Config, goModPath string, gen []*rule.Rule) error {
+	buildModules, err := listBuildModules(c, filepath.Dir(goModPath), false, []string{"./..."})
 	if err != nil {
-		return "", err
+		return fmt.Errorf("-mark_test_only: %v", err)
+	}
+	existing := make(map[string]*rule.Rule)
+	for _, r := range c.Repos {
+		if r.Kind() == "go_repository" {
+			existing[r.Name()] = r
+		}
+	}
+	for _, r := range gen {
+		testOnly := !buildModules[r.AttrString("importpath")]
+		rs := []*rule.Rule{r}
+		if er, ok := existing[r.Name()]; ok {
+			rs = append(rs, er)
+		}
+		for _, r := range rs {
+			r.DelComment(testOnlyComment)
+			if testOnly {
+				r.AddComment(testOnlyComment)
+			}
+		}
 	}
+	return nil
+}
 
-	goModCopy, err := os.Create(filepath.Join(tempDir, "go.mod"))
+// listBuildModules returns the set of paths of modules providing packages
+// in the build closure of the packages matched by patterns in the main
+// module's directory dir, including the main module. If tests is true, test
+// dependencies of the matched packages are included too.
+func listBuildModules(c *config.Config, dir string, tests bool, patterns []string) (map[string]bool, error) {
+	data, err := goListBuildModules(dir, goCommandEnv(getGoConfig(c)), tests, patterns)
 	if err != nil {
-		os.Remove(tempDir)
-		return "", err
+		return nil, err
+	}
+	modules := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			modules[line] = true
+		}
+	}
+	return modules, nil
+}
+
+// replaceCommentPrefix starts the comment added above go_repository rules for
+// replaced modules with -replace_comments.
+const replaceCommentPrefix = "# via: "
+
+// modulePathVersion formats a module path and version as path@version, or
+// just path if version is empty, as for a replacement without a version.
+func modulePathVersion(path, version string) string {
+	if version == "" {
+		return path
+	}
+	return path + "@" + version
+}
+
+// setReplaceComments adds a comment like "# via: A@v1 => B@v2" above each
+// generated go_repository rule for a replaced module, listing the module and
+// its replacements. via maps module paths to those lists. The go command
+// applies at most one replacement to each module, so a list currently has
+// two elements, but the comment format doesn't depend on that. Comments are
+// also updated on existing rules in c.Repos with the same names, since the
+// merge doesn't copy comments.
+func setReplaceComments(c *config.Config, gen []*rule.Rule, via map[string][]string) {
+	existing := make(map[string]*rule.Rule)
+	for _, r := range c.Repos {
+		if r.Kind() == "go_repository" {
+			existing[r.Name()] = r
+		}
+	}
+	for _, r := range gen {
+		rs := []*rule.Rule{r}
+		if er, ok := existing[r.Name()]; ok {
+			rs = append(rs, er)
+		}
+		chain := via[r.AttrString("importpath")]
+		for _, r := range rs {
+			for _, comment := range r.Comments() {
+				if strings.HasPrefix(comment, replaceCommentPrefix) {
+					r.DelComment(comment)
+				}
+			}
+			if len(chain) > 0 {
+				r.AddComment(replaceCommentPrefix + strings.Join(chain, " => "))
+			}
+		}
 	}
-	defer func() {
-		if cerr := goModCopy.Close(); err == nil && cerr != nil {
-			err = cerr
+}
+
+// checkMinVersions compares the versions of generated go_repository rules
+// with minimum versions set with -min_version. For a replaced module, the
+// replacement's path and version are checked. A warning is logged for each
+// module below its minimum version, or with -min_version_strict, an error
+// listing all of them is returned.
+func checkMinVersions(c *config.Config, gc *goConfig, gen []*rule.Rule) error {
+	if len(gc.minVersions) == 0 {
+		return nil
+	}
+	var errs []string
+	for _, r := range gen {
+		modPath := r.AttrString("replace")
+		if modPath == "" {
+			modPath = r.AttrString("importpath")
+		}
+		minVersion, ok := gc.minVersions[modPath]
+		if !ok {
+			continue
+		}
+		version := r.AttrString("version")
+		if version == "" || compareVersions(version, minVersion) >= 0 {
+			continue
+		}
+		msg := fmt.Sprintf("%s@%s is below the minimum version %s set with -min_version", modPath, version, minVersion)
+		if gc.strictMinVersions {
+			errs = append(errs, msg)
+		} else {
+			c.WarnCategoryf("min-version", "%s", msg)
 		}
-	}()
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("-min_version_strict: modules are below their minimum versions:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
 
-	_, err = io.Copy(goModCopy, goModOrig)
+// readGoModModules returns the modules required in the go.mod file at
+// goModPath, as go list would report them, except for the main module.
+// This avoids running go list, but it only works if every requirement has
+// a sum in the adjacent go.sum file and no modules are replaced; ok is false
+// otherwise. Unlike go list, this doesn't find indirect dependencies that
+// go.mod doesn't list. If directOnly is true, requirements marked
+// "// indirect" are skipped, and they don't need sums.
+func readGoModModules(goModPath string, directOnly bool) (mods []*module, ok bool) {
+	data, err := ioutil.ReadFile(goModPath)
 	if err != nil {
-		os.RemoveAll(tempDir)
-		return "", err
+		return nil, false
+	}
+	requires, hasReplace, err := readGoModRequires(goModPath, data)
+	if err != nil || hasReplace {
+		return nil, false
+	}
+	sums := readGoSum(filepath.Join(filepath.Dir(goModPath), "go.sum"))
+	for _, req := range requires {
+		if directOnly && req.indirect {
+			continue
+		}
+		if _, ok := sums[req.path+"@"+req.version]; !ok {
+			return nil, false
+		}
+		mods = append(mods, &module{Path: req.path, Version: req.version})
+	}
+	return mods, true
+}
+
+// goModRequire is a requirement read from a go.mod file.
+type goModRequire struct {
+	path, version string
+
+	// indirect is true if the requirement is marked with an "// indirect"
+	// comment, meaning no package in the main module imports it.
+	indirect bool
+}
+
+// readGoModRequires returns the requirements in require directives in
+// go.mod content read from filename, and whether the content has any replace
+// directives.
+func readGoModRequires(filename string, data []byte) (requires []goModRequire, hasReplace bool, err error) {
+	directives, err := parseGoMod(filename, data)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, d := range directives {
+		switch d.verb {
+		case "replace":
+			hasReplace = true
+		case "require":
+			if len(d.args) != 2 {
+				return nil, false, &goModError{Filename: filename, Line: d.line, Msg: "usage: require module/path v1.2.3"}
+			}
+			path, err := unquoteGoModArg(d.args[0])
+			if err != nil {
+				return nil, false, &goModError{Filename: filename, Line: d.line, Msg: err.Error()}
+			}
+			version, err := unquoteGoModArg(d.args[1])
+			if err != nil {
+				return nil, false, &goModError{Filename: filename, Line: d.line, Msg: err.Error()}
+			}
+			requires = append(requires, goModRequire{
+				path:     path,
+				version:  version,
+				indirect: d.indirect,
+			})
+		}
+	}
+	return requires, hasReplace, nil
+}
+
+// isIndirectComment returns whether a line from a go.mod file ends with an
+// "// indirect" comment. The go command may add other text to the comment
+// after a semicolon.
+func isIndirectComment(line string) bool {
+	i := strings.Index(line, "//")
+	if i < 0 {
+		return false
+	}
+	comment := strings.TrimSpace(line[i+len("//"):])
+	return comment == "indirect" || strings.HasPrefix(comment, "indirect;")
+}
+
+// readGoSum returns a map from "path@version" to the sum of each module
+// listed in a go.sum file. Sums for go.mod files alone are not included,
+// nor are sums that aren't in the h1 form checked by isModuleZipSum.
+// An empty map is returned if the file can't be read.
+func readGoSum(goSumPath string) map[string]string {
+	sums := make(map[string]string)
+	data, _ := ioutil.ReadFile(goSumPath)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fields := bytes.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		path, version, sum := string(fields[0]), string(fields[1]), string(fields[2])
+		if strings.HasSuffix(version, "/go.mod") || !isModuleZipSum(sum) {
+			continue
+		}
+		sums[path+"@"+version] = sum
+		// Sums may also be looked up by canonical version, in case go.sum
+		// spells the version differently than go list.
+		if canonical := canonicalPathVersion(path + "@" + version); canonical != path+"@"+version {
+			if _, ok := sums[canonical]; !ok {
+				sums[canonical] = sum
+			}
+		}
+	}
+	return sums
+}
+
+// isModuleZipSum returns whether sum has the form of a module zip sum that
+// go_repository can verify: "h1:" followed by a base64-encoded hash. The h1
+// hash covers the module's files, not the zip itself, so it's the same on
+// every platform. Sums from other hash algorithms, or malformed ones, are
+// rejected, so a go.mod-only sum or a corrupt go.sum line is never
+// recorded as a module sum.
+func isModuleZipSum(sum string) bool {
+	hash := strings.TrimPrefix(sum, "h1:")
+	if hash == sum || hash == "" {
+		return false
+	}
+	for _, r := range hash {
+		if !('A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '+' || r == '/' || r == '=') {
+			return false
+		}
+	}
+	return true
+}
+
+// fileProxyDir returns the directory named by goproxy if it's a single
+// file:// URL. An empty string is returned for any other value, including
+// lists of proxies.
+func fileProxyDir(goproxy string) string {
+	if strings.ContainsAny(goproxy, ",|") {
+		return ""
+	}
+	u, err := url.Parse(goproxy)
+	if err != nil || u.Scheme != "file" || u.Path == "" {
+		return ""
+	}
+	p := u.Path
+	if runtime.GOOS == "windows" && len(p) >= 3 && p[0] == '/' && p[2] == ':' {
+		// file:///C:/dir has the path /C:/dir.
+		p = p[1:]
+	}
+	return filepath.FromSlash(p)
+}
+
+// readFileProxySums looks up sums for modules in pathVers (path@version
+// strings, keys of pathToModule) in the .ziphash files of a module proxy
+// mirror in proxyDir, which has the same layout as the module download
+// cache. Sums that are found are set on their modules and returned as go.sum
+// entries. Modules without a valid sum in the mirror are returned in missing.
+func readFileProxySums(proxyDir string, pathToModule map[string]*module, pathVers []string) (missing []string, found []goSumEntry) {
+	for _, pathVer := range pathVers {
+		i := strings.LastIndex(pathVer, "@")
+		modPath, version := pathVer[:i], pathVer[i+1:]
+		zipHashPath := filepath.Join(proxyDir, filepath.FromSlash(escapeModulePath(modPath)), "@v", escapeModulePath(version)+".ziphash")
+		data, err := ioutil.ReadFile(zipHashPath)
+		sum := strings.TrimSpace(string(data))
+		if err != nil || !isModuleZipSum(sum) {
+			missing = append(missing, pathVer)
+			continue
+		}
+		pathToModule[pathVer].Sum = sum
+		found = append(found, goSumEntry{modPath, version, sum})
+	}
+	return missing, found
+}
+
+// escapeModulePath escapes a module path or version the way the go command
+// does for file names in the module cache and in proxies: each upper-case
+// letter is replaced with "!" followed by the lower-case letter.
+func escapeModulePath(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if 'A' <= r && r <= 'Z' {
+			sb.WriteByte('!')
+			r += 'a' - 'A'
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// goSumEntry is a line in a go.sum file. For the sum of a module's go.mod
+// file alone, version ends with "/go.mod".
+type goSumEntry struct {
+	path, version, sum string
+}
+
+// addGoSumEntries adds entries to the go.sum file at goSumPath, creating the
+// file if it doesn't exist. Entries for a path and version already in the
+// file are skipped; existing lines are never changed or removed. Each new
+// line is inserted before the first existing line that sorts after it, so a
+// sorted go.sum stays sorted. The number of lines added is returned.
+func addGoSumEntries(goSumPath string, entries []goSumEntry) (added int, err error) {
+	data, err := ioutil.ReadFile(goSumPath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	key := func(path, version string) string { return path + " " + version }
+	existing := make(map[string]bool)
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) == 3 {
+			existing[key(fields[0], fields[1])] = true
+		}
+	}
+	var missing []goSumEntry
+	for _, e := range entries {
+		k := key(e.path, e.version)
+		if !existing[k] {
+			existing[k] = true
+			missing = append(missing, e)
+		}
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	// Lines are ordered the way the go command orders them: by path, then by
+	// semantic version, with a version's "/go.mod" line after its module line.
+	less := func(path1, version1, path2, version2 string) bool {
+		if path1 != path2 {
+			return path1 < path2
+		}
+		v1, mod1 := strings.TrimSuffix(version1, "/go.mod"), strings.HasSuffix(version1, "/go.mod")
+		v2, mod2 := strings.TrimSuffix(version2, "/go.mod"), strings.HasSuffix(version2, "/go.mod")
+		if v1 != v2 {
+			if c := compareVersions(v1, v2); c != 0 {
+				return c < 0
+			}
+			return v1 < v2
+		}
+		return !mod1 && mod2
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		return less(missing[i].path, missing[i].version, missing[j].path, missing[j].version)
+	})
+
+	var buf bytes.Buffer
+	writeEntry := func(e goSumEntry) {
+		fmt.Fprintf(&buf, "%s %s %s\n", e.path, e.version, e.sum)
+	}
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) == 3 {
+			for len(missing) > 0 && less(missing[0].path, missing[0].version, fields[0], fields[1]) {
+				writeEntry(missing[0])
+				missing = missing[1:]
+				added++
+			}
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	for _, e := range missing {
+		writeEntry(e)
+		added++
+	}
+	if err := ioutil.WriteFile(goSumPath, buf.Bytes(), 0666); err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// lookupSum returns the sum for a module in sums, a map returned by
+// readGoSum. pathVer is the module path and version separated by "@". If there
+// is no sum for that exact version, the sum for the canonical form of the
+// version is returned. An empty string is returned if neither is found.
+func lookupSum(sums map[string]string, pathVer string) string {
+	if sum, ok := sums[pathVer]; ok {
+		return sum
+	}
+	return sums[canonicalPathVersion(pathVer)]
+}
+
+// canonicalPathVersion returns pathVer, a module path and version separated
+// by "@", with the version in canonical form. If the version is not valid,
+// pathVer is returned unchanged.
+func canonicalPathVersion(pathVer string) string {
+	i := strings.LastIndex(pathVer, "@")
+	if i < 0 {
+		return pathVer
+	}
+	if v := canonicalVersion(pathVer[i+1:]); v != "" {
+		return pathVer[:i+1] + v
+	}
+	return pathVer
+}
+
+// canonicalVersion returns the canonical form of a semantic version:
+// missing minor and patch numbers are filled in with zeros, and build
+// metadata is removed, except for "+incompatible", which is meaningful to
+// the go command. For example, "v1.2" becomes "v1.2.0". An empty string is
+// returned if the version is not valid.
+func canonicalVersion(v string) string {
+	if !strings.HasPrefix(v, "v") {
+		return ""
+	}
+	v = v[1:]
+	var build string
+	if i := strings.Index(v, "+"); i >= 0 {
+		if v[i:] == "+incompatible" {
+			build = v[i:]
+		}
+		v = v[:i]
+	}
+	var prerelease string
+	if i := strings.Index(v, "-"); i >= 0 {
+		v, prerelease = v[:i], v[i:]
+	}
+	nums := strings.Split(v, ".")
+	if len(nums) > 3 || prerelease != "" && len(nums) != 3 {
+		return ""
+	}
+	for _, n := range nums {
+		if n == "" || strings.Trim(n, "0123456789") != "" || len(n) > 1 && n[0] == '0' {
+			return ""
+		}
+	}
+	for len(nums) < 3 {
+		nums = append(nums, "0")
+	}
+	return "v" + strings.Join(nums, ".") + prerelease + build
+}
+
+// compareVersions compares two semantic versions according to semantic
+// versioning precedence, returning -1, 0, or 1. Pseudo-versions are
+// prerelease versions, so they're ordered by their timestamps between the
+// versions they're derived from. Build metadata is ignored. Invalid
+// versions are considered lower than valid versions.
+func compareVersions(v, w string) int {
+	cv, cw := canonicalVersion(v), canonicalVersion(w)
+	if cv == "" || cw == "" {
+		switch {
+		case cv == cw:
+			return 0
+		case cv == "":
+			return -1
+		default:
+			return 1
+		}
+	}
+	splitVersion := func(v string) (nums []string, prerelease string) {
+		v = strings.TrimSuffix(v[1:], "+incompatible")
+		if i := strings.IndexByte(v, '-'); i >= 0 {
+			v, prerelease = v[:i], v[i+1:]
+		}
+		return strings.Split(v, "."), prerelease
+	}
+	numsV, preV := splitVersion(cv)
+	numsW, preW := splitVersion(cw)
+	for i := range numsV {
+		if c := compareNumbers(numsV[i], numsW[i]); c != 0 {
+			return c
+		}
+	}
+	// A version without a prerelease has higher precedence than one with.
+	switch {
+	case preV == preW:
+		return 0
+	case preV == "":
+		return 1
+	case preW == "":
+		return -1
+	}
+	idsV, idsW := strings.Split(preV, "."), strings.Split(preW, ".")
+	for i := 0; i < len(idsV) && i < len(idsW); i++ {
+		a, b := idsV[i], idsW[i]
+		if a == b {
+			continue
+		}
+		aNum := strings.Trim(a, "0123456789") == ""
+		bNum := strings.Trim(b, "0123456789") == ""
+		switch {
+		case aNum && bNum:
+			return compareNumbers(a, b)
+		case aNum:
+			return -1
+		case bNum:
+			return 1
+		case a < b:
+			return -1
+		default:
+			return 1
+		}
+	}
+	switch {
+	case len(idsV) < len(idsW):
+		return -1
+	case len(idsV) > len(idsW):
+		return 1
+	}
+	return 0
+}
+
+// compareNumbers compares two strings of decimal digits without leading
+// zeros by numeric value.
+func compareNumbers(a, b string) int {
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// readModulePath returns the module path declared in the go.mod file at
+// goModPath. An error is returned if the file can't be read or doesn't
+// contain a module directive.
+func readModulePath(goModPath string) (string, error) {
+	data, err := ioutil.ReadFile(goModPath)
+	if err != nil {
+		return "", err
+	}
+	directives, err := parseGoMod(goModPath, data)
+	if err != nil {
+		return "", err
+	}
+	for _, d := range directives {
+		if d.verb != "module" || len(d.args) != 1 {
+			continue
+		}
+		modulePath, err := unquoteGoModArg(d.args[0])
+		if err != nil {
+			return "", fmt.Errorf("%s: invalid module path %s", goModPath, d.args[0])
+		}
+		return modulePath, nil
+	}
+	return "", fmt.Errorf("%s: no module directive found", goModPath)
+}
+
+// readVendoredModules returns the paths of modules listed in a
+// vendor/modules.txt file written by "go mod vendor". Module lines have the
+// form "# path version [=> replacement]". Package lines and "##" annotations
+// are ignored.
+func readVendoredModules(modulesTxtPath string) ([]string, error) {
+	data, err := ioutil.ReadFile(modulesTxtPath)
+	if err != nil {
+		return nil, err
+	}
+	var modulePaths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "# ") {
+			continue
+		}
+		fields := strings.Fields(line[len("# "):])
+		if len(fields) == 0 {
+			continue
+		}
+		modulePaths = append(modulePaths, fields[0])
+	}
+	return modulePaths, nil
+}
+
+// isVendoredImport returns whether imp is provided by a module listed in
+// vendor/modules.txt.
+func (gc *goConfig) isVendoredImport(imp string) bool {
+	for _, modulePath := range gc.vendoredModules {
+		if pathtools.HasPrefix(imp, modulePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// localModules is the set of modules in this repository, found in go.mod
+// files in subdirectories. The repository is searched the first time a
+// module is looked up, independently of the directories Gazelle visits, so
+// imports of modules outside those directories are resolved too.
+type localModules struct {
+	once     sync.Once
+	repoRoot string
+
+	// paths maps module paths to the slash-separated directories containing
+	// them, relative to the repository root.
+	paths map[string]string
+}
+
+func newLocalModules(repoRoot string) *localModules {
+	return &localModules{repoRoot: repoRoot}
+}
+
+// find returns the path of the module in this repository that provides the
+// package imp and the directory containing it. If several modules match, the
+// one with the longest path is returned.
+func (lm *localModules) find(imp string) (modulePath, rel string, ok bool) {
+	if lm == nil {
+		return "", "", false
+	}
+	lm.once.Do(lm.load)
+	for mp, r := range lm.paths {
+		if pathtools.HasPrefix(imp, mp) && len(mp) > len(modulePath) {
+			modulePath, rel, ok = mp, r, true
+		}
+	}
+	return modulePath, rel, ok
+}
+
+// load searches the repository for go.mod files. Like the go command, it
+// skips testdata and vendor directories and directories whose names start
+// with "." or "_". The go.mod file in the repository root is not a local
+// module, since packages in it are resolved with the prefix.
+func (lm *localModules) load() {
+	lm.paths = make(map[string]string)
+	filepath.Walk(lm.repoRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			base := info.Name()
+			if p != lm.repoRoot && (base == "testdata" || base == "vendor" || strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() != "go.mod" {
+			return nil
+		}
+		dir := filepath.Dir(p)
+		if dir == lm.repoRoot {
+			return nil
+		}
+		rel, err := filepath.Rel(lm.repoRoot, dir)
+		if err != nil {
+			return nil
+		}
+		if modulePath, err := readModulePath(p); err == nil && modulePath != "" {
+			lm.paths[modulePath] = filepath.ToSlash(rel)
+		}
+		return nil
+	})
+}
+
+// findLocalModule returns the path of the module in this repository that
+// provides the package imp and the directory containing it.
+func (gc *goConfig) findLocalModule(imp string) (modulePath, rel string, ok bool) {
+	return gc.localModules.find(imp)
+}
+
+// validateReplaces runs go mod download for each replacement module in
+// pathToModule, which maps replacement path@version strings to the replaced
+// modules. Sums of downloaded modules are recorded. An error listing every
+// replacement that couldn't be downloaded is returned. Replacements without
+// versions are not checked. env is passed to goModDownload.
+func validateReplaces(dir string, pathToModule map[string]*module, env []string) error {
+	var replaceArgs []string
+	for pathVer, mod := range pathToModule {
+		if mod.Replace != nil && !strings.HasSuffix(pathVer, "@") {
+			replaceArgs = append(replaceArgs, pathVer)
+		}
+	}
+	if len(replaceArgs) == 0 {
+		return nil
+	}
+	sort.Strings(replaceArgs)
+
+	// go mod download exits with an error if any module can't be downloaded,
+	// but it still reports each module in its output.
+	data, err := goModDownload(dir, replaceArgs, env)
+	if err != nil && len(data) == 0 {
+		return err
+	}
+	downloaded := make(map[string]bool)
+	var errs []string
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var dl struct {
+			Path, Version, Sum, Error string
+		}
+		if err := dec.Decode(&dl); err != nil {
+			return err
+		}
+		pathVer := dl.Path + "@" + dl.Version
+		mod, ok := pathToModule[pathVer]
+		if !ok {
+			continue
+		}
+		downloaded[pathVer] = true
+		if dl.Error != "" {
+			errs = append(errs, fmt.Sprintf("%s (replacing %s@%s): %s", pathVer, mod.Path, mod.Version, dl.Error))
+		} else if mod.Sum == "" {
+			mod.Sum = dl.Sum
+		}
+	}
+	for _, pathVer := range replaceArgs {
+		if !downloaded[pathVer] {
+			mod := pathToModule[pathVer]
+			errs = append(errs, fmt.Sprintf("%s (replacing %s@%s): not reported by go mod download", pathVer, mod.Path, mod.Version))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("-validate_replaces: could not download replacement modules:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// checkGoToolchain warns if the go.mod file at goModPath has a toolchain
+// directive naming a newer version of Go than the go command Gazelle will
+// run. In that case, the go command may download and run the requested
+// toolchain instead. Nothing is checked if GOTOOLCHAIN is set, since the
+// user has already chosen a toolchain.
+func checkGoToolchain(c *config.Config, goModPath string) {
+	if os.Getenv("GOTOOLCHAIN") != "" {
+		return
+	}
+	data, err := ioutil.ReadFile(goModPath)
+	if err != nil {
+		return
+	}
+	toolchain := readGoModToolchain(data)
+	if toolchain == "" || toolchain == "default" {
+		return
+	}
+	version, err := goToolVersion()
+	if err != nil {
+		c.Debugf("%s: could not determine go version: %v", goModPath, err)
+		return
+	}
+	requested, installed := goSemver(toolchain), goSemver(version)
+	newer := compareVersions(requested, installed) > 0
+	if canonicalVersion(requested) == "" || canonicalVersion(installed) == "" {
+		// Versions that can't be compared are reported if they differ.
+		newer = toolchain != version
+	}
+	if newer {
+		c.WarnCategoryf("toolchain", "%s: toolchain %s is requested, but %s is %s. The go command may download %s. Set GOTOOLCHAIN to choose a toolchain explicitly.", goModPath, toolchain, findGoTool(), version, toolchain)
+	}
+}
+
+// checkGoModPruning returns an error if the go.mod file at goModPath enables
+// module graph pruning (with "go 1.17" or higher), but the go command is too
+// old to prune the module graph. Older versions of go list report the full
+// graph, so the imported go_repository rules would depend on which version
+// of Go is installed. Nothing is checked if the version of the go command
+// can't be determined.
+func checkGoModPruning(goModPath string) error {
+	data, err := ioutil.ReadFile(goModPath)
+	if err != nil {
+		return nil
+	}
+	goVersion := readGoModGoVersion(data)
+	if goVersion == "" || !goVersionAtLeast(goVersion, 17) {
+		return nil
+	}
+	toolVersion, err := goToolVersion()
+	if err != nil || toolVersion == "" || goVersionAtLeast(toolVersion, 17) {
+		return nil
+	}
+	return fmt.Errorf("%s: go %s enables module graph pruning, but %s is %s, which lists the unpruned module graph. Use Go 1.17 or newer so that the same modules are imported regardless of the installed Go version.", goModPath, goVersion, findGoTool(), toolVersion)
+}
+
+// readGoModToolchain returns the toolchain named by a toolchain directive in
+// go.mod content, or "" if there is none.
+func readGoModToolchain(data []byte) string {
+	return readGoModDirectiveArg(data, "toolchain")
+}
+
+// readGoModGoVersion returns the version named by a go directive in go.mod
+// content, for example, "1.17", or "" if there is none.
+func readGoModGoVersion(data []byte) string {
+	return readGoModDirectiveArg(data, "go")
+}
+
+// readGoModDirectiveArg returns the argument of the first directive named
+// verb with exactly one argument in go.mod content, or "" if there is none
+// or the content can't be parsed.
+func readGoModDirectiveArg(data []byte, verb string) string {
+	directives, err := parseGoMod("go.mod", data)
+	if err != nil {
+		return ""
+	}
+	for _, d := range directives {
+		if d.verb == verb && len(d.args) == 1 {
+			return d.args[0]
+		}
+	}
+	return ""
+}
+
+// goVersionAtLeast returns whether v, a Go version like "1.17", "1.17.3",
+// "go1.16.5", or "go1.21rc1", is Go 1.minor or newer. False is returned if
+// v can't be parsed.
+func goVersionAtLeast(v string, minor int) bool {
+	v = strings.TrimPrefix(v, "go")
+	if !strings.HasPrefix(v, "1.") {
+		return false
+	}
+	v = v[len("1."):]
+	end := 0
+	for end < len(v) && '0' <= v[end] && v[end] <= '9' {
+		end++
+	}
+	n, err := strconv.Atoi(v[:end])
+	return err == nil && n >= minor
+}
+
+// goSemver converts a Go release name like "go1.21.3" or "go1.22rc1" into a
+// semantic version like "v1.21.3" or "v1.22.0-rc1" for compareVersions. Text
+// after a "-" or " ", as in custom builds, is ignored.
+func goSemver(v string) string {
+	v = strings.TrimPrefix(v, "go")
+	if i := strings.IndexAny(v, "- "); i >= 0 {
+		v = v[:i]
+	}
+	var prerelease string
+	if i := strings.IndexFunc(v, func(r rune) bool { return 'a' <= r && r <= 'z' }); i >= 0 {
+		v, prerelease = v[:i], "-"+v[i:]
+	}
+	for strings.Count(v, ".") < 2 {
+		v += ".0"
+	}
+	return "v" + v + prerelease
+}
+
+// goToolVersion returns the version of the go command, for example,
+// "go1.21.3".
+var goToolVersion = func() (string, error) {
+	goTool := findGoTool()
+	out, err := exec.Command(goTool, "env", "GOVERSION").Output()
+	if err != nil {
+		return "", err
+	}
+	if v := strings.TrimSpace(string(out)); v != "" {
+		return v, nil
+	}
+	// GOVERSION was added in Go 1.16. Older versions print an empty line, so
+	// fall back to parsing "go version go1.15.2 linux/amd64".
+	out, err = exec.Command(goTool, "version").Output()
+	if err != nil {
+		return "", err
+	}
+	if fields := strings.Fields(string(out)); len(fields) >= 3 {
+		return fields[2], nil
+	}
+	return "", fmt.Errorf("could not parse output of %s version: %q", goTool, out)
+}
+
+// goListModules invokes "go list" in a directory containing a go.mod file.
+// env is a list of additional environment variables (see goCommandEnv).
+var goListModules = func(dir string, env []string) ([]byte, error) {
+	goTool := findGoTool()
+	cmd := exec.Command(goTool, "list", "-m", "-json", "all")
+	cmd.Stderr = os.Stderr
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	// The temporary directory has no vendor directory, so -mod=vendor (for
+	// example, from GOFLAGS in the environment) would make go list fail or
+	// report a different set of modules. -mod=mod was added in Go 1.14.
+	if v, err := goToolVersion(); err == nil && goVersionAtLeast(v, 14) {
+		cmd.Env = append(cmd.Env, "GOFLAGS=-mod=mod")
+	}
+	return cmd.Output()
+}
+
+// goListBuildModules invokes "go list -deps" in the main module's directory
+// and prints the path of the module providing each package needed to build
+// the packages matched by patterns, one per line. If tests is true, packages
+// needed to build their tests are included. Paths may be repeated.
+var goListBuildModules = func(dir string, env []string, tests bool, patterns []string) ([]byte, error) {
+	goTool := findGoTool()
+	args := []string{"list", "-e", "-deps", "-f", "{{with .Module}}{{.Path}}{{end}}"}
+	if tests {
+		args = append(args, "-test")
+	}
+	args = append(args, patterns...)
+	cmd := exec.Command(goTool, args...)
+	cmd.Stderr = os.Stderr
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	return cmd.Output()
+}
+
+// goModDownload invokes "go mod download" in a directory containing a
+// go.mod file. env is a list of additional environment variables.
+var goModDownload = func(dir string, args, env []string) ([]byte, error) {
+	goTool := findGoTool()
+	cmd := exec.Command(goTool, "mod", "download", "-json")
+	cmd.Args = append(cmd.Args, args...)
+	cmd.Stderr = os.Stderr
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	return cmd.Output()
+}
+
+// goModDownloadSumDB invokes "go mod download" like goModDownload, but the
+// checksum database is required to verify each module, even if it's already
+// in the module cache. The output is returned even if the command fails, since
+// it describes modules that couldn't be verified.
+var goModDownloadSumDB = func(dir string, args, env []string) ([]byte, error) {
+	goTool := findGoTool()
+	cmd := exec.Command(goTool, "mod", "download", "-json")
+	cmd.Args = append(cmd.Args, args...)
+	cmd.Stderr = os.Stderr
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), env...), sumDBEnv()...)
+	return cmd.Output()
+}
+
+// goCommandEnv returns environment variables to set, in addition to the
+// current environment, when running the go command to import modules.
+func goCommandEnv(gc *goConfig) []string {
+	var env []string
+	if gc.goModCache != "" {
+		env = append(env, "GOMODCACHE="+gc.goModCache)
+	}
+	if gc.noNetwork {
+		// go list fails instead of downloading modules that aren't in the
+		// module cache.
+		env = append(env, "GOPROXY=off")
+	}
+	return env
+}
+
+// sumDBEnv returns environment variables that force the go command to
+// verify modules with the checksum database. The go.mod copied by
+// copyGoModToTemp has no go.sum next to it, so every module is checked.
+func sumDBEnv() []string {
+	return []string{
+		"GO111MODULE=on",
+		"GOSUMDB=" + sumDB(),
+		"GONOSUMDB=",
+		"GOPRIVATE=",
+		"GOFLAGS=-mod=mod",
+	}
+}
+
+// sumDB returns the value of GOSUMDB, or the default checksum database if
+// GOSUMDB is unset or "off".
+func sumDB() string {
+	if sumDB := os.Getenv("GOSUMDB"); sumDB != "" && sumDB != "off" {
+		return sumDB
+	}
+	return "sum.golang.org"
+}
+
+// sumDBVerifiedExpr returns a string expression for a go_repository sum
+// attribute with a comment naming the checksum database that verified it.
+func sumDBVerifiedExpr(sum string) bzl.Expr {
+	// GOSUMDB may be "name+key url"; only the name is interesting.
+	name := strings.Fields(sumDB())[0]
+	if i := strings.IndexByte(name, '+'); i >= 0 {
+		name = name[:i]
+	}
+	e := &bzl.StringExpr{Value: sum}
+	e.Comments.Suffix = []bzl.Comment{{Token: "# verified by " + name}}
+	return e
+}
+
+// copyGoModToTemp copies to given go.mod file to a temporary directory.
+// go list tends to mutate go.mod files, but gazelle shouldn't do that.
+// The file is checked with checkGoMod first, so that syntax errors are
+// reported against the original file instead of the copy.
+func copyGoModToTemp(filename string) (tempDir string, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	if err := checkGoMod(filename, data); err != nil {
+		return "", err
+	}
+
+	tempDir, err = ioutil.TempDir("", "gazelle-temp-gomod")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tempDir, "go.mod"), data, 0666); err != nil {
+		os.RemoveAll(tempDir)
+		return "", err
+	}
+	return tempDir, nil
+}
+
+// goModError describes a syntax error in a go.mod file.
+type goModError struct {
+	// Filename is the path to the go.mod file.
+	Filename string
+
+	// Line is the 1-based line number where the error was found, or 0 if
+	// the error doesn't apply to a specific line.
+	Line int
+
+	// Msg describes the problem.
+	Msg string
+}
+
+func (e *goModError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Filename, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.Filename, e.Line, e.Msg)
+}
+
+// goModLineVerbs is the set of go.mod directives that may not be written as
+// blocks. Any other directive, including ones added in newer versions of
+// Go, may be.
+var goModLineVerbs = map[string]bool{
+	"module":    true,
+	"go":        true,
+	"toolchain": true,
+}
+
+// checkGoMod performs a basic syntax check of go.mod content. It checks the
+// argument counts of the directives known to Gazelle, and checks that
+// quotes and blocks are terminated. Other directives are accepted without
+// checking their arguments, so that go.mod files written for newer versions
+// of Go aren't rejected; the go command reports any problems with them.
+// A *goModError is returned for the first problem found.
+//
+// This is not a full parser; it only aims to catch mistakes before they
+// cause confusing errors from the go command.
+func checkGoMod(filename string, data []byte) error {
+	errorf := func(line int, format string, args ...interface{}) error {
+		return &goModError{Filename: filename, Line: line, Msg: fmt.Sprintf(format, args...)}
+	}
+	directives, err := parseGoMod(filename, data)
+	if err != nil {
+		return err
+	}
+	haveModule := false
+	for _, d := range directives {
+		lineNum, verb, args := d.line, d.verb, d.args
+		switch verb {
+		case "module":
+			if len(args) != 1 {
+				return errorf(lineNum, "usage: module module/path")
+			}
+			haveModule = true
+		case "go":
+			if len(args) != 1 {
+				return errorf(lineNum, "usage: go 1.23")
+			}
+		case "toolchain":
+			if len(args) != 1 {
+				return errorf(lineNum, "usage: toolchain go1.21.0")
+			}
+		case "replace":
+			arrow := -1
+			for j, arg := range args {
+				if arg == "=>" {
+					arrow = j
+					break
+				}
+			}
+			if arrow < 1 || arrow > 2 || len(args)-arrow-1 < 1 || len(args)-arrow-1 > 2 {
+				return errorf(lineNum, "usage: replace module/path [v1.2.3] => other/module v1.4 or => ../local/directory")
+			}
+		case "require", "exclude":
+			if len(args) != 2 {
+				return errorf(lineNum, "usage: %s module/path v1.2.3", verb)
+			}
+		case "retract":
+			if len(args) == 0 {
+				return errorf(lineNum, "usage: retract v1.2.3 or retract [v1.2.3, v1.3.0]")
+			}
+		case "godebug":
+			if len(args) != 1 || !strings.Contains(args[0], "=") {
+				return errorf(lineNum, "usage: godebug key=value")
+			}
+		case "tool", "ignore":
+			if len(args) != 1 {
+				return errorf(lineNum, "usage: %s path", verb)
+			}
+		}
+	}
+	if !haveModule {
+		return errorf(0, "no module directive found")
+	}
+	return nil
+}
+
+// goModDirective is a directive read from a go.mod file. Each line in a
+// block is a separate directive with the block's verb.
+type goModDirective struct {
+	// line is the 1-based line number of the directive.
+	line int
+
+	verb string
+
+	// args are the directive's arguments. Quoted strings keep their quotes;
+	// use unquoteGoModArg to remove them.
+	args []string
+
+	// indirect is true if the line ends with an "// indirect" comment.
+	indirect bool
+}
+
+// parseGoMod splits go.mod content read from filename into directives,
+// using goModTokens to split each line. It checks that quotes and blocks are
+// terminated and that directives in goModLineVerbs aren't written as
+// blocks, but not the arguments of directives. A *goModError is returned for
+// the first problem found.
+func parseGoMod(filename string, data []byte) ([]goModDirective, error) {
+	errorf := func(line int, format string, args ...interface{}) error {
+		return &goModError{Filename: filename, Line: line, Msg: fmt.Sprintf(format, args...)}
+	}
+	var directives []goModDirective
+	blockVerb, blockLine := "", 0
+	for i, line := range strings.Split(string(data), "\n") {
+		lineNum := i + 1
+		tokens, err := goModTokens(line)
+		if err != nil {
+			return nil, errorf(lineNum, "%v", err)
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+
+		var verb string
+		args := tokens
+		if blockVerb != "" {
+			if len(tokens) == 1 && tokens[0] == ")" {
+				blockVerb = ""
+				continue
+			}
+			verb = blockVerb
+		} else {
+			verb, args = tokens[0], tokens[1:]
+			if verb == ")" {
+				return nil, errorf(lineNum, "unexpected )")
+			}
+			if len(args) == 1 && args[0] == "(" {
+				if goModLineVerbs[verb] {
+					return nil, errorf(lineNum, "%s directive may not be used as a block", verb)
+				}
+				blockVerb, blockLine = verb, lineNum
+				continue
+			}
+		}
+		directives = append(directives, goModDirective{
+			line:     lineNum,
+			verb:     verb,
+			args:     args,
+			indirect: isIndirectComment(line),
+		})
+	}
+	if blockVerb != "" {
+		return nil, errorf(blockLine, "%s block is not terminated", blockVerb)
+	}
+	return directives, nil
+}
+
+// unquoteGoModArg removes quotes from a directive argument returned by
+// goModTokens. Arguments without quotes are returned unchanged.
+func unquoteGoModArg(arg string) (string, error) {
+	if strings.HasPrefix(arg, `"`) || strings.HasPrefix(arg, "`") {
+		return strconv.Unquote(arg)
+	}
+	return arg, nil
+}
+
+// goModTokens splits a line from a go.mod file into tokens. Comments are
+// removed. Quoted strings are returned as single tokens, including quotes.
+func goModTokens(line string) ([]string, error) {
+	var tokens []string
+	for {
+		line = strings.TrimLeft(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "//") {
+			return tokens, nil
+		}
+		var n int
+		switch line[0] {
+		case '"', '`':
+			n = -1
+			for j := 1; j < len(line); j++ {
+				if line[0] == '"' && line[j] == '\\' {
+					j++
+				} else if line[j] == line[0] {
+					n = j + 1
+					break
+				}
+			}
+			if n < 0 {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+		case '(', ')':
+			n = 1
+		default:
+			n = strings.IndexAny(line, " \t\r()\"`")
+			if n < 0 {
+				n = len(line)
+			}
+			if c := strings.Index(line[:n], "//"); c > 0 {
+				n = c
+			}
+		}
+		tokens = append(tokens, line[:n])
+		line = line[n:]
 	}
-	return tempDir, err
 }
 
 // findGoTool attempts to locate the go executable. If GOROOT is set, we'll
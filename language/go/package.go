@@ -24,6 +24,7 @@ import (
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
 	"github.com/bazelbuild/bazel-gazelle/language/proto"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 )
@@ -36,6 +37,9 @@ type goPackage struct {
 	proto                 protoTarget
 	hasTestdata           bool
 	importPath            string
+
+	// generates lists //go:generate directives in the package's .go files.
+	generates []goGenerate
 }
 
 // goTarget contains information used to generate an individual Go rule
@@ -43,6 +47,19 @@ type goPackage struct {
 type goTarget struct {
 	sources, imports, copts, clinkopts platformStringsBuilder
 	cgo                                bool
+
+	// cdeps contains absolute labels of cc rules that #cgo pkg-config
+	// packages and LDFLAGS -l libraries were resolved to.
+	cdeps platformStringsBuilder
+
+	// rawClinkopts is like clinkopts, but -l libraries resolved to cdeps are
+	// not removed. It's used when cdeps can't be set.
+	rawClinkopts platformStringsBuilder
+
+	// unmappedPkgConfigs and unmappedCgoLibs contain names of pkg-config
+	// packages and -l libraries that couldn't be resolved to labels. They're
+	// reported when rules are generated.
+	unmappedPkgConfigs, unmappedCgoLibs []string
 }
 
 // protoTarget contains information used to generate a go_proto_library rule.
@@ -92,6 +109,10 @@ func (pkg *goPackage) addFile(c *config.Config, info fileInfo, cgo bool) error {
 	switch {
 	case info.ext == unknownExt || !cgo && (info.ext == cExt || info.ext == csExt):
 		return nil
+	case info.isCgo && getGoConfig(c).libraryPure == "on":
+		// The package is built without cgo, so files that use it can't be
+		// compiled. C sources are skipped above since no file uses cgo.
+		return nil
 	case info.ext == protoExt:
 		if pcMode := getProtoMode(c); pcMode == proto.LegacyMode {
 			// Only add files in legacy mode. This is used to generate a filegroup
@@ -108,6 +129,21 @@ func (pkg *goPackage) addFile(c *config.Config, info fileInfo, cgo bool) error {
 		pkg.library.addFile(c, info)
 	}
 
+	for _, line := range info.goGenerates {
+		pkg.generates = append(pkg.generates, goGenerate{file: info.name, line: line})
+	}
+
+	// An import comment sets the package's import path, overriding the path
+	// inferred from the prefix. Like the go command, we ignore import comments
+	// in module mode.
+	if info.ext == goExt && info.importPath != "" && !getGoConfig(c).moduleMode {
+		if pkg.importPath == "" {
+			pkg.importPath = info.importPath
+		} else if pkg.importPath != info.importPath {
+			return fmt.Errorf("%s: import comment %q conflicts with %q in another file", info.path, info.importPath, pkg.importPath)
+		}
+	}
+
 	return nil
 }
 
@@ -152,21 +188,21 @@ func (pkg *goPackage) inferImportPath(c *config.Config) error {
 		log.Panic("importPath already set")
 	}
 	gc := getGoConfig(c)
+	if importPath, ok := gc.gopathImportPath(pkg.rel); ok {
+		pkg.importPath = importPath
+		return nil
+	}
 	if !gc.prefixSet {
 		return fmt.Errorf("%s: go prefix is not set, so importpath can't be determined for rules. Set a prefix with a '# gazelle:prefix' comment or with -go_prefix on the command line", pkg.dir)
 	}
 	pkg.importPath = inferImportPath(gc, pkg.rel)
-
-	if pkg.rel == gc.prefixRel {
-		pkg.importPath = gc.prefix
-	} else {
-		fromPrefixRel := strings.TrimPrefix(pkg.rel, gc.prefixRel+"/")
-		pkg.importPath = path.Join(gc.prefix, fromPrefixRel)
-	}
 	return nil
 }
 
 func inferImportPath(gc *goConfig, rel string) string {
+	if importPath, ok := gc.gopathImportPath(rel); ok {
+		return importPath
+	}
 	if rel == gc.prefixRel {
 		return gc.prefix
 	} else {
@@ -204,6 +240,7 @@ func goProtoImportPath(gc *goConfig, pkg proto.Package, rel string) string {
 }
 
 func (t *goTarget) addFile(c *config.Config, info fileInfo) {
+	gc := getGoConfig(c)
 	t.cgo = t.cgo || info.isCgo
 	add := getPlatformStringsAddFunction(c, info, nil)
 	add(&t.sources, info.name)
@@ -220,8 +257,65 @@ func (t *goTarget) addFile(c *config.Config, info fileInfo) {
 		if len(clinkopts.tags) > 0 {
 			optAdd = getPlatformStringsAddFunction(c, info, clinkopts.tags)
 		}
-		optAdd(&t.clinkopts, clinkopts.opts)
+		optAdd(&t.rawClinkopts, clinkopts.opts)
+		opts, libs, unmapped := splitCgoLibs(gc, clinkopts.opts)
+		if opts != "" {
+			optAdd(&t.clinkopts, opts)
+		}
+		for _, l := range libs {
+			optAdd(&t.cdeps, l.String())
+		}
+		t.unmappedCgoLibs = append(t.unmappedCgoLibs, unmapped...)
+	}
+	for _, pkgConfig := range info.pkgConfigs {
+		optAdd := add
+		if len(pkgConfig.tags) > 0 {
+			optAdd = getPlatformStringsAddFunction(c, info, pkgConfig.tags)
+		}
+		if l, ok := gc.pkgConfigLabels[pkgConfig.opts]; ok {
+			optAdd(&t.cdeps, l.String())
+		} else {
+			t.unmappedPkgConfigs = append(t.unmappedPkgConfigs, pkgConfig.opts)
+		}
+	}
+}
+
+// splitCgoLibs removes -l flags for libraries mapped with
+// # gazelle:resolve_cgo_lib directives from opts, a group of LDFLAGS joined
+// with optSeparator. The remaining options and the labels of the mapped
+// libraries are returned. If any libraries are mapped, names of other -l
+// libraries are returned as unmapped, so they can be reported.
+func splitCgoLibs(gc *goConfig, opts string) (string, []label.Label, []string) {
+	if len(gc.cgoLibLabels) == 0 {
+		return opts, nil, nil
+	}
+	var kept, unmapped []string
+	var libs []label.Label
+	split := strings.Split(opts, optSeparator)
+	for i := 0; i < len(split); i++ {
+		opt := split[i]
+		var name string
+		switch {
+		case opt == "-l" && i+1 < len(split):
+			name = split[i+1]
+		case strings.HasPrefix(opt, "-l") && len(opt) > len("-l"):
+			name = opt[len("-l"):]
+		default:
+			kept = append(kept, opt)
+			continue
+		}
+		l, ok := gc.cgoLibLabels[name]
+		if !ok {
+			unmapped = append(unmapped, name)
+			kept = append(kept, opt)
+			continue
+		}
+		libs = append(libs, l)
+		if opt == "-l" {
+			i++
+		}
 	}
+	return strings.Join(kept, optSeparator), libs, unmapped
 }
 
 func protoTargetFromProtoPackage(name string, pkg proto.Package) protoTarget {
@@ -0,0 +1,148 @@
+/* Copyright 2019 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package golang
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"sort"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// repoAttrsRule sets attributes on generated go_repository rules whose
+// importpath matches pattern. Rules are created by flags like -build_file
+// and read from the file named with -repo_attrs_file.
+type repoAttrsRule struct {
+	pattern string
+	attrs   map[string]interface{}
+
+	// appendLists is set for rules created by repeatable list flags like
+	// -environ. Their list values are added to the attribute instead of
+	// replacing it.
+	appendLists bool
+}
+
+// readRepoAttrsFile reads a JSON object mapping importpath patterns to
+// objects of go_repository attributes, for example:
+//
+//	{
+//	  "golang.org/x/*": {"build_naming_convention": "go_default_library"}
+//	}
+//
+// Patterns use the syntax of path.Match. Rules are returned in the order they
+// appear in the file, since later matching rules override earlier ones.
+// Attribute values may be strings, booleans, integers, or lists of strings.
+func readRepoAttrsFile(filename string) ([]repoAttrsRule, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode tokens at the top level instead of decoding into a map, which
+	// would lose the order of patterns.
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf("%s: expected an object mapping importpath patterns to attributes", filename)
+	}
+	var rules []repoAttrsRule
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		pattern := tok.(string)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid importpath pattern %q: %v", filename, pattern, err)
+		}
+		var rawAttrs map[string]interface{}
+		if err := dec.Decode(&rawAttrs); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", filename, pattern, err)
+		}
+		attrs := make(map[string]interface{})
+		for key, raw := range rawAttrs {
+			if key == "name" || key == "importpath" {
+				return nil, fmt.Errorf("%s: %s: attribute %q may not be set", filename, pattern, key)
+			}
+			value, err := repoAttrValue(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: attribute %q: %v", filename, pattern, key, err)
+			}
+			attrs[key] = value
+		}
+		rules = append(rules, repoAttrsRule{pattern: pattern, attrs: attrs})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return rules, nil
+}
+
+// repoAttrValue converts a value decoded from JSON to a value that may be
+// passed to rule.SetAttr.
+func repoAttrValue(raw interface{}) (interface{}, error) {
+	switch v := raw.(type) {
+	case string, bool:
+		return v, nil
+	case float64:
+		if v != math.Trunc(v) {
+			return nil, fmt.Errorf("number %v is not an integer", v)
+		}
+		return int(v), nil
+	case []interface{}:
+		strs := make([]string, 0, len(v))
+		for _, elem := range v {
+			s, ok := elem.(string)
+			if !ok {
+				return nil, fmt.Errorf("lists may only contain strings")
+			}
+			strs = append(strs, s)
+		}
+		return strs, nil
+	default:
+		return nil, fmt.Errorf("value must be a string, boolean, integer, or list of strings")
+	}
+}
+
+// applyRepoAttrs sets attributes from every rule whose pattern matches the
+// importpath of r, in order, so the last matching rule wins for each
+// attribute.
+func applyRepoAttrs(rules []repoAttrsRule, r *rule.Rule) {
+	importPath := r.AttrString("importpath")
+	for _, ar := range rules {
+		if ok, _ := path.Match(ar.pattern, importPath); !ok {
+			continue
+		}
+		keys := make([]string, 0, len(ar.attrs))
+		for key := range ar.attrs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := ar.attrs[key]
+			if list, ok := value.([]string); ok && ar.appendLists {
+				value = append(r.AttrStrings(key), list...)
+			}
+			r.SetAttr(key, value)
+		}
+	}
+}
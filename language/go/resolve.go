@@ -19,10 +19,18 @@ import (
 	"errors"
 	"fmt"
 	"go/build"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
 	"log"
+	"os"
 	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/label"
@@ -30,6 +38,7 @@ import (
 	"github.com/bazelbuild/bazel-gazelle/repo"
 	"github.com/bazelbuild/bazel-gazelle/resolve"
 	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 func (_ *goLang) Imports(_ *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
@@ -67,12 +76,26 @@ func (gl *goLang) Resolve(c *config.Config, ix *resolve.RuleIndex, rc *repo.Remo
 	}
 	imports := importsRaw.(rule.PlatformStrings)
 	r.DelAttr("deps")
-	resolve := ResolveGo
-	if r.Kind() == "go_proto_library" {
-		resolve = resolveProto
-	}
+	verbose := getGoConfig(c).verboseResolve
 	deps, errs := imports.Map(func(imp string) (string, error) {
-		l, err := resolve(c, ix, rc, imp, from)
+		var l label.Label
+		var err error
+		var tr *resolveTrace
+		if verbose {
+			tr = &resolveTrace{}
+		}
+		if r.Kind() == "go_proto_library" {
+			l, err = resolveProto(c, ix, rc, imp, from)
+			tr.setSource("proto")
+		} else if tl, ok := getGoConfig(c).testResolves[imp]; ok && r.Kind() == "go_test" {
+			l = tl
+			tr.setSource("test directive")
+		} else {
+			l, err = resolveGo(c, ix, rc, imp, from, tr)
+		}
+		if tr != nil {
+			logResolveTrace(c, imp, from, l, err, tr)
+		}
 		if err == skipImportError {
 			return "", nil
 		} else if err != nil {
@@ -83,12 +106,33 @@ func (gl *goLang) Resolve(c *config.Config, ix *resolve.RuleIndex, rc *repo.Remo
 				return "", nil
 			}
 		}
+		// A library for a main package imported from another package can't be
+		// private.
+		if ml, ok := gl.mainLibs[l]; ok && l.Pkg != from.Pkg {
+			ml.r.SetAttr("visibility", ml.visibility)
+		}
 		l = l.Rel(from.Repo, from.Pkg)
 		return l.String(), nil
 	})
 	for _, err := range errs {
 		log.Print(err)
 	}
+	// Several imports may resolve to the same label, for example, with
+	// resolve_prefix directives.
+	deps, _ = deps.MapSlice(func(ls []string) ([]string, error) {
+		seen := make(map[string]bool)
+		unique := ls[:0]
+		for _, l := range ls {
+			if !seen[l] {
+				seen[l] = true
+				unique = append(unique, l)
+			}
+		}
+		return unique, nil
+	})
+	if r.Kind() == "go_library" {
+		deps = addKeepDeps(getGoConfig(c).keepDeps, deps, from)
+	}
 	if !deps.IsEmpty() {
 		if r.Kind() == "go_proto_library" {
 			// protos may import the same library multiple times by different names,
@@ -101,6 +145,120 @@ func (gl *goLang) Resolve(c *config.Config, ix *resolve.RuleIndex, rc *repo.Remo
 	}
 }
 
+// logResolveTrace logs how imp was resolved from the rule with label from,
+// for -verbose_resolve. Each line starts with the import path, so output may
+// be filtered with grep.
+func logResolveTrace(c *config.Config, imp string, from label.Label, l label.Label, err error, tr *resolveTrace) {
+	var result string
+	switch {
+	case err == skipImportError:
+		result = "skipped"
+	case err != nil:
+		result = "error: " + err.Error()
+	default:
+		result = l.String()
+	}
+	msg := fmt.Sprintf("resolve %q from %s: %s (%s)", imp, from, result, tr.source)
+	if len(tr.candidates) > 0 {
+		msg += "; candidates: " + strings.Join(tr.candidates, ", ")
+	}
+	c.Infof("%s", msg)
+}
+
+// UnresolvedImports returns imports of r that can't be resolved to a library
+// in this repository or in a repository declared in WORKSPACE, grouped by
+// the source files that import them. Imports that aren't found in any source
+// file are listed under the label of r. This is used by the list-unresolved
+// command.
+func (_ *goLang) UnresolvedImports(c *config.Config, ix *resolve.RuleIndex, rc *repo.RemoteCache, r *rule.Rule, importsRaw interface{}, from label.Label) map[string][]string {
+	if importsRaw == nil || r.Kind() == "go_proto_library" {
+		return nil
+	}
+	knownRepos := map[string]bool{"": true, c.RepoName: true}
+	for _, repoRule := range c.Repos {
+		knownRepos[repoRule.Name()] = true
+	}
+	imports := importsRaw.(rule.PlatformStrings)
+	var unresolved []string
+	for _, imp := range imports.Flat() {
+		l, err := ResolveGo(c, ix, rc, imp, from)
+		if err == skipImportError || err == nil && knownRepos[l.Repo] {
+			continue
+		}
+		unresolved = append(unresolved, imp)
+	}
+	if len(unresolved) == 0 {
+		return nil
+	}
+
+	want := make(map[string]bool)
+	for _, imp := range unresolved {
+		want[imp] = true
+	}
+	var srcs []string
+	if expr := r.Attr("srcs"); expr != nil {
+		bzl.Walk(expr, func(x bzl.Expr, _ []bzl.Expr) {
+			if s, ok := x.(*bzl.StringExpr); ok && strings.HasSuffix(s.Value, ".go") {
+				srcs = append(srcs, s.Value)
+			}
+		})
+	}
+	byFile := make(map[string][]string)
+	found := make(map[string]bool)
+	fset := token.NewFileSet()
+	dir := filepath.Join(c.RepoRoot, filepath.FromSlash(from.Pkg))
+	for _, src := range srcs {
+		pf, err := parser.ParseFile(fset, filepath.Join(dir, src), nil, parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+		for _, spec := range pf.Imports {
+			imp, err := strconv.Unquote(spec.Path.Value)
+			if err != nil || !want[imp] {
+				continue
+			}
+			file := path.Join(from.Pkg, src)
+			byFile[file] = append(byFile[file], imp)
+			found[imp] = true
+		}
+	}
+	for _, imp := range unresolved {
+		if !found[imp] {
+			byFile[from.String()] = append(byFile[from.String()], imp)
+		}
+	}
+	return byFile
+}
+
+// addKeepDeps adds labels set with # gazelle:go_keep_dep to the generic
+// deps of a library, unless they're already present or refer to the
+// library itself.
+func addKeepDeps(keepDeps []label.Label, deps rule.PlatformStrings, from label.Label) rule.PlatformStrings {
+	if len(keepDeps) == 0 {
+		return deps
+	}
+	present := make(map[string]bool)
+	for _, dep := range deps.Generic {
+		present[dep] = true
+	}
+	added := false
+	for _, l := range keepDeps {
+		if l.Equal(from) {
+			continue
+		}
+		dep := l.Rel(from.Repo, from.Pkg).String()
+		if !present[dep] {
+			present[dep] = true
+			deps.Generic = append(deps.Generic, dep)
+			added = true
+		}
+	}
+	if added {
+		sort.Strings(deps.Generic)
+	}
+	return deps
+}
+
 var (
 	skipImportError = errors.New("std or self import")
 	notFoundError   = errors.New("rule not found")
@@ -113,6 +271,28 @@ var (
 // This may be used directly by other language extensions related to Go
 // (gomock). Gazelle calls Language.Resolve instead.
 func ResolveGo(c *config.Config, ix *resolve.RuleIndex, rc *repo.RemoteCache, imp string, from label.Label) (label.Label, error) {
+	return resolveGo(c, ix, rc, imp, from, nil)
+}
+
+// resolveTrace records how an import was resolved, for -verbose_resolve.
+type resolveTrace struct {
+	// source describes where the resolved label came from, for example,
+	// "index" or "external".
+	source string
+
+	// candidates are labels of indexed rules that provide the import.
+	candidates []string
+}
+
+func (tr *resolveTrace) setSource(source string) {
+	if tr != nil {
+		tr.source = source
+	}
+}
+
+// resolveGo is ResolveGo, but records how the import was resolved in tr if
+// tr is not nil.
+func resolveGo(c *config.Config, ix *resolve.RuleIndex, rc *repo.RemoteCache, imp string, from label.Label, tr *resolveTrace) (label.Label, error) {
 	gc := getGoConfig(c)
 	pcMode := getProtoMode(c)
 	if build.IsLocalImport(imp) {
@@ -124,14 +304,22 @@ func ResolveGo(c *config.Config, ix *resolve.RuleIndex, rc *repo.RemoteCache, im
 	}
 
 	if IsStandard(imp) {
+		tr.setSource("stdlib")
 		return label.NoLabel, skipImportError
 	}
 
 	if l, ok := resolve.FindRuleWithOverride(c, resolve.ImportSpec{Lang: "go", Imp: imp}, "go"); ok {
+		tr.setSource("directive")
+		// A resolve_prefix directive may cover the rule's own package, for
+		// example, when a single library provides a tree of packages.
+		if l.Equal(from) {
+			return label.NoLabel, skipImportError
+		}
 		return l, nil
 	}
 
 	if pcMode.ShouldUseKnownImports() {
+		tr.setSource("known proto import")
 		// These are commonly used libraries that depend on Well Known Types.
 		// They depend on the generated versions of these protos to avoid conflicts.
 		// However, since protoc-gen-go depends on these libraries, we generate
@@ -157,16 +345,37 @@ func ResolveGo(c *config.Config, ix *resolve.RuleIndex, rc *repo.RemoteCache, im
 		}
 	}
 
+	if gc.caseInsensitiveFS {
+		imp = chooseImportCase(c, ix, imp, from)
+	}
+
+	if tr != nil {
+		for _, m := range ix.FindRulesByImport(resolve.ImportSpec{Lang: "go", Imp: imp}, "go") {
+			tr.candidates = append(tr.candidates, m.Label.String())
+		}
+	}
+	tr.setSource("index")
 	if l, err := resolveWithIndexGo(ix, imp, from); err == nil || err == skipImportError {
 		return l, err
 	} else if err != notFoundError {
 		return label.NoLabel, err
 	}
 
+	// Packages built from generated sources aren't indexed, since there are no
+	// source files for Gazelle to generate rules from.
+	if l, ok := gc.generatedPackages[imp]; ok {
+		tr.setSource("generated package")
+		if l.Equal(from) {
+			return label.NoLabel, skipImportError
+		}
+		return l, nil
+	}
+
 	// Special cases for rules_go and bazel_gazelle.
 	// These have names that don't following conventions and they're
 	// typeically declared with http_archive, not go_repository, so Gazelle
 	// won't recognize them.
+	tr.setSource("special case")
 	if pathtools.HasPrefix(imp, "github.com/bazelbuild/rules_go") {
 		pkg := pathtools.TrimPrefix(imp, "github.com/bazelbuild/rules_go")
 		return label.New("io_bazel_rules_go", pkg, "go_default_library"), nil
@@ -175,18 +384,49 @@ func ResolveGo(c *config.Config, ix *resolve.RuleIndex, rc *repo.RemoteCache, im
 		return label.New("bazel_gazelle", pkg, "go_default_library"), nil
 	}
 
-	if !c.IndexLibraries {
-		// packages in current repo were not indexed, relying on prefix to decide what may have been in
+	// Packages in other modules in this repository are built from source here,
+	// not from external repositories.
+	if modulePath, rel, ok := gc.findLocalModule(imp); ok {
+		tr.setSource("local module")
+		pkg := path.Join(rel, pathtools.TrimPrefix(imp, modulePath))
+		return localLibraryLabel(c, pkg, imp), nil
+	}
+
+	if l, ok := gc.findWorkspaceRoot(imp); ok {
+		tr.setSource("workspace root")
+		return l, nil
+	}
+
+	if !c.IndexLibraries || c.LazyIndex {
+		// packages in current repo were not indexed (or with a lazy index, may
+		// not have been), relying on prefix to decide what may have been in
 		// current repo
 		if pathtools.HasPrefix(imp, gc.prefix) {
+			tr.setSource("prefix")
 			pkg := path.Join(gc.prefixRel, pathtools.TrimPrefix(imp, gc.prefix))
 			return label.New("", pkg, defaultLibName), nil
 		}
+		// In a GOPATH-style tree, imports of directories that exist under src
+		// are resolved there. Other imports are external.
+		if gc.gopathLayout {
+			pkg := path.Join(gc.gopathRel, "src", imp)
+			if fi, err := os.Stat(filepath.Join(c.RepoRoot, filepath.FromSlash(pkg))); err == nil && fi.IsDir() {
+				tr.setSource("gopath layout")
+				return label.New("", pkg, defaultLibName), nil
+			}
+		}
+	}
+
+	if gc.isVendoredImport(imp) {
+		tr.setSource("vendored")
+		return resolveVendored(rc, imp)
 	}
 
 	if gc.depMode == externalMode {
-		return resolveExternal(gc.moduleMode, rc, imp)
+		tr.setSource("external")
+		return resolveExternal(gc, rc, imp)
 	} else {
+		tr.setSource("vendored")
 		return resolveVendored(rc, imp)
 	}
 }
@@ -201,7 +441,7 @@ func resolveWithIndexGo(ix *resolve.RuleIndex, imp string, from label.Label) (la
 	var bestMatch resolve.FindResult
 	var bestMatchIsVendored bool
 	var bestMatchVendorRoot string
-	var matchError error
+	var ambiguous []string
 
 	for _, m := range matches {
 		// Apply vendoring logic for Go libraries. A library in a vendor directory
@@ -229,17 +469,19 @@ func resolveWithIndexGo(ix *resolve.RuleIndex, imp string, from label.Label) (la
 			bestMatch = m
 			bestMatchIsVendored = isVendored
 			bestMatchVendorRoot = vendorRoot
-			matchError = nil
+			ambiguous = nil
 		} else if (!isVendored && bestMatchIsVendored) || (isVendored && len(vendorRoot) < len(bestMatchVendorRoot)) {
 			// Current match is worse
 		} else {
 			// Match is ambiguous
-			// TODO: consider listing all the ambiguous rules here.
-			matchError = fmt.Errorf("rule %s imports %q which matches multiple rules: %s and %s. # gazelle:resolve may be used to disambiguate", from, imp, bestMatch.Label, m.Label)
+			if ambiguous == nil {
+				ambiguous = []string{bestMatch.Label.String()}
+			}
+			ambiguous = append(ambiguous, m.Label.String())
 		}
 	}
-	if matchError != nil {
-		return label.NoLabel, matchError
+	if ambiguous != nil {
+		return label.NoLabel, ambiguousImportError(from, imp, ambiguous)
 	}
 	if bestMatch.Label.Equal(label.NoLabel) {
 		return label.NoLabel, notFoundError
@@ -250,9 +492,79 @@ func resolveWithIndexGo(ix *resolve.RuleIndex, imp string, from label.Label) (la
 	return bestMatch.Label, nil
 }
 
+// chooseImportCase returns the casing of imp that should be looked up in the
+// index when the repository is on a case-insensitive file system. Libraries
+// with import paths that differ only in case may be generated from the same
+// directory there, so only one of them is used. The import path with the same
+// casing as the prefix is preferred, then imp itself, then the first import
+// path in sorted order.
+func chooseImportCase(c *config.Config, ix *resolve.RuleIndex, imp string, from label.Label) string {
+	gc := getGoConfig(c)
+	variants := ix.FindImportCaseVariants(resolve.ImportSpec{Lang: "go", Imp: imp})
+	switch len(variants) {
+	case 0:
+		return imp
+	case 1:
+		return variants[0].Imp
+	}
+
+	chosen := ""
+	if gc.prefix != "" {
+		for _, v := range variants {
+			if pathtools.HasPrefix(v.Imp, gc.prefix) {
+				chosen = v.Imp
+				break
+			}
+		}
+	}
+	if chosen == "" {
+		for _, v := range variants {
+			if v.Imp == imp {
+				chosen = imp
+				break
+			}
+		}
+	}
+	if chosen == "" {
+		chosen = variants[0].Imp
+	}
+
+	imps := make([]string, len(variants))
+	for i, v := range variants {
+		imps[i] = strconv.Quote(v.Imp)
+	}
+	c.Debugf("%s: import %q matches libraries with import paths that differ only in case: %s. Using %q.", from, imp, strings.Join(imps, ", "), chosen)
+	return chosen
+}
+
+// isCaseInsensitiveDir returns whether dir is on a case-insensitive file
+// system. This is checked by looking up dir with the case of its base name
+// swapped. If dir has no letters in its base name, false is returned.
+func isCaseInsensitiveDir(dir string) bool {
+	base := filepath.Base(dir)
+	swapped := strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, base)
+	if swapped == base {
+		return false
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return false
+	}
+	swappedFi, err := os.Stat(filepath.Join(filepath.Dir(dir), swapped))
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, swappedFi)
+}
+
 var modMajorRex = regexp.MustCompile(`/v\d+(?:/|$)`)
 
-func resolveExternal(moduleMode bool, rc *repo.RemoteCache, imp string) (label.Label, error) {
+func resolveExternal(gc *goConfig, rc *repo.RemoteCache, imp string) (label.Label, error) {
 	// If we're in module mode, use "go list" to find the module path and
 	// repository name. Otherwise, use special cases (for github.com, golang.org)
 	// or send a GET with ?go-get=1 to find the root. If the path contains
@@ -261,6 +573,7 @@ func resolveExternal(moduleMode bool, rc *repo.RemoteCache, imp string) (label.L
 	// Eventually module mode will be the only mode. But for now, it's expensive
 	// and not the common case, especially when known repositories aren't
 	// listed in WORKSPACE (which is currently the case within go_repository).
+	moduleMode := gc.moduleMode
 	if !moduleMode {
 		moduleMode = pathWithoutSemver(imp) != ""
 	}
@@ -285,9 +598,54 @@ func resolveExternal(moduleMode bool, rc *repo.RemoteCache, imp string) (label.L
 		pkg = pathtools.TrimPrefix(impWithoutSemver, prefix)
 	}
 
+	// Libraries in repositories with hand-written build files may have
+	// non-default names, listed in a manifest.
+	if l, ok := gc.repoManifests[repo][pkg]; ok {
+		l.Repo = repo
+		return l, nil
+	}
+
 	return label.New(repo, pkg, defaultLibName), nil
 }
 
+// localLibraryLabel returns the label of the library for imp in the
+// directory pkg of this repository, which may not have been indexed. If the
+// build file there declares a go_library with importpath imp, that library is
+// used, even if it doesn't have the name Gazelle would generate.
+func localLibraryLabel(c *config.Config, pkg, imp string) label.Label {
+	dir := filepath.Join(c.RepoRoot, filepath.FromSlash(pkg))
+	if files, err := ioutil.ReadDir(dir); err == nil {
+		if buildPath := rule.MatchBuildFileName(dir, c.ValidBuildFileNames, files); buildPath != "" {
+			if f, err := rule.LoadFile(buildPath, pkg); err == nil {
+				for _, r := range f.Rules {
+					if isGoLibrary(r.Kind()) && r.AttrString("importpath") == imp {
+						return label.New("", pkg, r.Name())
+					}
+				}
+			}
+		}
+	}
+	return label.New("", pkg, defaultLibName)
+}
+
+// findWorkspaceRoot returns the label of the library for imp in another
+// workspace, set with # gazelle:resolve_workspace_root. If several import
+// prefixes match, the longest one is used.
+func (gc *goConfig) findWorkspaceRoot(imp string) (label.Label, bool) {
+	var best *workspaceRoot
+	for i := range gc.workspaceRoots {
+		wr := &gc.workspaceRoots[i]
+		if pathtools.HasPrefix(imp, wr.importPrefix) && (best == nil || len(wr.importPrefix) > len(best.importPrefix)) {
+			best = wr
+		}
+	}
+	if best == nil {
+		return label.NoLabel, false
+	}
+	pkg := path.Join(best.pkg, pathtools.TrimPrefix(imp, best.importPrefix))
+	return label.New(best.repo, pkg, defaultLibName), true
+}
+
 func resolveVendored(rc *repo.RemoteCache, imp string) (label.Label, error) {
 	return label.New("", path.Join("vendor", imp), defaultLibName), nil
 }
@@ -300,6 +658,9 @@ func resolveProto(c *config.Config, ix *resolve.RuleIndex, rc *repo.RemoteCache,
 	}
 
 	if l, ok := resolve.FindRuleWithOverride(c, resolve.ImportSpec{Lang: "proto", Imp: imp}, "go"); ok {
+		if l.Equal(from) {
+			return label.NoLabel, skipImportError
+		}
 		return l, nil
 	}
 
@@ -350,13 +711,26 @@ var wellKnownProtos = map[string]bool{
 	"google/protobuf/wrappers.proto":        true,
 }
 
+// ambiguousImportError returns an error for an import that's provided by
+// more than one rule, listing all of them. This usually means the same
+// importpath was declared in multiple packages, for example, after one was
+// copied during a refactor.
+func ambiguousImportError(from label.Label, imp string, labels []string) error {
+	sort.Strings(labels)
+	return fmt.Errorf("rule %s imports %q which matches multiple rules: %s. Each importpath should be declared in only one package; # gazelle:resolve may be used to disambiguate", from, imp, strings.Join(labels, ", "))
+}
+
 func resolveWithIndexProto(ix *resolve.RuleIndex, imp string, from label.Label) (label.Label, error) {
 	matches := ix.FindRulesByImport(resolve.ImportSpec{Lang: "proto", Imp: imp}, "go")
 	if len(matches) == 0 {
 		return label.NoLabel, notFoundError
 	}
 	if len(matches) > 1 {
-		return label.NoLabel, fmt.Errorf("multiple rules (%s and %s) may be imported with %q from %s", matches[0].Label, matches[1].Label, imp, from)
+		labels := make([]string, len(matches))
+		for i, m := range matches {
+			labels[i] = m.Label.String()
+		}
+		return label.NoLabel, ambiguousImportError(from, imp, labels)
 	}
 	if matches[0].IsSelfImport(from) {
 		return label.NoLabel, skipImportError
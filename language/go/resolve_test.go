@@ -16,7 +16,10 @@ limitations under the License.
 package golang
 
 import (
+	"bytes"
 	"fmt"
+	"log"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -26,6 +29,7 @@ import (
 	"github.com/bazelbuild/bazel-gazelle/repo"
 	"github.com/bazelbuild/bazel-gazelle/resolve"
 	"github.com/bazelbuild/bazel-gazelle/rule"
+	"github.com/bazelbuild/bazel-gazelle/testtools"
 	bzl "github.com/bazelbuild/buildtools/build"
 	"golang.org/x/tools/go/vcs"
 )
@@ -131,6 +135,114 @@ go_library(
     importpath = "a",
     deps = ["//:good"],
 )
+`,
+		}, {
+			desc: "override_prefix",
+			index: []buildFile{{
+				content: `
+# gazelle:resolve_prefix go example.com/legacy/ //legacy:lib
+# gazelle:resolve_prefix go example.com/legacy/special //legacy/special:lib
+# gazelle:resolve go example.com/legacy/special/exact //:exact
+`,
+			}},
+			old: buildFile{
+				rel: "test",
+				content: `
+go_library(
+    name = "a",
+    importpath = "a",
+    _imports = [
+        "example.com/legacy",
+        "example.com/legacy/foo/bar",
+        "example.com/legacy/special/x",
+        "example.com/legacy/special/exact",
+        "example.com/legacyother",
+    ],
+)
+`,
+			},
+			want: `
+go_library(
+    name = "a",
+    importpath = "a",
+    deps = [
+        "//:exact",
+        "//legacy:lib",
+        "//legacy/special:lib",
+        "//vendor/example.com/legacyother:go_default_library",
+    ],
+)
+`,
+		}, {
+			desc: "override_prefix_self",
+			index: []buildFile{{
+				content: `
+# gazelle:resolve_prefix go example.com/legacy/ //legacy:lib
+`,
+			}},
+			old: buildFile{
+				rel: "legacy",
+				content: `
+go_library(
+    name = "lib",
+    importpath = "example.com/legacy",
+    _imports = [
+        "example.com/legacy/x",
+        "example.com/legacy/y",
+    ],
+)
+`,
+			},
+			want: `
+go_library(
+    name = "lib",
+    importpath = "example.com/legacy",
+)
+`,
+		}, {
+			desc: "workspace_root",
+			index: []buildFile{{
+				content: `
+# gazelle:resolve_workspace_root @sibling // example.com/sibling
+# gazelle:resolve_workspace_root @tools //go/src example.com/sibling/tools
+`,
+			}, {
+				rel: "local",
+				content: `
+go_library(
+    name = "go_default_library",
+    importpath = "example.com/sibling/indexed",
+)
+`,
+			}},
+			old: buildFile{
+				rel: "test",
+				content: `
+go_library(
+    name = "a",
+    importpath = "a",
+    _imports = [
+        "example.com/sibling",
+        "example.com/sibling/foo/bar",
+        "example.com/sibling/indexed",
+        "example.com/sibling/tools/lint",
+        "example.com/siblingother",
+    ],
+)
+`,
+			},
+			want: `
+go_library(
+    name = "a",
+    importpath = "a",
+    deps = [
+        "//local:go_default_library",
+        "//vendor/example.com/siblingother:go_default_library",
+        "@sibling//:go_default_library",
+        "@sibling//foo/bar:go_default_library",
+        "@tools//go/src/lint:go_default_library",
+    ],
+)
 `,
 		}, {
 			desc: "same_package",
@@ -1159,6 +1271,258 @@ func TestResolveExternal(t *testing.T) {
 	}
 }
 
+func TestResolveExternalManifest(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{{
+		Path: "third_party/repo.manifest",
+		Content: `
+# Hand-written targets in @com_example_repo.
+. //:repo
+lib //lib:custom_lib
+`,
+	}})
+	defer cleanup()
+
+	c, langs, cexts := testConfig(
+		t,
+		"-go_prefix=example.com/local",
+		"-repo_root="+dir)
+	f, err := rule.LoadData(filepath.Join(dir, "BUILD.bazel"), "", []byte("# gazelle:go_repository_manifest com_example_repo third_party/repo.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cext := range cexts {
+		cext.Configure(c, "", f)
+	}
+	ix := resolve.NewRuleIndex(nil)
+	ix.Finish()
+	gl := langs[1].(*goLang)
+	rc := testRemoteCache(nil)
+	for _, tc := range []struct {
+		importpath, want string
+	}{
+		{importpath: "example.com/repo", want: "@com_example_repo//:repo"},
+		{importpath: "example.com/repo/lib", want: "@com_example_repo//lib:custom_lib"},
+		{importpath: "example.com/repo/other", want: "@com_example_repo//other:go_default_library"},
+	} {
+		t.Run(tc.importpath, func(t *testing.T) {
+			r := rule.NewRule("go_library", "x")
+			imports := rule.PlatformStrings{Generic: []string{tc.importpath}}
+			gl.Resolve(c, ix, rc, r, imports, label.New("", "", "x"))
+			deps := r.AttrStrings("deps")
+			if len(deps) != 1 {
+				t.Fatalf("deps: got %d; want 1", len(deps))
+			}
+			if deps[0] != tc.want {
+				t.Errorf("got %s; want %s", deps[0], tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveVendoredModules(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{{
+		Path: "vendor/modules.txt",
+		Content: `# example.com/repo v1.0.0
+## explicit
+example.com/repo
+example.com/repo/lib
+# example.com/replaced v1.2.0 => example.com/fork v1.2.1
+example.com/replaced/sub
+`,
+	}})
+	defer cleanup()
+
+	c, langs, _ := testConfig(
+		t,
+		"-go_prefix=example.com/local",
+		"-repo_root="+dir,
+		"-vendor")
+	ix := resolve.NewRuleIndex(nil)
+	ix.Finish()
+	gl := langs[1].(*goLang)
+	rc := testRemoteCache(nil)
+	for _, tc := range []struct {
+		importpath, want string
+	}{
+		{importpath: "example.com/repo", want: "//vendor/example.com/repo:go_default_library"},
+		{importpath: "example.com/repo/lib", want: "//vendor/example.com/repo/lib:go_default_library"},
+		{importpath: "example.com/replaced/sub", want: "//vendor/example.com/replaced/sub:go_default_library"},
+		{importpath: "example.com/repo.git/x", want: "@com_example_repo_git//x:go_default_library"},
+	} {
+		t.Run(tc.importpath, func(t *testing.T) {
+			r := rule.NewRule("go_library", "x")
+			imports := rule.PlatformStrings{Generic: []string{tc.importpath}}
+			gl.Resolve(c, ix, rc, r, imports, label.New("", "", "x"))
+			deps := r.AttrStrings("deps")
+			if len(deps) != 1 {
+				t.Fatalf("deps: got %d; want 1", len(deps))
+			}
+			if deps[0] != tc.want {
+				t.Errorf("got %s; want %s", deps[0], tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveAmbiguous(t *testing.T) {
+	c, langs, _ := testConfig(t, "-go_prefix=example.com/repo")
+	mrslv := make(mapResolver)
+	for _, lang := range langs {
+		for kind := range lang.Kinds() {
+			mrslv[kind] = lang
+		}
+	}
+	ix := resolve.NewRuleIndex(mrslv.Resolver)
+	for _, rel := range []string{"old", "new", "newer"} {
+		f, err := rule.LoadData(filepath.Join(rel, "BUILD.bazel"), rel, []byte(`
+go_library(
+    name = "go_default_library",
+    importpath = "example.com/repo/lib",
+)
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range f.Rules {
+			ix.AddRule(c, r, f)
+		}
+	}
+	ix.Finish()
+
+	_, err := resolveWithIndexGo(ix, "example.com/repo/lib", label.New("", "bin", "bin"))
+	if err == nil {
+		t.Fatal("got success; want error")
+	}
+	want := "matches multiple rules: //new:go_default_library, //newer:go_default_library, //old:go_default_library."
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q; want error containing %q", err, want)
+	}
+}
+
+func TestResolveVerbose(t *testing.T) {
+	c, langs, cexts := testConfig(t, "-go_prefix=example.com/repo", "-verbose_resolve")
+	mrslv := make(mapResolver)
+	for _, lang := range langs {
+		for kind := range lang.Kinds() {
+			mrslv[kind] = lang
+		}
+	}
+	ix := resolve.NewRuleIndex(mrslv.Resolver)
+	f, err := rule.LoadData("lib/BUILD.bazel", "lib", []byte(`
+# gazelle:resolve go example.com/override //override:lib
+
+go_library(
+    name = "go_default_library",
+    importpath = "example.com/repo/lib",
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range f.Rules {
+		ix.AddRule(c, r, f)
+	}
+	ix.Finish()
+	for _, cext := range cexts {
+		cext.Configure(c, "lib", f)
+	}
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	gl := langs[1].(*goLang)
+	r := rule.NewRule("go_binary", "bin")
+	imports := rule.PlatformStrings{Generic: []string{
+		"fmt",
+		"example.com/override",
+		"example.com/repo/lib",
+		"github.com/pkg/errors",
+	}}
+	gl.Resolve(c, ix, testRemoteCache(nil), r, imports, label.New("", "cmd", "bin"))
+
+	logs := logBuf.String()
+	for _, want := range []string{
+		`resolve "fmt" from //cmd:bin: skipped (stdlib)`,
+		`resolve "example.com/override" from //cmd:bin: //override:lib (directive)`,
+		`resolve "example.com/repo/lib" from //cmd:bin: //lib:go_default_library (index); candidates: //lib:go_default_library`,
+		`resolve "github.com/pkg/errors" from //cmd:bin: @com_github_pkg_errors//:go_default_library (external)`,
+	} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("log does not contain %q:\n%s", want, logs)
+		}
+	}
+}
+
+func TestResolveCaseInsensitive(t *testing.T) {
+	c, langs, _ := testConfig(t, "-go_prefix=example.com/Repo")
+	getGoConfig(c).caseInsensitiveFS = true
+	mrslv := make(mapResolver)
+	for _, lang := range langs {
+		for kind := range lang.Kinds() {
+			mrslv[kind] = lang
+		}
+	}
+	ix := resolve.NewRuleIndex(mrslv.Resolver)
+	for _, bf := range []struct{ rel, content string }{
+		{
+			rel: "lib",
+			content: `
+go_library(
+    name = "go_default_library",
+    importpath = "example.com/Repo/lib",
+)
+`,
+		}, {
+			rel: "old/lib",
+			content: `
+go_library(
+    name = "go_default_library",
+    importpath = "example.com/repo/lib",
+)
+`,
+		}, {
+			rel: "other",
+			content: `
+go_library(
+    name = "go_default_library",
+    importpath = "example.com/Other",
+)
+`,
+		},
+	} {
+		f, err := rule.LoadData(filepath.Join(filepath.FromSlash(bf.rel), "BUILD.bazel"), bf.rel, []byte(bf.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range f.Rules {
+			ix.AddRule(c, r, f)
+		}
+	}
+	ix.Finish()
+	gl := langs[1].(*goLang)
+	rc := testRemoteCache(nil)
+	for _, tc := range []struct {
+		importpath, want string
+	}{
+		{importpath: "example.com/repo/lib", want: "//lib:go_default_library"},
+		{importpath: "example.com/Repo/lib", want: "//lib:go_default_library"},
+		{importpath: "example.com/other", want: "//other:go_default_library"},
+	} {
+		t.Run(tc.importpath, func(t *testing.T) {
+			r := rule.NewRule("go_library", "x")
+			imports := rule.PlatformStrings{Generic: []string{tc.importpath}}
+			gl.Resolve(c, ix, rc, r, imports, label.New("", "", "x"))
+			deps := r.AttrStrings("deps")
+			if len(deps) != 1 {
+				t.Fatalf("deps: got %d; want 1", len(deps))
+			}
+			if deps[0] != tc.want {
+				t.Errorf("got %s; want %s", deps[0], tc.want)
+			}
+		})
+	}
+}
+
 func testRemoteCache(knownRepos []repo.Repo) *repo.RemoteCache {
 	rc, _ := repo.NewRemoteCache(knownRepos)
 	rc.RepoRootForImportPath = stubRepoRootForImportPath
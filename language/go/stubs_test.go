@@ -21,7 +21,7 @@ func init() {
 	goModDownload = goModDownloadStub
 }
 
-func goListModulesStub(dir string) ([]byte, error) {
+func goListModulesStub(dir string, env []string) ([]byte, error) {
 	return []byte(`{
 	"Path": "github.com/bazelbuild/bazel-gazelle",
 	"Main": true,
@@ -98,7 +98,7 @@ func goListModulesStub(dir string) ([]byte, error) {
 `), nil
 }
 
-func goModDownloadStub(dir string, args []string) ([]byte, error) {
+func goModDownloadStub(dir string, args, env []string) ([]byte, error) {
 	return []byte(`{
 	"Path": "golang.org/x/tools",
 	"Version": "v0.0.0-20190122202912-9c309ee22fab",
@@ -0,0 +1 @@
+package protos_multiple_go_packages
@@ -16,10 +16,12 @@ limitations under the License.
 package golang
 
 import (
+	"errors"
 	"path/filepath"
 	"sort"
 	"strings"
 
+	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/language"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 	"golang.org/x/sync/errgroup"
@@ -30,6 +32,9 @@ import (
 // (in the same format as 'go get'). If no version is specified, @latest
 // is requested.
 func (*goLang) UpdateRepos(args language.UpdateReposArgs) language.UpdateReposResult {
+	if getGoConfig(args.Config).requireSumDB {
+		return language.UpdateReposResult{Error: errRequireSumDBFromFile}
+	}
 	gen := make([]*rule.Rule, len(args.Imports))
 	var eg errgroup.Group
 	for i := range args.Imports {
@@ -48,7 +53,7 @@ func (*goLang) UpdateRepos(args language.UpdateReposArgs) language.UpdateReposRe
 			gen[i].SetAttr("importpath", modPath)
 			gen[i].SetAttr("version", version)
 			gen[i].SetAttr("sum", sum)
-			setBuildAttrs(getGoConfig(args.Config), gen[i])
+			setBuildAttrs(args.Config, gen[i])
 			return nil
 		})
 	}
@@ -58,20 +63,39 @@ func (*goLang) UpdateRepos(args language.UpdateReposArgs) language.UpdateReposRe
 	return language.UpdateReposResult{Gen: gen}
 }
 
+var errRequireSumDBFromFile = errors.New("-require_sumdb may only be used when importing from go.mod with -from_file")
+
 var repoImportFuncs = map[string]func(args language.ImportReposArgs) language.ImportReposResult{
 	"Gopkg.lock":  importReposFromDep,
 	"go.mod":      importReposFromModules,
 	"Godeps.json": importReposFromGodep,
 }
 
+// repoImportFuncsByExt is checked for files whose names aren't in
+// repoImportFuncs. These formats don't have conventional file names.
+var repoImportFuncsByExt = map[string]func(args language.ImportReposArgs) language.ImportReposResult{
+	".csv": importReposFromTable,
+	".tsv": importReposFromTable,
+}
+
+func repoImportFunc(path string) func(args language.ImportReposArgs) language.ImportReposResult {
+	if fn, ok := repoImportFuncs[filepath.Base(path)]; ok {
+		return fn
+	}
+	return repoImportFuncsByExt[filepath.Ext(path)]
+}
+
 func (*goLang) CanImport(path string) bool {
-	return repoImportFuncs[filepath.Base(path)] != nil
+	return repoImportFunc(path) != nil
 }
 
 func (*goLang) ImportRepos(args language.ImportReposArgs) language.ImportReposResult {
-	res := repoImportFuncs[filepath.Base(args.Path)](args)
+	if getGoConfig(args.Config).requireSumDB && filepath.Base(args.Path) != "go.mod" {
+		return language.ImportReposResult{Error: errRequireSumDBFromFile}
+	}
+	res := repoImportFunc(args.Path)(args)
 	for _, r := range res.Gen {
-		setBuildAttrs(getGoConfig(args.Config), r)
+		setBuildAttrs(args.Config, r)
 	}
 	if args.Prune {
 		genNamesSet := make(map[string]bool)
@@ -88,7 +112,8 @@ func (*goLang) ImportRepos(args language.ImportReposArgs) language.ImportReposRe
 	return res
 }
 
-func setBuildAttrs(gc *goConfig, r *rule.Rule) {
+func setBuildAttrs(c *config.Config, r *rule.Rule) {
+	gc := getGoConfig(c)
 	if gc.buildExternalAttr != "" {
 		r.SetAttr("build_external", gc.buildExternalAttr)
 	}
@@ -105,9 +130,10 @@ func setBuildAttrs(gc *goConfig, r *rule.Rule) {
 		r.SetAttr("build_file_proto_mode", gc.buildFileProtoModeAttr)
 	}
 	if gc.buildExtraArgsAttr != "" {
-		extraArgs := strings.Split(gc.buildExtraArgsAttr, ",")
-		r.SetAttr("build_extra_args", extraArgs)
+		r.SetAttr("build_extra_args", strings.Split(gc.buildExtraArgsAttr, ","))
 	}
+	applyRepoAttrs(gc.repoAttrs, r)
+	gc.directivesPolicy.apply(c, r)
 }
 
 func sortRules(rules []*rule.Rule) {
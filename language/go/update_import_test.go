@@ -16,7 +16,13 @@ limitations under the License.
 package golang
 
 import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -303,6 +309,49 @@ go_repository(
     commit = "748d386b5c1ea99658fd69fe9f03991ce86a90c1",
     importpath = "github.com/golang/protobuf",
 )
+`,
+		}, {
+			desc: "tsv",
+			files: []testtools.FileSpec{{
+				Path: "deps.tsv",
+				Content: `
+# Exported from another tool.
+importpath	version	sum	name
+golang.org/x/net	v0.0.0-20190311183353-d8887717615a	h1:oWX7TPOiFAMXLq8o0ikBYfCJVlRHBcsciT5bXOrH628=	
+golang.org/x/text	v0.3.0	h1:g61tztE5qeGQ89tm6NTjjM9VPIm088od1l6aSorWRWg=	custom_text
+`,
+			}},
+			want: `
+go_repository(
+    name = "custom_text",
+    importpath = "golang.org/x/text",
+    sum = "h1:g61tztE5qeGQ89tm6NTjjM9VPIm088od1l6aSorWRWg=",
+    version = "v0.3.0",
+)
+
+go_repository(
+    name = "org_golang_x_net",
+    importpath = "golang.org/x/net",
+    sum = "h1:oWX7TPOiFAMXLq8o0ikBYfCJVlRHBcsciT5bXOrH628=",
+    version = "v0.0.0-20190311183353-d8887717615a",
+)
+`,
+		}, {
+			desc: "csv",
+			files: []testtools.FileSpec{{
+				Path: "deps.csv",
+				Content: `
+Version,ImportPath,Sum,Source
+v0.3.0,golang.org/x/text,h1:g61tztE5qeGQ89tm6NTjjM9VPIm088od1l6aSorWRWg=,"exported, by hand"
+`,
+			}},
+			want: `
+go_repository(
+    name = "org_golang_x_text",
+    importpath = "golang.org/x/text",
+    sum = "h1:g61tztE5qeGQ89tm6NTjjM9VPIm088od1l6aSorWRWg=",
+    version = "v0.3.0",
+)
 `,
 		},
 	} {
@@ -341,3 +390,2655 @@ go_repository(
 		})
 	}
 }
+
+func TestEnvironAttr(t *testing.T) {
+	gc := newGoConfig()
+	c := config.New()
+	c.Exts[goName] = gc
+	f := &repoAttrFlag{rules: &gc.repoAttrs, attr: "environ", list: singleList}
+	for _, v := range []string{
+		"golang.org/x/*=CGO_CFLAGS=-O2",
+		"example.com/foo=FOO=1",
+		"golang.org/x/sys=CGO_ENABLED=0",
+	} {
+		if err := f.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Set("golang.org/x/sys"); err == nil {
+		t.Error("got success setting flag without value; want error")
+	}
+
+	r := rule.NewRule("go_repository", "org_golang_x_sys")
+	r.SetAttr("importpath", "golang.org/x/sys")
+	setBuildAttrs(c, r)
+	got := r.AttrStrings("environ")
+	want := []string{"CGO_CFLAGS=-O2", "CGO_ENABLED=0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got environ %q; want %q", got, want)
+	}
+
+	r = rule.NewRule("go_repository", "com_example_bar")
+	r.SetAttr("importpath", "example.com/bar")
+	setBuildAttrs(c, r)
+	if r.Attr("environ") != nil {
+		t.Errorf("got environ %q; want none", r.AttrStrings("environ"))
+	}
+}
+
+func TestBuildExtraArgsAttr(t *testing.T) {
+	gc := newGoConfig()
+	c := config.New()
+	c.Exts[goName] = gc
+	f := &repoAttrFlag{rules: &gc.repoAttrs, attr: "build_extra_args", all: &gc.buildExtraArgsAttr, list: commaList}
+	for _, v := range []string{
+		"-exclude=testdata",
+		"example.com/*=-go_naming_convention=import",
+		"example.com/foo=-build_tags=foo,-index=false",
+	} {
+		if err := f.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		importpath string
+		want       []string
+	}{
+		{
+			importpath: "example.com/foo",
+			want:       []string{"-exclude=testdata", "-go_naming_convention=import", "-build_tags=foo", "-index=false"},
+		}, {
+			importpath: "example.com/bar",
+			want:       []string{"-exclude=testdata", "-go_naming_convention=import"},
+		}, {
+			importpath: "golang.org/x/sys",
+			want:       []string{"-exclude=testdata"},
+		},
+	} {
+		r := rule.NewRule("go_repository", "")
+		r.SetAttr("importpath", tc.importpath)
+		setBuildAttrs(c, r)
+		if got := r.AttrStrings("build_extra_args"); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got build_extra_args %q; want %q", tc.importpath, got, tc.want)
+		}
+	}
+}
+
+func TestBuildFileGenerationAttr(t *testing.T) {
+	gc := newGoConfig()
+	c := config.New()
+	c.Exts[goName] = gc
+	f := &repoAttrFlag{rules: &gc.repoAttrs, attr: "build_file_generation", all: &gc.buildFileGenerationAttr, allowed: validBuildFileGenerationAttr}
+	for _, v := range []string{
+		"off",
+		"example.com/*=auto",
+		"example.com/foo=on",
+	} {
+		if err := f.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Set("example.com/bar=sometimes"); err == nil {
+		t.Error("invalid mode: got success; want error")
+	}
+
+	for _, tc := range []struct {
+		importpath, want string
+	}{
+		{importpath: "example.com/foo", want: "on"},
+		{importpath: "example.com/bar", want: "auto"},
+		{importpath: "golang.org/x/sys", want: "off"},
+	} {
+		r := rule.NewRule("go_repository", "")
+		r.SetAttr("importpath", tc.importpath)
+		setBuildAttrs(c, r)
+		if got := r.AttrString("build_file_generation"); got != tc.want {
+			t.Errorf("%s: got build_file_generation %q; want %q", tc.importpath, got, tc.want)
+		}
+	}
+}
+
+func TestBuildFileProtoModeAttr(t *testing.T) {
+	gc := newGoConfig()
+	c := config.New()
+	c.Exts[goName] = gc
+	f := &repoAttrFlag{rules: &gc.repoAttrs, attr: "build_file_proto_mode", all: &gc.buildFileProtoModeAttr, allowed: validBuildFileProtoModeAttr}
+	for _, v := range []string{
+		"default",
+		"example.com/*=disable_global",
+		"example.com/foo=package",
+	} {
+		if err := f.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Set("example.com/bar=regenerate"); err == nil {
+		t.Error("invalid mode: got success; want error")
+	}
+
+	for _, tc := range []struct {
+		importpath, want string
+	}{
+		{importpath: "example.com/foo", want: "package"},
+		{importpath: "example.com/bar", want: "disable_global"},
+		{importpath: "golang.org/x/sys", want: "default"},
+	} {
+		r := rule.NewRule("go_repository", "")
+		r.SetAttr("importpath", tc.importpath)
+		setBuildAttrs(c, r)
+		if got := r.AttrString("build_file_proto_mode"); got != tc.want {
+			t.Errorf("%s: got build_file_proto_mode %q; want %q", tc.importpath, got, tc.want)
+		}
+	}
+
+	// Manually set values are preserved when generated rules are merged.
+	gen := rule.NewRule("go_repository", "com_example_bar")
+	gen.SetAttr("importpath", "example.com/bar")
+	setBuildAttrs(c, gen)
+	old := rule.NewRule("go_repository", "com_example_bar")
+	old.SetAttr("importpath", "example.com/bar")
+	old.SetAttr("build_file_proto_mode", "legacy")
+	rule.MergeRules(gen, old, goKinds["go_repository"].MergeableAttrs, "WORKSPACE")
+	if got := old.AttrString("build_file_proto_mode"); got != "legacy" {
+		t.Errorf("after merge: got build_file_proto_mode %q; want %q", got, "legacy")
+	}
+}
+
+func TestPrePatchesAttr(t *testing.T) {
+	gc := newGoConfig()
+	c := config.New()
+	c.Exts[goName] = gc
+	f := &repoAttrFlag{rules: &gc.repoAttrs, attr: "pre_patches", list: commaList}
+	for _, v := range []string{
+		"example.com/*=//patches:all.patch",
+		"example.com/foo=//patches:foo1.patch,//patches:foo2.patch",
+	} {
+		if err := f.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		importpath string
+		want       []string
+	}{
+		{importpath: "example.com/foo", want: []string{"//patches:all.patch", "//patches:foo1.patch", "//patches:foo2.patch"}},
+		{importpath: "example.com/bar", want: []string{"//patches:all.patch"}},
+		{importpath: "golang.org/x/sys"},
+	} {
+		r := rule.NewRule("go_repository", "")
+		r.SetAttr("importpath", tc.importpath)
+		setBuildAttrs(c, r)
+		if got := r.AttrStrings("pre_patches"); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got pre_patches %q; want %q", tc.importpath, got, tc.want)
+		}
+	}
+
+	// Manually set patches are preserved when generated rules are merged.
+	gen := rule.NewRule("go_repository", "com_example_bar")
+	gen.SetAttr("importpath", "example.com/bar")
+	setBuildAttrs(c, gen)
+	old := rule.NewRule("go_repository", "com_example_bar")
+	old.SetAttr("importpath", "example.com/bar")
+	old.SetAttr("pre_patches", []string{"//patches:manual.patch"})
+	rule.MergeRules(gen, old, goKinds["go_repository"].MergeableAttrs, "WORKSPACE")
+	if got, want := old.AttrStrings("pre_patches"), []string{"//patches:manual.patch"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after merge: got pre_patches %q; want %q", got, want)
+	}
+}
+
+func TestBuildFileAttr(t *testing.T) {
+	gc := newGoConfig()
+	c := config.New()
+	c.Exts[goName] = gc
+	f := &repoAttrFlag{rules: &gc.repoAttrs, attr: "build_file"}
+	for _, v := range []string{
+		"example.com/*=//third_party/overrides:BUILD.example",
+		"example.com/foo=//third_party/overrides:BUILD.foo",
+	} {
+		if err := f.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		importpath, want string
+	}{
+		{importpath: "example.com/foo", want: "//third_party/overrides:BUILD.foo"},
+		{importpath: "example.com/bar", want: "//third_party/overrides:BUILD.example"},
+		{importpath: "golang.org/x/sys"},
+	} {
+		r := rule.NewRule("go_repository", "")
+		r.SetAttr("importpath", tc.importpath)
+		setBuildAttrs(c, r)
+		if got := r.AttrString("build_file"); got != tc.want {
+			t.Errorf("%s: got build_file %q; want %q", tc.importpath, got, tc.want)
+		}
+	}
+
+	// Manually set build files are preserved when generated rules are merged.
+	gen := rule.NewRule("go_repository", "com_example_bar")
+	gen.SetAttr("importpath", "example.com/bar")
+	setBuildAttrs(c, gen)
+	old := rule.NewRule("go_repository", "com_example_bar")
+	old.SetAttr("importpath", "example.com/bar")
+	old.SetAttr("build_file", "//third_party:BUILD.manual")
+	rule.MergeRules(gen, old, goKinds["go_repository"].MergeableAttrs, "WORKSPACE")
+	if got, want := old.AttrString("build_file"), "//third_party:BUILD.manual"; got != want {
+		t.Errorf("after merge: got build_file %q; want %q", got, want)
+	}
+}
+
+func TestRepoAttrsFile(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "attrs.json",
+			Content: `{
+  "golang.org/x/*": {
+    "build_naming_convention": "go_default_library",
+    "build_directives": ["gazelle:exclude testdata"],
+    "patch_args": ["-p1"]
+  },
+  "golang.org/x/tools": {"build_file_generation": "off", "patch_args": ["-p0"]},
+  "example.com/*": {"build_file_proto_mode": "disable"}
+}`,
+		}, {
+			Path:    "bad_value.json",
+			Content: `{"example.com/*": {"patch_args": [1]}}`,
+		}, {
+			Path:    "bad_name.json",
+			Content: `{"example.com/*": {"name": "x"}}`,
+		},
+	})
+	defer cleanup()
+
+	gc := newGoConfig()
+	c := config.New()
+	c.Exts[goName] = gc
+	gc.buildFileGenerationAttr = "on"
+	f := &repoAttrFlag{rules: &gc.repoAttrs, attr: "build_file_proto_mode", all: &gc.buildFileProtoModeAttr, allowed: validBuildFileProtoModeAttr}
+	if err := f.Set("example.com/foo=package"); err != nil {
+		t.Fatal(err)
+	}
+	fileAttrs, err := readRepoAttrsFile(filepath.Join(dir, "attrs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc.repoAttrs = append(gc.repoAttrs, fileAttrs...)
+
+	for _, tc := range []struct {
+		importpath string
+		want       map[string]interface{}
+	}{
+		{
+			// Later patterns override earlier ones.
+			importpath: "golang.org/x/tools",
+			want: map[string]interface{}{
+				"build_file_generation":   "off",
+				"build_naming_convention": "go_default_library",
+				"build_directives":        []string{"gazelle:exclude testdata"},
+				"patch_args":              []string{"-p0"},
+			},
+		}, {
+			importpath: "golang.org/x/sys",
+			want: map[string]interface{}{
+				"build_file_generation":   "on",
+				"build_naming_convention": "go_default_library",
+				"build_directives":        []string{"gazelle:exclude testdata"},
+				"patch_args":              []string{"-p1"},
+			},
+		}, {
+			// The file overrides flags.
+			importpath: "example.com/foo",
+			want: map[string]interface{}{
+				"build_file_generation": "on",
+				"build_file_proto_mode": "disable",
+			},
+		},
+	} {
+		r := rule.NewRule("go_repository", "")
+		r.SetAttr("importpath", tc.importpath)
+		setBuildAttrs(c, r)
+		got := make(map[string]interface{})
+		for _, key := range r.AttrKeys() {
+			if key == "name" || key == "importpath" {
+				continue
+			}
+			if s := r.AttrString(key); s != "" {
+				got[key] = s
+			} else {
+				got[key] = r.AttrStrings(key)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got attrs %v; want %v", tc.importpath, got, tc.want)
+		}
+	}
+
+	for _, name := range []string{"bad_value.json", "bad_name.json"} {
+		if _, err := readRepoAttrsFile(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s: got success; want error", name)
+		}
+	}
+}
+
+func TestDirectivesPolicy(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "policy.json",
+			Content: `{
+  "example.com": ["gazelle:go_naming_convention import"],
+  "example.com/platform/": ["gazelle:proto disable", "gazelle:exclude testdata"],
+  "example.com/attrs": ["gazelle:exclude docs"]
+}`,
+		}, {
+			Path:    "attrs.json",
+			Content: `{"example.com/attrs": {"build_directives": ["gazelle:exclude tools"]}}`,
+		}, {
+			Path:    "bad.json",
+			Content: `{"example.com": ["exclude testdata"]}`,
+		},
+	})
+	defer cleanup()
+
+	gc := newGoConfig()
+	c := config.New()
+	c.Exts[goName] = gc
+	gc.repoAttrs = []repoAttrsRule{{pattern: "example.com/platform/flagged", attrs: map[string]interface{}{"build_file_proto_mode": "default"}}}
+	var err error
+	gc.directivesPolicy, err = readDirectivesPolicy(filepath.Join(dir, "policy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileAttrs, err := readRepoAttrsFile(filepath.Join(dir, "attrs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc.repoAttrs = append(gc.repoAttrs, fileAttrs...)
+
+	for _, tc := range []struct {
+		importpath string
+		want       []string
+	}{
+		{
+			importpath: "example.com/platform/foo",
+			want:       []string{"gazelle:go_naming_convention import", "gazelle:proto disable", "gazelle:exclude testdata"},
+		}, {
+			// The proto mode set with a flag wins.
+			importpath: "example.com/platform/flagged",
+			want:       []string{"gazelle:go_naming_convention import", "gazelle:exclude testdata"},
+		}, {
+			// Prefixes match whole path components.
+			importpath: "example.com/platformer",
+			want:       []string{"gazelle:go_naming_convention import"},
+		}, {
+			// build_directives set with flags win.
+			importpath: "example.com/attrs",
+			want:       []string{"gazelle:exclude tools"},
+		}, {
+			importpath: "golang.org/x/sys",
+		},
+	} {
+		r := rule.NewRule("go_repository", "")
+		r.SetAttr("importpath", tc.importpath)
+		setBuildAttrs(c, r)
+		if got := r.AttrStrings("build_directives"); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got build_directives %q; want %q", tc.importpath, got, tc.want)
+		}
+	}
+
+	if _, err := readDirectivesPolicy(filepath.Join(dir, "bad.json")); err == nil {
+		t.Error("bad.json: got success; want error")
+	}
+}
+
+func TestImportsTableMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		desc, content string
+		wantErrs      []string
+	}{
+		{
+			desc:     "missing_columns",
+			content:  "importpath\tversion\n",
+			wantErrs: []string{"deps.tsv:1: header is missing required columns: sum"},
+		}, {
+			desc:     "empty",
+			content:  "# nothing here\n",
+			wantErrs: []string{"deps.tsv: missing header row"},
+		}, {
+			desc: "bad_rows",
+			content: `importpath	version	sum
+example.com/a	v1.0.0	h1:a=
+example.com/b	v1.0.0
+example.com/c	master	h1:c=
+example.com/a	v1.1.0	md5:a
+`,
+			wantErrs: []string{
+				"deps.tsv:3: got 2 columns; want 3",
+				`deps.tsv:4: version "master" is not a module version`,
+				`deps.tsv:5: example.com/a is already listed on line 2; sum "md5:a" is not an h1: hash`,
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{{
+				Path:    "deps.tsv",
+				Content: tc.content,
+			}})
+			defer cleanup()
+
+			c := &config.Config{Exts: map[string]interface{}{}}
+			gl := NewLanguage()
+			gl.Configure(c, "", nil)
+			result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+				Config: c,
+				Path:   filepath.Join(dir, "deps.tsv"),
+			})
+			if result.Error == nil {
+				t.Fatal("got success; want error")
+			}
+			got := strings.Replace(result.Error.Error(), dir+string(filepath.Separator), "", -1)
+			for _, want := range tc.wantErrs {
+				if !strings.Contains(got, want) {
+					t.Errorf("got error:\n%s\nwant error containing %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestImportsValidateReplaces(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require (
+	example.com/good v1.0.0
+	example.com/bad v1.0.0
+)
+
+replace (
+	example.com/good => example.com/goodfork v1.1.0
+	example.com/bad => example.com/nonexistent v1.1.0
+)
+`,
+		},
+	})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{
+	"Path": "example.com/m",
+	"Main": true
+}
+{
+	"Path": "example.com/bad",
+	"Version": "v1.0.0",
+	"Replace": {
+		"Path": "example.com/nonexistent",
+		"Version": "v1.1.0"
+	}
+}
+{
+	"Path": "example.com/good",
+	"Version": "v1.0.0",
+	"Replace": {
+		"Path": "example.com/goodfork",
+		"Version": "v1.1.0"
+	}
+}
+`), nil
+	}
+	oldDownload := goModDownload
+	defer func() { goModDownload = oldDownload }()
+	goModDownload = func(dir string, args, env []string) ([]byte, error) {
+		return []byte(`{
+	"Path": "example.com/nonexistent",
+	"Version": "v1.1.0",
+	"Error": "unrecognized import path"
+}
+{
+	"Path": "example.com/goodfork",
+	"Version": "v1.1.0",
+	"Sum": "h1:goodfork"
+}
+`), fmt.Errorf("exit status 1")
+	}
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	getGoConfig(c).validateReplaces = true
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error == nil {
+		t.Fatal("got success; want error")
+	}
+	want := "example.com/nonexistent@v1.1.0 (replacing example.com/bad@v1.0.0): unrecognized import path"
+	if !strings.Contains(result.Error.Error(), want) {
+		t.Errorf("got error %q; want error containing %q", result.Error, want)
+	}
+	if strings.Contains(result.Error.Error(), "goodfork") {
+		t.Errorf("got error %q; want no error for example.com/goodfork", result.Error)
+	}
+	if len(result.Gen) > 0 {
+		t.Errorf("got %d rules; want none", len(result.Gen))
+	}
+}
+
+func TestCheckGoToolchain(t *testing.T) {
+	if old, ok := os.LookupEnv("GOTOOLCHAIN"); ok {
+		defer os.Setenv("GOTOOLCHAIN", old)
+	} else {
+		defer os.Unsetenv("GOTOOLCHAIN")
+	}
+	oldVersion := goToolVersion
+	defer func() { goToolVersion = oldVersion }()
+	goToolVersion = func() (string, error) { return "go1.21.0", nil }
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tc := range []struct {
+		desc, content, goToolchain string
+		wantWarning                bool
+	}{
+		{
+			desc:    "no_toolchain",
+			content: "module example.com/m\n\ngo 1.21\n",
+		}, {
+			desc:    "same_toolchain",
+			content: "module example.com/m\n\ngo 1.21\n\ntoolchain go1.21.0\n",
+		}, {
+			desc:        "newer_toolchain",
+			content:     "module example.com/m\n\ngo 1.21\n\ntoolchain go1.21.3 // comment\n",
+			wantWarning: true,
+		}, {
+			desc:    "older_toolchain",
+			content: "module example.com/m\n\ngo 1.20\n\ntoolchain go1.20.3\n",
+		}, {
+			desc:    "release_candidate_toolchain",
+			content: "module example.com/m\n\ngo 1.21\n\ntoolchain go1.21rc3\n",
+		}, {
+			desc:        "gotoolchain_set",
+			content:     "module example.com/m\n\ngo 1.21\n\ntoolchain go1.21.3\n",
+			goToolchain: "local",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{{Path: "go.mod", Content: tc.content}})
+			defer cleanup()
+			if tc.goToolchain != "" {
+				os.Setenv("GOTOOLCHAIN", tc.goToolchain)
+			} else {
+				os.Unsetenv("GOTOOLCHAIN")
+			}
+			logBuf.Reset()
+
+			checkGoToolchain(&config.Config{}, filepath.Join(dir, "go.mod"))
+			want := "is requested"
+			if got := strings.Contains(logBuf.String(), want); got != tc.wantWarning {
+				t.Errorf("got log %q; want warning %v", logBuf.String(), tc.wantWarning)
+			}
+		})
+	}
+}
+
+func TestCheckGoModPruning(t *testing.T) {
+	oldVersion := goToolVersion
+	defer func() { goToolVersion = oldVersion }()
+
+	for _, tc := range []struct {
+		desc, content, toolVersion string
+		wantErr                    bool
+	}{
+		{
+			desc:        "no_go_directive",
+			content:     "module example.com/m\n",
+			toolVersion: "go1.16.5",
+		}, {
+			desc:        "unpruned",
+			content:     "module example.com/m\n\ngo 1.16\n",
+			toolVersion: "go1.16.5",
+		}, {
+			desc:        "pruned_new_go",
+			content:     "module example.com/m\n\ngo 1.17\n",
+			toolVersion: "go1.21rc1",
+		}, {
+			desc:        "pruned_old_go",
+			content:     "module example.com/m\n\ngo 1.17\n",
+			toolVersion: "go1.16.5",
+			wantErr:     true,
+		}, {
+			desc:        "pruned_patch_version",
+			content:     "module example.com/m\n\ngo 1.21.3\n",
+			toolVersion: "go1.9",
+			wantErr:     true,
+		}, {
+			desc:    "unknown_go",
+			content: "module example.com/m\n\ngo 1.17\n",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{{Path: "go.mod", Content: tc.content}})
+			defer cleanup()
+			goToolVersion = func() (string, error) {
+				if tc.toolVersion == "" {
+					return "", fmt.Errorf("no go")
+				}
+				return tc.toolVersion, nil
+			}
+
+			err := checkGoModPruning(filepath.Join(dir, "go.mod"))
+			if got := err != nil; got != tc.wantErr {
+				t.Errorf("got error %v; want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckGoMod(t *testing.T) {
+	for _, tc := range []struct {
+		desc, content, wantErr string
+	}{
+		{
+			desc: "valid",
+			content: `module "example.com/m" // comment
+
+go 1.12
+
+toolchain go1.21.3
+
+require (
+	github.com/pkg/errors v0.8.1
+	golang.org/x/tools v0.0.0-20190122202912-9c309ee22fab // indirect
+)
+
+replace github.com/pkg/errors => github.com/pkg/errors v0.8.0
+replace golang.org/x/tools v0.0.0-20190122202912-9c309ee22fab => ../tools
+
+exclude (
+	github.com/pkg/errors v0.7.0
+)
+
+godebug default=go1.21
+
+godebug (
+	panicnil=1
+	asynctimerchan=0
+)
+
+tool golang.org/x/tools/cmd/stringer
+
+tool (
+	example.com/m/cmd/gen
+)
+
+ignore ./node_modules
+
+ignore (
+	./testdata/big
+)
+`,
+		}, {
+			desc:    "unknown_directive",
+			content: "module example.com/m\n\nfuture (\n\tsome args\n)\nfuture other args\n",
+		}, {
+			desc:    "bad_godebug",
+			content: "module example.com/m\n\ngodebug (\n\tpanicnil\n)\n",
+			wantErr: "go.mod:4: usage: godebug key=value",
+		}, {
+			desc:    "bad_require",
+			content: "module example.com/m\n\nrequire (\n\tgithub.com/pkg/errors\n)\n",
+			wantErr: "go.mod:4: usage: require module/path v1.2.3",
+		}, {
+			desc:    "bad_replace",
+			content: "module example.com/m\n\nreplace github.com/pkg/errors v0.8.1\n",
+			wantErr: "go.mod:3: usage: replace",
+		}, {
+			desc:    "unterminated_block",
+			content: "module example.com/m\n\nrequire (\n\tgithub.com/pkg/errors v0.8.1\n",
+			wantErr: "go.mod:3: require block is not terminated",
+		}, {
+			desc:    "unterminated_quote",
+			content: "module \"example.com/m\n",
+			wantErr: "go.mod:1: unterminated quoted string",
+		}, {
+			desc:    "module_block",
+			content: "module (\n\texample.com/m\n)\n",
+			wantErr: "go.mod:1: module directive may not be used as a block",
+		}, {
+			desc:    "no_module",
+			content: "go 1.12\n",
+			wantErr: "go.mod: no module directive found",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := checkGoMod("go.mod", []byte(tc.content))
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got no error; want %q", tc.wantErr)
+			}
+			if _, ok := err.(*goModError); !ok {
+				t.Errorf("got error of type %T; want *goModError", err)
+			}
+			if !strings.HasPrefix(err.Error(), tc.wantErr) {
+				t.Errorf("got error %q; want prefix %q", err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadGoMod(t *testing.T) {
+	content := `module "example.com/m" // comment
+
+go 1.17
+
+require "github.com/pkg/errors" v0.8.1 // indirect; for tests
+
+require (
+	golang.org/x/tools v0.1.0
+	// require example.com/commented v1.0.0
+)
+
+replace golang.org/x/tools => ../tools
+`
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{{Path: "go.mod", Content: content}})
+	defer cleanup()
+	goModPath := filepath.Join(dir, "go.mod")
+
+	if modulePath, err := readModulePath(goModPath); err != nil {
+		t.Error(err)
+	} else if modulePath != "example.com/m" {
+		t.Errorf("got module path %q; want %q", modulePath, "example.com/m")
+	}
+	if got := readGoModGoVersion([]byte(content)); got != "1.17" {
+		t.Errorf("got go version %q; want %q", got, "1.17")
+	}
+
+	requires, hasReplace, err := readGoModRequires(goModPath, []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRequires := []goModRequire{
+		{path: "github.com/pkg/errors", version: "v0.8.1", indirect: true},
+		{path: "golang.org/x/tools", version: "v0.1.0"},
+	}
+	if !reflect.DeepEqual(requires, wantRequires) {
+		t.Errorf("got requires %#v; want %#v", requires, wantRequires)
+	}
+	if !hasReplace {
+		t.Error("got hasReplace false; want true")
+	}
+
+	_, _, err = readGoModRequires(goModPath, []byte("module example.com/m\n\nrequire (\n"))
+	if _, ok := err.(*goModError); !ok {
+		t.Errorf("unterminated block: got error %v; want *goModError", err)
+	}
+}
+
+func TestCopyGoModToTempMalformed(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{{
+		Path:    "go.mod",
+		Content: "module example.com/m\n\nrequire github.com/pkg/errors\n",
+	}})
+	defer cleanup()
+
+	goModPath := filepath.Join(dir, "go.mod")
+	tempDir, err := copyGoModToTemp(goModPath)
+	if err == nil {
+		os.RemoveAll(tempDir)
+		t.Fatal("got no error; want error for malformed go.mod")
+	}
+	want := goModPath + ":3: "
+	if !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("got error %q; want prefix %q", err.Error(), want)
+	}
+}
+
+func TestImportsRequireSumDB(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module github.com/bazelbuild/bazel-gazelle
+
+require gopkg.in/yaml.v2 v2.2.2
+`,
+		}, {
+			Path:    "go.sum",
+			Content: "gopkg.in/yaml.v2 v2.2.2 h1:untrusted\n",
+		},
+	})
+	defer cleanup()
+
+	for _, tc := range []struct {
+		desc, failPath, wantErr string
+	}{
+		{
+			desc: "verified",
+		}, {
+			desc:     "unverified",
+			failPath: "gopkg.in/yaml.v2",
+			wantErr:  "gopkg.in/yaml.v2@v2.2.2",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			oldDownload := goModDownloadSumDB
+			defer func() { goModDownloadSumDB = oldDownload }()
+			goModDownloadSumDB = func(dir string, args, env []string) ([]byte, error) {
+				buf := &strings.Builder{}
+				for _, arg := range args {
+					i := strings.IndexByte(arg, '@')
+					path, version := arg[:i], arg[i+1:]
+					if path == tc.failPath {
+						fmt.Fprintf(buf, `{"Path": %q, "Version": %q, "Error": "verifying module: checksum mismatch"}`+"\n", path, version)
+					} else {
+						fmt.Fprintf(buf, `{"Path": %q, "Version": %q, "Sum": "h1:verified"}`+"\n", path, version)
+					}
+				}
+				return []byte(buf.String()), nil
+			}
+
+			c := &config.Config{Exts: map[string]interface{}{}}
+			gl := NewLanguage()
+			gl.Configure(c, "", nil)
+			getGoConfig(c).requireSumDB = true
+			rc, rcCleanup := repo.NewRemoteCache(nil)
+			defer rcCleanup()
+			result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+				Config: c,
+				Path:   filepath.Join(dir, "go.mod"),
+				Cache:  rc,
+			})
+			if tc.wantErr != "" {
+				if result.Error == nil || !strings.Contains(result.Error.Error(), tc.wantErr) {
+					t.Fatalf("got error %v; want error containing %q", result.Error, tc.wantErr)
+				}
+				return
+			}
+			if result.Error != nil {
+				t.Fatal(result.Error)
+			}
+			f := rule.EmptyFile("test", "")
+			for _, r := range result.Gen {
+				r.Insert(f)
+			}
+			got := string(f.Format())
+			if strings.Contains(got, "h1:untrusted") {
+				t.Errorf("sum from go.sum was used:\n%s", got)
+			}
+			if !strings.Contains(got, `sum = "h1:verified",  # verified by `) {
+				t.Errorf("sums not marked as verified:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestImportsSkipGoList(t *testing.T) {
+	for _, tc := range []struct {
+		desc, goMod, goSum string
+		wantGoList         bool
+	}{
+		{
+			desc: "all_sums",
+			goMod: `
+module example.com/m
+
+require (
+	github.com/pkg/errors v0.8.1
+	golang.org/x/tools v0.0.0-20190122202912-9c309ee22fab // indirect
+)
+`,
+			goSum: `
+github.com/pkg/errors v0.8.1 h1:errors
+github.com/pkg/errors v0.8.1/go.mod h1:errorsmod
+golang.org/x/tools v0.0.0-20190122202912-9c309ee22fab h1:tools
+`,
+		}, {
+			desc: "missing_sum",
+			goMod: `
+module example.com/m
+
+require github.com/pkg/errors v0.8.1
+`,
+			goSum: `
+github.com/pkg/errors v0.8.1/go.mod h1:errorsmod
+`,
+			wantGoList: true,
+		}, {
+			desc: "replace",
+			goMod: `
+module example.com/m
+
+require github.com/pkg/errors v0.8.1
+
+replace github.com/pkg/errors => github.com/fork/errors v0.8.2
+`,
+			goSum: `
+github.com/pkg/errors v0.8.1 h1:errors
+`,
+			wantGoList: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+				{Path: "go.mod", Content: tc.goMod},
+				{Path: "go.sum", Content: tc.goSum},
+			})
+			defer cleanup()
+
+			calledGoList := false
+			oldGoList := goListModules
+			defer func() { goListModules = oldGoList }()
+			goListModules = func(dir string, env []string) ([]byte, error) {
+				calledGoList = true
+				return oldGoList(dir, env)
+			}
+
+			c := &config.Config{Exts: map[string]interface{}{}}
+			gl := NewLanguage()
+			gl.Configure(c, "", nil)
+			getGoConfig(c).skipGoList = true
+			rc, rcCleanup := repo.NewRemoteCache(nil)
+			defer rcCleanup()
+			result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+				Config: c,
+				Path:   filepath.Join(dir, "go.mod"),
+				Cache:  rc,
+			})
+			if result.Error != nil {
+				t.Fatal(result.Error)
+			}
+			if calledGoList != tc.wantGoList {
+				t.Fatalf("called go list: got %v; want %v", calledGoList, tc.wantGoList)
+			}
+			if tc.wantGoList {
+				return
+			}
+			f := rule.EmptyFile("test", "")
+			for _, r := range result.Gen {
+				r.Insert(f)
+			}
+			got := strings.TrimSpace(string(f.Format()))
+			want := strings.TrimSpace(`
+go_repository(
+    name = "com_github_pkg_errors",
+    importpath = "github.com/pkg/errors",
+    sum = "h1:errors",
+    version = "v0.8.1",
+)
+
+go_repository(
+    name = "org_golang_x_tools",
+    importpath = "golang.org/x/tools",
+    sum = "h1:tools",
+    version = "v0.0.0-20190122202912-9c309ee22fab",
+)
+`)
+			if got != want {
+				t.Errorf("got:\n%s\n\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestImportsSkipGoListChecksGoMod(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path:    "go.mod",
+			Content: "module example.com/m\n\ngo 1.17\n\nrequire github.com/pkg/errors v0.8.1\n",
+		}, {
+			Path:    "go.sum",
+			Content: "github.com/pkg/errors v0.8.1 h1:errors\n",
+		},
+	})
+	defer cleanup()
+
+	oldVersion := goToolVersion
+	defer func() { goToolVersion = oldVersion }()
+	goToolVersion = func() (string, error) { return "go1.16.5", nil }
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	getGoConfig(c).skipGoList = true
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error == nil || !strings.Contains(result.Error.Error(), "enables module graph pruning") {
+		t.Errorf("got error %v; want module graph pruning error", result.Error)
+	}
+}
+
+func TestImportsDirectOnly(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module github.com/bazelbuild/bazel-gazelle
+
+require (
+	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/bazelbuild/buildtools v0.0.0-20190202002759-027686e28d67
+	github.com/davecgh/go-spew v1.1.1 // indirect
+)
+`,
+		}, {
+			Path: "go.sum",
+			Content: `
+github.com/BurntSushi/toml v0.3.1 h1:WXkYYl6Yr3qBf1K79EBnL4mak0OimBfB0XUf9Vl28OQ=
+github.com/bazelbuild/buildtools v0.0.0-20190202002759-027686e28d67 h1:zS8p6ZRbNVa7QfK3tpoIRDqGzCA2J0uJffaMTWoneac=
+github.com/davecgh/go-spew v1.1.1 h1:vj9j/u1bqnvCEfJOwUhtlOARqs3+rkHYY13jYWTU97c=
+`,
+		},
+	})
+	defer cleanup()
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	getGoConfig(c).directOnly = true
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	f := rule.EmptyFile("test", "")
+	for _, r := range result.Gen {
+		r.Insert(f)
+	}
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+go_repository(
+    name = "com_github_bazelbuild_buildtools",
+    importpath = "github.com/bazelbuild/buildtools",
+    sum = "h1:zS8p6ZRbNVa7QfK3tpoIRDqGzCA2J0uJffaMTWoneac=",
+    version = "v0.0.0-20190202002759-027686e28d67",
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\n\nwant:\n%s", got, want)
+	}
+}
+
+func TestImportsReplaceWithoutVersion(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require example.com/dep v1.0.0
+
+replace example.com/dep => example.com/fork
+`,
+		},
+	})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{
+	"Path": "example.com/m",
+	"Main": true
+}
+{
+	"Path": "example.com/dep",
+	"Version": "v1.0.0",
+	"Replace": {
+		"Path": "example.com/fork"
+	}
+}
+`), nil
+	}
+	oldDownload := goModDownload
+	defer func() { goModDownload = oldDownload }()
+	goModDownload = func(dir string, args, env []string) ([]byte, error) {
+		return nil, fmt.Errorf("unexpected call to go mod download: %v", args)
+	}
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	f := rule.EmptyFile("test", "")
+	for _, r := range result.Gen {
+		r.Insert(f)
+	}
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+go_repository(
+    name = "com_example_dep",
+    importpath = "example.com/dep",
+    replace = "example.com/fork",
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\n\nwant:\n%s", got, want)
+	}
+}
+
+func TestImportsSamePathReplace(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require (
+	example.com/dep v1.0.0
+	example.com/other v1.0.0
+)
+
+replace example.com/dep => example.com/dep v1.2.0
+
+replace example.com/other => example.com/fork v1.1.0
+`,
+		}, {
+			Path: "go.sum",
+			Content: `
+example.com/dep v1.2.0 h1:dep=
+example.com/fork v1.1.0 h1:fork=
+`,
+		},
+	})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{
+	"Path": "example.com/m",
+	"Main": true
+}
+{
+	"Path": "example.com/dep",
+	"Version": "v1.0.0",
+	"Replace": {
+		"Path": "example.com/dep",
+		"Version": "v1.2.0"
+	}
+}
+{
+	"Path": "example.com/other",
+	"Version": "v1.0.0",
+	"Replace": {
+		"Path": "example.com/fork",
+		"Version": "v1.1.0"
+	}
+}
+`), nil
+	}
+	oldDownload := goModDownload
+	defer func() { goModDownload = oldDownload }()
+	goModDownload = func(dir string, args, env []string) ([]byte, error) {
+		return nil, fmt.Errorf("unexpected call to go mod download: %v", args)
+	}
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	f := rule.EmptyFile("test", "")
+	for _, r := range result.Gen {
+		r.Insert(f)
+	}
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+go_repository(
+    name = "com_example_dep",
+    importpath = "example.com/dep",
+    sum = "h1:dep=",
+    version = "v1.2.0",
+)
+
+go_repository(
+    name = "com_example_other",
+    importpath = "example.com/other",
+    replace = "example.com/fork",
+    sum = "h1:fork=",
+    version = "v1.1.0",
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\n\nwant:\n%s", got, want)
+	}
+}
+
+func TestImportsReplaceComments(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require (
+	example.com/dep v1.0.0
+	example.com/other v1.0.0
+	example.com/plain v1.0.0
+)
+
+replace example.com/dep => example.com/dep v1.2.0
+
+replace example.com/other => example.com/fork v1.1.0
+`,
+		}, {
+			Path: "go.sum",
+			Content: `
+example.com/dep v1.2.0 h1:dep=
+example.com/fork v1.1.0 h1:fork=
+example.com/plain v1.0.0 h1:plain=
+`,
+		},
+	})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{
+	"Path": "example.com/m",
+	"Main": true
+}
+{
+	"Path": "example.com/dep",
+	"Version": "v1.0.0",
+	"Replace": {
+		"Path": "example.com/dep",
+		"Version": "v1.2.0"
+	}
+}
+{
+	"Path": "example.com/other",
+	"Version": "v1.0.0",
+	"Replace": {
+		"Path": "example.com/fork",
+		"Version": "v1.1.0"
+	}
+}
+{
+	"Path": "example.com/plain",
+	"Version": "v1.0.0"
+}
+`), nil
+	}
+
+	// An existing rule has a stale comment from an earlier replacement.
+	existing, err := rule.LoadData("WORKSPACE", "", []byte(`
+# via: example.com/plain@v0.9.0 => example.com/oldfork@v0.9.1
+go_repository(
+    name = "com_example_plain",
+    importpath = "example.com/plain",
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &config.Config{Exts: map[string]interface{}{}, Repos: existing.Rules}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	getGoConfig(c).replaceComments = true
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	f := rule.EmptyFile("test", "")
+	for _, r := range result.Gen {
+		r.Insert(f)
+	}
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+# via: example.com/dep@v1.0.0 => example.com/dep@v1.2.0
+go_repository(
+    name = "com_example_dep",
+    importpath = "example.com/dep",
+    sum = "h1:dep=",
+    version = "v1.2.0",
+)
+
+# via: example.com/other@v1.0.0 => example.com/fork@v1.1.0
+go_repository(
+    name = "com_example_other",
+    importpath = "example.com/other",
+    replace = "example.com/fork",
+    sum = "h1:fork=",
+    version = "v1.1.0",
+)
+
+go_repository(
+    name = "com_example_plain",
+    importpath = "example.com/plain",
+    sum = "h1:plain=",
+    version = "v1.0.0",
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\n\nwant:\n%s", got, want)
+	}
+	if comments := existing.Rules[0].Comments(); len(comments) > 0 {
+		t.Errorf("existing rule: got comments %q; want none", comments)
+	}
+}
+
+func TestCanonicalVersion(t *testing.T) {
+	for _, tc := range []struct {
+		v, want string
+	}{
+		{v: "v1.2.3", want: "v1.2.3"},
+		{v: "v1.2", want: "v1.2.0"},
+		{v: "v1", want: "v1.0.0"},
+		{v: "v1.2.3+meta", want: "v1.2.3"},
+		{v: "v2.0.0+incompatible", want: "v2.0.0+incompatible"},
+		{v: "v0.0.0-20190122202912-9c309ee22fab", want: "v0.0.0-20190122202912-9c309ee22fab"},
+		{v: "v1.2-pre", want: ""},
+		{v: "v01.2.3", want: ""},
+		{v: "1.2.3", want: ""},
+		{v: "", want: ""},
+	} {
+		if got := canonicalVersion(tc.v); got != tc.want {
+			t.Errorf("canonicalVersion(%q): got %q; want %q", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		v, w string
+		want int
+	}{
+		{v: "v1.2.3", w: "v1.2.3", want: 0},
+		{v: "v1.2", w: "v1.2.0", want: 0},
+		{v: "v1.2.3", w: "v1.10.0", want: -1},
+		{v: "v2.0.0+incompatible", w: "v1.9.9", want: 1},
+		{v: "v1.2.3-pre", w: "v1.2.3", want: -1},
+		{v: "v1.2.3-alpha.2", w: "v1.2.3-alpha.10", want: -1},
+		{v: "v1.2.3-alpha", w: "v1.2.3-alpha.1", want: -1},
+		{v: "v1.2.3-1", w: "v1.2.3-alpha", want: -1},
+		{v: "v0.0.0-20190122202912-9c309ee22fab", w: "v0.0.0-20180101000000-abcdefabcdef", want: 1},
+		{v: "v0.0.0-20190122202912-9c309ee22fab", w: "v0.1.0", want: -1},
+		{v: "v1.2.4-0.20190122202912-9c309ee22fab", w: "v1.2.3", want: 1},
+		{v: "v1.2.4-0.20190122202912-9c309ee22fab", w: "v1.2.4", want: -1},
+		{v: "bad", w: "v0.0.1", want: -1},
+	} {
+		if got := compareVersions(tc.v, tc.w); got != tc.want {
+			t.Errorf("compareVersions(%q, %q): got %d; want %d", tc.v, tc.w, got, tc.want)
+		}
+		if got := compareVersions(tc.w, tc.v); got != -tc.want {
+			t.Errorf("compareVersions(%q, %q): got %d; want %d", tc.w, tc.v, got, -tc.want)
+		}
+	}
+}
+
+func TestImportsMinVersion(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{{
+		Path: "go.mod",
+		Content: `
+module example.com/m
+
+require (
+	example.com/old v1.2.3
+	example.com/new v1.10.0
+	example.com/replaced v1.0.0
+)
+
+replace example.com/replaced => example.com/fork v0.0.0-20190122202912-9c309ee22fab
+`,
+	}})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{"Path": "example.com/m", "Main": true}
+{"Path": "example.com/old", "Version": "v1.2.3", "Sum": "h1:old"}
+{"Path": "example.com/new", "Version": "v1.10.0"}
+{"Path": "example.com/replaced", "Version": "v1.0.0", "Replace": {"Path": "example.com/fork", "Version": "v0.0.0-20190122202912-9c309ee22fab"}}
+`), nil
+	}
+	oldDownload := goModDownload
+	defer func() { goModDownload = oldDownload }()
+	goModDownload = func(dir string, args, env []string) ([]byte, error) {
+		return []byte(`{"Path": "example.com/old", "Version": "v1.2.3", "Sum": "h1:old"}
+{"Path": "example.com/new", "Version": "v1.10.0", "Sum": "h1:new"}
+{"Path": "example.com/fork", "Version": "v0.0.0-20190122202912-9c309ee22fab", "Sum": "h1:fork"}
+`), nil
+	}
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, strict := range []bool{false, true} {
+		logBuf.Reset()
+		c := &config.Config{Exts: map[string]interface{}{}}
+		gl := NewLanguage()
+		fs := flag.NewFlagSet("gazelle", flag.ContinueOnError)
+		gl.RegisterFlags(fs, "update-repos", c)
+		args := []string{
+			"-min_version=example.com/old@v1.3.0",
+			"-min_version=example.com/new@v1.9",
+			"-min_version=example.com/fork@v0.0.0-20200101000000-abcdefabcdef",
+			"-min_version=example.com/replaced@v2.0.0",
+		}
+		if strict {
+			args = append(args, "-min_version_strict")
+		}
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		rc, rcCleanup := repo.NewRemoteCache(nil)
+		defer rcCleanup()
+		result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+			Config: c,
+			Path:   filepath.Join(dir, "go.mod"),
+			Cache:  rc,
+		})
+
+		wantBelow := []string{
+			"example.com/old@v1.2.3 is below the minimum version v1.3.0",
+			"example.com/fork@v0.0.0-20190122202912-9c309ee22fab is below the minimum version v0.0.0-20200101000000-abcdefabcdef",
+		}
+		got := logBuf.String()
+		if strict {
+			if result.Error == nil {
+				t.Fatal("with -min_version_strict, got success; want error")
+			}
+			got = result.Error.Error()
+		} else if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		for _, want := range wantBelow {
+			if !strings.Contains(got, want) {
+				t.Errorf("strict=%v: got %q; want message containing %q", strict, got, want)
+			}
+		}
+		if strings.Contains(got, "example.com/new") || strings.Contains(got, "example.com/replaced") {
+			t.Errorf("strict=%v: got %q; want no message about example.com/new or example.com/replaced", strict, got)
+		}
+	}
+}
+
+func TestImportsReplaceCanonicalVersion(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require example.com/dep v1.0.0
+
+replace example.com/dep => example.com/fork v1.2
+`,
+		}, {
+			Path: "go.sum",
+			Content: `
+example.com/fork v1.2.0 h1:fork
+`,
+		},
+	})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{
+	"Path": "example.com/m",
+	"Main": true
+}
+{
+	"Path": "example.com/dep",
+	"Version": "v1.0.0",
+	"Replace": {
+		"Path": "example.com/fork",
+		"Version": "v1.2"
+	}
+}
+`), nil
+	}
+	oldDownload := goModDownload
+	defer func() { goModDownload = oldDownload }()
+	goModDownload = func(dir string, args, env []string) ([]byte, error) {
+		return nil, fmt.Errorf("unexpected call to go mod download: %v", args)
+	}
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	f := rule.EmptyFile("test", "")
+	for _, r := range result.Gen {
+		r.Insert(f)
+	}
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+go_repository(
+    name = "com_example_dep",
+    importpath = "example.com/dep",
+    replace = "example.com/fork",
+    sum = "h1:fork",
+    version = "v1.2",
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\n\nwant:\n%s", got, want)
+	}
+}
+
+func TestImportsUpdateGoSum(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require (
+	example.com/a v1.0.0
+	example.com/b v1.0.0
+	example.com/c v1.0.0
+)
+`,
+		}, {
+			Path: "go.sum",
+			Content: `example.com/a v1.0.0 h1:a
+example.com/a v1.0.0/go.mod h1:amod
+example.com/c v1.0.0 h1:c
+example.com/c v1.0.0/go.mod h1:cmod
+`,
+		},
+	})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{"Path": "example.com/m", "Main": true}
+{"Path": "example.com/a", "Version": "v1.0.0"}
+{"Path": "example.com/b", "Version": "v1.0.0"}
+{"Path": "example.com/c", "Version": "v1.0.0"}
+`), nil
+	}
+	oldDownload := goModDownload
+	defer func() { goModDownload = oldDownload }()
+	goModDownload = func(dir string, args, env []string) ([]byte, error) {
+		if want := []string{"example.com/b@v1.0.0"}; !reflect.DeepEqual(args, want) {
+			t.Errorf("go mod download args: got %q; want %q", args, want)
+		}
+		return []byte(`{"Path": "example.com/b", "Version": "v1.0.0", "Sum": "h1:b", "GoModSum": "h1:bmod"}`), nil
+	}
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	getGoConfig(c).updateGoSum = true
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	for i := 0; i < 2; i++ {
+		result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+			Config: c,
+			Path:   filepath.Join(dir, "go.mod"),
+			Cache:  rc,
+		})
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		if len(result.Gen) != 3 {
+			t.Errorf("got %d rules; want 3", len(result.Gen))
+		}
+		// The second import finds every sum in go.sum.
+		goModDownload = func(dir string, args, env []string) ([]byte, error) {
+			t.Errorf("unexpected go mod download %q", args)
+			return nil, nil
+		}
+	}
+
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "go.sum",
+		Content: `example.com/a v1.0.0 h1:a
+example.com/a v1.0.0/go.mod h1:amod
+example.com/b v1.0.0 h1:b
+example.com/b v1.0.0/go.mod h1:bmod
+example.com/c v1.0.0 h1:c
+example.com/c v1.0.0/go.mod h1:cmod
+`,
+	}})
+}
+
+func TestAddGoSumEntries(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{{
+		Path: "go.sum",
+		Content: `example.com/a v1.2.0 h1:a120
+example.com/a v1.2.0/go.mod h1:a120mod
+example.com/a v1.10.0 h1:a1100
+example.com/a v1.10.0/go.mod h1:a1100mod
+`,
+	}})
+	defer cleanup()
+
+	goSumPath := filepath.Join(dir, "go.sum")
+	added, err := addGoSumEntries(goSumPath, []goSumEntry{
+		{"example.com/a", "v1.9.0/go.mod", "h1:a190mod"},
+		{"example.com/a", "v1.9.0", "h1:a190"},
+		{"example.com/a", "v1.11.0", "h1:a1110"},
+		{"example.com/a", "v1.10.0", "h1:different"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 3 {
+		t.Errorf("got %d lines added; want 3", added)
+	}
+	testtools.CheckFiles(t, dir, []testtools.FileSpec{{
+		Path: "go.sum",
+		Content: `example.com/a v1.2.0 h1:a120
+example.com/a v1.2.0/go.mod h1:a120mod
+example.com/a v1.9.0 h1:a190
+example.com/a v1.9.0/go.mod h1:a190mod
+example.com/a v1.10.0 h1:a1100
+example.com/a v1.10.0/go.mod h1:a1100mod
+example.com/a v1.11.0 h1:a1110
+`,
+	}})
+}
+
+func TestImportsGoModCache(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{{
+		Path:    "go.mod",
+		Content: "module example.com/m\n\nrequire example.com/a v1.0.0\n",
+	}})
+	defer cleanup()
+	cacheDir := filepath.Join(dir, "cache")
+	wantEnv := []string{"GOMODCACHE=" + cacheDir}
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		if !reflect.DeepEqual(env, wantEnv) {
+			t.Errorf("go list env: got %q; want %q", env, wantEnv)
+		}
+		return []byte(`{"Path": "example.com/m", "Main": true}
+{"Path": "example.com/a", "Version": "v1.0.0"}
+`), nil
+	}
+	oldDownload := goModDownload
+	defer func() { goModDownload = oldDownload }()
+	goModDownload = func(dir string, args, env []string) ([]byte, error) {
+		if !reflect.DeepEqual(env, wantEnv) {
+			t.Errorf("go mod download env: got %q; want %q", env, wantEnv)
+		}
+		return []byte(`{"Path": "example.com/a", "Version": "v1.0.0", "Sum": "h1:a"}`), nil
+	}
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	getGoConfig(c).goModCache = cacheDir
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if len(result.Gen) != 1 {
+		t.Errorf("got %d rules; want 1", len(result.Gen))
+	}
+}
+
+func TestImportsModuleZipSumsOnly(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require (
+	example.com/a v1.0.0
+	example.com/b v1.0.0
+	example.com/c v1.0.0
+)
+`,
+		}, {
+			// a has only a go.mod sum, and b's sum is malformed. Both must be
+			// downloaded rather than recorded.
+			Path: "go.sum",
+			Content: `example.com/a v1.0.0/go.mod h1:amod
+example.com/b v1.0.0 md5:b
+example.com/c v1.0.0 h1:c
+`,
+		},
+	})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{"Path": "example.com/m", "Main": true}
+{"Path": "example.com/a", "Version": "v1.0.0"}
+{"Path": "example.com/b", "Version": "v1.0.0"}
+{"Path": "example.com/c", "Version": "v1.0.0"}
+`), nil
+	}
+	oldDownload := goModDownload
+	defer func() { goModDownload = oldDownload }()
+	goModDownload = func(dir string, args, env []string) ([]byte, error) {
+		if want := []string{"example.com/a@v1.0.0", "example.com/b@v1.0.0"}; !reflect.DeepEqual(args, want) {
+			t.Errorf("go mod download args: got %q; want %q", args, want)
+		}
+		return []byte(`{"Path": "example.com/a", "Version": "v1.0.0", "Sum": "h1:a", "GoModSum": "h1:amod"}
+{"Path": "example.com/b", "Version": "v1.0.0", "Sum": "h1:not base64!"}
+`), nil
+	}
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	f := rule.EmptyFile("test", "")
+	for _, r := range result.Gen {
+		r.Insert(f)
+	}
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+go_repository(
+    name = "com_example_a",
+    importpath = "example.com/a",
+    sum = "h1:a",
+    version = "v1.0.0",
+)
+
+go_repository(
+    name = "com_example_c",
+    importpath = "example.com/c",
+    sum = "h1:c",
+    version = "v1.0.0",
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\n\nwant:\n%s", got, want)
+	}
+}
+
+func TestIsModuleZipSum(t *testing.T) {
+	for _, tc := range []struct {
+		sum  string
+		want bool
+	}{
+		{"h1:5+8j8FTpnFV4nEImW/ofkzEt8VoOiLXxdYIDsB73T38=", true},
+		{"h1:", false},
+		{"", false},
+		{"h2:5+8j8FTpnFV4nEImW/ofkzEt8VoOiLXxdYIDsB73T38=", false},
+		{"5+8j8FTpnFV4nEImW/ofkzEt8VoOiLXxdYIDsB73T38=", false},
+		{"h1:not base64!", false},
+	} {
+		if got := isModuleZipSum(tc.sum); got != tc.want {
+			t.Errorf("isModuleZipSum(%q): got %v; want %v", tc.sum, got, tc.want)
+		}
+	}
+}
+
+func TestImportsMarkTestOnly(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require (
+	example.com/build v1.0.0
+	example.com/test v1.0.0
+)
+`,
+		}, {
+			Path: "go.sum",
+			Content: `
+example.com/build v1.0.0 h1:build=
+example.com/test v1.0.0 h1:test=
+`,
+		},
+	})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{
+	"Path": "example.com/m",
+	"Main": true
+}
+{
+	"Path": "example.com/build",
+	"Version": "v1.0.0"
+}
+{
+	"Path": "example.com/test",
+	"Version": "v1.0.0"
+}
+`), nil
+	}
+	oldListBuild := goListBuildModules
+	defer func() { goListBuildModules = oldListBuild }()
+	goListBuildModules = func(dir string, env []string, tests bool, patterns []string) ([]byte, error) {
+		return []byte("example.com/m\nexample.com/build\nexample.com/build\n"), nil
+	}
+
+	// An existing rule for a module that's now needed to build is unmarked.
+	existing := rule.NewRule("go_repository", "com_example_build")
+	existing.AddComment(testOnlyComment)
+	c := &config.Config{Exts: map[string]interface{}{}, Repos: []*rule.Rule{existing}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	getGoConfig(c).markTestOnly = true
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	got := make(map[string][]string)
+	for _, r := range result.Gen {
+		got[r.Name()] = r.Comments()
+	}
+	want := map[string][]string{
+		"com_example_build": {},
+		"com_example_test":  {testOnlyComment},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got comments %q; want %q", got, want)
+	}
+	if cs := existing.Comments(); len(cs) != 0 {
+		t.Errorf("got comments %q on existing rule; want none", cs)
+	}
+}
+
+func TestImportsPackage(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require (
+	example.com/server v1.0.0
+	example.com/client v1.0.0
+)
+`,
+		}, {
+			Path: "go.sum",
+			Content: `
+example.com/server v1.0.0 h1:server=
+example.com/client v1.0.0 h1:client=
+`,
+		},
+	})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{
+	"Path": "example.com/m",
+	"Main": true
+}
+{
+	"Path": "example.com/server",
+	"Version": "v1.0.0"
+}
+{
+	"Path": "example.com/client",
+	"Version": "v1.0.0"
+}
+`), nil
+	}
+	oldListBuild := goListBuildModules
+	defer func() { goListBuildModules = oldListBuild }()
+	var gotTests bool
+	var gotPatterns []string
+	goListBuildModules = func(dir string, env []string, tests bool, patterns []string) ([]byte, error) {
+		gotTests, gotPatterns = tests, patterns
+		return []byte("example.com/m\nexample.com/server\n"), nil
+	}
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	getGoConfig(c).packagePatterns = "./cmd/server/...,./internal/..."
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if wantPatterns := []string{"./cmd/server/...", "./internal/..."}; !gotTests || !reflect.DeepEqual(gotPatterns, wantPatterns) {
+		t.Errorf("go list -deps: got tests %v, patterns %q; want true, %q", gotTests, gotPatterns, wantPatterns)
+	}
+	var got []string
+	for _, r := range result.Gen {
+		got = append(got, r.AttrString("importpath"))
+	}
+	if want := []string{"example.com/server"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	// Patterns that match nothing are an error, rather than importing nothing.
+	goListBuildModules = func(dir string, env []string, tests bool, patterns []string) ([]byte, error) {
+		return nil, nil
+	}
+	result = gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error == nil || !strings.Contains(result.Error.Error(), "matched no packages") {
+		t.Errorf("got error %v; want error about matching no packages", result.Error)
+	}
+}
+
+func TestImportsNoNetwork(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require (
+	example.com/present v1.0.0
+	example.com/missing v1.0.0
+	example.com/other v1.1.0
+)
+`,
+		}, {
+			Path:    "go.sum",
+			Content: "example.com/present v1.0.0 h1:present=\n",
+		},
+	})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	var gotEnv []string
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		gotEnv = env
+		return []byte(`{
+	"Path": "example.com/m",
+	"Main": true
+}
+{
+	"Path": "example.com/present",
+	"Version": "v1.0.0"
+}
+{
+	"Path": "example.com/missing",
+	"Version": "v1.0.0"
+}
+{
+	"Path": "example.com/other",
+	"Version": "v1.1.0"
+}
+`), nil
+	}
+	oldDownload := goModDownload
+	defer func() { goModDownload = oldDownload }()
+	goModDownload = func(dir string, args, env []string) ([]byte, error) {
+		t.Errorf("unexpected call to go mod download: %v", args)
+		return nil, nil
+	}
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	getGoConfig(c).noNetwork = true
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	want := "-no_network: sums for these modules are missing from go.sum and would be downloaded:\n\texample.com/missing@v1.0.0\n\texample.com/other@v1.1.0"
+	if result.Error == nil || result.Error.Error() != want {
+		t.Errorf("got error %v; want %q", result.Error, want)
+	}
+	if !reflect.DeepEqual(gotEnv, []string{"GOPROXY=off"}) {
+		t.Errorf("go list: got env %q; want GOPROXY=off", gotEnv)
+	}
+}
+
+func TestNoNetworkFlags(t *testing.T) {
+	for _, args := range [][]string{
+		{"-require_sumdb"},
+		{"-validate_replaces"},
+		{"-report_sizes"},
+		{"-module_archive", "example.com/*=https://mirror.example.com/{path}/{version}.zip"},
+	} {
+		c := &config.Config{Exts: map[string]interface{}{}}
+		gl := NewLanguage()
+		fs := flag.NewFlagSet("gazelle", flag.ContinueOnError)
+		gl.RegisterFlags(fs, "update-repos", c)
+		if err := fs.Parse(append([]string{"-no_network"}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		want := fmt.Sprintf("-no_network: can't be used with %s, which downloads modules", args[0])
+		if err := gl.CheckFlags(fs, c); err == nil || err.Error() != want {
+			t.Errorf("%s: got error %v; want %q", args[0], err, want)
+		}
+	}
+}
+
+func TestImportsSumDBSnapshot(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require (
+	example.com/good v1.0.0
+	example.com/bad v1.0.0
+	example.com/missing v1.0.0
+	example.com/nosum v1.0.0
+)
+`,
+		}, {
+			Path: "go.sum",
+			Content: `
+example.com/good v1.0.0 h1:good=
+example.com/bad v1.0.0 h1:bad=
+example.com/missing v1.0.0 h1:missing=
+`,
+		}, {
+			Path: "snapshot",
+			Content: `
+example.com/good v1.0.0 h1:good=
+example.com/good v1.0.0/go.mod h1:goodmod=
+example.com/bad v1.0.0 h1:different=
+`,
+		},
+	})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{
+	"Path": "example.com/m",
+	"Main": true
+}
+{
+	"Path": "example.com/good",
+	"Version": "v1.0.0"
+}
+{
+	"Path": "example.com/bad",
+	"Version": "v1.0.0"
+}
+{
+	"Path": "example.com/missing",
+	"Version": "v1.0.0"
+}
+{
+	"Path": "example.com/nosum",
+	"Version": "v1.0.0"
+}
+`), nil
+	}
+	oldDownload := goModDownload
+	defer func() { goModDownload = oldDownload }()
+	goModDownload = func(dir string, args, env []string) ([]byte, error) {
+		return []byte(`{
+	"Path": "example.com/nosum",
+	"Version": "v1.0.0",
+	"Error": "unrecognized import path"
+}
+`), nil
+	}
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	getGoConfig(c).sumDBSnapshot = filepath.Join(dir, "snapshot")
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error == nil {
+		t.Fatal("got success; want error")
+	}
+	for _, want := range []string{
+		"example.com/bad@v1.0.0: sum h1:bad= does not match h1:different= in snapshot",
+		"example.com/missing@v1.0.0: not found in snapshot",
+		"example.com/nosum@v1.0.0: not found in go.sum or reported by go mod download",
+	} {
+		if !strings.Contains(result.Error.Error(), want) {
+			t.Errorf("got error %q; want error containing %q", result.Error, want)
+		}
+	}
+	if strings.Contains(result.Error.Error(), "example.com/good") {
+		t.Errorf("got error %q; want no error for example.com/good", result.Error)
+	}
+}
+
+func TestImportsReportSizes(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require (
+	example.com/changed v1.1.0
+	example.com/new v1.0.0
+	example.com/same v1.0.0
+)
+`,
+		}, {
+			Path: "go.sum",
+			Content: `
+example.com/changed v1.1.0 h1:changed=
+example.com/new v1.0.0 h1:new=
+example.com/same v1.0.0 h1:same=
+`,
+		}, {
+			Path:    "cache/changed.zip",
+			Content: strings.Repeat("x", 2048),
+		}, {
+			Path:    "cache/new.zip",
+			Content: "xyz",
+		},
+	})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{
+	"Path": "example.com/m",
+	"Main": true
+}
+{
+	"Path": "example.com/changed",
+	"Version": "v1.1.0"
+}
+{
+	"Path": "example.com/new",
+	"Version": "v1.0.0"
+}
+{
+	"Path": "example.com/same",
+	"Version": "v1.0.0"
+}
+`), nil
+	}
+	oldDownload := goModDownload
+	defer func() { goModDownload = oldDownload }()
+	var gotArgs []string
+	goModDownload = func(_ string, args, env []string) ([]byte, error) {
+		gotArgs = args
+		return []byte(fmt.Sprintf(`{
+	"Path": "example.com/changed",
+	"Version": "v1.1.0",
+	"Zip": %q
+}
+{
+	"Path": "example.com/new",
+	"Version": "v1.0.0",
+	"Zip": %q
+}
+`, filepath.Join(dir, "cache/changed.zip"), filepath.Join(dir, "cache/new.zip"))), nil
+	}
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	same := rule.NewRule("go_repository", "com_example_same")
+	same.SetAttr("importpath", "example.com/same")
+	same.SetAttr("sum", "h1:same=")
+	same.SetAttr("version", "v1.0.0")
+	changed := rule.NewRule("go_repository", "com_example_changed")
+	changed.SetAttr("importpath", "example.com/changed")
+	changed.SetAttr("sum", "h1:old=")
+	changed.SetAttr("version", "v1.0.0")
+	c := &config.Config{Exts: map[string]interface{}{}, Repos: []*rule.Rule{same, changed}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	getGoConfig(c).reportSizes = true
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if len(result.Gen) != 3 {
+		t.Errorf("got %d rules; want 3", len(result.Gen))
+	}
+	if want := []string{"example.com/changed@v1.1.0", "example.com/new@v1.0.0"}; !reflect.DeepEqual(gotArgs, want) {
+		t.Errorf("got go mod download args %q; want %q", gotArgs, want)
+	}
+	logs := logBuf.String()
+	for _, want := range []string{
+		"example.com/changed@v1.1.0: 2.0 KiB",
+		"example.com/new@v1.0.0: 3 B",
+		"-report_sizes: 2 new or changed modules, 2.0 KiB total",
+	} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("log does not contain %q:\n%s", want, logs)
+		}
+	}
+	if strings.Contains(logs, "example.com/same@") {
+		t.Errorf("log reports unchanged module example.com/same:\n%s", logs)
+	}
+}
+
+func TestImportsFileProxy(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require (
+	example.com/mirrored v1.0.0
+	example.com/missing v1.0.0
+	example.com/malformed v1.0.0
+	github.com/Upper/mod v1.0.0
+)
+`,
+		}, {
+			Path:    "proxy/example.com/mirrored/@v/v1.0.0.ziphash",
+			Content: "h1:mirrored=\n",
+		}, {
+			Path:    "proxy/example.com/malformed/@v/v1.0.0.ziphash",
+			Content: "not a sum\n",
+		}, {
+			Path:    "proxy/github.com/!upper/mod/@v/v1.0.0.ziphash",
+			Content: "h1:upper=",
+		},
+	})
+	defer cleanup()
+
+	oldGoProxy, hadGoProxy := os.LookupEnv("GOPROXY")
+	defer func() {
+		if hadGoProxy {
+			os.Setenv("GOPROXY", oldGoProxy)
+		} else {
+			os.Unsetenv("GOPROXY")
+		}
+	}()
+	os.Setenv("GOPROXY", "file://"+filepath.ToSlash(filepath.Join(dir, "proxy")))
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{"Path": "example.com/m", "Main": true}
+{"Path": "example.com/mirrored", "Version": "v1.0.0"}
+{"Path": "example.com/missing", "Version": "v1.0.0"}
+{"Path": "example.com/malformed", "Version": "v1.0.0"}
+{"Path": "github.com/Upper/mod", "Version": "v1.0.0"}
+`), nil
+	}
+	oldDownload := goModDownload
+	defer func() { goModDownload = oldDownload }()
+	goModDownload = func(dir string, args, env []string) ([]byte, error) {
+		if want := []string{"example.com/malformed@v1.0.0", "example.com/missing@v1.0.0"}; !reflect.DeepEqual(args, want) {
+			t.Errorf("go mod download args: got %q; want %q", args, want)
+		}
+		return []byte(`{"Path": "example.com/malformed", "Version": "v1.0.0", "Sum": "h1:malformed="}
+{"Path": "example.com/missing", "Version": "v1.0.0", "Sum": "h1:missing="}
+`), nil
+	}
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	gl.Configure(c, "", nil)
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	got := make(map[string]string)
+	for _, r := range result.Gen {
+		got[r.AttrString("importpath")] = r.AttrString("sum")
+	}
+	want := map[string]string{
+		"example.com/malformed": "h1:malformed=",
+		"example.com/mirrored":  "h1:mirrored=",
+		"example.com/missing":   "h1:missing=",
+		"github.com/Upper/mod":  "h1:upper=",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got sums %v; want %v", got, want)
+	}
+}
+
+func TestFileProxyDir(t *testing.T) {
+	for _, tc := range []struct {
+		goproxy, want string
+	}{
+		{"", ""},
+		{"off", ""},
+		{"https://proxy.golang.org,direct", ""},
+		{"file:///srv/goproxy", filepath.FromSlash("/srv/goproxy")},
+		{"file:///srv/goproxy,direct", ""},
+		{"file:///srv/a|file:///srv/b", ""},
+	} {
+		if got := fileProxyDir(tc.goproxy); got != tc.want {
+			t.Errorf("fileProxyDir(%q): got %q; want %q", tc.goproxy, got, tc.want)
+		}
+	}
+}
+
+func TestImportsModuleArchive(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require (
+	example.com/internal/a v1.2.0
+	example.com/internal/broken v1.0.0
+	example.com/public v1.0.0
+)
+`,
+		}, {
+			Path:    "go.sum",
+			Content: "example.com/public v1.0.0 h1:public=\n",
+		},
+	})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{"Path": "example.com/m", "Main": true}
+{"Path": "example.com/internal/a", "Version": "v1.2.0"}
+{"Path": "example.com/internal/broken", "Version": "v1.0.0"}
+{"Path": "example.com/public", "Version": "v1.0.0"}
+`), nil
+	}
+	oldDownload := goModDownload
+	defer func() { goModDownload = oldDownload }()
+	goModDownload = func(dir string, args, env []string) ([]byte, error) {
+		t.Errorf("unexpected go mod download %q", args)
+		return nil, nil
+	}
+	sums := map[string]string{
+		"https://artifacts.example.com/example.com/internal/a/v1.2.0.tar.gz": "0123abcd",
+	}
+	oldFetch := fetchArchiveSHA256
+	defer func() { fetchArchiveSHA256 = oldFetch }()
+	fetchArchiveSHA256 = func(archiveURL string) (string, error) {
+		if sum, ok := sums[archiveURL]; ok {
+			return sum, nil
+		}
+		return "", fmt.Errorf("%s: 404 Not Found", archiveURL)
+	}
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	fs := flag.NewFlagSet("gazelle", flag.ContinueOnError)
+	gl.RegisterFlags(fs, "update-repos", c)
+	if err := fs.Parse([]string{"-module_archive", "example.com/internal/*=https://artifacts.example.com/{path}/{version}.tar.gz,a-{version}"}); err != nil {
+		t.Fatal(err)
+	}
+	gl.Configure(c, "", nil)
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	importRepos := func() language.ImportReposResult {
+		return gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+			Config: c,
+			Path:   filepath.Join(dir, "go.mod"),
+			Cache:  rc,
+		})
+	}
+
+	// An archive that can't be downloaded is an error, since the rule
+	// would have no sha256.
+	result := importRepos()
+	if result.Error == nil {
+		t.Fatal("got success; want error for example.com/internal/broken")
+	}
+	wantErr := "example.com/internal/broken@v1.0.0: https://artifacts.example.com/example.com/internal/broken/v1.0.0.tar.gz: 404 Not Found"
+	if !strings.Contains(result.Error.Error(), wantErr) {
+		t.Errorf("got error %q; want error containing %q", result.Error, wantErr)
+	}
+
+	sums["https://artifacts.example.com/example.com/internal/broken/v1.0.0.tar.gz"] = "4567cdef"
+	result = importRepos()
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+
+	f := rule.EmptyFile("test", "")
+	for _, r := range result.Gen {
+		r.Insert(f)
+	}
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+go_repository(
+    name = "com_example_internal_a",
+    importpath = "example.com/internal/a",
+    sha256 = "0123abcd",
+    strip_prefix = "a-v1.2.0",
+    urls = ["https://artifacts.example.com/example.com/internal/a/v1.2.0.tar.gz"],
+)
+
+go_repository(
+    name = "com_example_internal_broken",
+    importpath = "example.com/internal/broken",
+    sha256 = "4567cdef",
+    strip_prefix = "a-v1.0.0",
+    urls = ["https://artifacts.example.com/example.com/internal/broken/v1.0.0.tar.gz"],
+)
+
+go_repository(
+    name = "com_example_public",
+    importpath = "example.com/public",
+    sum = "h1:public=",
+    version = "v1.0.0",
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestImportsVCSCommit(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: "go.mod",
+			Content: `
+module example.com/m
+
+require (
+	example.com/fork/a v1.0.0
+	example.com/fork/tagged v1.2.0
+	example.com/other v0.0.0-20190102030405-abcdefabcdef
+)
+
+replace example.com/fork/a => github.com/me/a v0.0.0-20190102030405-0123456789ab
+`,
+		}, {
+			Path: "go.sum",
+			Content: `example.com/fork/tagged v1.2.0 h1:tagged=
+example.com/other v0.0.0-20190102030405-abcdefabcdef h1:other=
+`,
+		},
+	})
+	defer cleanup()
+
+	oldGoList := goListModules
+	defer func() { goListModules = oldGoList }()
+	goListModules = func(dir string, env []string) ([]byte, error) {
+		return []byte(`{"Path": "example.com/m", "Main": true}
+{"Path": "example.com/fork/a", "Version": "v1.0.0", "Replace": {"Path": "github.com/me/a", "Version": "v0.0.0-20190102030405-0123456789ab"}}
+{"Path": "example.com/fork/tagged", "Version": "v1.2.0"}
+{"Path": "example.com/other", "Version": "v0.0.0-20190102030405-abcdefabcdef"}
+`), nil
+	}
+	oldDownload := goModDownload
+	defer func() { goModDownload = oldDownload }()
+	goModDownload = func(dir string, args, env []string) ([]byte, error) {
+		t.Errorf("unexpected go mod download %q", args)
+		return nil, nil
+	}
+
+	c := &config.Config{Exts: map[string]interface{}{}}
+	gl := NewLanguage()
+	fs := flag.NewFlagSet("gazelle", flag.ContinueOnError)
+	gl.RegisterFlags(fs, "update-repos", c)
+	if err := fs.Parse([]string{"-vcs_commit", "example.com/fork/*=https://{path}.git"}); err != nil {
+		t.Fatal(err)
+	}
+	gl.Configure(c, "", nil)
+	rc, rcCleanup := repo.NewRemoteCache(nil)
+	defer rcCleanup()
+	result := gl.(language.RepoImporter).ImportRepos(language.ImportReposArgs{
+		Config: c,
+		Path:   filepath.Join(dir, "go.mod"),
+		Cache:  rc,
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+
+	f := rule.EmptyFile("test", "")
+	for _, r := range result.Gen {
+		r.Insert(f)
+	}
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+go_repository(
+    name = "com_example_fork_a",
+    commit = "0123456789ab",
+    importpath = "example.com/fork/a",
+    remote = "https://github.com/me/a.git",
+    vcs = "git",
+)
+
+go_repository(
+    name = "com_example_fork_tagged",
+    importpath = "example.com/fork/tagged",
+    sum = "h1:tagged=",
+    version = "v1.2.0",
+)
+
+go_repository(
+    name = "com_example_other",
+    importpath = "example.com/other",
+    sum = "h1:other=",
+    version = "v0.0.0-20190102030405-abcdefabcdef",
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPseudoVersionCommit(t *testing.T) {
+	for _, tc := range []struct {
+		v, want string
+		ok      bool
+	}{
+		{"v0.0.0-20190102030405-0123456789ab", "0123456789ab", true},
+		{"v1.2.4-0.20190102030405-0123456789ab", "0123456789ab", true},
+		{"v1.2.3-pre.0.20190102030405-0123456789ab", "0123456789ab", true},
+		{"v2.0.0-20190102030405-0123456789ab+incompatible", "0123456789ab", true},
+		{"v1.2.3", "", false},
+		{"v1.2.3-rc.1", "", false},
+		{"", "", false},
+	} {
+		if got, ok := pseudoVersionCommit(tc.v); got != tc.want || ok != tc.ok {
+			t.Errorf("pseudoVersionCommit(%q): got %q, %v; want %q, %v", tc.v, got, ok, tc.want, tc.ok)
+		}
+	}
+}
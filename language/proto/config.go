@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"log"
 	"path"
+	"strconv"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
@@ -57,6 +58,23 @@ type ProtoConfig struct {
 	// If set, Gazelle will apply this value to the import_prefix attribute
 	// within the proto_library_rule.
 	importPrefix string
+
+	// wellKnownTypesRepo is the name of the repository containing
+	// proto_library rules for the Well Known Types, like
+	// google/protobuf/timestamp.proto. Set with
+	// # gazelle:proto_well_known_types_repo.
+	wellKnownTypesRepo string
+
+	// aliases maps legacy rule names to the names of generated rules. An
+	// alias rule is generated for each legacy name so that references to it
+	// keep working. Set with # gazelle:proto_alias, and inherited by
+	// subdirectories.
+	aliases map[string]string
+
+	// javaLibrary indicates whether a java_proto_library rule should be
+	// generated for each proto_library rule. Set with
+	// # gazelle:proto_java_library, and inherited by subdirectories.
+	javaLibrary bool
 }
 
 // GetProtoConfig returns the proto language configuration. If the proto
@@ -177,7 +195,7 @@ func (f *modeFlag) String() string {
 }
 
 func (_ *protoLang) RegisterFlags(fs *flag.FlagSet, cmd string, c *config.Config) {
-	pc := &ProtoConfig{}
+	pc := &ProtoConfig{wellKnownTypesRepo: wellKnownTypesRepo}
 	c.Exts[protoName] = pc
 
 	// Note: the -proto flag does not set the ModeExplicit flag. We want to
@@ -193,7 +211,7 @@ func (_ *protoLang) CheckFlags(fs *flag.FlagSet, c *config.Config) error {
 }
 
 func (_ *protoLang) KnownDirectives() []string {
-	return []string{"proto", "proto_group", "proto_strip_import_prefix", "proto_import_prefix"}
+	return []string{"proto", "proto_alias", "proto_group", "proto_strip_import_prefix", "proto_import_prefix", "proto_java_library", "proto_well_known_types_repo"}
 }
 
 func (_ *protoLang) Configure(c *config.Config, rel string, f *rule.File) {
@@ -211,6 +229,23 @@ func (_ *protoLang) Configure(c *config.Config, rel string, f *rule.File) {
 				}
 				pc.Mode = mode
 				pc.ModeExplicit = true
+			case "proto_alias":
+				// Special syntax (empty value) to reset directive.
+				if d.Value == "" {
+					pc.aliases = nil
+					continue
+				}
+				fields := strings.Fields(d.Value)
+				if len(fields) != 2 {
+					c.Warnf("%s: expected two arguments (gazelle:proto_alias old_name new_name), got %v", f.Path, fields)
+					continue
+				}
+				aliases := make(map[string]string)
+				for k, v := range pc.aliases {
+					aliases[k] = v
+				}
+				aliases[fields[0]] = fields[1]
+				pc.aliases = aliases
 			case "proto_group":
 				pc.groupOption = d.Value
 			case "proto_strip_import_prefix":
@@ -222,6 +257,25 @@ func (_ *protoLang) Configure(c *config.Config, rel string, f *rule.File) {
 				}
 			case "proto_import_prefix":
 				pc.importPrefix = d.Value
+			case "proto_java_library":
+				// Special syntax (empty value) to reset directive.
+				if d.Value == "" {
+					pc.javaLibrary = false
+					continue
+				}
+				javaLibrary, err := strconv.ParseBool(d.Value)
+				if err != nil {
+					c.Warnf("%s: invalid proto_java_library value %q: %v", f.Path, d.Value, err)
+					continue
+				}
+				pc.javaLibrary = javaLibrary
+			case "proto_well_known_types_repo":
+				// Special syntax (empty value) to reset directive.
+				if d.Value == "" {
+					pc.wellKnownTypesRepo = wellKnownTypesRepo
+				} else {
+					pc.wellKnownTypesRepo = strings.TrimPrefix(d.Value, "@")
+				}
 			}
 		}
 	}
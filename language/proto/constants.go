@@ -24,4 +24,8 @@ const (
 	// wellKnownTypesGoPrefix is the import path for the Go repository containing
 	// pre-generated code for the Well Known Types.
 	wellKnownTypesGoPrefix = "github.com/golang/protobuf"
+
+	// wellKnownTypesRepo is the default name of the repository containing
+	// proto_library rules for the Well Known Types.
+	wellKnownTypesRepo = "com_google_protobuf"
 )
@@ -18,6 +18,7 @@ package proto
 import (
 	"fmt"
 	"log"
+	"path"
 	"sort"
 	"strings"
 
@@ -47,7 +48,7 @@ func (_ *protoLang) GenerateRules(args language.GenerateArgs) language.GenerateR
 			genProtoFiles = append(genProtoFiles, name)
 		}
 	}
-	pkgs := buildPackages(pc, args.Dir, args.Rel, regularProtoFiles, genProtoFiles)
+	pkgs := buildPackages(c, args.Dir, args.Rel, regularProtoFiles, genProtoFiles)
 	shouldSetVisibility := args.File == nil || !args.File.HasDefaultVisibility()
 	var res language.GenerateResult
 	for _, pkg := range pkgs {
@@ -56,6 +57,9 @@ func (_ *protoLang) GenerateRules(args language.GenerateArgs) language.GenerateR
 			res.Empty = append(res.Empty, r)
 		} else {
 			res.Gen = append(res.Gen, r)
+			if pc.javaLibrary {
+				res.Gen = append(res.Gen, generateJavaProto(r))
+			}
 		}
 	}
 	sort.SliceStable(res.Gen, func(i, j int) bool {
@@ -66,9 +70,104 @@ func (_ *protoLang) GenerateRules(args language.GenerateArgs) language.GenerateR
 		res.Imports[i] = r.PrivateAttr(config.GazelleImportsKey)
 	}
 	res.Empty = append(res.Empty, generateEmpty(args.File, regularProtoFiles, genProtoFiles)...)
+	if pc.javaLibrary {
+		for _, r := range res.Empty {
+			if r.Kind() == "proto_library" {
+				res.Empty = append(res.Empty, rule.NewRule("java_proto_library", JavaProtoLibraryName(r.Name())))
+			}
+		}
+	}
+	aliases, emptyAliases := GenerateAliases(c, args.File, res.Gen)
+	for _, r := range aliases {
+		res.Gen = append(res.Gen, r)
+		res.Imports = append(res.Imports, nil)
+	}
+	res.Empty = append(res.Empty, emptyAliases...)
 	return res
 }
 
+// aliasComment is added above alias rules generated for
+// # gazelle:proto_alias. Only alias rules with this comment are updated or
+// deleted; other alias rules are left alone.
+const aliasComment = "# legacy name (proto_alias)"
+
+// GenerateAliases returns alias rules for legacy names mapped to the names of
+// rules in gen with # gazelle:proto_alias. This lets targets that refer to
+// the legacy names keep working after rules are renamed. An alias is not
+// generated if f already has a rule with the legacy name that Gazelle didn't
+// generate, or if a rule in gen has that name.
+//
+// empty contains alias rules previously generated in f whose legacy names
+// are no longer mapped, so they can be deleted.
+//
+// The Go extension calls this for go_proto_library rules.
+func GenerateAliases(c *config.Config, f *rule.File, gen []*rule.Rule) (aliases, empty []*rule.Rule) {
+	pc := GetProtoConfig(c)
+	if pc == nil {
+		return nil, nil
+	}
+	if f != nil {
+		for _, r := range f.Rules {
+			if isGeneratedAlias(r) && pc.aliases[r.Name()] == "" {
+				empty = append(empty, rule.NewRule("alias", r.Name()))
+			}
+		}
+	}
+
+	genByName := make(map[string]*rule.Rule)
+	for _, r := range gen {
+		genByName[r.Name()] = r
+	}
+	var oldNames []string
+	for oldName, newName := range pc.aliases {
+		if genByName[newName] != nil && genByName[oldName] == nil {
+			oldNames = append(oldNames, oldName)
+		}
+	}
+	sort.Strings(oldNames)
+
+	for _, oldName := range oldNames {
+		if f != nil {
+			if r := findRuleByName(f, oldName); r != nil && !isGeneratedAlias(r) {
+				c.Warnf("%s: not generating alias %s for %s: a %s rule with that name already exists", f.Path, oldName, pc.aliases[oldName], r.Kind())
+				continue
+			}
+		}
+		target := genByName[pc.aliases[oldName]]
+		a := rule.NewRule("alias", oldName)
+		a.AddComment(aliasComment)
+		a.SetAttr("actual", ":"+target.Name())
+		if vis := target.Attr("visibility"); vis != nil {
+			a.SetAttr("visibility", vis)
+		}
+		aliases = append(aliases, a)
+	}
+	return aliases, empty
+}
+
+// isGeneratedAlias returns whether r is an alias rule generated by
+// GenerateAliases.
+func isGeneratedAlias(r *rule.Rule) bool {
+	if r.Kind() != "alias" {
+		return false
+	}
+	for _, c := range r.Comments() {
+		if c == aliasComment {
+			return true
+		}
+	}
+	return false
+}
+
+func findRuleByName(f *rule.File, name string) *rule.Rule {
+	for _, r := range f.Rules {
+		if r.Name() == name {
+			return r
+		}
+	}
+	return nil
+}
+
 // RuleName returns a name for a proto_library derived from the given strings.
 // For each string, RuleName will look for a non-empty suffix of identifier
 // characters and then append "_proto" to that.
@@ -95,7 +194,8 @@ func RuleName(names ...string) string {
 // buildPackage extracts metadata from the .proto files in a directory and
 // constructs possibly several packages, then selects a package to generate
 // a proto_library rule for.
-func buildPackages(pc *ProtoConfig, dir, rel string, protoFiles, genFiles []string) []*Package {
+func buildPackages(c *config.Config, dir, rel string, protoFiles, genFiles []string) []*Package {
+	pc := GetProtoConfig(c)
 	packageMap := make(map[string]*Package)
 	for _, name := range protoFiles {
 		info := protoFileInfo(dir, name)
@@ -123,10 +223,12 @@ func buildPackages(pc *ProtoConfig, dir, rel string, protoFiles, genFiles []stri
 		if pkg == nil {
 			return nil // empty rule created in generateEmpty
 		}
+		pkgs := splitPackageByGoPackage(c, rel, pkg)
+		genPkg := selectGenFilePackage(rel, pkgs)
 		for _, name := range genFiles {
-			pkg.addGenFile(dir, name)
+			genPkg.addGenFile(dir, name)
 		}
-		return []*Package{pkg}
+		return pkgs
 
 	case PackageMode:
 		pkgs := make([]*Package, 0, len(packageMap))
@@ -159,6 +261,76 @@ func selectPackage(dir, rel string, packageMap map[string]*Package) (*Package, e
 	return nil, fmt.Errorf("%s: directory contains multiple proto packages. Gazelle can only generate a proto_library for one package.", dir)
 }
 
+// splitPackageByGoPackage divides a package into several packages if its
+// files disagree on the go_package option. Each of these packages will have
+// its own proto_library (and go_proto_library) with the correct import path.
+// Files without a go_package option are grouped together. If the packages
+// can't be given distinct rule names, pkg is returned unsplit.
+func splitPackageByGoPackage(c *config.Config, rel string, pkg *Package) []*Package {
+	pc := GetProtoConfig(c)
+	fileNames := make([]string, 0, len(pkg.Files))
+	for name := range pkg.Files {
+		fileNames = append(fileNames, name)
+	}
+	sort.Strings(fileNames)
+
+	goPkgMap := make(map[string]*Package)
+	var goPkgKeys []string
+	for _, name := range fileNames {
+		info := pkg.Files[name]
+		key := ""
+		for _, opt := range info.Options {
+			if opt.Key == "go_package" {
+				key = opt.Value
+				break
+			}
+		}
+		if goPkgMap[key] == nil {
+			goPkgMap[key] = newPackage(pkg.Name)
+			goPkgKeys = append(goPkgKeys, key)
+		}
+		goPkgMap[key].addFile(info)
+	}
+	if _, ok := goPkgMap[""]; len(goPkgMap) == 1 || len(goPkgMap) == 2 && ok {
+		return []*Package{pkg}
+	}
+
+	sort.Strings(goPkgKeys)
+	pkgs := make([]*Package, 0, len(goPkgKeys))
+	ruleNames := make(map[string]bool)
+	for _, key := range goPkgKeys {
+		p := goPkgMap[key]
+		name := RuleName(goPackageName(p), pc.GoPrefix, rel)
+		if ruleNames[name] {
+			c.Warnf("%s: proto files have different go_package options, but Gazelle can't generate distinct proto_library names for them", rel)
+			return []*Package{pkg}
+		}
+		ruleNames[name] = true
+		pkgs = append(pkgs, p)
+	}
+	return pkgs
+}
+
+// selectGenFilePackage chooses the package that generated .proto files are
+// added to when splitPackageByGoPackage returns more than one. Generated
+// files don't exist yet, so their go_package options aren't known. Files
+// without a go_package option are preferred, then the package whose Go
+// package name matches the directory name, then the first package in order
+// of go_package.
+func selectGenFilePackage(rel string, pkgs []*Package) *Package {
+	for _, pkg := range pkgs {
+		if _, ok := pkg.Options["go_package"]; !ok {
+			return pkg
+		}
+	}
+	for _, pkg := range pkgs {
+		if goPackageName(pkg) == path.Base(rel) {
+			return pkg
+		}
+	}
+	return pkgs[0]
+}
+
 // goPackageName guesses the identifier in package declarations at the top of
 // the .pb.go files that will be generated for this package. "" is returned
 // if the package name cannot be determined.
@@ -229,6 +401,25 @@ func generateProto(pc *ProtoConfig, rel string, pkg *Package, shouldSetVisibilit
 	return r
 }
 
+// JavaProtoLibraryName returns the name of the java_proto_library rule
+// generated for the proto_library rule named protoName, replacing the
+// "_proto" suffix with "_java_proto".
+func JavaProtoLibraryName(protoName string) string {
+	return strings.TrimSuffix(protoName, "_proto") + "_java_proto"
+}
+
+// generateJavaProto creates a java_proto_library rule for the proto_library
+// rule protoRule. Its deps are known when it's generated, so they aren't
+// resolved later.
+func generateJavaProto(protoRule *rule.Rule) *rule.Rule {
+	r := rule.NewRule("java_proto_library", JavaProtoLibraryName(protoRule.Name()))
+	r.SetAttr("deps", []string{":" + protoRule.Name()})
+	if vis := protoRule.Attr("visibility"); vis != nil {
+		r.SetAttr("visibility", vis)
+	}
+	return r
+}
+
 // generateEmpty generates a list of proto_library rules that may be deleted.
 // This is generated from existing proto_library rules with srcs lists that
 // don't match any static or generated files.
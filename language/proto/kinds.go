@@ -25,6 +25,16 @@ var protoKinds = map[string]rule.KindInfo{
 		},
 		ResolveAttrs: map[string]bool{"deps": true},
 	},
+	"java_proto_library": {
+		NonEmptyAttrs:  map[string]bool{"deps": true},
+		MergeableAttrs: map[string]bool{"deps": true},
+	},
+	// Only alias rules generated for # gazelle:proto_alias are matched with
+	// generated and empty rules; see GenerateAliases.
+	"alias": {
+		NonEmptyAttrs:  map[string]bool{"actual": true},
+		MergeableAttrs: map[string]bool{"actual": true},
+	},
 }
 
 var protoLoads = []rule.LoadInfo{
@@ -15,7 +15,10 @@ limitations under the License.
 
 package proto
 
-import "path/filepath"
+import (
+	"os"
+	"path/filepath"
+)
 
 // Package contains metadata for a set of .proto files that have the
 // same package name. This translates to a proto_library rule.
@@ -47,6 +50,29 @@ func (p *Package) addFile(info FileInfo) {
 	p.HasServices = p.HasServices || info.HasServices
 }
 
+// ReadPackage reads the .proto files named in srcs in dir and returns a
+// Package describing them, like the Package attached to generated
+// proto_library rules with PackageKey. It's used for existing rules that
+// weren't generated in this run. Files that don't exist are skipped; ok is
+// false if none of them exist.
+func ReadPackage(dir string, srcs []string) (pkg Package, ok bool) {
+	var p *Package
+	for _, name := range srcs {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			continue
+		}
+		info := protoFileInfo(dir, name)
+		if p == nil {
+			p = newPackage(info.PackageName)
+		}
+		p.addFile(info)
+	}
+	if p == nil {
+		return Package{}, false
+	}
+	return *p, true
+}
+
 func (p *Package) addGenFile(dir, name string) {
 	p.Files[name] = FileInfo{
 		Name: name,
@@ -25,28 +25,63 @@ import (
 
 	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/pathtools"
 	"github.com/bazelbuild/bazel-gazelle/repo"
 	"github.com/bazelbuild/bazel-gazelle/resolve"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 )
 
+// JavaProtoLang is the language of the ImportSpecs by which java_proto_library
+// rules are indexed. The import strings are the paths of .proto files in the
+// proto_library rules they depend on, the same as for proto_library rules.
+const JavaProtoLang = "java_proto"
+
 func (_ *protoLang) Imports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
-	rel := f.Pkg
-	srcs := r.AttrStrings("srcs")
+	if r.Kind() == "java_proto_library" {
+		return javaProtoImports(c, r, f)
+	}
+	return protoImports(c, r.AttrStrings("srcs"), f.Pkg, "proto")
+}
+
+// javaProtoImports returns ImportSpecs for the .proto files in the
+// proto_library rules in f that the java_proto_library rule r depends on.
+func javaProtoImports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
+	imports := []resolve.ImportSpec{}
+	for _, dep := range r.AttrStrings("deps") {
+		l, err := label.Parse(dep)
+		if err != nil || !l.Relative && (l.Repo != "" || l.Pkg != f.Pkg) {
+			continue
+		}
+		protoRule := findRuleByName(f, l.Name)
+		if protoRule == nil || protoRule.Kind() != "proto_library" {
+			continue
+		}
+		imports = append(imports, protoImports(c, protoRule.AttrStrings("srcs"), f.Pkg, JavaProtoLang)...)
+	}
+	return imports
+}
+
+// protoImports returns ImportSpecs in the language lang for the .proto files
+// srcs in the package rel, taking import prefix directives into account.
+func protoImports(c *config.Config, srcs []string, rel, lang string) []resolve.ImportSpec {
 	imports := make([]resolve.ImportSpec, len(srcs))
 	pc := GetProtoConfig(c)
 	prefix := rel
 	if pc.stripImportPrefix != "" {
-		prefix = strings.TrimPrefix(rel, pc.stripImportPrefix[1:])
-		if rel == prefix {
+		// The prefix is relative to the repository root and may end with a
+		// slash. Packages nested more deeply below it are imported by their
+		// paths relative to it, so components are matched, not characters.
+		strip := strings.TrimSuffix(pc.stripImportPrefix[1:], "/")
+		if !pathtools.HasPrefix(rel, strip) {
 			return nil
 		}
+		prefix = pathtools.TrimPrefix(rel, strip)
 	}
 	if pc.importPrefix != "" {
 		prefix = path.Join(pc.importPrefix, prefix)
 	}
 	for i, src := range srcs {
-		imports[i] = resolve.ImportSpec{Lang: "proto", Imp: path.Join(prefix, src)}
+		imports[i] = resolve.ImportSpec{Lang: lang, Imp: path.Join(prefix, src)}
 	}
 	return imports
 }
@@ -99,7 +134,11 @@ func resolveProto(c *config.Config, ix *resolve.RuleIndex, r *rule.Rule, imp str
 		return l, nil
 	}
 
+	wktLabel, isWKT := wellKnownTypeLabel(pc, imp)
 	if l, ok := knownImports[imp]; ok && pc.Mode.ShouldUseKnownImports() {
+		if isWKT {
+			l = wktLabel
+		}
 		if l.Equal(from) {
 			return label.NoLabel, skipImportError
 		} else {
@@ -113,6 +152,13 @@ func resolveProto(c *config.Config, ix *resolve.RuleIndex, r *rule.Rule, imp str
 		return label.NoLabel, err
 	}
 
+	// Well Known Types are resolved even when known imports aren't used (in
+	// disable_global mode) if they're not indexed. Otherwise, they would be
+	// resolved to a package that doesn't exist.
+	if isWKT {
+		return wktLabel, nil
+	}
+
 	rel := path.Dir(imp)
 	if rel == "." {
 		rel = ""
@@ -121,6 +167,18 @@ func resolveProto(c *config.Config, ix *resolve.RuleIndex, r *rule.Rule, imp str
 	return label.New("", rel, name), nil
 }
 
+// wellKnownTypeLabel returns the label of the proto_library rule for the
+// Well Known Type imported with imp, in the repository set with
+// # gazelle:proto_well_known_types_repo. ok is false if imp is not a Well
+// Known Type.
+func wellKnownTypeLabel(pc *ProtoConfig, imp string) (l label.Label, ok bool) {
+	known, ok := knownImports[imp]
+	if !ok || known.Repo != wellKnownTypesRepo {
+		return label.NoLabel, false
+	}
+	return label.New(pc.wellKnownTypesRepo, known.Pkg, known.Name), true
+}
+
 func resolveWithIndex(ix *resolve.RuleIndex, imp string, from label.Label) (label.Label, error) {
 	matches := ix.FindRulesByImport(resolve.ImportSpec{Lang: "proto", Imp: imp}, "proto")
 	if len(matches) == 0 {
@@ -17,6 +17,7 @@ package proto
 
 import (
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -69,6 +70,58 @@ proto_library(
         "@go_googleapis//google/type:latlng_proto",
     ],
 )
+`,
+		}, {
+			desc: "well_known_repo",
+			index: []buildFile{{
+				rel: "",
+				content: `
+# gazelle:proto_well_known_types_repo @protobuf
+`,
+			}},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = [
+        "google/protobuf/timestamp.proto",
+        "google/rpc/status.proto",
+    ],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = [
+        "@go_googleapis//google/rpc:status_proto",
+        "@protobuf//:timestamp_proto",
+    ],
+)
+`,
+		}, {
+			desc: "well_known_disable_global",
+			index: []buildFile{{
+				rel: "",
+				content: `
+# gazelle:proto disable_global
+`,
+			}},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = [
+        "google/protobuf/timestamp.proto",
+        "google/rpc/status.proto",
+    ],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = [
+        "//google/rpc:rpc_proto",
+        "@com_google_protobuf//:timestamp_proto",
+    ],
+)
 `,
 		}, {
 			desc: "known",
@@ -238,6 +291,39 @@ proto_library(
     srcs = ["dep.proto"],
     deps = ["//foo:foo_proto"],
 )
+`,
+		}, {
+			desc: "index_same_package",
+			index: []buildFile{
+				{
+					rel: "a",
+					content: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+`,
+				}, {
+					rel: "b",
+					content: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+`,
+				},
+			},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = ["b/foo.proto"],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = ["//b:foo_proto"],
+)
 `,
 		}, {
 			desc: "unknown",
@@ -310,6 +396,87 @@ proto_library(
     name = "dep_proto",
     deps = ["//bar:bar_proto"],
 )
+`,
+		}, {
+			desc: "strip_import_prefix nested",
+			index: []buildFile{{
+				rel: "",
+				content: `
+# gazelle:proto_strip_import_prefix /foo/bar
+`,
+			}, {
+				rel: "foo/bar/sub/deep",
+				content: `
+proto_library(
+    name = "deep_proto",
+    srcs = ["deep.proto"],
+)
+`,
+			}, {
+				rel: "foo/barbaz",
+				content: `
+proto_library(
+    name = "barbaz_proto",
+    srcs = ["barbaz.proto"],
+)
+`,
+			},
+			},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = [
+        "sub/deep/deep.proto",
+        "baz/barbaz.proto",
+    ],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = [
+        "//baz:baz_proto",
+        "//foo/bar/sub/deep:deep_proto",
+    ],
+)
+`,
+		}, {
+			desc: "nested directories",
+			index: []buildFile{{
+				rel: "a/b/c/d",
+				content: `
+proto_library(
+    name = "d_proto",
+    srcs = ["d.proto"],
+)
+`,
+			}, {
+				rel: "a/b",
+				content: `
+proto_library(
+    name = "b_proto",
+    srcs = ["b.proto"],
+)
+`,
+			},
+			},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = [
+        "a/b/c/d/d.proto",
+        "a/b/b.proto",
+    ],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = [
+        "//a/b:b_proto",
+        "//a/b/c/d:d_proto",
+    ],
+)
 `,
 		}, {
 			desc: "import_prefix",
@@ -369,6 +536,34 @@ proto_library(
     name = "dep_proto",
     deps = ["//foo:foo_proto"],
 )
+`,
+		}, {
+			desc: "java_proto_library",
+			index: []buildFile{{
+				rel: "foo",
+				content: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+
+java_proto_library(
+    name = "foo_java_proto",
+    deps = [":foo_proto"],
+)
+`,
+			}},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = ["foo/foo.proto"],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = ["//foo:foo_proto"],
+)
 `,
 		},
 	} {
@@ -376,6 +571,7 @@ proto_library(
 			c, lang, cexts := testConfig(t, ".")
 			mrslv := make(mapResolver)
 			mrslv["proto_library"] = lang
+			mrslv["java_proto_library"] = lang
 			ix := resolve.NewRuleIndex(mrslv.Resolver)
 			rc := (*repo.RemoteCache)(nil)
 			for _, bf := range tc.index {
@@ -415,6 +611,38 @@ proto_library(
 	}
 }
 
+func TestJavaProtoImports(t *testing.T) {
+	c, lang, _ := testConfig(t, ".")
+	f, err := rule.LoadData("foo/BUILD.bazel", "foo", []byte(`
+proto_library(
+    name = "foo_proto",
+    srcs = [
+        "a.proto",
+        "b.proto",
+    ],
+)
+
+java_proto_library(
+    name = "foo_java_proto",
+    deps = [
+        ":foo_proto",
+        "//other:other_proto",
+    ],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := lang.Imports(c, f.Rules[1], f)
+	want := []resolve.ImportSpec{
+		{Lang: JavaProtoLang, Imp: "foo/a.proto"},
+		{Lang: JavaProtoLang, Imp: "foo/b.proto"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
 func convertImportsAttr(r *rule.Rule) interface{} {
 	value := r.AttrStrings("_imports")
 	if value == nil {
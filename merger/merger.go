@@ -38,9 +38,11 @@ package merger
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 // Phase indicates which attributes should be merged in matching rules.
@@ -159,6 +161,171 @@ func MergeFile(oldFile *rule.File, emptyRules, genRules []*rule.Rule, phase Phas
 	}
 }
 
+// SortRules reorders the rules in f that the rules in genRules were merged
+// into or inserted as by MergeFile, so that the order doesn't depend on the
+// order in which rules were generated or inserted. Rules with kinds in
+// kindOrder come first, in that order, followed by rules of other kinds in
+// alphabetical order of kind. Rules of the same kind are sorted by name.
+// Sorted rules occupy the positions of the original rules; other rules,
+// including rules of kinds Gazelle generates that weren't generated in this
+// run, and other statements are not moved.
+func SortRules(f *rule.File, genRules []*rule.Rule, kinds map[string]rule.KindInfo, kindOrder []string) {
+	rank := make(map[string]int)
+	for i, kind := range kindOrder {
+		rank[kind] = i + 1
+	}
+	rules := mergedRules(f, genRules, kinds)
+	f.SortRules(rules, func(r1, r2 *rule.Rule) bool {
+		k1, k2 := r1.Kind(), r2.Kind()
+		if rank1, rank2 := rank[k1], rank[k2]; rank1 != rank2 {
+			return rank1 != 0 && (rank2 == 0 || rank1 < rank2)
+		}
+		if k1 != k2 {
+			return k1 < k2
+		}
+		return r1.Name() < r2.Name()
+	})
+}
+
+// GroupDepsByLocality separates labels of targets in external repositories
+// (those beginning with "@") from labels of targets in the same repository
+// in the deps attributes of the rules in f that the rules in genRules were
+// merged into or inserted as by MergeFile. Deps are sorted with
+// in-repository labels first, so a blank line is inserted before the first
+// external label that follows an in-repository label. Other rules are not
+// changed.
+func GroupDepsByLocality(f *rule.File, genRules []*rule.Rule, kinds map[string]rule.KindInfo) {
+	// Sync sorts srcs and deps of modified rules. The separator must be
+	// inserted after sorting, since sorting may move labels.
+	f.Sync()
+	for _, r := range mergedRules(f, genRules, kinds) {
+		deps := r.Attr("deps")
+		if deps == nil {
+			continue
+		}
+		bzl.Walk(deps, func(e bzl.Expr, _ []bzl.Expr) {
+			list, ok := e.(*bzl.ListExpr)
+			if !ok {
+				return
+			}
+			seenLocal, separated := false, false
+			for _, elem := range list.List {
+				removeBlankLines(elem)
+				com := elem.Comment()
+
+				s, ok := elem.(*bzl.StringExpr)
+				if !ok {
+					continue
+				}
+				if !strings.HasPrefix(s.Value, "@") {
+					seenLocal = true
+				} else if seenLocal && !separated {
+					com.Before = append([]bzl.Comment{{Token: ""}}, com.Before...)
+					separated = true
+				}
+			}
+		})
+	}
+}
+
+// GroupDepsByPrefix reorders labels in the deps attributes of the rules in f
+// that the rules in genRules were merged into or inserted as by MergeFile, so
+// that labels are grouped by prefix. groups lists the label prefixes in each
+// group, in order. A label belongs to the group with the longest matching
+// prefix; labels that match no prefix come last. Labels keep their relative
+// order within each group, and a blank line is inserted between groups.
+// Lists that contain anything other than strings are not reordered. Other
+// rules are not changed.
+func GroupDepsByPrefix(f *rule.File, genRules []*rule.Rule, kinds map[string]rule.KindInfo, groups [][]string) {
+	// Sync sorts srcs and deps of modified rules. Labels must be grouped
+	// after sorting, or sorting would undo the grouping.
+	f.Sync()
+	for _, r := range mergedRules(f, genRules, kinds) {
+		deps := r.Attr("deps")
+		if deps == nil {
+			continue
+		}
+		bzl.Walk(deps, func(e bzl.Expr, _ []bzl.Expr) {
+			list, ok := e.(*bzl.ListExpr)
+			if !ok || len(list.List) == 0 {
+				return
+			}
+			groupOf := make(map[bzl.Expr]int)
+			for _, elem := range list.List {
+				s, ok := elem.(*bzl.StringExpr)
+				if !ok {
+					return
+				}
+				groupOf[elem] = depsGroup(groups, s.Value)
+			}
+			for _, elem := range list.List {
+				removeBlankLines(elem)
+			}
+
+			// Comments before the first element belong to the list, so they
+			// stay at the top.
+			head := list.List[0].Comment().Before
+			list.List[0].Comment().Before = nil
+			sort.SliceStable(list.List, func(i, j int) bool {
+				return groupOf[list.List[i]] < groupOf[list.List[j]]
+			})
+			list.List[0].Comment().Before = append(head, list.List[0].Comment().Before...)
+
+			for i := 1; i < len(list.List); i++ {
+				if groupOf[list.List[i]] != groupOf[list.List[i-1]] {
+					com := list.List[i].Comment()
+					com.Before = append([]bzl.Comment{{Token: ""}}, com.Before...)
+				}
+			}
+		})
+	}
+}
+
+// mergedRules returns the rules in f that the rules in genRules were merged
+// into or inserted as by MergeFile, found the same way MergeFile matches
+// them. Rules marked with "# keep" weren't changed by merging, so they are
+// not returned.
+func mergedRules(f *rule.File, genRules []*rule.Rule, kinds map[string]rule.KindInfo) []*rule.Rule {
+	var rules []*rule.Rule
+	seen := make(map[*rule.Rule]bool)
+	for _, genRule := range genRules {
+		r, err := Match(f.Rules, genRule, kinds[genRule.Kind()])
+		if err != nil || r == nil || r.ShouldKeep() || seen[r] {
+			continue
+		}
+		seen[r] = true
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// depsGroup returns the index of the group in groups with the longest prefix
+// of label, or len(groups) if no prefix matches.
+func depsGroup(groups [][]string, label string) int {
+	group, longest := len(groups), -1
+	for i, prefixes := range groups {
+		for _, p := range prefixes {
+			if strings.HasPrefix(label, p) && len(p) > longest {
+				group, longest = i, len(p)
+			}
+		}
+	}
+	return group
+}
+
+// removeBlankLines removes blank lines before elem, which may have been
+// inserted to separate groups of labels.
+func removeBlankLines(elem bzl.Expr) {
+	com := elem.Comment()
+	before := com.Before[:0]
+	for _, c := range com.Before {
+		if c.Token != "" {
+			before = append(before, c)
+		}
+	}
+	com.Before = before
+}
+
 // substituteRule replaces local labels (those beginning with ":", referring to
 // targets in the same package) according to a substitution map. This is used
 // to update generated rules before merging when the corresponding existing
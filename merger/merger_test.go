@@ -198,6 +198,92 @@ go_library(
         ],
     }),
 )
+`,
+	}, {
+		desc: "keep in every case of old dict omits from gen list",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = select({
+        "@io_bazel_rules_go//go/platform:linux": [
+            "foo.go",  # keep
+        ],
+        "//conditions:default": [
+            "foo.go",  # keep
+        ],
+    }),
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "foo.go",
+    ],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = select({
+        "@io_bazel_rules_go//go/platform:linux": [
+            "foo.go",  # keep
+        ],
+        "//conditions:default": [
+            "foo.go",  # keep
+        ],
+    }),
+)
+`,
+	}, {
+		desc: "keep in some cases of old dict adds to gen list",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "foo.go",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:linux": [
+            "foo_linux.go",  # keep
+        ],
+        "//conditions:default": [],
+    }),
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "foo.go",
+        "foo_linux.go",
+    ],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "foo.go",
+        "foo_linux.go",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:linux": [
+            "foo_linux.go",  # keep
+        ],
+        "//conditions:default": [],
+    }),
+)
 `,
 	}, {
 		desc: "merge old list with gen dict",
@@ -996,3 +1082,247 @@ go_binary(name = "z")
 		})
 	}
 }
+
+func TestSortRules(t *testing.T) {
+	f, err := rule.LoadData("BUILD.bazel", "", []byte(`
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library", "go_test")
+
+package(default_visibility = ["//visibility:public"])
+
+go_binary(
+    name = "cmd",
+    embed = [":go_default_library"],
+)
+
+# Tests for the library.
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+)
+
+go_proto_library(
+    name = "foo_go_proto",
+    proto = ":foo_proto",
+)
+
+exports_files(["data.txt"])
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The go_proto_library wasn't generated in this run, so it stays in place.
+	gen := []*rule.Rule{
+		rule.NewRule("go_binary", "cmd"),
+		rule.NewRule("go_test", "go_default_test"),
+		rule.NewRule("go_library", "go_default_library"),
+		rule.NewRule("proto_library", "foo_proto"),
+	}
+	merger.SortRules(f, gen, testKinds, []string{"go_library", "go_test", "go_binary"})
+	want := `load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library", "go_test")
+
+package(default_visibility = ["//visibility:public"])
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)
+
+# Tests for the library.
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+)
+
+go_proto_library(
+    name = "foo_go_proto",
+    proto = ":foo_proto",
+)
+
+exports_files(["data.txt"])
+
+go_binary(
+    name = "cmd",
+    embed = [":go_default_library"],
+)
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+`
+	if got := string(f.Format()); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	for i, r := range f.Rules[1:] {
+		if r.Index() <= f.Rules[i].Index() {
+			t.Errorf("rules not ordered by index after sorting: %s at %d follows %s at %d", r.Name(), r.Index(), f.Rules[i].Name(), f.Rules[i].Index())
+		}
+	}
+}
+
+func TestGroupDepsByLocality(t *testing.T) {
+	f, err := rule.LoadData("BUILD.bazel", "", []byte(`
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    deps = [
+        "//a:go_default_library",
+        "//b:go_default_library",
+        "@com_example_x//:go_default_library",
+        # external comment
+        "@com_example_y//:go_default_library",
+    ],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    deps = ["@com_example_z//:go_default_library"],
+)
+
+go_library(
+    name = "manual",
+    deps = [
+        "//c",
+        "@d",
+    ],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The manual library wasn't generated in this run, so it's not changed.
+	gen := []*rule.Rule{
+		rule.NewRule("go_library", "go_default_library"),
+		rule.NewRule("go_test", "go_default_test"),
+	}
+	merger.GroupDepsByLocality(f, gen, testKinds)
+	want := `go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    deps = [
+        "//a:go_default_library",
+        "//b:go_default_library",
+
+        "@com_example_x//:go_default_library",
+        # external comment
+        "@com_example_y//:go_default_library",
+    ],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    deps = ["@com_example_z//:go_default_library"],
+)
+
+go_library(
+    name = "manual",
+    deps = [
+        "//c",
+        "@d",
+    ],
+)
+`
+	if got := string(f.Format()); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Grouping again should not add another separator.
+	merger.GroupDepsByLocality(f, gen, testKinds)
+	if got := string(f.Format()); got != want {
+		t.Errorf("after second call, got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGroupDepsByPrefix(t *testing.T) {
+	f, err := rule.LoadData("BUILD.bazel", "", []byte(`
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    deps = [
+        # head comment
+        ":embed",
+        "//a:go_default_library",
+
+        "@com_example_x//:go_default_library",
+        # sys comment
+        "@org_golang_x_sys//unix:go_default_library",
+        "@org_golang_x_tools//go/packages:go_default_library",
+    ],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    deps = select({
+        "@io_bazel_rules_go//go/platform:linux": [
+            "//b:go_default_library",
+            "@org_golang_x_sys//unix:go_default_library",
+        ],
+        "//conditions:default": [],
+    }),
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := [][]string{
+		{"@org_golang_x_"},
+		{":", "//"},
+		{"@"},
+	}
+	gen := []*rule.Rule{
+		rule.NewRule("go_library", "go_default_library"),
+		rule.NewRule("go_test", "go_default_test"),
+	}
+	merger.GroupDepsByPrefix(f, gen, testKinds, groups)
+	want := `go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    deps = [
+        # head comment
+        # sys comment
+        "@org_golang_x_sys//unix:go_default_library",
+        "@org_golang_x_tools//go/packages:go_default_library",
+
+        ":embed",
+        "//a:go_default_library",
+
+        "@com_example_x//:go_default_library",
+    ],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    deps = select({
+        "@io_bazel_rules_go//go/platform:linux": [
+            "@org_golang_x_sys//unix:go_default_library",
+
+            "//b:go_default_library",
+        ],
+        "//conditions:default": [],
+    }),
+)
+`
+	if got := string(f.Format()); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Grouping again should not change anything.
+	merger.GroupDepsByPrefix(f, gen, testKinds, groups)
+	if got := string(f.Format()); got != want {
+		t.Errorf("after second call, got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -17,18 +17,20 @@ package resolve
 
 import (
 	"flag"
-	"log"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/pathtools"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 )
 
 // FindRuleWithOverride searches the current configuration for user-specified
 // dependency resolution overrides. Overrides specified later (in configuration
 // files in deeper directories, or closer to the end of the file) are
-// returned first. If no override is found, label.NoLabel is returned.
+// returned first. If no exact override is found, prefix overrides (set with
+// resolve_prefix) are checked, and the one with the longest matching prefix
+// is returned. If no override is found, label.NoLabel is returned.
 func FindRuleWithOverride(c *config.Config, imp ImportSpec, lang string) (label.Label, bool) {
 	rc := getResolveConfig(c)
 	for i := len(rc.overrides) - 1; i >= 0; i-- {
@@ -37,9 +39,30 @@ func FindRuleWithOverride(c *config.Config, imp ImportSpec, lang string) (label.
 			return o.dep, true
 		}
 	}
+
+	var best *overrideSpec
+	for i := len(rc.prefixOverrides) - 1; i >= 0; i-- {
+		o := &rc.prefixOverrides[i]
+		if o.matchesPrefix(imp, lang) && (best == nil || len(o.imp.Imp) > len(best.imp.Imp)) {
+			best = o
+		}
+	}
+	if best != nil {
+		return best.dep, true
+	}
 	return label.NoLabel, false
 }
 
+// RemapRepo returns the name that repo was renamed to with a repo_remap
+// directive. If repo was not renamed, it is returned unchanged.
+func RemapRepo(c *config.Config, repo string) string {
+	rc := getResolveConfig(c)
+	if newRepo, ok := rc.repoRemaps[repo]; ok {
+		return newRepo
+	}
+	return repo
+}
+
 type overrideSpec struct {
 	imp  ImportSpec
 	lang string
@@ -52,8 +75,25 @@ func (o overrideSpec) matches(imp ImportSpec, lang string) bool {
 		(o.lang == "" || o.lang == lang)
 }
 
+// matchesPrefix returns whether imp is o.imp.Imp or is below it. Only whole
+// path components are matched, so "example.com/foo" is not below
+// "example.com/f".
+func (o overrideSpec) matchesPrefix(imp ImportSpec, lang string) bool {
+	return imp.Lang == o.imp.Lang &&
+		pathtools.HasPrefix(imp.Imp, o.imp.Imp) &&
+		(o.lang == "" || o.lang == lang)
+}
+
 type resolveConfig struct {
 	overrides []overrideSpec
+
+	// prefixOverrides are set with resolve_prefix directives. The import
+	// strings are prefixes, without trailing slashes.
+	prefixOverrides []overrideSpec
+
+	// repoRemaps maps old repository names to new names. Set with repo_remap
+	// directives. Names don't include a leading "@".
+	repoRemaps map[string]string
 }
 
 const resolveName = "_resolve"
@@ -71,45 +111,75 @@ func (_ *Configurer) RegisterFlags(fs *flag.FlagSet, cmd string, c *config.Confi
 func (_ *Configurer) CheckFlags(fs *flag.FlagSet, c *config.Config) error { return nil }
 
 func (_ *Configurer) KnownDirectives() []string {
-	return []string{"resolve"}
+	return []string{"repo_remap", "resolve", "resolve_prefix"}
 }
 
 func (_ *Configurer) Configure(c *config.Config, rel string, f *rule.File) {
 	rc := getResolveConfig(c)
 	rcCopy := &resolveConfig{
-		overrides: rc.overrides[:],
+		overrides:       rc.overrides[:],
+		prefixOverrides: rc.prefixOverrides[:],
+		repoRemaps:      rc.repoRemaps,
 	}
 
 	if f != nil {
 		for _, d := range f.Directives {
-			if d.Key == "resolve" {
+			switch d.Key {
+			case "resolve":
+				if o, ok := parseOverride(c, d, rel, "import-string"); ok {
+					rcCopy.overrides = append(rcCopy.overrides, o)
+				}
+			case "resolve_prefix":
+				if o, ok := parseOverride(c, d, rel, "import-prefix"); ok {
+					o.imp.Imp = strings.TrimSuffix(o.imp.Imp, "/")
+					rcCopy.prefixOverrides = append(rcCopy.prefixOverrides, o)
+				}
+			case "repo_remap":
 				parts := strings.Fields(d.Value)
-				o := overrideSpec{}
-				var lbl string
-				if len(parts) == 3 {
-					o.imp.Lang = parts[0]
-					o.imp.Imp = parts[1]
-					lbl = parts[2]
-				} else if len(parts) == 4 {
-					o.imp.Lang = parts[0]
-					o.lang = parts[1]
-					o.imp.Imp = parts[2]
-					lbl = parts[3]
-				} else {
-					log.Printf("could not parse directive: %s\n\texpected gazelle:resolve source-language [import-language] import-string label", d.Value)
+				if len(parts) != 2 {
+					c.Warnf("could not parse directive: %s\n\texpected gazelle:repo_remap old_repo new_repo", d.Value)
 					continue
 				}
-				var err error
-				o.dep, err = label.Parse(lbl)
-				if err != nil {
-					log.Printf("gazelle:resolve %s: %v", d.Value, err)
-					continue
+				// Copy the map, since it's shared with the parent directory.
+				remaps := make(map[string]string)
+				for k, v := range rcCopy.repoRemaps {
+					remaps[k] = v
 				}
-				o.dep = o.dep.Abs("", rel)
-				rcCopy.overrides = append(rcCopy.overrides, o)
+				remaps[strings.TrimPrefix(parts[0], "@")] = strings.TrimPrefix(parts[1], "@")
+				rcCopy.repoRemaps = remaps
 			}
 		}
 	}
 
 	c.Exts[resolveName] = rcCopy
 }
+
+// parseOverride parses the value of a resolve or resolve_prefix directive.
+// impName describes the import argument in error messages. Errors are
+// logged, and false is returned.
+func parseOverride(c *config.Config, d rule.Directive, rel, impName string) (overrideSpec, bool) {
+	parts := strings.Fields(d.Value)
+	o := overrideSpec{}
+	var lbl string
+	if len(parts) == 3 {
+		o.imp.Lang = parts[0]
+		o.imp.Imp = parts[1]
+		lbl = parts[2]
+	} else if len(parts) == 4 {
+		o.imp.Lang = parts[0]
+		o.lang = parts[1]
+		o.imp.Imp = parts[2]
+		lbl = parts[3]
+	} else {
+		c.Warnf("could not parse directive: %s\n\texpected gazelle:%s source-language [import-language] %s label", d.Value, d.Key, impName)
+		return overrideSpec{}, false
+	}
+	var err error
+	o.dep, err = label.Parse(lbl)
+	if err != nil {
+		c.Warnf("gazelle:%s %s: %v", d.Key, d.Value, err)
+		return overrideSpec{}, false
+	}
+	o.dep = o.dep.Abs("", rel)
+	return o, true
+}
@@ -17,11 +17,15 @@ package resolve
 
 import (
 	"log"
+	"sort"
+	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/merger"
 	"github.com/bazelbuild/bazel-gazelle/repo"
 	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 // ImportSpec describes a library to be imported. Imp is an import string for
@@ -68,6 +72,24 @@ type RuleIndex struct {
 	labelMap  map[label.Label]*ruleRecord
 	importMap map[ImportSpec][]*ruleRecord
 	mrslv     func(r *rule.Rule, pkgRel string) Resolver
+
+	// foldedImports maps ImportSpecs with lower case import strings to the
+	// indexed ImportSpecs that are equal to them, ignoring case.
+	foldedImports map[ImportSpec][]ImportSpec
+
+	// aliases maps labels of alias rules to the labels of their actual
+	// targets. Only aliases that refer to targets in the same package
+	// are recorded.
+	aliases map[label.Label]label.Label
+
+	// loaded and loadedAliases hold rules and aliases read with Load. They're
+	// merged into the index in Finish.
+	loaded        []*ruleRecord
+	loadedAliases map[label.Label]label.Label
+
+	// visitedPkgs is the set of packages marked with MarkVisited. Loaded
+	// rules in these packages are not indexed.
+	visitedPkgs map[string]bool
 }
 
 // ruleRecord contains information about a rule relevant to import indexing.
@@ -76,6 +98,9 @@ type ruleRecord struct {
 	label label.Label
 	file  *rule.File
 
+	// lang is the name of the Resolver for the rule.
+	lang string
+
 	// importedAs is a list of ImportSpecs by which this rule may be imported.
 	// Used to build a map from ImportSpecs to ruleRecords.
 	importedAs []ImportSpec
@@ -90,6 +115,10 @@ type ruleRecord struct {
 	// rule. Embedded rules should not be indexed.
 	embedded bool
 
+	// aliases is a list of labels for alias rules in the same package that
+	// refer to this rule.
+	aliases []label.Label
+
 	didCollectEmbeds bool
 }
 
@@ -99,19 +128,30 @@ type ruleRecord struct {
 // Resolvers that support those kinds.
 func NewRuleIndex(mrslv func(r *rule.Rule, pkgRel string) Resolver) *RuleIndex {
 	return &RuleIndex{
-		labelMap: make(map[label.Label]*ruleRecord),
-		mrslv:    mrslv,
+		labelMap:      make(map[label.Label]*ruleRecord),
+		mrslv:         mrslv,
+		aliases:       make(map[label.Label]label.Label),
+		loadedAliases: make(map[label.Label]label.Label),
+		visitedPkgs:   make(map[string]bool),
 	}
 }
 
 // AddRule adds a rule r to the index. The rule will only be indexed if there
 // is a known resolver for the rule's kind and Resolver.Imports returns a
-// non-nil slice.
+// non-nil slice. alias rules that refer to a target in the same package are
+// also recorded; after Finish, they are treated as equivalent to their
+// actual targets.
 //
 // AddRule may only be called before Finish.
 func (ix *RuleIndex) AddRule(c *config.Config, r *rule.Rule, f *rule.File) {
+	if r.Kind() == "alias" {
+		ix.addAlias(c, r, f)
+		return
+	}
+
 	var imps []ImportSpec
-	if rslv := ix.mrslv(r, f.Pkg); rslv != nil {
+	rslv := ix.mrslv(r, f.Pkg)
+	if rslv != nil {
 		imps = rslv.Imports(c, r, f)
 	}
 	// If imps == nil, the rule is not importable. If imps is the empty slice,
@@ -124,6 +164,7 @@ func (ix *RuleIndex) AddRule(c *config.Config, r *rule.Rule, f *rule.File) {
 		rule:       r,
 		label:      label.New(c.RepoName, f.Pkg, r.Name()),
 		file:       f,
+		lang:       rslv.Name(),
 		importedAs: imps,
 	}
 	if _, ok := ix.labelMap[record.label]; ok {
@@ -134,6 +175,17 @@ func (ix *RuleIndex) AddRule(c *config.Config, r *rule.Rule, f *rule.File) {
 	ix.labelMap[record.label] = record
 }
 
+// addAlias records an alias rule if its actual attribute refers to a target
+// in the same package.
+func (ix *RuleIndex) addAlias(c *config.Config, r *rule.Rule, f *rule.File) {
+	actual, err := label.Parse(r.AttrString("actual"))
+	if err != nil || actual.Repo != "" || !actual.Relative && actual.Pkg != f.Pkg {
+		return
+	}
+	from := label.New(c.RepoName, f.Pkg, r.Name())
+	ix.aliases[from] = actual.Abs(from.Repo, from.Pkg)
+}
+
 // Finish constructs the import index and performs any other necessary indexing
 // actions after all rules have been added. This step is necessary because
 // a rule may be indexed differently based on what rules are added later.
@@ -141,12 +193,36 @@ func (ix *RuleIndex) AddRule(c *config.Config, r *rule.Rule, f *rule.File) {
 // Finish must be called after all AddRule calls and before any
 // FindRulesByImport calls.
 func (ix *RuleIndex) Finish() {
+	ix.mergeLoaded()
+	ix.collectAliases()
 	for _, r := range ix.rules {
 		ix.collectEmbeds(r)
 	}
 	ix.buildImportIndex()
 }
 
+// collectAliases adds alias labels to the records of the rules they refer
+// to, so that the aliases may be found by label in place of those rules.
+func (ix *RuleIndex) collectAliases() {
+	for from, actual := range ix.aliases {
+		r, ok := ix.labelMap[actual]
+		if !ok {
+			continue
+		}
+		if _, ok := ix.labelMap[from]; ok {
+			log.Printf("multiple rules found with label %s", from)
+			continue
+		}
+		ix.labelMap[from] = r
+		r.aliases = append(r.aliases, from)
+	}
+	for _, r := range ix.rules {
+		sort.Slice(r.aliases, func(i, j int) bool {
+			return r.aliases[i].String() < r.aliases[j].String()
+		})
+	}
+}
+
 func (ix *RuleIndex) collectEmbeds(r *ruleRecord) {
 	if r.didCollectEmbeds {
 		return
@@ -185,6 +261,21 @@ func (ix *RuleIndex) buildImportIndex() {
 			ix.importMap[imp] = append(ix.importMap[imp], r)
 		}
 	}
+
+	ix.foldedImports = make(map[ImportSpec][]ImportSpec)
+	for imp := range ix.importMap {
+		key := foldImportSpec(imp)
+		ix.foldedImports[key] = append(ix.foldedImports[key], imp)
+	}
+	for _, imps := range ix.foldedImports {
+		sort.Slice(imps, func(i, j int) bool {
+			return imps[i].Imp < imps[j].Imp
+		})
+	}
+}
+
+func foldImportSpec(imp ImportSpec) ImportSpec {
+	return ImportSpec{Lang: imp.Lang, Imp: strings.ToLower(imp.Imp)}
 }
 
 func (ix *RuleIndex) findRuleByLabel(label label.Label, from label.Label) (*ruleRecord, bool) {
@@ -202,6 +293,10 @@ type FindResult struct {
 	// rule embeds. It may contains duplicates and does not include the label
 	// for the rule itself.
 	Embeds []label.Label
+
+	// Aliases is a list of labels for alias rules in the same package as the
+	// matched rule which refer to it.
+	Aliases []label.Label
 }
 
 // FindRulesByImport attempts to resolve an import string to a rule record.
@@ -218,25 +313,113 @@ func (ix *RuleIndex) FindRulesByImport(imp ImportSpec, lang string) []FindResult
 	matches := ix.importMap[imp]
 	results := make([]FindResult, 0, len(matches))
 	for _, m := range matches {
-		if ix.mrslv(m.rule, "").Name() != lang {
+		if m.lang != lang {
 			continue
 		}
 		results = append(results, FindResult{
-			Label:  m.label,
-			Embeds: m.embeds,
+			Label:   m.label,
+			Embeds:  m.embeds,
+			Aliases: m.aliases,
 		})
 	}
 	return results
 }
 
-// IsSelfImport returns true if the result's label matches the given label
-// or the result's rule transitively embeds the rule with the given label.
+// FindImportCaseVariants returns the indexed ImportSpecs in the same language
+// as imp whose import strings are equal to imp.Imp, ignoring case. imp itself
+// is included if it is indexed. The results are sorted by import string.
+//
+// On case-insensitive file systems, import strings that differ only in case
+// may refer to the same directory, so callers may use this to detect and
+// resolve collisions.
+//
+// FindImportCaseVariants must be called after Finish.
+func (ix *RuleIndex) FindImportCaseVariants(imp ImportSpec) []ImportSpec {
+	return ix.foldedImports[foldImportSpec(imp)]
+}
+
+// FindAliasTarget returns the label of the rule that an alias rule refers to.
+// l may be relative to from. ok is false if l is not the label of an alias
+// recorded in the index, or if the alias's target is not indexed.
+//
+// FindAliasTarget must be called after Finish.
+func (ix *RuleIndex) FindAliasTarget(l, from label.Label) (actual label.Label, ok bool) {
+	l = l.Abs(from.Repo, from.Pkg)
+	if _, ok := ix.aliases[l]; !ok {
+		return label.NoLabel, false
+	}
+	r, ok := ix.labelMap[l]
+	if !ok {
+		return label.NoLabel, false
+	}
+	return r.label, true
+}
+
+// RemoveAliasedDeps removes labels from the resolved attributes of rules,
+// which were generated for f and have been resolved, when the matching rule
+// in f already lists an alias of the same target with a "# keep" comment.
+// Without this, the attribute would contain both the alias and the target it
+// refers to after merging.
+//
+// RemoveAliasedDeps must be called after Finish and before rules are merged
+// into f.
+func (ix *RuleIndex) RemoveAliasedDeps(c *config.Config, f *rule.File, rules []*rule.Rule, kinds map[string]rule.KindInfo) {
+	for _, r := range rules {
+		info := kinds[r.Kind()]
+		oldRule, err := merger.Match(f.Rules, r, info)
+		if err != nil || oldRule == nil {
+			continue
+		}
+		from := label.New(c.RepoName, f.Pkg, oldRule.Name())
+		for attr := range info.ResolveAttrs {
+			expr := r.Attr(attr)
+			if expr == nil {
+				continue
+			}
+			provided := make(map[label.Label]bool)
+			bzl.Walk(oldRule.Attr(attr), func(x bzl.Expr, _ []bzl.Expr) {
+				s, ok := x.(*bzl.StringExpr)
+				if !ok || !rule.ShouldKeep(s) {
+					return
+				}
+				if l, err := label.Parse(s.Value); err == nil {
+					if actual, ok := ix.FindAliasTarget(l, from); ok {
+						provided[actual] = true
+					}
+				}
+			})
+			if len(provided) == 0 {
+				continue
+			}
+			expr = rule.MapExprStrings(expr, func(s string) string {
+				if l, err := label.Parse(s); err == nil && provided[l.Abs(from.Repo, from.Pkg)] {
+					return ""
+				}
+				return s
+			})
+			if expr == nil {
+				r.DelAttr(attr)
+			} else {
+				r.SetAttr(attr, expr)
+			}
+		}
+	}
+}
+
+// IsSelfImport returns true if the result's label or one of its aliases
+// matches the given label or the result's rule transitively embeds the rule
+// with the given label.
 // Self imports cause cyclic dependencies, so the caller may want to omit
 // the dependency or report an error.
 func (r FindResult) IsSelfImport(from label.Label) bool {
 	if from.Equal(r.Label) {
 		return true
 	}
+	for _, a := range r.Aliases {
+		if from.Equal(a) {
+			return true
+		}
+	}
 	for _, e := range r.Embeds {
 		if from.Equal(e) {
 			return true
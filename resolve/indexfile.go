@@ -0,0 +1,170 @@
+/* Copyright 2019 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// indexFile is the format of a saved index, written by Save and read by
+// Load.
+type indexFile struct {
+	Rules []indexFileRule `json:"rules"`
+}
+
+type indexFileRule struct {
+	Label    string            `json:"label"`
+	Kind     string            `json:"kind"`
+	Lang     string            `json:"lang"`
+	Imports  []indexFileImport `json:"imports"`
+	Embeds   []string          `json:"embeds,omitempty"`
+	Embedded bool              `json:"embedded,omitempty"`
+	Aliases  []string          `json:"aliases,omitempty"`
+}
+
+type indexFileImport struct {
+	Lang string `json:"lang"`
+	Imp  string `json:"imp"`
+}
+
+// Save writes the rules in the index to w as JSON, so they may be loaded
+// by a later run with Load instead of being indexed again.
+//
+// Save must be called after Finish.
+func (ix *RuleIndex) Save(w io.Writer) error {
+	var data indexFile
+	data.Rules = make([]indexFileRule, 0, len(ix.rules))
+	for _, r := range ix.rules {
+		fr := indexFileRule{
+			Label:    r.label.String(),
+			Kind:     r.rule.Kind(),
+			Lang:     r.lang,
+			Imports:  make([]indexFileImport, 0, len(r.importedAs)),
+			Embedded: r.embedded,
+		}
+		seen := make(map[ImportSpec]bool)
+		for _, imp := range r.importedAs {
+			if !seen[imp] {
+				seen[imp] = true
+				fr.Imports = append(fr.Imports, indexFileImport{Lang: imp.Lang, Imp: imp.Imp})
+			}
+		}
+		for _, e := range r.embeds {
+			fr.Embeds = append(fr.Embeds, e.String())
+		}
+		for _, a := range r.aliases {
+			fr.Aliases = append(fr.Aliases, a.String())
+		}
+		data.Rules = append(data.Rules, fr)
+	}
+	sort.Slice(data.Rules, func(i, j int) bool {
+		return data.Rules[i].Label < data.Rules[j].Label
+	})
+	out, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(out, '\n'))
+	return err
+}
+
+// Load reads rules saved with Save. Loaded rules are indexed as if they had
+// been added with AddRule, except rules in packages marked with MarkVisited
+// are dropped: the rules in those packages' build files are more current
+// than the saved ones, even if there are none.
+//
+// Load may only be called before Finish.
+func (ix *RuleIndex) Load(r io.Reader) error {
+	var data indexFile
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	for _, fr := range data.Rules {
+		l, err := label.Parse(fr.Label)
+		if err != nil {
+			return fmt.Errorf("rule %q: %v", fr.Label, err)
+		}
+		if fr.Kind == "" || fr.Lang == "" {
+			return fmt.Errorf("rule %s: missing kind or lang", fr.Label)
+		}
+		record := &ruleRecord{
+			rule:             rule.NewRule(fr.Kind, l.Name),
+			label:            l,
+			file:             &rule.File{Pkg: l.Pkg},
+			lang:             fr.Lang,
+			importedAs:       make([]ImportSpec, 0, len(fr.Imports)),
+			embedded:         fr.Embedded,
+			didCollectEmbeds: true,
+		}
+		for _, imp := range fr.Imports {
+			record.importedAs = append(record.importedAs, ImportSpec{Lang: imp.Lang, Imp: imp.Imp})
+		}
+		for _, e := range fr.Embeds {
+			el, err := label.Parse(e)
+			if err != nil {
+				return fmt.Errorf("rule %s: embed %q: %v", fr.Label, e, err)
+			}
+			record.embeds = append(record.embeds, el)
+		}
+		for _, a := range fr.Aliases {
+			al, err := label.Parse(a)
+			if err != nil {
+				return fmt.Errorf("rule %s: alias %q: %v", fr.Label, a, err)
+			}
+			// Aliases are attached to their targets again in Finish.
+			ix.loadedAliases[al] = l
+		}
+		ix.loaded = append(ix.loaded, record)
+	}
+	return nil
+}
+
+// MarkVisited records that the build file in pkg was visited, so rules from
+// pkg loaded with Load are stale and should not be indexed. Rules in pkg
+// should be added with AddRule instead.
+//
+// MarkVisited may only be called before Finish.
+func (ix *RuleIndex) MarkVisited(pkg string) {
+	ix.visitedPkgs[pkg] = true
+}
+
+// mergeLoaded adds rules read with Load to the index, except for rules in
+// packages marked with MarkVisited.
+func (ix *RuleIndex) mergeLoaded() {
+	for _, r := range ix.loaded {
+		if ix.visitedPkgs[r.label.Pkg] {
+			continue
+		}
+		if _, ok := ix.labelMap[r.label]; ok {
+			continue
+		}
+		ix.rules = append(ix.rules, r)
+		ix.labelMap[r.label] = r
+	}
+	for from, actual := range ix.loadedAliases {
+		if !ix.visitedPkgs[from.Pkg] {
+			ix.aliases[from] = actual
+		}
+	}
+	ix.loaded = nil
+	ix.loadedAliases = nil
+}
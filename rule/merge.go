@@ -124,6 +124,14 @@ func mergeExprs(src, dst bzl.Expr) (bzl.Expr, error) {
 func mergePlatformStringsExprs(src, dst platformStringsExprs) (platformStringsExprs, error) {
 	var ps platformStringsExprs
 	var err error
+
+	// Strings marked with "# keep" in every case of a select in dst are
+	// already provided on all platforms, so they aren't added to the generic
+	// list. Otherwise, Bazel would report duplicates.
+	if kept := keptSelectStrings(dst); len(kept) > 0 && src.generic != nil {
+		src.generic = filterList(src.generic, kept)
+	}
+
 	ps.generic = mergeList(src.generic, dst.generic)
 	if ps.os, err = mergeDict(src.os, dst.os); err != nil {
 		return platformStringsExprs{}, err
@@ -137,6 +145,66 @@ func mergePlatformStringsExprs(src, dst platformStringsExprs) (platformStringsEx
 	return ps, nil
 }
 
+// keptSelectStrings returns the set of strings marked with "# keep" in every
+// case of one of the select expressions in ps. Only selects with a
+// "//conditions:default" case are considered, since otherwise some platforms
+// wouldn't get the strings.
+func keptSelectStrings(ps platformStringsExprs) map[string]bool {
+	kept := make(map[string]bool)
+	for _, dict := range []*bzl.DictExpr{ps.os, ps.arch, ps.platform} {
+		if dict == nil {
+			continue
+		}
+		var counts map[string]int
+		hasDefault := false
+		for _, item := range dict.List {
+			kv := item.(*bzl.KeyValueExpr)
+			if stringValue(kv.Key) == "//conditions:default" {
+				hasDefault = true
+			}
+			list, ok := kv.Value.(*bzl.ListExpr)
+			if !ok {
+				counts = nil
+				break
+			}
+			if counts == nil {
+				counts = make(map[string]int)
+			}
+			seen := make(map[string]bool)
+			for _, v := range list.List {
+				if s := stringValue(v); s != "" && ShouldKeep(v) && !seen[s] {
+					seen[s] = true
+					counts[s]++
+				}
+			}
+		}
+		if !hasDefault {
+			continue
+		}
+		for s, n := range counts {
+			if n == len(dict.List) {
+				kept[s] = true
+			}
+		}
+	}
+	return kept
+}
+
+// filterList returns a copy of list without the strings in omit, or nil if
+// no strings remain.
+func filterList(list *bzl.ListExpr, omit map[string]bool) *bzl.ListExpr {
+	filtered := &bzl.ListExpr{ForceMultiLine: list.ForceMultiLine}
+	for _, v := range list.List {
+		if s := stringValue(v); s == "" || !omit[s] {
+			filtered.List = append(filtered.List, v)
+		}
+	}
+	if len(filtered.List) == 0 {
+		return nil
+	}
+	return filtered
+}
+
 func mergeList(src, dst *bzl.ListExpr) *bzl.ListExpr {
 	if dst == nil {
 		return src
@@ -26,6 +26,7 @@ limitations under the License.
 package rule
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -71,6 +72,10 @@ type File struct {
 	// Rules is a list of rules within the file (or function calls that look like
 	// rules). This should not be modified directly; use Rule methods instead.
 	Rules []*Rule
+
+	// Indent is the string written for each level of indentation by Format
+	// and Save. If empty, four spaces are written, like buildifier.
+	Indent string
 }
 
 // EmptyFile creates a File wrapped around an empty syntax tree.
@@ -362,20 +367,120 @@ func updateStmt(oldStmt *[]bzl.Expr, inserts, deletes, stmts []*stmt) {
 	*oldStmt = newStmt
 }
 
+// SortRules reorders the given rules, which must belong to f, according to
+// less. The sorted rules occupy the positions the rules occupied before,
+// so other statements, including rules not in the list, are not moved.
+// This method calls Sync internally.
+func (f *File) SortRules(rules []*Rule, less func(r1, r2 *Rule) bool) {
+	f.Sync()
+	stmts := f.File.Stmt
+	if f.function != nil {
+		stmts = f.function.stmt.Body
+	}
+	indices := make([]int, len(rules))
+	for i, r := range rules {
+		indices[i] = r.index
+	}
+	sort.Ints(indices)
+	sorted := make([]*Rule, len(rules))
+	copy(sorted, rules)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return less(sorted[i], sorted[j])
+	})
+	for i, r := range sorted {
+		r.index = indices[i]
+		stmts[r.index] = r.expr
+	}
+	sort.SliceStable(f.Rules, func(i, j int) bool {
+		return f.Rules[i].index < f.Rules[j].index
+	})
+}
+
 // Format formats the build file in a form that can be written to disk.
 // This method calls Sync internally.
 func (f *File) Format() []byte {
 	f.Sync()
-	return bzl.Format(f.File)
+	return f.format()
 }
 
 // Save writes the build file to disk. This method calls Sync internally.
 func (f *File) Save(path string) error {
 	f.Sync()
-	data := bzl.Format(f.File)
+	data := f.format()
 	return ioutil.WriteFile(path, data, 0666)
 }
 
+func (f *File) format() []byte {
+	data := bzl.Format(f.File)
+	if f.Indent != "" && f.Indent != bzlIndent {
+		data = reindent(data, f.Indent)
+	}
+	return data
+}
+
+// bzlIndent is the indentation written by bzl.Format for each level.
+const bzlIndent = "    "
+
+// reindent replaces each level of indentation written by bzl.Format in data
+// with indent. Lines that begin inside multi-line strings are not changed.
+func reindent(data []byte, indent string) []byte {
+	var buf bytes.Buffer
+	quote := "" // closing delimiter of an unterminated string
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+		if quote == "" {
+			n := 0
+			for n < len(line) && line[n] == ' ' {
+				n++
+			}
+			levels := n / len(bzlIndent)
+			buf.WriteString(strings.Repeat(indent, levels))
+			buf.Write(line[levels*len(bzlIndent):])
+		} else {
+			buf.Write(line)
+		}
+		quote = scanQuotes(line, quote)
+	}
+	return buf.Bytes()
+}
+
+// scanQuotes scans a line of formatted Starlark, starting inside a string
+// closed by quote (or outside any string if quote is empty). It returns the
+// closing delimiter of a string that's still open at the end of the line,
+// or "" if there is none.
+func scanQuotes(line []byte, quote string) string {
+	for i := 0; i < len(line); {
+		switch {
+		case quote != "" && line[i] == '\\':
+			i += 2
+		case quote != "" && bytes.HasPrefix(line[i:], []byte(quote)):
+			i += len(quote)
+			quote = ""
+		case quote != "":
+			i++
+		case line[i] == '#':
+			return ""
+		case bytes.HasPrefix(line[i:], []byte(`"""`)) || bytes.HasPrefix(line[i:], []byte("'''")):
+			quote = string(line[i : i+3])
+			i += 3
+		case line[i] == '"' || line[i] == '\'':
+			quote = string(line[i])
+			i++
+		default:
+			i++
+		}
+	}
+	if len(quote) == 1 {
+		// Only triple-quoted strings may span lines.
+		return ""
+	}
+	return quote
+}
+
 // HasDefaultVisibility returns whether the File contains a "package" rule with
 // a "default_visibility" attribute. Rules generated by Gazelle should not
 // have their own visibility attributes if this is the case.
@@ -616,6 +721,39 @@ func (r *Rule) ShouldKeep() bool {
 	return ShouldKeep(r.expr)
 }
 
+// Comments returns the text of the comments above the rule, including
+// their "#" prefixes.
+func (r *Rule) Comments() []string {
+	cs := r.expr.Comment().Before
+	comments := make([]string, len(cs))
+	for i, c := range cs {
+		comments[i] = c.Token
+	}
+	return comments
+}
+
+// AddComment adds a comment line above the rule. token should start with "#".
+func (r *Rule) AddComment(token string) {
+	cs := &r.expr.Comment().Before
+	*cs = append(*cs, bzl.Comment{Token: token})
+	r.updated = true
+}
+
+// DelComment removes comment lines above the rule that are equal to token.
+func (r *Rule) DelComment(token string) {
+	cs := &r.expr.Comment().Before
+	kept := (*cs)[:0]
+	for _, c := range *cs {
+		if c.Token != token {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) != len(*cs) {
+		*cs = kept
+		r.updated = true
+	}
+}
+
 // Kind returns the kind of rule this is (for example, "go_library").
 func (r *Rule) Kind() string {
 	return r.kind
@@ -704,6 +842,33 @@ func (r *Rule) DelAttr(key string) {
 	r.updated = true
 }
 
+// ClearAttrs removes all attributes from the rule except for "name", so that
+// they may be regenerated from scratch when the rule is merged. Attributes
+// marked with "# keep" comments are not removed. Within other list
+// attributes, elements marked with "# keep" comments are retained, and
+// the attribute is only removed if no elements remain.
+func (r *Rule) ClearAttrs() {
+	for key, attr := range r.attrs {
+		if key == "name" || ShouldKeep(attr) || ShouldKeep(attr.RHS) {
+			continue
+		}
+		if list, ok := attr.RHS.(*bzl.ListExpr); ok {
+			var kept []bzl.Expr
+			for _, e := range list.List {
+				if ShouldKeep(e) {
+					kept = append(kept, e)
+				}
+			}
+			if len(kept) > 0 {
+				list.List = kept
+				continue
+			}
+		}
+		delete(r.attrs, key)
+	}
+	r.updated = true
+}
+
 // SetAttr adds or replaces the named attribute with an expression produced
 // by ExprFromValue.
 func (r *Rule) SetAttr(key string, value interface{}) {
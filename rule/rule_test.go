@@ -346,3 +346,95 @@ func TestShouldKeepExpr(t *testing.T) {
 		})
 	}
 }
+
+func TestFormatIndent(t *testing.T) {
+	f, err := LoadData("BUILD.bazel", "", []byte(`
+genrule(
+    name = "gen",
+    srcs = [
+        "a.txt",  # "quoted" comment
+        'b"c.txt',
+    ],
+    cmd = """
+    echo   "indented"
+""",
+    outs = ["out.txt"],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Indent = "\t"
+	want := "genrule(\n" +
+		"\tname = \"gen\",\n" +
+		"\tsrcs = [\n" +
+		"\t\t\"a.txt\",  # \"quoted\" comment\n" +
+		"\t\t'b\"c.txt',\n" +
+		"\t],\n" +
+		"\tcmd = \"\"\"\n" +
+		"    echo   \"indented\"\n" +
+		"\"\"\",\n" +
+		"\touts = [\"out.txt\"],\n" +
+		")\n"
+	if got := string(f.Format()); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestClearAttrs(t *testing.T) {
+	f, err := LoadData("BUILD.bazel", "", []byte(`
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    cgo = True,  # keep
+    deps = [
+        ":a",
+        ":b",  # keep
+    ],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Rules[0].ClearAttrs()
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+go_library(
+    name = "go_default_library",
+    cgo = True,  # keep
+    deps = [
+        ":b",  # keep
+    ],
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\n\nwant:\n%s", got, want)
+	}
+}
+
+func TestRuleComments(t *testing.T) {
+	f, err := LoadData("BUILD.bazel", "", []byte(`
+# a
+# b
+go_library(name = "x")
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := f.Rules[0]
+	r.DelComment("# a")
+	r.AddComment("# c")
+	if got, want := r.Comments(), []string{"# b", "# c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	f.Sync()
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+# b
+# c
+go_library(name = "x")
+`)
+	if got != want {
+		t.Errorf("got:\n%s\n\nwant:\n%s", got, want)
+	}
+}
@@ -16,8 +16,12 @@ limitations under the License.
 package walk
 
 import (
+	"bufio"
 	"flag"
+	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
 	gzflag "github.com/bazelbuild/bazel-gazelle/flag"
@@ -29,11 +33,16 @@ import (
 // declared generated files, so we can't just stat.
 
 type walkConfig struct {
-	excludes []string
-	ignore   bool
-	follow   []string
+	excludes       []string
+	ignorePatterns []string
+	ignore         bool
+	follow         []string
 }
 
+// gazelleIgnoreName is the name of a file that lists patterns of files and
+// subdirectories to exclude, relative to the directory containing it.
+const gazelleIgnoreName = ".gazelleignore"
+
 const walkName = "_walk"
 
 func getWalkConfig(c *config.Config) *walkConfig {
@@ -50,6 +59,11 @@ func (wc *walkConfig) isExcluded(rel, base string) bool {
 			return true
 		}
 	}
+	for _, p := range wc.ignorePatterns {
+		if matched, _ := path.Match(p, f); matched {
+			return true
+		}
+	}
 	return false
 }
 
@@ -86,5 +100,42 @@ func (_ *Configurer) Configure(c *config.Config, rel string, f *rule.File) {
 		}
 	}
 
+	patterns, err := readGazelleIgnore(c, filepath.Join(c.RepoRoot, filepath.FromSlash(rel), gazelleIgnoreName))
+	if err != nil {
+		c.Warnf("%v", err)
+	}
+	for _, p := range patterns {
+		wcCopy.ignorePatterns = append(wcCopy.ignorePatterns, path.Join(rel, p))
+	}
+
 	c.Exts[walkName] = wcCopy
 }
+
+// readGazelleIgnore reads patterns from a .gazelleignore file. Each line
+// contains a slash-separated pattern in the syntax of path.Match. Blank lines
+// and lines starting with "#" are ignored. A missing file has no patterns.
+func readGazelleIgnore(c *config.Config, ignorePath string) ([]string, error) {
+	f, err := os.Open(ignorePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.Trim(line, "/")
+		if _, err := path.Match(line, ""); err != nil {
+			c.Warnf("%s: invalid pattern %q: %v", ignorePath, line, err)
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
@@ -48,6 +48,11 @@ const (
 	// Build files in parent directories are read in order to produce a complete
 	// configuration, but the callback is not called for parent directories.
 	UpdateDirsMode
+
+	// In UpdateSubdirsMode, Walk only visits and updates directories given to
+	// Walk and their subdirectories. Like UpdateDirsMode, build files in parent
+	// directories are read, but the callback is not called for them.
+	UpdateSubdirsMode
 )
 
 // WalkFunc is a callback called by Walk in each visited directory.
@@ -110,6 +115,12 @@ func Walk(c *config.Config, cexts []config.Configurer, dirs []string, mode Mode,
 		}
 	}
 
+	// Directives in a file loaded with -config apply in the repository root
+	// before directives in the root build file.
+	if c.ConfigFile != nil {
+		c = configure(cexts, knownDirectives, c, "", c.ConfigFile)
+	}
+
 	symlinks := symlinkResolver{visited: []string{c.RepoRoot}}
 
 	updateRels := buildUpdateRelMap(c.RepoRoot, dirs)
@@ -157,13 +168,13 @@ func Walk(c *config.Config, cexts []config.Configurer, dirs []string, mode Mode,
 
 		shouldUpdate := shouldUpdate(rel, mode, updateParent, updateRels)
 		for _, sub := range subdirs {
-			if subRel := path.Join(rel, sub); shouldVisit(subRel, mode, updateRels) {
+			if subRel := path.Join(rel, sub); shouldVisit(subRel, mode, shouldUpdate, updateRels) {
 				visit(c, filepath.Join(dir, sub), subRel, shouldUpdate)
 			}
 		}
 
 		update := !haveError && !wc.ignore && shouldUpdate
-		if shouldCall(rel, mode, updateRels) {
+		if shouldCall(rel, mode, shouldUpdate, updateRels) {
 			genFiles := findGenFiles(wc, f)
 			wf(dir, rel, c, update, f, subdirs, regularFiles, genFiles)
 		}
@@ -205,25 +216,38 @@ func buildUpdateRelMap(root string, dirs []string) map[string]bool {
 }
 
 // shouldCall returns true if Walk should call the callback in the
-// directory rel.
-func shouldCall(rel string, mode Mode, updateRels map[string]bool) bool {
-	return mode != UpdateDirsMode || updateRels[rel]
+// directory rel. update is the result of shouldUpdate for rel.
+func shouldCall(rel string, mode Mode, update bool, updateRels map[string]bool) bool {
+	switch mode {
+	case UpdateDirsMode:
+		return updateRels[rel]
+	case UpdateSubdirsMode:
+		return update
+	default:
+		return true
+	}
 }
 
 // shouldUpdate returns true if Walk should pass true to the callback's update
 // parameter in the directory rel. This indicates the build file should be
 // updated.
 func shouldUpdate(rel string, mode Mode, updateParent bool, updateRels map[string]bool) bool {
-	return mode == VisitAllUpdateSubdirsMode && updateParent || updateRels[rel]
+	return (mode == VisitAllUpdateSubdirsMode || mode == UpdateSubdirsMode) && updateParent || updateRels[rel]
 }
 
 // shouldVisit returns true if Walk should visit the subdirectory rel.
-func shouldVisit(rel string, mode Mode, updateRels map[string]bool) bool {
-	if mode != UpdateDirsMode {
+// updateParent indicates whether the parent of rel will be updated.
+func shouldVisit(rel string, mode Mode, updateParent bool, updateRels map[string]bool) bool {
+	switch mode {
+	case UpdateDirsMode:
+		_, ok := updateRels[rel]
+		return ok
+	case UpdateSubdirsMode:
+		_, ok := updateRels[rel]
+		return ok || updateParent
+	default:
 		return true
 	}
-	_, ok := updateRels[rel]
-	return ok
 }
 
 func loadBuildFile(c *config.Config, pkg, dir string, files []os.FileInfo) (*rule.File, error) {
@@ -108,6 +108,15 @@ func TestUpdateDirs(t *testing.T) {
 				{"update/ignore/sub", true},
 				{"update", true},
 			},
+		}, {
+			desc: "update_subdirs",
+			rels: []string{"update/ignore", "update/sub"},
+			mode: UpdateSubdirsMode,
+			want: []visitSpec{
+				{"update/ignore/sub", true},
+				{"update/ignore", false},
+				{"update/sub", true},
+			},
 		},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -225,6 +234,42 @@ func TestExcludeSelf(t *testing.T) {
 	}
 }
 
+func TestGazelleIgnore(t *testing.T) {
+	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
+		{
+			Path: ".gazelleignore",
+			Content: `
+# Generated code.
+*.pb.go
+gen/
+`,
+		},
+		{Path: "a.go"},
+		{Path: "a.pb.go"},
+		{Path: "gen/b.go"},
+		{
+			Path:    "sub/.gazelleignore",
+			Content: "c_*.go\n",
+		},
+		{Path: "sub/c.go"},
+		{Path: "sub/c_x.go"},
+		{Path: "sub/d.pb.go"},
+	})
+	defer cleanup()
+
+	c, cexts := testConfig(t, dir)
+	var files []string
+	Walk(c, cexts, []string{dir}, VisitAllUpdateSubdirsMode, func(_ string, rel string, _ *config.Config, _ bool, _ *rule.File, _, regularFiles, _ []string) {
+		for _, f := range regularFiles {
+			files = append(files, path.Join(rel, f))
+		}
+	})
+	want := []string{"sub/.gazelleignore", "sub/c.go", "sub/d.pb.go", ".gazelleignore", "a.go"}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got %#v; want %#v", files, want)
+	}
+}
+
 func TestGeneratedFiles(t *testing.T) {
 	dir, cleanup := testtools.CreateFiles(t, []testtools.FileSpec{
 		{